@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// acceptRoute is one ACCEPT_ROUTING entry, written mediatype=target. The
+// media type may be a type/* wildcard. A target without a dot is a
+// subdomain of the request's domain; one with a dot is a whole host.
+type acceptRoute struct {
+	mediaType string
+	target    string
+}
+
+func parseAcceptRouting(list string) ([]acceptRoute, error) {
+	var out []acceptRoute
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		mt, target, ok := cut(entry, "=")
+		mt = strings.ToLower(strings.TrimSpace(mt))
+		target = strings.ToLower(strings.TrimSpace(target))
+		typ, sub, ok2 := cut(mt, "/")
+		if !ok || !ok2 || typ == "" || typ == "*" || sub == "" || strings.Contains(sub, "/") {
+			return nil, fmt.Errorf("%q is not type/subtype=target", entry)
+		}
+		if target == "" || strings.ContainsAny(target, "/:* ") {
+			return nil, fmt.Errorf("%q: target must be a subdomain or host", entry)
+		}
+		out = append(out, acceptRoute{mediaType: mt, target: target})
+	}
+	return out, nil
+}
+
+// matches reports whether the route covers the lower-cased media type mt
+// from an Accept header.
+func (r acceptRoute) matches(mt string) bool {
+	if strings.HasSuffix(r.mediaType, "/*") {
+		return strings.HasPrefix(mt, strings.TrimSuffix(r.mediaType, "*")) && mt != r.mediaType
+	}
+	return mt == r.mediaType
+}
+
+// routeAccept returns the ACCEPT_ROUTING target for an Accept header: the
+// first route matching the most preferred media type that has one. Media
+// types are tried by q-value, in header order on a tie; q=0 and wildcard
+// types such as */* pick no route.
+func routeAccept(routes []acceptRoute, accept string) (string, bool) {
+	if len(routes) == 0 || accept == "" {
+		return "", false
+	}
+	type entry struct {
+		mt string
+		q  float64
+	}
+	var entries []entry
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		e := entry{mt: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, p := range params[1:] {
+			if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					e.q = f
+				}
+			}
+		}
+		if e.q > 0 && !strings.HasSuffix(e.mt, "/*") {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+	for _, e := range entries {
+		for _, r := range routes {
+			if r.matches(e.mt) {
+				return r.target, true
+			}
+		}
+	}
+	return "", false
+}
+
+// routedTarget is buildTarget with ACCEPT_ROUTING applied: a request whose
+// Accept header has a route goes to the route's host, with the same path.
+func routedTarget(cfg *Config, ctx *fasthttp.RequestCtx, domain string) (host, url string) {
+	host, url = buildTarget(cfg, ctx, domain)
+	target, ok := routeAccept(cfg.acceptRoutes, string(ctx.Request.Header.Peek("Accept")))
+	if !ok {
+		return host, url
+	}
+	if !strings.Contains(target, ".") {
+		target += "." + domain
+	}
+	return target, "https://" + target + strings.TrimPrefix(url, "https://"+host)
+}
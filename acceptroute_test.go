@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseAcceptRouting(t *testing.T) {
+	routes, err := parseAcceptRouting(" Application/JSON = apis , image/*=Thumbnails.roblox.com,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []acceptRoute{{"application/json", "apis"}, {"image/*", "thumbnails.roblox.com"}}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("parsed %+v, want %+v", routes, want)
+	}
+	for _, list := range []string{
+		"application/json",
+		"application/json=",
+		"json=apis",
+		"*/*=apis",
+		"application/=apis",
+		"application/json=https://apis.roblox.com",
+		"application/json=apis.roblox.com:443",
+	} {
+		if _, err := parseAcceptRouting(list); err == nil {
+			t.Errorf("%q accepted", list)
+		}
+	}
+}
+
+func TestRouteAccept(t *testing.T) {
+	routes, _ := parseAcceptRouting("application/json=apis,image/*=thumbnails,text/html=www.example.com")
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"application/json", "apis"},
+		{"Application/JSON; charset=utf-8", "apis"},
+		{"image/png", "thumbnails"},
+		{"image/*", ""},
+		{"text/plain", ""},
+		{"text/html, application/json", "www.example.com"},
+		{"text/html;q=0.5, application/json", "apis"},
+		{"text/plain, image/webp;q=0.9, */*;q=0.1", "thumbnails"},
+		{"application/json;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := routeAccept(routes, tt.accept); got != tt.want {
+			t.Errorf("routeAccept(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptRouting(t *testing.T) {
+	var gotHost, gotURI string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		gotHost, gotURI = string(ctx.Host()), string(ctx.RequestURI())
+		ctx.SetBodyString(gotHost)
+	}
+	cfg := testConfig()
+	cfg.AcceptRouting = "application/json=apis,image/*=cdn.example.com"
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	tests := []struct {
+		accept, host string
+	}{
+		{"text/html", "www.roblox.com"},
+		{"application/json", "apis.roblox.com"},
+		{"image/png", "cdn.example.com"},
+	}
+	for _, tt := range tests {
+		gotHost, gotURI = "", ""
+		resp := serveRaw(t, s, "GET /www/v1/things?x=1 HTTP/1.1\r\nHost: proxy\r\nAccept: "+tt.accept+"\r\n\r\n")
+		if gotHost != tt.host || gotURI != "/v1/things?x=1" {
+			t.Errorf("Accept %s: sent to %s%s, want %s/v1/things?x=1", tt.accept, gotHost, gotURI, tt.host)
+		}
+		// each route is cached on its own
+		if resp := serveRaw(t, s, "GET /www/v1/things?x=1 HTTP/1.1\r\nHost: proxy\r\nAccept: "+tt.accept+"\r\n\r\n"); string(resp.Body()) != tt.host {
+			t.Errorf("Accept %s again: %q, want %s", tt.accept, resp.Body(), tt.host)
+		}
+		if string(resp.Body()) != tt.host {
+			t.Errorf("Accept %s: %q", tt.accept, resp.Body())
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// isInternalPath reports whether path is served by the proxy itself rather
+// than forwarded upstream.
+func isInternalPath(path string) bool {
+	return path == "/metrics" || path == "/healthz" || path == "/readyz" || strings.HasPrefix(path, "/_proxy/") || strings.HasPrefix(path, "/admin/")
+}
+
+// isAdminPath reports whether path is an internal endpoint that is moved to
+// ADMIN_LISTEN when one is configured. Health probes are not: they stay on
+// every listener, and neither are the helper routes for game clients.
+func isAdminPath(path string) bool {
+	return isInternalPath(path) && path != "/healthz" && path != "/readyz" && !isClientRoute(path)
+}
+
+// isClientRoute reports whether path is one of the proxy's own routes
+// meant for game clients.
+func isClientRoute(path string) bool {
+	r, ok := findRoute(internalRoutes, path)
+	return ok && r.client
+}
+
+// internalRoute is one of the proxy's own endpoints. The handlers dispatch
+// by the route tables, and /_proxy/openapi is written from the same
+// tables, so the document lists every route there is.
+type internalRoute struct {
+	path    string   // exact path, or a prefix when it ends in "/"
+	doc     string   // path with {parameters} for the document; path when empty
+	methods []string // methods served, for the document
+	summary string   // empty keeps the route out of the document
+	client  bool     // meant for game clients, so it stays on the public listeners
+	admin   bool     // needs the ADMIN_KEY header rather than PROXYKEY
+	private bool     // hidden while KEY is unset, like /admin/
+	handler func(*Server, *fasthttp.RequestCtx)
+}
+
+// matches reports whether the route serves path.
+func (r internalRoute) matches(path string) bool {
+	if strings.HasSuffix(r.path, "/") {
+		return strings.HasPrefix(path, r.path)
+	}
+	return path == r.path
+}
+
+// findRoute returns the first route in routes serving path.
+func findRoute(routes []internalRoute, path string) (internalRoute, bool) {
+	for _, r := range routes {
+		if r.matches(path) {
+			return r, true
+		}
+	}
+	return internalRoute{}, false
+}
+
+// internalRoutes are the endpoints internalHandler dispatches. The
+// management API and /admin/ are documented by their own tables.
+var internalRoutes []internalRoute
+
+// adminRoutes are the /admin/ debugging endpoints.
+var adminRoutes = []internalRoute{
+	{path: "/admin/recent", methods: []string{"GET"}, summary: "The last proxied requests, oldest first.",
+		handler: func(s *Server, ctx *fasthttp.RequestCtx) { writeJSON(ctx, 200, s.recent.snapshot()) }},
+	{path: "/admin/echo", methods: []string{"GET"}, summary: "The request as the proxy received it, and the client IP it derives.",
+		handler: (*Server).echoHandler},
+	{path: "/admin/config", methods: []string{"GET"}, summary: "Every setting as loaded, secrets redacted.",
+		handler: (*Server).effectiveConfigHandler},
+	{path: "/admin/cache/warm", methods: []string{"POST"}, summary: "Fetch and cache a JSON array of /{subdomain}/{path} paths.",
+		handler: (*Server).cacheWarmHandler},
+	{path: "/admin/maintenance", methods: []string{"GET", "POST"}, admin: true,
+		summary: "Read or set maintenance mode, as {enabled, message, retryAfterSeconds}.", handler: (*Server).maintenanceHandler},
+}
+
+// internalRoutes is set here rather than where it's declared because
+// openAPIHandler, one of its handlers, reads it.
+func init() {
+	internalRoutes = []internalRoute{
+		{path: "/metrics", methods: []string{"GET"}, private: true, summary: "Prometheus metrics.", handler: (*Server).metricsHandler},
+		{path: "/_proxy/stats", methods: []string{"GET"}, private: true, summary: "Connection pool and response statistics.", handler: (*Server).statsHandler},
+		{path: "/_proxy/config", methods: []string{"GET"}, private: true, summary: "Settings that can change while the proxy runs.", handler: (*Server).runtimeConfigHandler},
+		{path: "/_proxy/maintenance", methods: []string{"GET", "POST"}, admin: true,
+			summary: "Read or set maintenance mode, as {enabled, message, retryAfterSeconds}.", handler: (*Server).maintenanceHandler},
+		{path: adminAPIPrefix, handler: (*Server).adminAPIHandler},
+		{path: "/_proxy/thumbnails", methods: []string{"GET"}, client: true,
+			summary: "Avatar headshot URLs for ?userIds=1,2,3, batched and cached.", handler: (*Server).thumbnailsHandler},
+		{path: "/_proxy/universe/", doc: "/_proxy/universe/{placeId}", methods: []string{"GET"}, client: true,
+			summary: "The universe a place belongs to.", handler: (*Server).universeHandler},
+		{path: "/_proxy/users/", doc: "/_proxy/users/{userId}/profile", methods: []string{"GET"}, client: true,
+			summary: "A user's info, avatar and counts in one answer.", handler: (*Server).profileHandler},
+		{path: "/_proxy/asset/", doc: "/_proxy/asset/{assetId}", methods: []string{"GET"}, client: true,
+			summary: "An asset's bytes, fetched through assetdelivery and its CDN.", handler: (*Server).assetHandler},
+		{path: "/_proxy/presence/watch", methods: []string{"GET"}, client: true,
+			summary: "Long-poll presence for ?userIds=1,2,3 until it changes.", handler: (*Server).presenceWatchHandler},
+		{path: "/_proxy/openapi", methods: []string{"GET"}, client: true,
+			summary: "This document.", handler: (*Server).openAPIHandler},
+		{path: "/_proxy/docs", methods: []string{"GET"}, client: true,
+			summary: "This document as an HTML page.", handler: (*Server).docsHandler},
+		{path: "/admin/", handler: (*Server).adminHandler},
+	}
+}
+
+// internalHandler dispatches the proxy's own endpoints. The private ones
+// describe the proxy's internals, so like /admin/ they only exist once KEY
+// is set, behind PROXYKEY.
+func (s *Server) internalHandler(ctx *fasthttp.RequestCtx) {
+	r, ok := findRoute(internalRoutes, string(ctx.Path()))
+	if !ok || (r.private && s.config().Key == "") {
+		proxyError(ctx, 404, "not_found", "Not found.")
+		return
+	}
+	r.handler(s, ctx)
+}
+
+// healthHandler serves /healthz (process is up) and /readyz (process is
+// accepting traffic; fails as soon as shutdown starts, and with
+// READYZ_WAIT_WARMUP until warmup is done). Maintenance mode
+// keeps /readyz passing, so the proxy stays in rotation to serve its 503,
+// but reports it in the body.
+func (s *Server) healthHandler(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Path()) == "/readyz" {
+		if s.isDraining() {
+			ctx.SetConnectionClose()
+			ctx.SetStatusCode(503)
+			ctx.SetBody([]byte("draining"))
+			return
+		}
+		if s.config().ReadyzWaitWarmup && !s.isWarm() {
+			ctx.SetStatusCode(503)
+			ctx.SetBody([]byte("warming up"))
+			return
+		}
+		if s.maintenanceState().Enabled {
+			ctx.SetStatusCode(200)
+			ctx.SetBody([]byte("maintenance"))
+			return
+		}
+	}
+	ctx.SetStatusCode(200)
+	ctx.SetBody([]byte("ok"))
+}
+
+// adminHandler serves the /admin/* debugging endpoints. The caller has
+// already validated PROXYKEY; when KEY is not configured at all the admin
+// surface is hidden so an open proxy never exposes it. Routes marked admin
+// are the exception: like the management API they need only the ADMIN_KEY
+// header, which their handlers check.
+func (s *Server) adminHandler(ctx *fasthttp.RequestCtx) {
+	r, ok := findRoute(adminRoutes, string(ctx.Path()))
+	if !ok || (s.config().Key == "" && !r.admin) {
+		proxyError(ctx, 404, "not_found", "Not found.")
+		return
+	}
+	r.handler(s, ctx)
+}
+
+// echoHandler serves /admin/echo: the request as the proxy received it,
+// after any load balancer in front, and the client IP it derives. The
+// PROXYKEY and ADMIN_KEY values are masked.
+func (s *Server) echoHandler(ctx *fasthttp.RequestCtx) {
+	headers := map[string][]string{}
+	ctx.Request.Header.VisitAll(func(k, v []byte) {
+		key := string(k)
+		value := string(v)
+		if strings.EqualFold(key, "PROXYKEY") || strings.EqualFold(key, "ADMIN_KEY") {
+			value = "REDACTED"
+		}
+		headers[key] = append(headers[key], value)
+	})
+	writeJSON(ctx, 200, map[string]interface{}{
+		"method":     string(ctx.Method()),
+		"uri":        string(ctx.RequestURI()),
+		"remoteAddr": ctx.RemoteAddr().String(),
+		"clientIp":   clientIP(s.config(), ctx),
+		"headers":    headers,
+	})
+}
+
+// effectiveConfigHandler serves /admin/config: every setting as the
+// process loaded it, keyed by its config file name, with secrets redacted.
+func (s *Server) effectiveConfigHandler(ctx *fasthttp.RequestCtx) {
+	cfg := s.config()
+	settings, err := cfg.effective()
+	if err != nil {
+		log.Printf("effective config: %v", err)
+		proxyError(ctx, 500, "internal_error", "Internal error.")
+		return
+	}
+	writeJSON(ctx, 200, settings)
+}
+
+// runtimeConfigHandler serves /_proxy/config: settings that can change
+// while the process runs.
+func (s *Server) runtimeConfigHandler(ctx *fasthttp.RequestCtx) {
+	writeJSON(ctx, 200, map[string]interface{}{
+		"maintenance": s.maintenanceState(),
+	})
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("JSON encode error: %v", err)
+		proxyError(ctx, 500, "internal_error", "Internal error.")
+		return
+	}
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+}
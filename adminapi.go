@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// adminAPIPrefix is where the management API is mounted.
+const adminAPIPrefix = "/_proxy/admin/"
+
+// isAdminAPIPath reports whether path is part of the management API, or
+// another route marked admin, which are authenticated with ADMIN_KEY
+// instead of PROXYKEY.
+func isAdminAPIPath(path string) bool {
+	if strings.HasPrefix(path, adminAPIPrefix) {
+		return true
+	}
+	for _, routes := range [][]internalRoute{internalRoutes, adminRoutes} {
+		if r, ok := findRoute(routes, path); ok && r.admin {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAPIHandler serves the management API under /_proxy/admin/. Game
+// servers hold PROXYKEY, so every route needs the ADMIN_KEY header
+// instead; without ADMIN_KEY configured none of them exist. Like the other
+// internal endpoints, they are only served on ADMIN_LISTEN when it's set.
+// Every answer is JSON, errors included.
+func (s *Server) adminAPIHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Request.Header.Set("Accept", "application/json")
+	if !s.checkAdminKey(ctx) {
+		return
+	}
+	r, ok := findRoute(adminAPIRoutes, string(ctx.Path()))
+	if !ok {
+		proxyError(ctx, 404, "not_found", "Not found.")
+		return
+	}
+	if adminMethod(ctx, r.methods) {
+		r.handler(s, ctx)
+	}
+}
+
+// adminAPIRoutes are the management API endpoints.
+var adminAPIRoutes = []internalRoute{
+	{path: adminAPIPrefix + "cache/purge", methods: []string{"POST"}, admin: true,
+		summary: "Empty the caches, or with {\"prefix\": \"/games/v1/\"} only the response cache entries under it.", handler: (*Server).cachePurgeHandler},
+	{path: adminAPIPrefix + "maintenance", methods: []string{"GET", "POST"}, admin: true,
+		summary: "Read or set maintenance mode, as {enabled, message, retryAfterSeconds}.", handler: (*Server).maintenanceHandler},
+	{path: adminAPIPrefix + "config", methods: []string{"GET"}, admin: true,
+		summary: "Every setting as loaded, secrets redacted.", handler: (*Server).effectiveConfigHandler},
+	{path: adminAPIPrefix + "keys/reload", methods: []string{"POST"}, admin: true,
+		summary: "Read KEY_FILE again.", handler: (*Server).keysReloadHandler},
+	{path: adminAPIPrefix + "stats/reset", methods: []string{"POST"}, admin: true,
+		summary: "Zero the statistics counters.", handler: (*Server).statsResetHandler},
+	{path: adminAPIPrefix + "mirror", methods: []string{"GET"}, admin: true,
+		summary: "MIRROR_SHADOWS comparison counts and the last differences.", handler: (*Server).mirrorHandler},
+}
+
+// adminMethod reports whether the request uses one of methods, answering
+// 405 when it doesn't.
+func adminMethod(ctx *fasthttp.RequestCtx, methods []string) bool {
+	for _, m := range methods {
+		if string(ctx.Method()) == m {
+			return true
+		}
+	}
+	ctx.Response.Header.Set("Allow", strings.Join(methods, ", "))
+	proxyError(ctx, 405, "method_not_allowed", "Use "+strings.Join(methods, " or ")+".")
+	return false
+}
+
+// cachePurgeHandler serves POST /_proxy/admin/cache/purge. A JSON body of
+// {"prefix": "/games/v1/"} removes the response cache entries for paths
+// under the prefix; no body empties every cache.
+func (s *Server) cachePurgeHandler(ctx *fasthttp.RequestCtx) {
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if body := ctx.PostBody(); len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			proxyError(ctx, 400, "invalid_body", "Invalid JSON body: "+err.Error())
+			return
+		}
+		if req.Prefix != "" && (!strings.HasPrefix(req.Prefix, "/") || strings.Count(req.Prefix, "/") < 2) {
+			proxyError(ctx, 400, "invalid_prefix", "prefix must be a /{subdomain}/{path} prefix.")
+			return
+		}
+	}
+	purged := 0
+	if req.Prefix == "" {
+		for _, c := range []*responseCache{s.cache, s.thumbCache, s.profileCache} {
+			if c != nil {
+				purged += c.purge("")
+			}
+		}
+	} else if s.cache != nil {
+		cfg := s.config()
+		parts := strings.SplitN(req.Prefix[1:], "/", 2)
+		purged = s.cache.purge("https://" + strings.ToLower(parts[0]) + "." + cfg.TargetDomain + cfg.basePath + "/" + parts[1])
+	}
+	log.Printf("AUDIT cache purge %q: %d entries", req.Prefix, purged)
+	writeJSON(ctx, 200, map[string]interface{}{"purged": purged})
+}
+
+// keysReloadHandler serves POST /_proxy/admin/keys/reload: KEY_FILE is
+// read again and its key replaces the current one, leaving every other
+// setting as it is. An empty file is refused rather than turning
+// authentication off.
+func (s *Server) keysReloadHandler(ctx *fasthttp.RequestCtx) {
+	cfg := s.config()
+	if cfg.KeyFile == "" {
+		proxyError(ctx, 409, "no_key_file", "KEY_FILE is not set.")
+		return
+	}
+	b, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		log.Printf("Reloading key file: %v", err)
+		proxyError(ctx, 500, "key_file_error", "Key file could not be read.")
+		return
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		proxyError(ctx, 500, "key_file_error", "Key file is empty.")
+		return
+	}
+	next := *cfg
+	next.Key = key
+	s.setConfig(&next)
+	changed := key != cfg.Key
+	log.Printf("AUDIT key file reloaded (changed: %v)", changed)
+	writeJSON(ctx, 200, map[string]interface{}{"reloaded": true, "changed": changed})
+}
+
+// statsResetHandler serves POST /_proxy/admin/stats/reset: the counters
+// behind /metrics, /_proxy/stats and /admin/recent start again from zero.
+// Gauges of what's open or in flight now are left alone.
+func (s *Server) statsResetHandler(ctx *fasthttp.RequestCtx) {
+	s.pool.reset()
+	s.sizes.reset()
+	s.legacy.reset()
+	s.transforms.reset()
+	s.upstreamErrors.reset()
+	s.recent.reset()
+	log.Printf("AUDIT stats reset")
+	writeJSON(ctx, 200, map[string]interface{}{"reset": []string{"pool", "responseSizes", "legacy", "transforms", "upstreamErrors", "recent"}})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func adminAPIRequest(t *testing.T, s *Server, method, route, headers, body string) *fasthttp.Response {
+	t.Helper()
+	return serveRaw(t, s, method+" /_proxy/admin/"+route+" HTTP/1.1\r\nHost: proxy\r\n"+headers+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+}
+
+func TestAdminAPIAuth(t *testing.T) {
+	routes := []struct{ method, route string }{
+		{"POST", "cache/purge"},
+		{"GET", "maintenance"},
+		{"GET", "config"},
+		{"POST", "keys/reload"},
+		{"POST", "stats/reset"},
+	}
+	tests := []struct {
+		name     string
+		adminKey string
+		headers  string
+		status   int
+		code     string
+	}{
+		{"admin key unset", "", "ADMIN_KEY: x\r\n", 404, "not_found"},
+		{"no header", "admin", "", 403, "invalid_admin_key"},
+		{"wrong key", "admin", "ADMIN_KEY: admin2\r\n", 403, "invalid_admin_key"},
+		{"PROXYKEY isn't enough", "admin", "PROXYKEY: secret\r\n", 403, "invalid_admin_key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Key = "secret"
+			cfg.AdminKey = tt.adminKey
+			s := newTestServer(t, cfg, okUpstream)
+			for _, r := range routes {
+				resp := adminAPIRequest(t, s, r.method, r.route, tt.headers, "")
+				if resp.StatusCode() != tt.status || string(resp.Header.Peek("X-Proxy-Error")) != tt.code {
+					t.Errorf("%s %s: %d %q, want %d %s", r.method, r.route, resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"), tt.status, tt.code)
+				}
+				if string(resp.Header.ContentType()) != "application/json" {
+					t.Errorf("%s %s: Content-Type %q", r.method, r.route, resp.Header.ContentType())
+				}
+			}
+		})
+	}
+
+	// ADMIN_KEY alone is enough, without PROXYKEY
+	cfg := testConfig()
+	cfg.Key = "secret"
+	cfg.AdminKey = "admin"
+	s := newTestServer(t, cfg, okUpstream)
+	if resp := adminAPIRequest(t, s, "GET", "config", "ADMIN_KEY: admin\r\n", ""); resp.StatusCode() != 200 {
+		t.Errorf("with ADMIN_KEY only: %d %s", resp.StatusCode(), resp.Body())
+	}
+	for _, tc := range []struct {
+		method, route string
+		status        int
+	}{{"GET", "nope", 404}, {"GET", "cache/purge", 405}, {"POST", "config", 405}} {
+		if resp := adminAPIRequest(t, s, tc.method, tc.route, "ADMIN_KEY: admin\r\n", ""); resp.StatusCode() != tc.status {
+			t.Errorf("%s %s: %d, want %d", tc.method, tc.route, resp.StatusCode(), tc.status)
+		}
+	}
+
+	// moved off the public listeners by ADMIN_LISTEN
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/_proxy/admin/config")
+	ctx.Request.Header.Set("ADMIN_KEY", "admin")
+	s.publicOnly(ctx)
+	if ctx.Response.StatusCode() != 404 {
+		t.Errorf("on a public listener: %d, want 404", ctx.Response.StatusCode())
+	}
+}
+
+func TestAdminAPIRoutes(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte("first\n"), 0600)
+	cfg := testConfig()
+	cfg.Key = "first"
+	cfg.KeyFile = keyFile
+	cfg.AdminKey = "admin"
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, okUpstream)
+	admin := func(method, route, body string) map[string]interface{} {
+		t.Helper()
+		resp := adminAPIRequest(t, s, method, route, "ADMIN_KEY: admin\r\n", body)
+		if resp.StatusCode() != 200 {
+			t.Fatalf("%s %s: %d %s", method, route, resp.StatusCode(), resp.Body())
+		}
+		var out map[string]interface{}
+		if err := json.Unmarshal(resp.Body(), &out); err != nil {
+			t.Fatalf("%s %s: %v", method, route, err)
+		}
+		return out
+	}
+	get := func(path, key string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: "+key+"\r\n\r\n")
+	}
+
+	// cache purge, by prefix and then everything
+	for _, p := range []string{"/games/v1/a", "/games/v1/b", "/users/v1/c"} {
+		get(p, "first")
+	}
+	if out := admin("POST", "cache/purge", `{"prefix":"/games/v1/"}`); out["purged"] != float64(2) {
+		t.Errorf("purge by prefix: %v", out)
+	}
+	if resp := get("/users/v1/c", "first"); string(resp.Header.Peek("X-Proxy-Cache")) != "HIT" {
+		t.Errorf("entry outside the prefix: X-Proxy-Cache %q", resp.Header.Peek("X-Proxy-Cache"))
+	}
+	if out := admin("POST", "cache/purge", ""); out["purged"] != float64(1) {
+		t.Errorf("purge all: %v", out)
+	}
+	if resp := adminAPIRequest(t, s, "POST", "cache/purge", "ADMIN_KEY: admin\r\n", `{"prefix":"games"}`); resp.StatusCode() != 400 {
+		t.Errorf("bad prefix: %d", resp.StatusCode())
+	}
+
+	// maintenance
+	if out := admin("POST", "maintenance", `{"enabled":true,"message":"Later."}`); out["enabled"] != true {
+		t.Errorf("maintenance: %v", out)
+	}
+	if resp := get("/games/v1/a", "first"); resp.StatusCode() != 503 {
+		t.Errorf("in maintenance: %d", resp.StatusCode())
+	}
+	admin("POST", "maintenance", `{"enabled":false}`)
+
+	// config, secrets redacted
+	if out := admin("GET", "config", ""); out["key"] != "REDACTED" || out["admin_key"] != "REDACTED" || out["retries"] != float64(cfg.Retries) {
+		t.Errorf("config: key %v, admin_key %v, retries %v", out["key"], out["admin_key"], out["retries"])
+	}
+
+	// keys reload
+	os.WriteFile(keyFile, []byte("second\n"), 0600)
+	if out := admin("POST", "keys/reload", ""); out["changed"] != true {
+		t.Errorf("keys reload: %v", out)
+	}
+	if resp := get("/games/v1/a", "first"); resp.StatusCode() != 407 {
+		t.Errorf("old key after reload: %d", resp.StatusCode())
+	}
+	if resp := get("/games/v1/a", "second"); resp.StatusCode() != 200 {
+		t.Errorf("new key after reload: %d", resp.StatusCode())
+	}
+	os.WriteFile(keyFile, nil, 0600)
+	if resp := adminAPIRequest(t, s, "POST", "keys/reload", "ADMIN_KEY: admin\r\n", ""); resp.StatusCode() != 500 || s.config().Key != "second" {
+		t.Errorf("empty key file: %d, key %q", resp.StatusCode(), s.config().Key)
+	}
+
+	// stats reset
+	if len(s.recent.snapshot()) == 0 || atomic.LoadInt64(&s.sizes.count) == 0 {
+		t.Fatal("no stats recorded")
+	}
+	admin("POST", "stats/reset", "")
+	if n := len(s.recent.snapshot()); n != 0 {
+		t.Errorf("%d recent requests after reset", n)
+	}
+	if n := atomic.LoadInt64(&s.sizes.count); n != 0 {
+		t.Errorf("%d responses counted after reset", n)
+	}
+}
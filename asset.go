@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// followParam is the reserved query parameter that asks the proxy to fetch
+// the asset an assetdelivery reply points at: _follow=true. It is never
+// sent upstream.
+var followParam = reserveQuery("_follow", "true on an assetdelivery GET to be answered with the asset's bytes instead of its location.")
+
+const (
+	// assetMaxRedirects is how many CDN redirects are followed for one
+	// asset before giving up.
+	assetMaxRedirects = 5
+
+	// assetCDNDomain is where assetdelivery sends clients for asset bytes.
+	assetCDNDomain = "rbxcdn.com"
+)
+
+// wantsAssetFollow strips _follow from an assetdelivery GET request and
+// reports whether it was true.
+func wantsAssetFollow(ctx *fasthttp.RequestCtx, subdomain string) bool {
+	if subdomain != "assetdelivery" || !ctx.IsGet() {
+		return false
+	}
+	v, ok := queryParam(ctx, followParam)
+	if !ok {
+		return false
+	}
+	setQueryParam(ctx, followParam, nil)
+	return v == "true"
+}
+
+// assetHandler serves GET /_proxy/asset/{assetId}: the asset's bytes,
+// fetched through assetdelivery and its CDN as with _follow=true.
+func (s *Server) assetHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		proxyError(ctx, 405, "method_not_allowed", "Use GET.")
+		return
+	}
+	assetID, err := strconv.ParseInt(strings.TrimPrefix(string(ctx.Path()), "/_proxy/asset/"), 10, 64)
+	if err != nil || assetID < 1 {
+		proxyError(ctx, 400, "invalid_asset_id", "Use /_proxy/asset/{assetId}.")
+		return
+	}
+	cfg := s.config()
+	s.followAsset(cfg, internalCtx(ctx, "GET", "/assetdelivery/v1/asset/?id="+strconv.FormatInt(assetID, 10), nil), ctx)
+	s.throttleBody(cfg, ctx, "assetdelivery")
+}
+
+// followAsset sends the assetdelivery request in req and answers out with
+// the asset it leads to. The asset location is taken from a redirect or
+// from the location(s) field of a JSON reply, and fetched from the CDN
+// (following up to assetMaxRedirects more redirects) into out with the
+// CDN's Content-Type. Locations off rbxcdn.com and TARGET_DOMAIN are
+// refused, as are assets over ASSET_MAX_BYTES. Failures are answered with
+// a proxy error; a reply that is already the asset is passed on as it is.
+func (s *Server) followAsset(cfg *Config, req, out *fasthttp.RequestCtx) {
+	// the reply is read for its location, so it has to come back plain
+	req.Request.Header.Del("Accept-Encoding")
+	resp, err := s.makeRequest(req, 1)
+	defer fasthttp.ReleaseResponse(resp)
+	if err != nil {
+		proxyError(out, resp.StatusCode(), string(resp.Header.Peek("X-Proxy-Error")), string(resp.Body()))
+		return
+	}
+
+	location := assetLocation(resp)
+	if location == "" {
+		if resp.StatusCode() == 200 && !isJSONContentType(resp.Header.ContentType()) {
+			writeAsset(cfg, out, resp)
+			return
+		}
+		status := resp.StatusCode()
+		if status < 400 || status >= 500 {
+			status = 502
+		}
+		proxyError(out, status, "asset_location_missing", "assetdelivery answered "+strconv.Itoa(resp.StatusCode())+" without an asset location.")
+		return
+	}
+
+	base, _ := url.Parse("https://assetdelivery." + cfg.TargetDomain + "/")
+	for redirects := 0; ; redirects++ {
+		u, err := base.Parse(location)
+		if err != nil || u.Scheme != "https" || !assetHostAllowed(cfg, u.Hostname()) {
+			proxyError(out, 502, "asset_location_invalid", "Asset location "+strconv.Quote(location)+" is not on "+assetCDNDomain+".")
+			return
+		}
+		resp.Reset()
+		cdnReq := fasthttp.AcquireRequest()
+		cdnReq.SetRequestURI(u.String())
+		cdnReq.Header.Set("User-Agent", cfg.UserAgent)
+		err = s.client.DoTimeout(cdnReq, resp, cfg.Timeout.D())
+		fasthttp.ReleaseRequest(cdnReq)
+		if err != nil {
+			proxyError(out, 502, "asset_cdn_error", "Fetching the asset from the CDN failed: "+err.Error())
+			return
+		}
+		if status := resp.StatusCode(); status >= 300 && status < 400 {
+			if redirects == assetMaxRedirects {
+				proxyError(out, 502, "asset_redirect_loop", "The CDN redirected more than "+strconv.Itoa(assetMaxRedirects)+" times.")
+				return
+			}
+			base = u
+			location = string(resp.Header.Peek("Location"))
+			continue
+		}
+		if resp.StatusCode() != 200 {
+			proxyError(out, 502, "asset_cdn_error", "The CDN answered "+strconv.Itoa(resp.StatusCode())+" for the asset.")
+			return
+		}
+		writeAsset(cfg, out, resp)
+		return
+	}
+}
+
+// assetLocation returns where an assetdelivery reply points: its redirect
+// Location, or the location field of a v1 JSON reply, or the first of the
+// locations of a v2 one.
+func assetLocation(resp *fasthttp.Response) string {
+	if status := resp.StatusCode(); status >= 300 && status < 400 {
+		return string(resp.Header.Peek("Location"))
+	}
+	if resp.StatusCode() != 200 || !isJSONContentType(resp.Header.ContentType()) {
+		return ""
+	}
+	var body struct {
+		Location  string `json:"location"`
+		Locations []struct {
+			Location string `json:"location"`
+		} `json:"locations"`
+	}
+	if json.Unmarshal(resp.Body(), &body) != nil {
+		return ""
+	}
+	if body.Location == "" && len(body.Locations) > 0 {
+		return body.Locations[0].Location
+	}
+	return body.Location
+}
+
+// assetHostAllowed reports whether host is on the CDN or TARGET_DOMAIN.
+func assetHostAllowed(cfg *Config, host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range []string{assetCDNDomain, strings.ToLower(cfg.TargetDomain)} {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAsset answers out with the asset in resp, or a 502 when it is over
+// ASSET_MAX_BYTES.
+func writeAsset(cfg *Config, out *fasthttp.RequestCtx, resp *fasthttp.Response) {
+	if n := len(resp.Body()); int64(n) > cfg.AssetMaxBytes {
+		proxyError(out, 502, "asset_too_large", "The asset is "+strconv.Itoa(n)+" bytes, over the "+strconv.FormatInt(cfg.AssetMaxBytes, 10)+" byte limit.")
+		return
+	}
+	out.SetStatusCode(200)
+	out.SetContentType(string(resp.Header.ContentType()))
+	if ce := resp.Header.Peek("Content-Encoding"); len(ce) > 0 {
+		out.Response.Header.SetBytesV("Content-Encoding", ce)
+	}
+	out.SetBody(resp.Body())
+	out.Response.Header.SetContentLength(len(resp.Body()))
+}
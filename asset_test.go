@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAssetFollow(t *testing.T) {
+	asset := bytes.Repeat([]byte{0x3c, 0x72, 0x6f, 0x62, 0x6c, 0x6f, 0x78, 0x21, 0x00, 0xff}, 1000)
+	var sawFollow bool
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if ctx.QueryArgs().Has(followParam) {
+			sawFollow = true
+		}
+		switch string(ctx.Host()) + string(ctx.Path()) {
+		case "assetdelivery.roblox.com/v1/asset/":
+			switch string(ctx.QueryArgs().Peek("id")) {
+			case "1":
+				ctx.Redirect("https://c1.rbxcdn.com/hash1", 302)
+			case "2":
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{"location":"https://c2.rbxcdn.com/hash1"}`)
+			case "3":
+				ctx.Redirect("https://c3.rbxcdn.com/loop", 302)
+			case "4":
+				ctx.Redirect("https://c4.rbxcdn.com/missing", 302)
+			case "5":
+				ctx.Redirect("https://evil.example.com/hash1", 302)
+			default:
+				ctx.SetContentType("application/json")
+				ctx.Error(`{"errors":[{"code":404,"message":"Request asset was not found"}]}`, 404)
+			}
+		case "assetdelivery.roblox.com/v2/asset/":
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{"locations":[{"location":"https://c0.rbxcdn.com/hash1"}]}`)
+		case "c0.rbxcdn.com/hash1", "c1.rbxcdn.com/hash1", "c2.rbxcdn.com/hash1":
+			ctx.SetContentType("application/octet-stream")
+			ctx.SetBody(asset)
+		case "c3.rbxcdn.com/loop":
+			ctx.Redirect("/loop", 302)
+		default:
+			ctx.Error("not found", 404)
+		}
+	}
+	cfg := testConfig()
+	s := newTestServer(t, cfg, upstream)
+	get := func(uri string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\nAccept: application/json\r\n\r\n")
+	}
+
+	for _, uri := range []string{
+		"/assetdelivery/v1/asset/?id=1&_follow=true",
+		"/assetdelivery/v1/asset/?id=2&_follow=true",
+		"/assetdelivery/v2/asset/?id=2&_follow=true",
+		"/_proxy/asset/1",
+	} {
+		resp := get(uri)
+		if resp.StatusCode() != 200 || !bytes.Equal(resp.Body(), asset) {
+			t.Errorf("%s: %d, %d bytes", uri, resp.StatusCode(), len(resp.Body()))
+		}
+		if ct := string(resp.Header.ContentType()); ct != "application/octet-stream" {
+			t.Errorf("%s: Content-Type %q", uri, ct)
+		}
+		if cl := resp.Header.ContentLength(); cl != len(asset) {
+			t.Errorf("%s: Content-Length %d, want %d", uri, cl, len(asset))
+		}
+	}
+	if sawFollow {
+		t.Error("_follow was sent upstream")
+	}
+
+	// without _follow the location is passed on
+	if resp := get("/assetdelivery/v1/asset/?id=2"); string(resp.Body()) != `{"location":"https://c2.rbxcdn.com/hash1"}` {
+		t.Errorf("no follow: %d %q", resp.StatusCode(), resp.Body())
+	}
+
+	for _, tc := range []struct {
+		uri    string
+		status int
+		code   string
+	}{
+		{"/assetdelivery/v1/asset/?id=3&_follow=true", 502, "asset_redirect_loop"},
+		{"/assetdelivery/v1/asset/?id=4&_follow=true", 502, "asset_cdn_error"},
+		{"/assetdelivery/v1/asset/?id=5&_follow=true", 502, "asset_location_invalid"},
+		{"/assetdelivery/v1/asset/?id=9&_follow=true", 404, "asset_location_missing"},
+		{"/_proxy/asset/abc", 400, "invalid_asset_id"},
+	} {
+		resp := get(tc.uri)
+		var body struct {
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(resp.Body(), &body); err != nil || resp.StatusCode() != tc.status || body.Code != tc.code {
+			t.Errorf("%s: %d %q, want %d %s", tc.uri, resp.StatusCode(), resp.Body(), tc.status, tc.code)
+		}
+	}
+
+	cfg.AssetMaxBytes = int64(len(asset) - 1)
+	if resp := get("/_proxy/asset/1"); resp.StatusCode() != 502 || !bytes.Contains(resp.Body(), []byte("asset_too_large")) {
+		t.Errorf("over asset_max_bytes: %d %q", resp.StatusCode(), resp.Body())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// bandwidthChunk is the most a throttled body reads at a time. Keeping it
+// small interleaves concurrent bodies on a shared bucket.
+const bandwidthChunk = 16 << 10
+
+// tokenBucket hands out tokens (bytes, or retries) at rate per second with
+// up to one second of burst, and at least one token. Reservations may drive
+// the balance negative; later callers wait behind earlier ones, so a shared
+// bucket is served in arrival order.
+type tokenBucket struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := math.Max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill adds the tokens earned since the last call. b.mu must be held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take takes one token if one is available, without waiting.
+func (b *tokenBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// available returns the current balance.
+func (b *tokenBucket) available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+// bandwidthLimiter holds the BANDWIDTH_LIMIT bucket and the per-subdomain
+// BANDWIDTH_LIMIT_OVERRIDES buckets, created on first use.
+type bandwidthLimiter struct {
+	global *tokenBucket // nil without BANDWIDTH_LIMIT
+
+	mu   sync.Mutex
+	subs map[string]*tokenBucket
+}
+
+func newBandwidthLimiter(cfg *Config) *bandwidthLimiter {
+	l := &bandwidthLimiter{subs: map[string]*tokenBucket{}}
+	if cfg.BandwidthLimit > 0 {
+		l.global = newTokenBucket(float64(cfg.BandwidthLimit))
+	}
+	return l
+}
+
+// buckets returns the buckets a response for subdomain draws from.
+func (l *bandwidthLimiter) buckets(cfg *Config, subdomain string) []*tokenBucket {
+	var out []*tokenBucket
+	if l.global != nil {
+		out = append(out, l.global)
+	}
+	if rate, ok := cfg.BandwidthLimitOverrides.lookup(subdomain); ok {
+		l.mu.Lock()
+		b := l.subs[subdomain]
+		if b == nil {
+			b = newTokenBucket(float64(rate))
+			l.subs[subdomain] = b
+		}
+		l.mu.Unlock()
+		out = append(out, b)
+	}
+	return out
+}
+
+// throttleBody replaces the response body with a stream paced by the
+// bandwidth limits for subdomain. Bodies within the burst are sent at once.
+func (s *Server) throttleBody(cfg *Config, ctx *fasthttp.RequestCtx, subdomain string) {
+	buckets := s.bandwidth.buckets(cfg, subdomain)
+	if len(buckets) == 0 || len(ctx.Response.Body()) == 0 {
+		return
+	}
+	// SetBodyStream recycles the current body buffer
+	body := append([]byte(nil), ctx.Response.Body()...)
+	ctx.Response.SetBodyStream(&throttledReader{r: bytes.NewReader(body), buckets: buckets}, len(body))
+}
+
+// throttledReader reads from r no faster than every bucket allows.
+type throttledReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, b := range t.buckets {
+			if d := b.reserve(n); d > wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fetchTimed runs requestHandler on raw and returns the response body
+// along with how long it took to drain.
+func fetchTimed(t *testing.T, s *Server, raw string) ([]byte, time.Duration) {
+	t.Helper()
+	var req fasthttp.Request
+	if err := req.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		t.Errorf("parsing request: %v", err)
+		return nil, 0
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	start := time.Now()
+	s.requestHandler(&ctx)
+	body := append([]byte(nil), ctx.Response.Body()...)
+	return body, time.Since(start)
+}
+
+// checkRate fails unless sending size bytes at rate, after a one-second
+// burst, plausibly took elapsed.
+func checkRate(t *testing.T, size, rate int, elapsed time.Duration) {
+	t.Helper()
+	want := time.Duration(float64(size-rate) / float64(rate) * float64(time.Second))
+	if elapsed < want*8/10 || elapsed > want*15/10 {
+		t.Errorf("sending %d bytes at %d B/s took %v, want about %v", size, rate, elapsed, want)
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 2<<20)
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/small" {
+			ctx.SetBodyString("small")
+			return
+		}
+		ctx.SetBody(large)
+	}
+	cfg := testConfig()
+	cfg.BandwidthLimit = 1 << 20
+	s := newTestServer(t, cfg, upstream)
+
+	body, elapsed := fetchTimed(t, s, "GET /catalog/large HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if !bytes.Equal(body, large) {
+		t.Fatalf("body is %d bytes, want %d", len(body), len(large))
+	}
+	checkRate(t, len(large), cfg.BandwidthLimit, elapsed)
+
+	// The bucket is now empty, but a small body still only waits for its
+	// own bytes
+	body, elapsed = fetchTimed(t, s, "GET /catalog/small HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if string(body) != "small" || elapsed > 100*time.Millisecond {
+		t.Errorf("small response = %q in %v, want it unthrottled", body, elapsed)
+	}
+}
+
+func TestBandwidthLimitShared(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 512<<10)
+	cfg := testConfig()
+	cfg.BandwidthLimit = 1 << 20
+	s := newTestServer(t, cfg, func(ctx *fasthttp.RequestCtx) { ctx.SetBody(large) })
+
+	// Use up the burst so both downloads below are paced from the start
+	fetchTimed(t, s, "GET /catalog/large HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	fetchTimed(t, s, "GET /catalog/large HTTP/1.1\r\nHost: proxy\r\n\r\n")
+
+	// Two concurrent downloads share the limit and finish together
+	var wg sync.WaitGroup
+	times := make([]time.Duration, 2)
+	start := time.Now()
+	for i := range times {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body, _ := fetchTimed(t, s, "GET /catalog/large HTTP/1.1\r\nHost: proxy\r\n\r\n")
+			if len(body) != len(large) {
+				t.Errorf("body is %d bytes, want %d", len(body), len(large))
+			}
+			times[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+	want := time.Duration(2*len(large)) * time.Second / time.Duration(cfg.BandwidthLimit)
+	if elapsed := time.Since(start); elapsed < want*8/10 || elapsed > want*15/10 {
+		t.Errorf("concurrent downloads took %v, want about %v", elapsed, want)
+	}
+	if d := times[0] - times[1]; d > 300*time.Millisecond || d < -300*time.Millisecond {
+		t.Errorf("downloads finished %v apart, want them to share the limit fairly", d)
+	}
+}
+
+func TestBandwidthLimitOverrides(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 1<<20)
+	cfg := testConfig()
+	cfg.BandwidthLimitOverrides = SubdomainLimits{"assetdelivery": 512 << 10}
+	s := newTestServer(t, cfg, func(ctx *fasthttp.RequestCtx) { ctx.SetBody(large) })
+
+	_, elapsed := fetchTimed(t, s, "GET /assetdelivery/v1/asset HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	checkRate(t, len(large), 512<<10, elapsed)
+
+	if _, elapsed := fetchTimed(t, s, "GET /catalog/large HTTP/1.1\r\nHost: proxy\r\n\r\n"); elapsed > 200*time.Millisecond {
+		t.Errorf("catalog response took %v, want it unthrottled", elapsed)
+	}
+}
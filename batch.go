@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// defaultBatchEndpoints is the default BATCH_ENDPOINTS: the Roblox batch
+// endpoints that cap how many IDs one call may carry.
+const defaultBatchEndpoints = "presence/v1/presence/users=100:userIds,users/v1/users=100:userIds,thumbnails/v1/batch=100:"
+
+// batchEndpoint is one BATCH_ENDPOINTS entry, written
+// subdomain/path=limit:field. The pattern is matched with path.Match, and
+// field names the JSON body's ID array; an empty field means the body is
+// the array itself.
+type batchEndpoint struct {
+	pattern string
+	limit   int
+	field   string
+}
+
+func parseBatchEndpoints(list string) ([]batchEndpoint, error) {
+	var out []batchEndpoint
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, spec, ok := cut(entry, "=")
+		limit, field, ok2 := cut(spec, ":")
+		n, err := strconv.Atoi(limit)
+		if !ok || !ok2 || err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not subdomain/path=limit:field", entry)
+		}
+		pattern = strings.ToLower(strings.Trim(pattern, "/"))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		out = append(out, batchEndpoint{pattern: pattern, limit: n, field: field})
+	}
+	return out, nil
+}
+
+// cut is strings.Cut, which needs Go 1.18.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// batchRequest is a request to a batch endpoint carrying more IDs than its
+// limit.
+type batchRequest struct {
+	endpoint batchEndpoint
+	body     map[string]json.RawMessage // nil when the body is the array
+	ids      []json.RawMessage
+}
+
+// oversizedBatch returns the batch request ctx carries when it has more
+// IDs than its endpoint allows, or nil.
+func oversizedBatch(cfg *Config, ctx *fasthttp.RequestCtx) *batchRequest {
+	if !ctx.IsPost() || len(ctx.Request.Header.Peek("Content-Encoding")) > 0 {
+		return nil
+	}
+	p := strings.ToLower(strings.Trim(string(ctx.Path()), "/"))
+	for _, ep := range cfg.batchEndpoints {
+		if ok, _ := path.Match(ep.pattern, p); !ok {
+			continue
+		}
+		b := &batchRequest{endpoint: ep}
+		ids := ctx.Request.Body()
+		if ep.field != "" {
+			if json.Unmarshal(ids, &b.body) != nil {
+				return nil
+			}
+			ids = b.body[ep.field]
+		}
+		if json.Unmarshal(ids, &b.ids) != nil || len(b.ids) <= ep.limit {
+			return nil
+		}
+		return b
+	}
+	return nil
+}
+
+// chunkBody is the request body carrying ids.
+func (b *batchRequest) chunkBody(ids []json.RawMessage) []byte {
+	if b.body == nil {
+		body, _ := json.Marshal(ids)
+		return body
+	}
+	fields := make(map[string]json.RawMessage, len(b.body))
+	for k, v := range b.body {
+		fields[k] = v
+	}
+	fields[b.endpoint.field], _ = json.Marshal(ids)
+	body, _ := json.Marshal(fields)
+	return body
+}
+
+// splitBatch sends b in chunks of at most its endpoint's limit, at most
+// BATCH_CONCURRENCY at a time, and merges the data arrays of the replies in
+// request order. The IDs of a chunk that fails get an error entry each in
+// place of their data, so one bad chunk doesn't fail the rest; only when
+// every chunk fails is the first failure returned as it is.
+func (s *Server) splitBatch(cfg *Config, ctx *fasthttp.RequestCtx, b *batchRequest) (*fasthttp.Response, error) {
+	var chunks [][]json.RawMessage
+	for ids := b.ids; len(ids) > 0; {
+		n := b.endpoint.limit
+		if n > len(ids) {
+			n = len(ids)
+		}
+		chunks = append(chunks, ids[:n])
+		ids = ids[n:]
+	}
+
+	resps := make([]*fasthttp.Response, len(chunks))
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, cfg.BatchConcurrency)
+	var wg sync.WaitGroup
+	for i, ids := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ids []json.RawMessage) {
+			defer func() { <-sem; wg.Done() }()
+			var req fasthttp.Request
+			ctx.Request.CopyTo(&req)
+			// the replies are merged, so they have to come back uncompressed
+			req.Header.Del("Accept-Encoding")
+			req.SetBody(b.chunkBody(ids))
+			var c fasthttp.RequestCtx
+			c.Init(&req, ctx.RemoteAddr(), nil)
+			resps[i], errs[i] = s.makeRequest(&c, 1)
+		}(i, ids)
+	}
+	wg.Wait()
+
+	var merged map[string]json.RawMessage
+	var data []json.RawMessage
+	failed := 0
+	for i, resp := range resps {
+		var page struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		var fields map[string]json.RawMessage
+		if errs[i] == nil && resp.StatusCode() == 200 &&
+			json.Unmarshal(resp.Body(), &fields) == nil && json.Unmarshal(resp.Body(), &page) == nil {
+			if merged == nil {
+				merged = fields
+			}
+			data = append(data, page.Data...)
+			continue
+		}
+		failed++
+		for _, id := range chunks[i] {
+			entry, _ := json.Marshal(map[string]interface{}{
+				"id": id,
+				"error": map[string]interface{}{
+					"code":   "batch_failed",
+					"status": resp.StatusCode(),
+				},
+			})
+			data = append(data, entry)
+		}
+	}
+	if failed == len(chunks) {
+		for _, resp := range resps[1:] {
+			fasthttp.ReleaseResponse(resp)
+		}
+		return resps[0], errs[0]
+	}
+	for _, resp := range resps {
+		fasthttp.ReleaseResponse(resp)
+	}
+
+	merged["data"], _ = json.Marshal(data)
+	body, _ := json.Marshal(merged)
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(200)
+	resp.Header.SetContentType("application/json")
+	resp.Header.Set("X-Proxy-Split", strconv.Itoa(len(chunks)))
+	resp.SetBody(body)
+	return resp, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// batchUpstream answers {"userIds":[...]} or a bare array of IDs with one
+// data entry per ID, refusing more than three IDs and failing any chunk
+// holding an ID in fail. Earlier IDs answer slower, so chunks finish out of
+// order.
+func batchUpstream(calls *int32, fail map[int]bool) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(calls, 1)
+		var req struct {
+			UserIDs []int `json:"userIds"`
+		}
+		if json.Unmarshal(ctx.PostBody(), &req) != nil {
+			json.Unmarshal(ctx.PostBody(), &req.UserIDs)
+		}
+		if len(req.UserIDs) > 3 {
+			ctx.Error(`{"errors":[{"message":"Too many ids"}]}`, 400)
+			return
+		}
+		time.Sleep(time.Duration(20-req.UserIDs[0]) * 5 * time.Millisecond)
+		var data []string
+		for _, id := range req.UserIDs {
+			if fail[id] {
+				ctx.Error(`{"errors":[]}`, 500)
+				return
+			}
+			data = append(data, fmt.Sprintf(`{"id":%d}`, id))
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"data":[` + strings.Join(data, ",") + `]}`)
+	}
+}
+
+func postBatch(t *testing.T, s *Server, path, body string) (*fasthttp.Response, []map[string]interface{}) {
+	t.Helper()
+	resp := serveRaw(t, s, fmt.Sprintf("POST %s HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", path, len(body), body))
+	var page struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(resp.Body(), &page)
+	return resp, page.Data
+}
+
+func idList(n int) string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i + 1)
+	}
+	return "[" + strings.Join(ids, ",") + "]"
+}
+
+func TestBatchSplit(t *testing.T) {
+	var calls int32
+	cfg := testConfig()
+	cfg.BatchEndpoints = "users/v1/users=3:userIds, thumbnails/v1/batch=3:"
+	s := newTestServer(t, cfg, batchUpstream(&calls, nil))
+
+	for _, tc := range []struct {
+		path, body string
+		ids, split int
+	}{
+		{"/users/v1/users", `{"userIds":` + idList(3) + `,"excludeBannedUsers":true}`, 3, 1},
+		{"/users/v1/users", `{"userIds":` + idList(4) + `,"excludeBannedUsers":true}`, 4, 2},
+		{"/users/v1/users", `{"userIds":` + idList(10) + `}`, 10, 4},
+		{"/thumbnails/v1/batch", idList(7), 7, 3},
+	} {
+		atomic.StoreInt32(&calls, 0)
+		resp, data := postBatch(t, s, tc.path, tc.body)
+		if resp.StatusCode() != 200 || len(data) != tc.ids {
+			t.Errorf("%d IDs to %s: %d with %d entries", tc.ids, tc.path, resp.StatusCode(), len(data))
+			continue
+		}
+		for i, entry := range data {
+			if entry["id"] != float64(i+1) {
+				t.Errorf("%d IDs to %s: entry %d = %v, want id %d", tc.ids, tc.path, i, entry, i+1)
+			}
+		}
+		if n := int(atomic.LoadInt32(&calls)); n != tc.split {
+			t.Errorf("%d IDs to %s: %d upstream calls, want %d", tc.ids, tc.path, n, tc.split)
+		}
+		want := ""
+		if tc.split > 1 {
+			want = fmt.Sprint(tc.split)
+		}
+		if got := string(resp.Header.Peek("X-Proxy-Split")); got != want {
+			t.Errorf("%d IDs to %s: X-Proxy-Split = %q, want %q", tc.ids, tc.path, got, want)
+		}
+	}
+}
+
+func TestBatchSplitFailures(t *testing.T) {
+	var calls int32
+	cfg := testConfig()
+	cfg.BatchEndpoints = "users/v1/users=3:userIds"
+	s := newTestServer(t, cfg, batchUpstream(&calls, map[int]bool{5: true}))
+
+	// The chunk holding 4-6 fails; its IDs become error entries in place
+	resp, data := postBatch(t, s, "/users/v1/users", `{"userIds":`+idList(8)+`}`)
+	if resp.StatusCode() != 200 || len(data) != 8 {
+		t.Fatalf("got %d with %d entries, want 200 with 8", resp.StatusCode(), len(data))
+	}
+	for i, entry := range data {
+		failed := i >= 3 && i <= 5
+		if entry["id"] != float64(i+1) || (entry["error"] != nil) != failed {
+			t.Errorf("entry %d = %v", i, entry)
+		}
+	}
+
+	// When every chunk fails the upstream's answer is passed on
+	s = newTestServer(t, cfg, batchUpstream(&calls, map[int]bool{1: true, 4: true}))
+	if resp, _ := postBatch(t, s, "/users/v1/users", `{"userIds":`+idList(5)+`}`); resp.StatusCode() != 500 {
+		t.Errorf("all chunks failing: status = %d, want 500", resp.StatusCode())
+	}
+}
+
+func TestBatchEndpointsConfig(t *testing.T) {
+	for _, list := range []string{"users/v1/users", "users/v1/users=0:userIds", "users/v1/users=x:userIds", "users/[=3:ids"} {
+		cfg := testConfig()
+		cfg.BatchEndpoints = list
+		if err := cfg.compile(); err == nil {
+			t.Errorf("batch_endpoints %q accepted", list)
+		}
+	}
+}
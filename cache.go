@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cachedResponse is an upstream response as stored in the response cache.
+type cachedResponse struct {
+	status  int
+	headers [][2]string
+	body    []byte
+	length  int // Content-Length; a HEAD entry has none of its body
+	age     int // upstream's Age when cached, in seconds
+	stored  time.Time
+	expires time.Time
+}
+
+func newCachedResponse(resp *fasthttp.Response) *cachedResponse {
+	r := &cachedResponse{
+		status: resp.StatusCode(),
+		body:   append([]byte(nil), resp.Body()...),
+	}
+	r.length = len(r.body)
+	if n := resp.Header.ContentLength(); r.length == 0 && n > 0 {
+		// the answer to a HEAD request: keep the length upstream gave
+		r.length = n
+	}
+	resp.Header.VisitAll(func(k, v []byte) {
+		switch key := strings.ToLower(string(k)); {
+		case isHopByHop(key):
+		case key == "age":
+			r.age, _ = strconv.Atoi(strings.TrimSpace(string(v)))
+		default:
+			// Cache-Control and Expires are kept as upstream sent them
+			r.headers = append(r.headers, [2]string{string(k), string(v)})
+		}
+	})
+	return r
+}
+
+// writeTo writes the cached response to ctx, with an Age that adds the
+// time spent in the cache to upstream's. With headersOnly the body is not
+// sent, but Content-Length still describes it, as for a HEAD response.
+func (r *cachedResponse) writeTo(ctx *fasthttp.RequestCtx, headersOnly bool) {
+	ctx.SetStatusCode(r.status)
+	for _, h := range r.headers {
+		ctx.Response.Header.Add(h[0], h[1])
+	}
+	ctx.Response.Header.Set("Age", strconv.Itoa(r.age+int(time.Since(r.stored).Seconds())))
+	if headersOnly {
+		ctx.Response.SkipBody = true
+		ctx.Response.Header.SetContentLength(r.length)
+	} else {
+		ctx.SetBody(r.body)
+	}
+	ctx.Response.Header.Set("X-Proxy-Cache", "HIT")
+}
+
+// cacheableStatus reports whether a response with status is stored in the
+// response cache: 200, and with CACHE_REDIRECTS the permanent redirects.
+// A cached redirect keeps its Location as upstream sent it.
+func cacheableStatus(cfg *Config, status int) bool {
+	switch status {
+	case 200:
+		return true
+	case 301, 308:
+		return cfg.CacheRedirects
+	}
+	return false
+}
+
+// hasCredentials reports whether the client sent Cookie or Authorization.
+// The answer may be for that user alone, so it is neither served from the
+// cache nor stored in it.
+func hasCredentials(ctx *fasthttp.RequestCtx) bool {
+	return len(ctx.Request.Header.Peek("Cookie")) > 0 || len(ctx.Request.Header.Peek("Authorization")) > 0
+}
+
+// sharedResponse reports whether upstream allows resp to be served to other
+// clients: it sets no cookie and isn't Cache-Control private or no-store.
+func sharedResponse(resp *fasthttp.Response) bool {
+	if len(resp.Header.Peek("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, directive := range strings.Split(string(resp.Header.Peek("Cache-Control")), ",") {
+		switch d := strings.ToLower(strings.TrimSpace(directive)); {
+		case d == "no-store", d == "private", strings.HasPrefix(d, "private="):
+			return false
+		}
+	}
+	return true
+}
+
+// responseCache is an LRU cache of upstream responses with a fixed TTL.
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+}
+
+type cacheItem struct {
+	key  string
+	resp *cachedResponse
+}
+
+// newResponseCache returns nil when ttl is not positive, which disables
+// caching.
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// configure applies a new TTL and size limit. Existing entries keep their
+// expiry; the cache shrinks on the next insert if maxEntries went down.
+func (c *responseCache) configure(ttl time.Duration, maxEntries int) {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	c.mu.Lock()
+	c.ttl = ttl
+	c.maxEntries = maxEntries
+	c.mu.Unlock()
+}
+
+// cacheKey identifies a cached response. The method keeps GET and HEAD apart
+// and Accept-Encoding keeps compressed and uncompressed variants apart.
+func cacheKey(method, acceptEncoding, url string) string {
+	return method + "\x00" + acceptEncoding + "\x00" + url
+}
+
+// lookup finds a cached response for the request. A HEAD request with no
+// HEAD entry may be answered from the GET entry, in which case headersOnly
+// is set and the cached body must not be sent.
+func (c *responseCache) lookup(method, acceptEncoding, url string) (r *cachedResponse, headersOnly bool) {
+	if r := c.get(cacheKey(method, acceptEncoding, url)); r != nil {
+		return r, false
+	}
+	if method == "HEAD" {
+		if r := c.get(cacheKey("GET", acceptEncoding, url)); r != nil {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	item := el.Value.(*cacheItem)
+	if time.Now().After(item.resp.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return item.resp
+}
+
+// purge removes the entries for upstream URLs starting with prefix, every
+// entry when prefix is empty, and returns how many it removed.
+func (c *responseCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		url := key[strings.LastIndexByte(key, 0)+1:]
+		if strings.HasPrefix(url, prefix) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *responseCache) set(key string, r *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	r.stored = now
+	r.expires = now.Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheItem).resp = r
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheItem{key: key, resp: r})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheItem).key)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCacheAge(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("Cache-Control", "public, max-age=60")
+		ctx.Response.Header.Set("Expires", "Thu, 15 Oct 2026 09:00:00 GMT")
+		ctx.Response.Header.Add("Vary", "Accept-Encoding")
+		ctx.Response.Header.Add("Vary", "Origin")
+		if string(ctx.Path()) == "/v1/aged" {
+			ctx.Response.Header.Set("Age", "10")
+		}
+		ctx.SetBodyString(`{"id":1}`)
+	}
+	cfg := testConfig()
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	get := func(path string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	}
+	// backdate moves the cached entries' time in the cache back by d
+	backdate := func(d time.Duration) {
+		for _, el := range s.cache.entries {
+			el.Value.(*cacheItem).resp.stored = el.Value.(*cacheItem).resp.stored.Add(-d)
+		}
+	}
+
+	resp := get("/games/v1/games")
+	if c := string(resp.Header.Peek("X-Proxy-Cache")); c != "MISS" || len(resp.Header.Peek("Age")) > 0 {
+		t.Errorf("first request: X-Proxy-Cache %q, Age %q", c, resp.Header.Peek("Age"))
+	}
+	for _, step := range []struct {
+		wait time.Duration
+		age  string
+	}{{0, "0"}, {3 * time.Second, "3"}, {5 * time.Second, "8"}} {
+		backdate(step.wait)
+		resp = get("/games/v1/games")
+		if c, age := string(resp.Header.Peek("X-Proxy-Cache")), string(resp.Header.Peek("Age")); c != "HIT" || age != step.age {
+			t.Errorf("cached: X-Proxy-Cache %q, Age %q, want HIT and %s", c, age, step.age)
+		}
+	}
+	if cc, exp := string(resp.Header.Peek("Cache-Control")), string(resp.Header.Peek("Expires")); cc != "public, max-age=60" || exp != "Thu, 15 Oct 2026 09:00:00 GMT" {
+		t.Errorf("cached: Cache-Control %q, Expires %q", cc, exp)
+	}
+	var vary []string
+	resp.Header.VisitAll(func(k, v []byte) {
+		if string(k) == "Vary" {
+			vary = append(vary, string(v))
+		}
+	})
+	if len(vary) != 2 {
+		t.Errorf("cached: Vary %q, want both values", vary)
+	}
+
+	// upstream's own Age is carried on
+	get("/games/v1/aged")
+	backdate(2 * time.Second)
+	if age := string(get("/games/v1/aged").Header.Peek("Age")); age != "12" {
+		t.Errorf("Age over upstream's 10 = %q, want 12", age)
+	}
+}
+
+func TestCacheRedirects(t *testing.T) {
+	var calls int
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		calls++
+		switch string(ctx.Path()) {
+		case "/v1/permanent":
+			ctx.Response.Header.Set("Location", "/v2/Permanent?a=1&b=%2F")
+			ctx.SetStatusCode(301)
+		case "/v1/found":
+			ctx.Response.Header.Set("Location", "https://www.roblox.com/x")
+			ctx.SetStatusCode(302)
+		}
+	}
+	cfg := testConfig()
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	get := func(path string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	}
+
+	for _, tc := range []struct {
+		path, location string
+		status         int
+		cached         bool
+	}{
+		{"/www/v1/permanent", "/v2/Permanent?a=1&b=%2F", 301, true},
+		{"/www/v1/found", "https://www.roblox.com/x", 302, false},
+	} {
+		calls = 0
+		get(tc.path)
+		resp := get(tc.path)
+		if resp.StatusCode() != tc.status || string(resp.Header.Peek("Location")) != tc.location {
+			t.Errorf("%s: %d to %q, want %d to %q", tc.path, resp.StatusCode(), resp.Header.Peek("Location"), tc.status, tc.location)
+		}
+		if hit := string(resp.Header.Peek("X-Proxy-Cache")) == "HIT"; hit != tc.cached || (calls == 1) != tc.cached {
+			t.Errorf("%s: X-Proxy-Cache %q after %d upstream calls, cached should be %v", tc.path, resp.Header.Peek("X-Proxy-Cache"), calls, tc.cached)
+		}
+	}
+
+	cfg.CacheRedirects = false
+	calls = 0
+	get("/www/v1/permanent?off")
+	if resp := get("/www/v1/permanent?off"); string(resp.Header.Peek("X-Proxy-Cache")) != "MISS" || calls != 2 {
+		t.Errorf("cache_redirects off: X-Proxy-Cache %q after %d upstream calls", resp.Header.Peek("X-Proxy-Cache"), calls)
+	}
+}
+
+func TestCacheHeadContentLength(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(`{"id":100}`)
+	}
+	cfg := testConfig()
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	head := "HEAD /games/v1/games HTTP/1.1\r\nHost: proxy\r\n\r\n"
+
+	miss := serveRaw(t, s, head)
+	hit := serveRaw(t, s, head)
+	if c := string(hit.Header.Peek("X-Proxy-Cache")); c != "HIT" {
+		t.Fatalf("second HEAD: X-Proxy-Cache %q, want HIT", c)
+	}
+	if miss.Header.ContentLength() != 10 || hit.Header.ContentLength() != miss.Header.ContentLength() {
+		t.Errorf("Content-Length: miss %d, hit %d, want 10 for both", miss.Header.ContentLength(), hit.Header.ContentLength())
+	}
+	if len(hit.Body()) != 0 {
+		t.Errorf("hit body = %q, want none", hit.Body())
+	}
+}
+
+func TestCacheKeyMethodAndEncoding(t *testing.T) {
+	var calls []string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		calls = append(calls, string(ctx.Method())+" "+string(ctx.Request.Header.Peek("Accept-Encoding")))
+		ctx.SetBodyString(`{"enc":"` + string(ctx.Request.Header.Peek("Accept-Encoding")) + `"}`)
+	}
+	cfg := testConfig()
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	do := func(method, path, encoding string) *fasthttp.Response {
+		t.Helper()
+		h := ""
+		if encoding != "" {
+			h = "Accept-Encoding: " + encoding + "\r\n"
+		}
+		return serveRaw(t, s, method+" "+path+" HTTP/1.1\r\nHost: proxy\r\n"+h+"\r\n")
+	}
+
+	// a HEAD entry never answers a GET with its empty body
+	do("HEAD", "/games/v1/a", "")
+	if resp := do("GET", "/games/v1/a", ""); string(resp.Header.Peek("X-Proxy-Cache")) != "MISS" || string(resp.Body()) != `{"enc":""}` {
+		t.Errorf("GET after HEAD: %q %q, want a MISS with the body", resp.Header.Peek("X-Proxy-Cache"), resp.Body())
+	}
+
+	// a GET entry answers a HEAD with its headers only
+	do("GET", "/games/v1/b", "")
+	resp := do("HEAD", "/games/v1/b", "")
+	if string(resp.Header.Peek("X-Proxy-Cache")) != "HIT" || len(resp.Body()) != 0 || resp.Header.ContentLength() != len(`{"enc":""}`) {
+		t.Errorf("HEAD after GET: %q, body %q, Content-Length %d; want a HIT with no body", resp.Header.Peek("X-Proxy-Cache"), resp.Body(), resp.Header.ContentLength())
+	}
+
+	// each Accept-Encoding has its own entry
+	do("GET", "/games/v1/c", "gzip")
+	if resp := do("GET", "/games/v1/c", ""); string(resp.Header.Peek("X-Proxy-Cache")) != "MISS" || string(resp.Body()) != `{"enc":""}` {
+		t.Errorf("plain after gzip: %q %q, want a MISS", resp.Header.Peek("X-Proxy-Cache"), resp.Body())
+	}
+	if resp := do("GET", "/games/v1/c", "gzip"); string(resp.Header.Peek("X-Proxy-Cache")) != "HIT" || string(resp.Body()) != `{"enc":"gzip"}` {
+		t.Errorf("gzip again: %q %q, want a HIT", resp.Header.Peek("X-Proxy-Cache"), resp.Body())
+	}
+	if want := "HEAD ,GET ,GET ,GET gzip,GET "; strings.Join(calls, ",") != want {
+		t.Errorf("upstream saw %q, want %q", strings.Join(calls, ","), want)
+	}
+}
+
+func TestCachePrivate(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string // extra request headers
+		header  string // upstream response header, as Name: value
+	}{
+		{"cookie", "Cookie: session=abc\r\n", ""},
+		{"authorization", "Authorization: Bearer abc\r\n", ""},
+		{"set-cookie", "", "Set-Cookie: session=abc"},
+		{"private", "", "Cache-Control: private, max-age=60"},
+		{"no-store", "", "Cache-Control: no-store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			upstream := func(ctx *fasthttp.RequestCtx) {
+				calls++
+				if name, value, ok := cut(tt.header, ": "); ok {
+					ctx.Response.Header.Set(name, value)
+				}
+				ctx.SetBodyString(`{"id":1}`)
+			}
+			cfg := testConfig()
+			cfg.CacheTTL = Duration(time.Minute)
+			s := newTestServer(t, cfg, upstream)
+			req := "GET /users/v1/users/authenticated HTTP/1.1\r\nHost: proxy\r\n" + tt.request + "\r\n"
+			serveRaw(t, s, req)
+			if resp := serveRaw(t, s, req); string(resp.Header.Peek("X-Proxy-Cache")) == "HIT" || calls != 2 {
+				t.Errorf("second request: X-Proxy-Cache %q after %d upstream calls, want 2 and no HIT", resp.Header.Peek("X-Proxy-Cache"), calls)
+			}
+			// nor is a client without credentials given it
+			if tt.request != "" {
+				serveRaw(t, s, "GET /users/v1/users/authenticated HTTP/1.1\r\nHost: proxy\r\n\r\n")
+				if calls != 3 {
+					t.Errorf("anonymous request served from the cache")
+				}
+			}
+		})
+	}
+}
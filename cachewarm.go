@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cacheWarmWorkers is how many paths /admin/cache/warm fetches at once.
+const cacheWarmWorkers = 4
+
+// cacheWarmResult is one path's outcome in the /admin/cache/warm summary.
+type cacheWarmResult struct {
+	Path   string `json:"path"`
+	OK     bool   `json:"ok"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// cacheWarmHandler serves POST /admin/cache/warm: it GETs each path in the
+// JSON array body, /{subdomain}/{path} as clients send them, and caches
+// the 200 answers as a client request would, under this request's
+// Accept-Encoding. A path that fails is reported and the rest go on. The
+// list may not be longer than CACHE_MAX_ENTRIES, so warmed entries don't
+// evict each other.
+func (s *Server) cacheWarmHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.Response.Header.Set("Allow", "POST")
+		proxyError(ctx, 405, "method_not_allowed", "Use POST.")
+		return
+	}
+	if s.cache == nil {
+		proxyError(ctx, 404, "cache_disabled", "The response cache is disabled.")
+		return
+	}
+	var paths []string
+	if err := json.Unmarshal(ctx.PostBody(), &paths); err != nil || len(paths) == 0 {
+		proxyError(ctx, 400, "invalid_paths", "Body must be a JSON array of paths.")
+		return
+	}
+	cfg := s.config()
+	if len(paths) > cfg.CacheMaxEntries {
+		proxyError(ctx, 400, "too_many_paths", "At most "+strconv.Itoa(cfg.CacheMaxEntries)+" paths (cache_max_entries) can be warmed at once.")
+		return
+	}
+
+	acceptEncoding := string(ctx.Request.Header.Peek("Accept-Encoding"))
+	results := make([]cacheWarmResult, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < cacheWarmWorkers && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = s.warmPath(cfg, ctx, paths[i], acceptEncoding)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if !r.OK {
+			failed++
+		}
+	}
+	writeJSON(ctx, 200, map[string]interface{}{
+		"cached":  len(paths) - failed,
+		"failed":  failed,
+		"results": results,
+	})
+}
+
+// warmPath fetches path upstream with acceptEncoding and caches a 200
+// answer.
+func (s *Server) warmPath(cfg *Config, ctx *fasthttp.RequestCtx, path, acceptEncoding string) cacheWarmResult {
+	res := cacheWarmResult{Path: path}
+	if !strings.HasPrefix(path, "/") || isInternalPath(path) || !strings.Contains(path[1:], "/") {
+		res.Error = "path must be /{subdomain}/{path}"
+		return res
+	}
+	if cfg.denyPaths.match(strings.SplitN(path, "?", 2)[0]) {
+		res.Error = "path is in deny_paths"
+		return res
+	}
+	c := internalCtx(ctx, "GET", path, nil)
+	if acceptEncoding != "" {
+		c.Request.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	resp, err := s.makeRequest(c, 1)
+	defer fasthttp.ReleaseResponse(resp)
+	res.Status = resp.StatusCode()
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case resp.StatusCode() != 200:
+		res.Error = "upstream answered " + strconv.Itoa(resp.StatusCode())
+	case len(resp.Header.Peek("X-Proxy-Canary")) > 0:
+		res.Error = "answered by the canary upstream"
+	case !sharedResponse(resp):
+		res.Error = "upstream marked the response private"
+	default:
+		_, targetURL := routedTarget(cfg, c, cfg.TargetDomain)
+		s.cache.set(cacheKey("GET", acceptEncoding, targetURL), newCachedResponse(resp))
+		res.OK = true
+	}
+	return res
+}
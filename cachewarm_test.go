@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCacheWarm(t *testing.T) {
+	var calls int32
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		if string(ctx.Path()) == "/v1/missing" {
+			ctx.SetStatusCode(404)
+			return
+		}
+		ctx.SetBodyString(`{"path":"` + string(ctx.Path()) + `"}`)
+	}
+	cfg := testConfig()
+	cfg.Key = "secret"
+	cfg.CacheTTL = Duration(time.Minute)
+	cfg.CacheMaxEntries = 4
+	cfg.DenyPaths = "/auth/"
+	s := newTestServer(t, cfg, upstream)
+	warm := func(body string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "POST /admin/cache/warm HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: secret\r\nAccept-Encoding: gzip\r\n"+
+			"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	}
+
+	resp := warm(`["/games/v1/games?universeIds=1", "/games/v1/missing", "/auth/v1/x", "/metrics"]`)
+	if resp.StatusCode() != 200 {
+		t.Fatalf("warm: %d %s", resp.StatusCode(), resp.Body())
+	}
+	var summary struct {
+		Cached, Failed int
+		Results        []cacheWarmResult
+	}
+	if err := json.Unmarshal(resp.Body(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Cached != 1 || summary.Failed != 3 || len(summary.Results) != 4 {
+		t.Fatalf("summary: %s", resp.Body())
+	}
+	for i, want := range []cacheWarmResult{
+		{Path: "/games/v1/games?universeIds=1", OK: true, Status: 200},
+		{Path: "/games/v1/missing", Status: 404, Error: "upstream answered 404"},
+		{Path: "/auth/v1/x", Error: "path is in deny_paths"},
+		{Path: "/metrics", Error: "path must be /{subdomain}/{path}"},
+	} {
+		if summary.Results[i] != want {
+			t.Errorf("result %d: %+v, want %+v", i, summary.Results[i], want)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+
+	// a client with the same Accept-Encoding is served from the cache
+	hit := serveRaw(t, s, "GET /games/v1/games?universeIds=1 HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: secret\r\nAccept-Encoding: gzip\r\n\r\n")
+	if string(hit.Header.Peek("X-Proxy-Cache")) != "HIT" || !strings.Contains(string(hit.Body()), "/v1/games") {
+		t.Errorf("after warming: X-Proxy-Cache %q, body %s", hit.Header.Peek("X-Proxy-Cache"), hit.Body())
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("upstream called %d times after the hit, want 2", n)
+	}
+
+	for body, code := range map[string]string{
+		`{"paths":[]}`:                         "invalid_paths",
+		`[]`:                                   "invalid_paths",
+		`["/a/1","/a/2","/a/3","/a/4","/a/5"]`: "too_many_paths",
+	} {
+		if resp := warm(body); resp.StatusCode() != 400 || string(resp.Header.Peek("X-Proxy-Error")) != code {
+			t.Errorf("%s: %d %q, want 400 %s", body, resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"), code)
+		}
+	}
+	if resp := serveRaw(t, s, "GET /admin/cache/warm HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: secret\r\n\r\n"); resp.StatusCode() != 405 {
+		t.Errorf("GET: %d, want 405", resp.StatusCode())
+	}
+
+	cfg = testConfig()
+	cfg.Key = "secret"
+	s = newTestServer(t, cfg, upstream)
+	if resp := warm(`["/games/v1/games"]`); resp.StatusCode() != 404 {
+		t.Errorf("cache disabled: %d, want 404", resp.StatusCode())
+	}
+}
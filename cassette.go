@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cassetteIndexFile names the index of a RECORD_DIR: cassette file by key.
+const cassetteIndexFile = "index.json"
+
+// cassetteKeyHeaders are the request headers that pick a recorded
+// response, along with the method, URL and body.
+var cassetteKeyHeaders = []string{"Accept", "Accept-Encoding", "Content-Type"}
+
+// errNoCassette is the error of a replayed request nothing was recorded
+// for.
+var errNoCassette = errors.New("no recorded response")
+
+// cassetteStore records upstream responses to RECORD_DIR, or with REPLAY
+// answers for upstream from them. Each response is a JSON cassette file;
+// the index maps request keys to files, so replay finds one without
+// reading the others.
+type cassetteStore struct {
+	dir string
+
+	mu    sync.Mutex
+	index map[string]string // cassette file by key
+}
+
+// cassette is a recorded upstream response, as stored on disk.
+type cassette struct {
+	Key          string              `json:"key"`
+	Method       string              `json:"method"`
+	URL          string              `json:"url"`
+	Recorded     time.Time           `json:"recorded"`
+	Status       int                 `json:"status"`
+	Headers      map[string][]string `json:"headers"`
+	Body         string              `json:"body"`
+	BodyEncoding string              `json:"bodyEncoding"` // text or base64
+}
+
+// newCassetteStore opens dir, reading its index when there is one. A
+// missing index is an empty one; one that can't be read is logged and
+// treated as empty, so replay answers 501 rather than guessing.
+func newCassetteStore(dir string) *cassetteStore {
+	c := &cassetteStore{dir: dir, index: map[string]string{}}
+	b, err := os.ReadFile(filepath.Join(dir, cassetteIndexFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Printf("WARN reading cassette index: %v", err)
+	default:
+		if err := json.Unmarshal(b, &c.index); err != nil {
+			log.Printf("WARN reading cassette index: %v", err)
+			c.index = map[string]string{}
+		}
+	}
+	return c
+}
+
+// cassetteKey identifies the upstream request req: its method, URL, and a
+// hash of the headers in cassetteKeyHeaders and the body. A streamed body
+// is hashed by its length.
+func cassetteKey(req *fasthttp.Request) string {
+	h := sha256.New()
+	for _, k := range cassetteKeyHeaders {
+		h.Write([]byte(k + ": " + string(req.Header.Peek(k)) + "\n"))
+	}
+	if req.IsBodyStream() {
+		h.Write([]byte("stream " + strconv.Itoa(req.Header.ContentLength())))
+	} else {
+		h.Write(req.Body())
+	}
+	return string(req.Header.Method()) + " " + req.URI().String() + " " + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// replay returns the response recorded for req, or a 501 naming its key
+// with errNoCassette.
+func (c *cassetteStore) replay(req *fasthttp.Request) (*fasthttp.Response, error) {
+	key := cassetteKey(req)
+	c.mu.Lock()
+	file, ok := c.index[key]
+	c.mu.Unlock()
+	if !ok {
+		return errorResponse(501, "cassette_missing", "Nothing recorded for "+key+"."), errNoCassette
+	}
+	var rec cassette
+	b, err := os.ReadFile(filepath.Join(c.dir, file))
+	if err == nil {
+		err = json.Unmarshal(b, &rec)
+	}
+	body := []byte(rec.Body)
+	if err == nil && rec.BodyEncoding == "base64" {
+		body, err = base64.StdEncoding.DecodeString(rec.Body)
+	}
+	if err != nil {
+		log.Printf("WARN reading cassette %s: %v", file, err)
+		return errorResponse(501, "cassette_missing", "Recording of "+key+" could not be read."), errNoCassette
+	}
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(rec.Status)
+	for k, vs := range rec.Headers {
+		for _, v := range vs {
+			resp.Header.Add(k, v)
+		}
+	}
+	resp.SetBody(body)
+	return resp, nil
+}
+
+// record writes resp as the recording for req, replacing any earlier one,
+// and adds it to the index. Failures are logged: recording never fails the
+// request.
+func (c *cassetteStore) record(req *fasthttp.Request, resp *fasthttp.Response) {
+	key := cassetteKey(req)
+	sum := sha256.Sum256([]byte(key))
+	file := hex.EncodeToString(sum[:8]) + ".json"
+	rec := cassette{
+		Key:      key,
+		Method:   string(req.Header.Method()),
+		URL:      req.URI().String(),
+		Recorded: time.Now().UTC(),
+		Status:   resp.StatusCode(),
+		Headers:  map[string][]string{},
+	}
+	resp.Header.VisitAll(func(k, v []byte) {
+		key := string(k)
+		if strings.EqualFold(key, "Content-Length") || isHopByHop(strings.ToLower(key)) {
+			return
+		}
+		rec.Headers[key] = append(rec.Headers[key], string(v))
+	})
+	rec.Body, rec.BodyEncoding = encodeBody(resp.Body())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		log.Printf("WARN recording %s: %v", key, err)
+		return
+	}
+	b, _ := json.MarshalIndent(rec, "", "  ")
+	if err := writeFileAtomic(filepath.Join(c.dir, file), b); err != nil {
+		log.Printf("WARN recording %s: %v", key, err)
+		return
+	}
+	c.index[key] = file
+	b, _ = json.MarshalIndent(c.index, "", "  ")
+	if err := writeFileAtomic(filepath.Join(c.dir, cassetteIndexFile), b); err != nil {
+		log.Printf("WARN writing cassette index: %v", err)
+	}
+}
+
+// writeFileAtomic writes b to path through a temporary file, so readers
+// never see it half written.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
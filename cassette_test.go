@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var calls int32
+	gzipped := fasthttp.AppendGzipBytes(nil, []byte(`{"data":[1,2,3]}`))
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		switch string(ctx.Path()) {
+		case "/v1/games":
+			ctx.SetContentType("application/json")
+			ctx.Response.Header.Add("X-Multi", "a")
+			ctx.Response.Header.Add("X-Multi", "b")
+			ctx.SetBodyString(`{"name":"` + string(ctx.QueryArgs().Peek("name")) + `"}`)
+		case "/v1/compressed":
+			ctx.SetContentType("application/json")
+			ctx.Response.Header.Set("Content-Encoding", "gzip")
+			ctx.SetBody(gzipped)
+		case "/v1/users":
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{"posted":` + string(ctx.PostBody()) + `}`)
+		default:
+			ctx.SetStatusCode(404)
+		}
+	}
+	requests := []string{
+		"GET /games/v1/games?name=a HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"GET /games/v1/games?name=b HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"GET /games/v1/compressed HTTP/1.1\r\nHost: proxy\r\nAccept-Encoding: gzip\r\n\r\n",
+		"POST /users/v1/users HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/json\r\nContent-Length: 5\r\n\r\n[1,2]",
+		"GET /games/v1/missing HTTP/1.1\r\nHost: proxy\r\n\r\n",
+	}
+	dir := filepath.Join(t.TempDir(), "cassettes")
+
+	cfg := testConfig()
+	cfg.RecordDir = dir
+	s := newTestServer(t, cfg, upstream)
+	var recorded []*fasthttp.Response
+	for _, raw := range requests {
+		recorded = append(recorded, serveRaw(t, s, raw))
+	}
+	if n := atomic.LoadInt32(&calls); n != int32(len(requests)) {
+		t.Fatalf("upstream called %d times while recording", n)
+	}
+
+	// human-readable files, with binary bodies in base64
+	var index map[string]string
+	b, err := os.ReadFile(filepath.Join(dir, cassetteIndexFile))
+	if err == nil {
+		err = json.Unmarshal(b, &index)
+	}
+	if err != nil || len(index) != len(requests) {
+		t.Fatalf("index: %v, %s", err, b)
+	}
+	for key, file := range index {
+		var rec cassette
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		if err == nil {
+			err = json.Unmarshal(b, &rec)
+		}
+		if err != nil || rec.Key != key {
+			t.Fatalf("%s: %v, %s", file, err, b)
+		}
+		if want := map[bool]string{true: "base64", false: "text"}[strings.Contains(key, "/v1/compressed")]; rec.BodyEncoding != want {
+			t.Errorf("%s: body encoding %s, want %s", key, rec.BodyEncoding, want)
+		}
+	}
+
+	// replayed without a network
+	cfg = testConfig()
+	cfg.RecordDir = dir
+	cfg.Replay = true
+	s = newTestServerDirect(t, cfg)
+	s.client.Dial = func(string) (net.Conn, error) { panic("dialed upstream in replay mode") }
+	for i, raw := range requests {
+		resp := serveRaw(t, s, raw)
+		want := recorded[i]
+		if resp.StatusCode() != want.StatusCode() || !bytes.Equal(resp.Body(), want.Body()) {
+			t.Errorf("request %d: %d %q, recorded %d %q", i, resp.StatusCode(), resp.Body(), want.StatusCode(), want.Body())
+		}
+		for _, h := range []string{"Content-Type", "Content-Encoding"} {
+			if got := string(resp.Header.Peek(h)); got != string(want.Header.Peek(h)) {
+				t.Errorf("request %d: %s %q, recorded %q", i, h, got, want.Header.Peek(h))
+			}
+		}
+	}
+	var multi []string
+	serveRaw(t, s, requests[0]).Header.VisitAll(func(k, v []byte) {
+		if string(k) == "X-Multi" {
+			multi = append(multi, string(v))
+		}
+	})
+	if len(multi) != 2 {
+		t.Errorf("repeated header replayed as %q", multi)
+	}
+
+	// a request that wasn't recorded, down to its body, is a 501
+	for _, raw := range []string{
+		"GET /games/v1/games?name=c HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"POST /users/v1/users HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/json\r\nContent-Length: 5\r\n\r\n[3,4]",
+	} {
+		resp := serveRaw(t, s, raw)
+		if resp.StatusCode() != 501 || string(resp.Header.Peek("X-Proxy-Error")) != "cassette_missing" ||
+			!strings.Contains(string(resp.Body()), "https://") {
+			t.Errorf("not recorded: %d %q %s", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"), resp.Body())
+		}
+	}
+	if _, err := s.dial("games.roblox.com:443"); err == nil {
+		t.Error("dialed upstream in replay mode")
+	}
+
+	cfg = testConfig()
+	cfg.Replay = true
+	if err := cfg.validate(); err == nil {
+		t.Error("replay without record_dir accepted")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Markers sniffed from the first challengeSniffBytes of an HTML page, in
+// lower case. Maintenance is checked first: maintenance pages don't carry
+// challenge scripts, but challenge pages can mention "maintenance".
+var (
+	maintenanceMarkers = []string{
+		"maintenance", "making things more awesome", "temporarily unavailable", "be back soon",
+	}
+	challengeMarkers = []string{
+		"captcha", "challenge", "cf-chl", "cloudflare", "attention required",
+		"checking your browser", "arkose", "verify you are human", "access denied",
+	}
+)
+
+const challengeSniffBytes = 64 << 10
+
+// apiPathRe matches Roblox API paths, whose first segment is the version.
+var apiPathRe = regexp.MustCompile(`^/v[0-9]+(/|$)`)
+
+// challengeDetector turns HTML pages served to API clients into
+// upstream_challenge and upstream_maintenance errors, counts them, and
+// with CHALLENGE_BREAKER_THRESHOLD stops sending a subdomain requests for
+// CHALLENGE_BREAKER_COOLDOWN after that many pages in a row.
+type challengeDetector struct {
+	challenges, maintenance int64
+
+	mu   sync.Mutex
+	subs map[string]*challengeRun
+	now  func() time.Time
+}
+
+type challengeRun struct {
+	pages     int
+	openUntil time.Time
+}
+
+func newChallengeDetector() *challengeDetector {
+	return &challengeDetector{subs: map[string]*challengeRun{}, now: time.Now}
+}
+
+// open returns how much longer subdomain's breaker stays open, or 0.
+func (d *challengeDetector) open(subdomain string) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.subs[subdomain]
+	if r == nil {
+		return 0
+	}
+	if left := r.openUntil.Sub(d.now()); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// check classifies the upstream response to ctx. It returns the error code
+// to answer with instead, or "" to pass the response on.
+func (d *challengeDetector) check(cfg *Config, ctx *fasthttp.RequestCtx, subdomain, path string, resp *fasthttp.Response) string {
+	if !cfg.HTMLChallengeDetection {
+		return ""
+	}
+	code := ""
+	if expectsJSON(ctx, path) {
+		code = classifyHTML(resp)
+	}
+	switch code {
+	case "upstream_challenge":
+		atomic.AddInt64(&d.challenges, 1)
+	case "upstream_maintenance":
+		atomic.AddInt64(&d.maintenance, 1)
+	}
+	d.observe(cfg, subdomain, code != "")
+	return code
+}
+
+// observe counts HTML pages in a row per subdomain and opens the breaker
+// at the threshold.
+func (d *challengeDetector) observe(cfg *Config, subdomain string, html bool) {
+	if cfg.ChallengeBreakerThreshold <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.subs[subdomain]
+	if !html {
+		if r != nil && !r.openUntil.After(d.now()) {
+			delete(d.subs, subdomain)
+		}
+		return
+	}
+	if r == nil {
+		r = &challengeRun{}
+		d.subs[subdomain] = r
+	}
+	if r.pages++; r.pages >= cfg.ChallengeBreakerThreshold {
+		r.pages = 0
+		r.openUntil = d.now().Add(cfg.ChallengeBreakerCooldown.D())
+	}
+}
+
+// expectsJSON reports whether the client asked for JSON or the upstream
+// path is a versioned API path.
+func expectsJSON(ctx *fasthttp.RequestCtx, path string) bool {
+	return strings.Contains(strings.ToLower(string(ctx.Request.Header.Peek("Accept"))), "application/json") ||
+		apiPathRe.MatchString(path)
+}
+
+// classifyHTML returns upstream_maintenance or upstream_challenge when resp
+// is an HTML page, going by its markers. Unmarked HTML counts as a
+// challenge when it came with a 200, where an API answer was due, and is
+// passed on otherwise, as with an ordinary HTML error page.
+func classifyHTML(resp *fasthttp.Response) string {
+	body, err := decodedBody(resp)
+	if err != nil {
+		return ""
+	}
+	if len(body) > challengeSniffBytes {
+		body = body[:challengeSniffBytes]
+	}
+	lower := bytes.ToLower(bytes.TrimSpace(body))
+	if !bytes.HasPrefix(lower, []byte("<!doctype html")) && !bytes.HasPrefix(lower, []byte("<html")) &&
+		!bytes.HasPrefix(bytes.ToLower(resp.Header.ContentType()), []byte("text/html")) {
+		return ""
+	}
+	for _, m := range maintenanceMarkers {
+		if bytes.Contains(lower, []byte(m)) {
+			return "upstream_maintenance"
+		}
+	}
+	for _, m := range challengeMarkers {
+		if bytes.Contains(lower, []byte(m)) {
+			return "upstream_challenge"
+		}
+	}
+	if resp.StatusCode() == 200 {
+		return "upstream_challenge"
+	}
+	return ""
+}
+
+func (d *challengeDetector) writeMetrics(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP roproxy_upstream_html_total Upstream HTML pages answered to API clients as errors.\n# TYPE roproxy_upstream_html_total counter\n")
+	fmt.Fprintf(b, "roproxy_upstream_html_total{code=\"upstream_challenge\"} %d\n", atomic.LoadInt64(&d.challenges))
+	fmt.Fprintf(b, "roproxy_upstream_html_total{code=\"upstream_maintenance\"} %d\n", atomic.LoadInt64(&d.maintenance))
+}
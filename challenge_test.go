@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	cloudflarePage = `<!DOCTYPE html>
+<html lang="en-US"><head><title>Just a moment...</title></head>
+<body><div id="cf-wrapper"><h1>Checking your browser before accessing roblox.com.</h1>
+<script src="/cdn-cgi/challenge-platform/h/b/orchestrate/chl_page/v1"></script></div></body></html>`
+	maintenancePage = `<!doctype html>
+<html><head><title>Roblox</title></head>
+<body><h1>We're making things more awesome. Be back soon.</h1>
+<p>Roblox is currently under maintenance.</p></body></html>`
+	plainPage = `<html><head><title>Roblox</title></head><body><div id="app"></div></body></html>`
+)
+
+func TestClassifyHTML(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        string
+	}{
+		{"cloudflare challenge", 403, "text/html; charset=UTF-8", cloudflarePage, "upstream_challenge"},
+		{"challenge with 200", 200, "text/html", cloudflarePage, "upstream_challenge"},
+		{"maintenance", 503, "text/html", maintenancePage, "upstream_maintenance"},
+		{"maintenance mislabelled as JSON", 200, "application/json", "\n  " + maintenancePage, "upstream_maintenance"},
+		{"unmarked page with 200", 200, "text/html", plainPage, "upstream_challenge"},
+		{"unmarked error page", 404, "text/html", plainPage, ""},
+		{"JSON", 200, "application/json", `{"errors":[{"message":"challenge"}]}`, ""},
+		{"text", 500, "text/plain", "maintenance", ""},
+	} {
+		var resp fasthttp.Response
+		resp.SetStatusCode(tc.status)
+		resp.Header.SetContentType(tc.contentType)
+		resp.SetBodyString(tc.body)
+		if got := classifyHTML(&resp); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	var resp fasthttp.Response
+	resp.SetStatusCode(200)
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.SetBody(fasthttp.AppendGzipBytes(nil, []byte(maintenancePage)))
+	if got := classifyHTML(&resp); got != "upstream_maintenance" {
+		t.Errorf("gzipped maintenance page: %q", got)
+	}
+}
+
+func TestHTMLChallengeDetection(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("text/html")
+		switch string(ctx.Path()) {
+		case "/maintenance":
+			ctx.SetStatusCode(503)
+			ctx.SetBodyString(maintenancePage)
+		case "/v1/users/1", "/home":
+			ctx.SetBodyString(cloudflarePage)
+		default:
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{"id":1}`)
+		}
+	}
+	cfg := testConfig()
+	s := newTestServer(t, cfg, upstream)
+	get := func(path, accept string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\nAccept: "+accept+"\r\n\r\n")
+	}
+
+	for _, tc := range []struct {
+		path, accept string
+		status       int
+		code         string
+	}{
+		{"/users/v1/users/1", "*/*", 503, "upstream_challenge"},
+		{"/www/maintenance", "application/json", 503, "upstream_maintenance"},
+		// a browser fetching a page isn't an API client
+		{"/www/home", "text/html", 200, ""},
+		{"/users/v2/users/1", "*/*", 200, ""},
+	} {
+		resp := get(tc.path, tc.accept)
+		if resp.StatusCode() != tc.status || string(resp.Header.Peek("X-Proxy-Error")) != tc.code {
+			t.Errorf("%s: %d %q, want %d %q", tc.path, resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"), tc.status, tc.code)
+		}
+		if tc.accept == "application/json" && tc.code != "" && !strings.Contains(string(resp.Body()), `"code":"`+tc.code+`"`) {
+			t.Errorf("%s: body %s", tc.path, resp.Body())
+		}
+	}
+
+	var b bytes.Buffer
+	s.challenges.writeMetrics(&b)
+	for _, want := range []string{
+		`roproxy_upstream_html_total{code="upstream_challenge"} 1`,
+		`roproxy_upstream_html_total{code="upstream_maintenance"} 1`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics missing %s:\n%s", want, b.String())
+		}
+	}
+
+	cfg.HTMLChallengeDetection = false
+	if resp := get("/users/v1/users/1", "application/json"); resp.StatusCode() != 200 || string(resp.Body()) != cloudflarePage {
+		t.Errorf("detection off: %d %q", resp.StatusCode(), resp.Body())
+	}
+}
+
+func TestChallengeBreaker(t *testing.T) {
+	var calls int
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		calls++
+		ctx.SetContentType("text/html")
+		ctx.SetBodyString(cloudflarePage)
+	}
+	cfg := testConfig()
+	cfg.ChallengeBreakerThreshold = 2
+	cfg.ChallengeBreakerCooldown = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	now := time.Now()
+	s.challenges.now = func() time.Time { return now }
+	get := func(path string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\nAccept: application/json\r\n\r\n")
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := string(get("/users/v1/users/1").Header.Peek("X-Proxy-Error")); code != "upstream_challenge" {
+			t.Fatalf("request %d: %q", i+1, code)
+		}
+	}
+	resp := get("/users/v1/users/1")
+	if code := string(resp.Header.Peek("X-Proxy-Error")); code != "circuit_open" || calls != 2 {
+		t.Errorf("after threshold: %q with %d upstream calls, want circuit_open with 2", code, calls)
+	}
+	if ra := string(resp.Header.Peek("Retry-After")); ra != "61" {
+		t.Errorf("Retry-After = %q", ra)
+	}
+	// other subdomains are unaffected
+	if code := string(get("/games/v1/games").Header.Peek("X-Proxy-Error")); code != "upstream_challenge" {
+		t.Errorf("other subdomain: %q", code)
+	}
+
+	now = now.Add(time.Minute)
+	get("/users/v1/users/1")
+	if calls != 4 {
+		t.Errorf("after cooldown: %d upstream calls, want 4", calls)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/valyala/fasthttp"
+)
+
+const bodyChecksumHeader = "X-Proxy-Body-SHA256"
+
+// setBodyChecksum sets X-Proxy-Body-SHA256 to the hex SHA-256 of the
+// response body with ADD_BODY_CHECKSUM. It runs once the body is final, and
+// before throttleBody turns it into a stream; responses that are already
+// streamed, and those sent without a body, are left without one.
+func setBodyChecksum(cfg *Config, ctx *fasthttp.RequestCtx) {
+	if !cfg.AddBodyChecksum || ctx.Response.IsBodyStream() || ctx.Response.SkipBody || ctx.IsHead() {
+		return
+	}
+	sum := sha256.Sum256(ctx.Response.Body())
+	ctx.Response.Header.Set(bodyChecksumHeader, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestBodyChecksum(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/v1/compressed" {
+			ctx.Response.Header.Set("Content-Encoding", "gzip")
+			ctx.SetBody(fasthttp.AppendGzipBytes(nil, []byte("asset bytes")))
+			return
+		}
+		ctx.SetBodyString("upstream " + string(ctx.Path()))
+	}
+	cfg := testConfig()
+	cfg.AddBodyChecksum = true
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	check := func(name string, resp *fasthttp.Response) {
+		t.Helper()
+		sum := sha256.Sum256(resp.Body())
+		if got, want := string(resp.Header.Peek(bodyChecksumHeader)), hex.EncodeToString(sum[:]); got != want || len(resp.Body()) == 0 {
+			t.Errorf("%s: %s %q, body sums to %s", name, bodyChecksumHeader, got, want)
+		}
+	}
+
+	get := "GET /games/v1/a HTTP/1.1\r\nHost: proxy\r\n\r\n"
+	check("miss", serveRaw(t, s, get))
+	resp := serveRaw(t, s, get)
+	if string(resp.Header.Peek("X-Proxy-Cache")) != "HIT" {
+		t.Fatalf("second request: X-Proxy-Cache %q", resp.Header.Peek("X-Proxy-Cache"))
+	}
+	check("hit", resp)
+	// the checksum is of the bytes sent, compressed or not
+	check("gzip", serveRaw(t, s, "GET /games/v1/compressed HTTP/1.1\r\nHost: proxy\r\nAccept-Encoding: gzip\r\n\r\n"))
+
+	if resp := serveRaw(t, s, "HEAD /games/v1/a HTTP/1.1\r\nHost: proxy\r\n\r\n"); len(resp.Header.Peek(bodyChecksumHeader)) > 0 {
+		t.Errorf("HEAD: %s %q", bodyChecksumHeader, resp.Header.Peek(bodyChecksumHeader))
+	}
+	cfg.AddBodyChecksum = false
+	if resp := serveRaw(t, s, "GET /games/v1/b HTTP/1.1\r\nHost: proxy\r\n\r\n"); len(resp.Header.Peek(bodyChecksumHeader)) > 0 {
+		t.Errorf("disabled: %s %q", bodyChecksumHeader, resp.Header.Peek(bodyChecksumHeader))
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigInt64(t *testing.T) {
+	tests := []struct {
+		env string
+		get func(*Config) int64
+	}{
+		{"LARGE_RESPONSE_WARN_BYTES", func(c *Config) int64 { return c.LargeResponseWarnBytes }},
+		{"PAGINATE_MAX_BYTES", func(c *Config) int64 { return c.PaginateMaxBytes }},
+		{"ASSET_MAX_BYTES", func(c *Config) int64 { return c.AssetMaxBytes }},
+		{"FIELDS_MAX_BYTES", func(c *Config) int64 { return c.FieldsMaxBytes }},
+		{"NORMALIZE_ERRORS_MAX_BYTES", func(c *Config) int64 { return c.NormalizeErrorsMaxBytes }},
+		{"MULTIPART_MAX_BYTES", func(c *Config) int64 { return c.MultipartMaxBytes }},
+		{"TRANSFORMS_MAX_BYTES", func(c *Config) int64 { return c.TransformsMaxBytes }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			env := map[string]string{tt.env: "1000"}
+			getenv := func(name string) string { return env[name] }
+			cfg, _, err := loadConfig(nil, getenv)
+			if err != nil {
+				t.Fatalf("from env: %v", err)
+			}
+			if got := tt.get(cfg); got != 1000 {
+				t.Errorf("from env: %d, want 1000", got)
+			}
+
+			flag := "-" + strings.ReplaceAll(strings.ToLower(tt.env), "_", "-") + "=2000"
+			cfg, _, err = loadConfig([]string{flag}, getenv)
+			if err != nil {
+				t.Fatalf("from flag: %v", err)
+			}
+			if got := tt.get(cfg); got != 2000 {
+				t.Errorf("from flag: %d, want 2000", got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidEnv(t *testing.T) {
+	env := map[string]string{
+		"TIMEOUT":            "soon",
+		"MAX_CONNS_PER_HOST": "many",
+		"OPENCLOUD_KEYS":     "hunter2-secret",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	_, _, err := loadConfig(nil, getenv)
+	if err == nil {
+		t.Fatal("invalid environment accepted")
+	}
+	for _, name := range []string{"TIMEOUT=", "MAX_CONNS_PER_HOST=", "OPENCLOUD_KEYS="} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't report %s", err, name)
+		}
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error %q leaks a secret value", err)
+	}
+
+	_, _, err = loadConfig([]string{"-opencloud-keys=hunter2-secret"}, func(string) string { return "" })
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("flag error %v, want one without the secret value", err)
+	}
+
+	env["STRICT_CONFIG"] = "false"
+	cfg, _, err := loadConfig(nil, getenv)
+	if err != nil {
+		t.Fatalf("STRICT_CONFIG=false: %v", err)
+	}
+	def := defaultConfig()
+	if cfg.Timeout != def.Timeout || cfg.MaxConnsPerHost != def.MaxConnsPerHost {
+		t.Errorf("invalid values not ignored: timeout %v, max conns %d", cfg.Timeout, cfg.MaxConnsPerHost)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	file := "port: \"1111\"\nretries: 5\nmax_conns_per_host: 7\n"
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"CONFIG_FILE": path, "PORT": "2222", "RETRIES": "6"}
+	cfg, _, err := loadConfig([]string{"-port=3333"}, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := defaultConfig()
+	if cfg.Port != "3333" {
+		t.Errorf("port = %q, want the flag's 3333", cfg.Port)
+	}
+	if cfg.Retries != 6 {
+		t.Errorf("retries = %d, want the environment's 6", cfg.Retries)
+	}
+	if cfg.MaxConnsPerHost != 7 {
+		t.Errorf("max_conns_per_host = %d, want the file's 7", cfg.MaxConnsPerHost)
+	}
+	if cfg.Timeout != def.Timeout {
+		t.Errorf("timeout = %v, want the default %v", cfg.Timeout, def.Timeout)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	if err := os.WriteFile(path, []byte("port: \"1111\"\nretires: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := loadConfig([]string{"-config", path}, func(string) string { return "" })
+	if err == nil || !strings.Contains(err.Error(), "retires") {
+		t.Errorf("misspelled key: %v, want an error naming it", err)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	getenv := func(path string) func(string) string {
+		return func(name string) string {
+			if name == "CONFIG_FILE" {
+				return path
+			}
+			return ""
+		}
+	}
+
+	path := write("proxy.json", `{"port": "1111", "timeout": "3s", "retries": 5, "opencloud_keys": {"games": "k1"}}`)
+	cfg, _, err := loadConfig(nil, getenv(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "1111" || cfg.Timeout.D() != 3*time.Second || cfg.Retries != 5 || cfg.OpenCloudKeys["games"] != "k1" {
+		t.Errorf("loaded port %q, timeout %v, retries %d, keys %v", cfg.Port, cfg.Timeout, cfg.Retries, cfg.OpenCloudKeys)
+	}
+
+	tests := []struct{ name, data, want string }{
+		{"malformed.json", `{"port": "1111",}`, "parsing config file"},
+		{"unknown.json", `{"port": "1111", "retires": 5}`, "retires"},
+		{"type.json", `{"retries": "many"}`, "many"},
+	}
+	for _, tt := range tests {
+		_, _, err := loadConfig(nil, getenv(write(tt.name, tt.data)))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error mentioning %q", tt.name, err, tt.want)
+		}
+	}
+	if _, _, err := loadConfig(nil, getenv(filepath.Join(dir, "missing.json"))); err == nil {
+		t.Error("missing config file accepted")
+	}
+}
+
+func TestLoadConfigDurations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	if err := os.WriteFile(path, []byte("client_read_timeout: 2\nserver_read_timeout: 1m30s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"CONFIG_FILE": path, "TIMEOUT": "500ms", "SHUTDOWN_TIMEOUT": "7"}
+	cfg, _, err := loadConfig(nil, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"timeout", cfg.Timeout.D(), 500 * time.Millisecond},
+		{"shutdown_timeout", cfg.ShutdownTimeout.D(), 7 * time.Second},
+		{"client_read_timeout", cfg.ClientReadTimeout.D(), 2 * time.Second},
+		{"server_read_timeout", cfg.ServerReadTimeout.D(), 90 * time.Second},
+		{"client write timeout", cfg.clientWriteTimeout(), 500 * time.Millisecond},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"soon", "-1", "10 s"} {
+		if _, _, err := loadConfig([]string{"-timeout=" + bad}, func(string) string { return "" }); err == nil {
+			t.Errorf("timeout %q accepted", bad)
+		}
+	}
+}
+
+func TestLoadTimeoutOverrides(t *testing.T) {
+	env := map[string]string{"TIMEOUT_OVERRIDES": "AssetDelivery=30s, thumbnails=15,default=5s"}
+	getenv := func(name string) string { return env[name] }
+	cfg, _, err := loadConfig(nil, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sub, want := range map[string]time.Duration{
+		"assetdelivery": 30 * time.Second,
+		"Thumbnails":    15 * time.Second,
+		"users":         5 * time.Second,
+	} {
+		if got := cfg.requestTimeout(sub); got != want {
+			t.Errorf("requestTimeout(%s) = %v, want %v", sub, got, want)
+		}
+	}
+	if got := cfg.clientReadTimeout(); got != 30*time.Second {
+		t.Errorf("client read timeout = %v, want it raised to the longest override", got)
+	}
+	dump := cfg.dump()
+	for _, want := range []string{"timeout_overrides:", "assetdelivery: 30s", "thumbnails: 15s", "default: 5s"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("config dump missing %q:\n%s", want, dump)
+		}
+	}
+
+	// without a default entry the other subdomains keep TIMEOUT
+	env["TIMEOUT_OVERRIDES"] = "assetdelivery=30s"
+	if cfg, _, err = loadConfig(nil, getenv); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.requestTimeout("users"); got != cfg.Timeout.D() {
+		t.Errorf("requestTimeout(users) = %v, want timeout %v", got, cfg.Timeout)
+	}
+
+	for _, bad := range []string{"users=soon", "users", "users=0s", "users=-1s"} {
+		env["TIMEOUT_OVERRIDES"] = bad
+		if _, _, err := loadConfig(nil, getenv); err == nil || !strings.Contains(err.Error(), "users") {
+			t.Errorf("TIMEOUT_OVERRIDES=%s: %v, want an error naming the entry", bad, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// csrfTokens remembers the last X-CSRF-TOKEN each upstream host handed out,
+// so later state-changing requests carry it without another challenge.
+type csrfTokens struct {
+	mu     sync.Mutex
+	byHost map[string]string
+}
+
+func newCSRFTokens() *csrfTokens {
+	return &csrfTokens{byHost: map[string]string{}}
+}
+
+func (c *csrfTokens) get(host string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.byHost[host]
+}
+
+func (c *csrfTokens) set(host, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byHost[host] = token
+}
+
+// needsCSRFToken reports whether requests with method are sent with the
+// cached X-CSRF-TOKEN and retried on a token challenge.
+func needsCSRFToken(cfg *Config, method []byte) bool {
+	if cfg.DisableCSRFRetry {
+		return false
+	}
+	switch string(method) {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// addCSRFToken sets the token cached for host on req, unless the client
+// sent its own.
+func (s *Server) addCSRFToken(cfg *Config, host string, req *fasthttp.Request) {
+	if !needsCSRFToken(cfg, req.Header.Method()) || len(req.Header.Peek("X-CSRF-TOKEN")) > 0 {
+		return
+	}
+	if token := s.csrf.get(host); token != "" {
+		req.Header.Set("X-CSRF-TOKEN", token)
+	}
+}
+
+// csrfChallenged reports whether resp is a CSRF challenge: a 403 carrying a
+// fresh X-CSRF-TOKEN. The token is cached for host and set on req, ready
+// to send again.
+func (s *Server) csrfChallenged(cfg *Config, host string, req *fasthttp.Request, resp *fasthttp.Response) bool {
+	if !needsCSRFToken(cfg, req.Header.Method()) || resp.StatusCode() != 403 {
+		return false
+	}
+	token := string(resp.Header.Peek("X-CSRF-TOKEN"))
+	if token == "" {
+		return false
+	}
+	s.csrf.set(host, token)
+	req.Header.Set("X-CSRF-TOKEN", token)
+	return true
+}
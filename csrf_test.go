@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// csrfUpstream accepts state-changing requests only with its current token
+// and challenges the rest, as Roblox does.
+type csrfUpstream struct {
+	mu    sync.Mutex
+	token string
+	sent  []string // X-CSRF-TOKEN of each request
+}
+
+func (u *csrfUpstream) handler(ctx *fasthttp.RequestCtx) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	got := string(ctx.Request.Header.Peek("X-CSRF-TOKEN"))
+	u.sent = append(u.sent, got)
+	if !ctx.IsGet() && got != u.token {
+		ctx.Error("Token Validation Failed", 403)
+		ctx.Response.Header.Set("X-CSRF-TOKEN", u.token)
+		return
+	}
+	okUpstream(ctx)
+}
+
+// take returns the tokens sent since the last call.
+func (u *csrfUpstream) take() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	sent := u.sent
+	u.sent = nil
+	return sent
+}
+
+func (u *csrfUpstream) rotate(token string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.token = token
+}
+
+func TestCSRFRetry(t *testing.T) {
+	u := &csrfUpstream{token: "one"}
+	s := newTestServer(t, testConfig(), u.handler)
+	post := "POST /auth/v2/logout HTTP/1.1\r\nHost: proxy\r\n\r\n"
+
+	check := func(step string, want ...string) {
+		t.Helper()
+		resp := serveRaw(t, s, post)
+		if resp.StatusCode() != 200 {
+			t.Errorf("%s: status = %d, want 200", step, resp.StatusCode())
+		}
+		if sent := u.take(); !equalStrings(sent, want) {
+			t.Errorf("%s: upstream saw tokens %q, want %q", step, sent, want)
+		}
+	}
+	check("challenge", "", "one")
+	check("cached token", "one")
+	u.rotate("two")
+	check("expired token", "one", "two")
+	check("new cached token", "two")
+
+	// GETs are never challenged and don't get the token
+	serveRaw(t, s, "GET /auth/v1/account HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if sent := u.take(); !equalStrings(sent, []string{""}) {
+		t.Errorf("GET sent tokens %q, want none", sent)
+	}
+}
+
+func TestCSRFRetryDisabled(t *testing.T) {
+	u := &csrfUpstream{token: "one"}
+	cfg := testConfig()
+	cfg.DisableCSRFRetry = true
+	s := newTestServer(t, cfg, u.handler)
+
+	resp := serveRaw(t, s, "POST /auth/v2/logout HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 403 || string(resp.Header.Peek("X-CSRF-TOKEN")) != "one" {
+		t.Errorf("got %d with X-CSRF-TOKEN %q, want the challenge passed through",
+			resp.StatusCode(), resp.Header.Peek("X-CSRF-TOKEN"))
+	}
+	if sent := u.take(); len(sent) != 1 {
+		t.Errorf("upstream saw %d requests, want 1", len(sent))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
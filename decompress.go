@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// upstreamAcceptEncoding is what the proxy asks upstream for when a client
+// wants compressed bytes but sent no Accept-Encoding of its own.
+const upstreamAcceptEncoding = "gzip, deflate, br"
+
+var decompressHeader = reserveHeader("X-Proxy-Decompress",
+	"true for the response body decoded, false for it as upstream compressed it, whatever Accept-Encoding says. Needs DECOMPRESS_HEADER_ENABLED.")
+
+// wantsDecompress reads the X-Proxy-Decompress request header when
+// DECOMPRESS_HEADER_ENABLED is set. set is false when the header is off or
+// absent, leaving Accept-Encoding as the client sent it.
+func wantsDecompress(cfg *Config, ctx *fasthttp.RequestCtx) (decompress, set bool) {
+	if !cfg.DecompressHeaderEnabled {
+		return false, false
+	}
+	v, err := strconv.ParseBool(string(ctx.Request.Header.Peek(decompressHeader)))
+	return v, err == nil
+}
+
+// applyDecompress sets the Accept-Encoding sent upstream for the client's
+// choice: none when it wants plain bytes, and upstreamAcceptEncoding when
+// it wants compressed bytes and didn't say which.
+func applyDecompress(ctx *fasthttp.RequestCtx, decompress bool) {
+	switch {
+	case decompress:
+		ctx.Request.Header.Del("Accept-Encoding")
+	case len(ctx.Request.Header.Peek("Accept-Encoding")) == 0:
+		ctx.Request.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+	}
+}
+
+// decodeBody replaces a gzip, deflate or br encoded body in resp with the
+// decoded bytes, dropping Content-Encoding and correcting Content-Length.
+// A body that fails to decode is left as it is, still labelled.
+func decodeBody(resp *fasthttp.Response) {
+	if len(resp.Header.Peek("Content-Encoding")) == 0 {
+		return
+	}
+	body, err := decodedBody(resp)
+	if err != nil {
+		log.Printf("WARN decompressing response body: %v", err)
+		return
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.SetContentLength(len(body))
+	resp.SetBody(body)
+}
+
+// decodedBody returns resp's body with its Content-Encoding undone,
+// leaving resp as it is.
+func decodedBody(resp *fasthttp.Response) ([]byte, error) {
+	switch encoding := string(resp.Header.Peek("Content-Encoding")); encoding {
+	case "":
+		return resp.Body(), nil
+	case "gzip":
+		return resp.BodyGunzip()
+	case "deflate":
+		return resp.BodyInflate()
+	case "br":
+		return resp.BodyUnbrotli()
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
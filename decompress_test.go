@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestDecompressHeader(t *testing.T) {
+	const payload = `{"data":"a response worth compressing, a response worth compressing"}`
+	var sawEncoding string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		sawEncoding = string(ctx.Request.Header.Peek("Accept-Encoding"))
+		ctx.SetContentType("application/json")
+		// like some Roblox endpoints, /always compresses whatever was asked
+		if strings.Contains(sawEncoding, "gzip") || string(ctx.Path()) == "/always" {
+			ctx.Response.Header.Set("Content-Encoding", "gzip")
+			ctx.SetBody(fasthttp.AppendGzipBytes(nil, []byte(payload)))
+			return
+		}
+		ctx.SetBodyString(payload)
+	}
+	cfg := testConfig()
+	cfg.DecompressHeaderEnabled = true
+	s := newTestServer(t, cfg, upstream)
+	get := func(path, headers string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET /users"+path+" HTTP/1.1\r\nHost: proxy\r\n"+headers+"\r\n")
+	}
+	plain := func(name string, resp *fasthttp.Response) {
+		t.Helper()
+		if ce := resp.Header.Peek("Content-Encoding"); len(ce) > 0 || string(resp.Body()) != payload {
+			t.Errorf("%s: Content-Encoding %q, body %q", name, ce, resp.Body())
+		}
+		if cl := resp.Header.ContentLength(); cl != len(payload) {
+			t.Errorf("%s: Content-Length %d, want %d", name, cl, len(payload))
+		}
+	}
+	gzipped := func(name string, resp *fasthttp.Response) {
+		t.Helper()
+		body, err := resp.BodyGunzip()
+		if string(resp.Header.Peek("Content-Encoding")) != "gzip" || err != nil || string(body) != payload {
+			t.Errorf("%s: Content-Encoding %q, gunzip %v %q", name, resp.Header.Peek("Content-Encoding"), err, body)
+		}
+		if cl := resp.Header.ContentLength(); cl != len(resp.Body()) {
+			t.Errorf("%s: Content-Length %d, body %d bytes", name, cl, len(resp.Body()))
+		}
+	}
+
+	plain("decompress", get("/v1/x", "Accept-Encoding: gzip\r\nX-Proxy-Decompress: true\r\n"))
+	if sawEncoding != "" {
+		t.Errorf("decompress sent Accept-Encoding %q upstream", sawEncoding)
+	}
+	plain("decompress, upstream compressing anyway", get("/always", "X-Proxy-Decompress: true\r\n"))
+
+	gzipped("compressed", get("/v1/x", "X-Proxy-Decompress: false\r\n"))
+	if sawEncoding != upstreamAcceptEncoding {
+		t.Errorf("compressed sent Accept-Encoding %q upstream, want %q", sawEncoding, upstreamAcceptEncoding)
+	}
+	gzipped("compressed, client's encodings", get("/v1/x", "Accept-Encoding: gzip\r\nX-Proxy-Decompress: false\r\n"))
+	if sawEncoding != "gzip" {
+		t.Errorf("client's Accept-Encoding became %q upstream", sawEncoding)
+	}
+
+	plain("no header", get("/v1/x", ""))
+	cfg.DecompressHeaderEnabled = false
+	plain("disabled", get("/v1/x", "X-Proxy-Decompress: false\r\n"))
+	if sawEncoding != "" {
+		t.Errorf("disabled header still sent Accept-Encoding %q upstream", sawEncoding)
+	}
+	gzipped("disabled, upstream compressing", get("/always", "X-Proxy-Decompress: true\r\n"))
+}
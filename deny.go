@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// denyList is DENY_PATHS: client paths, /{subdomain}/{path}, that are
+// refused without contacting upstream. A plain entry matches the path and
+// everything under it; an entry with *, ? or [ is a path.Match glob over
+// the whole path, where * stays within a segment.
+type denyList struct {
+	prefixes []string
+	globs    []string
+}
+
+// parseDenyPaths parses the comma-separated DENY_PATHS. Entries are
+// matched case-insensitively, as upstream paths are.
+func parseDenyPaths(list string) (*denyList, error) {
+	d := &denyList{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if !strings.HasPrefix(entry, "/") {
+			return nil, fmt.Errorf("%q must start with /", entry)
+		}
+		if strings.ContainsAny(entry, "*?[") {
+			if _, err := path.Match(entry, ""); err != nil {
+				return nil, fmt.Errorf("%q: %v", entry, err)
+			}
+			d.globs = append(d.globs, entry)
+			continue
+		}
+		d.prefixes = append(d.prefixes, strings.TrimSuffix(entry, "/"))
+	}
+	if len(d.prefixes) == 0 && len(d.globs) == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// match reports whether the client path p, without its query string, is
+// denied. p is unescaped and cleaned first so //, /./ and %2F spellings
+// of a denied path are caught too.
+func (d *denyList) match(p string) bool {
+	if d == nil {
+		return false
+	}
+	if u, err := url.PathUnescape(p); err == nil {
+		p = u
+	}
+	p = strings.ToLower(path.Clean("/" + p))
+	for _, prefix := range d.prefixes {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") || prefix == "" {
+			return true
+		}
+	}
+	for _, g := range d.globs {
+		if ok, _ := path.Match(g, p); ok {
+			return true
+		}
+	}
+	return false
+}
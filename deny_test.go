@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestDenyPathsMatch(t *testing.T) {
+	d, err := parseDenyPaths("/auth/, /users/v1/description , /accountsettings/v1/*/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]bool{
+		// prefix
+		"/auth/v2/login":  true,
+		"/auth":           true,
+		"/AUTH/v2/logout": true,
+		"/authx/v1":       false,
+		// exact, and anything under it
+		"/users/v1/description":      true,
+		"/users/v1/description/x":    true,
+		"/users/v1/descriptions":     false,
+		"/users/v1/users/1":          false,
+		"/users//v1/./description":   true,
+		"/users/v1%2Fdescription":    true,
+		"/users/v1/x/../description": true,
+		// glob
+		"/accountsettings/v1/email/password":   true,
+		"/accountsettings/v1/email":            false,
+		"/accountsettings/v1/a/b/password":     false,
+		"/accountsettings/v1/email/password/x": false,
+	} {
+		if got := d.match(p); got != want {
+			t.Errorf("%s: %v, want %v", p, got, want)
+		}
+	}
+
+	if d, err := parseDenyPaths(" , "); d != nil || err != nil {
+		t.Errorf("empty list: %v %v", d, err)
+	}
+	if (*denyList)(nil).match("/auth/v1") {
+		t.Error("nil list matched")
+	}
+	for _, bad := range []string{"auth/", "/a/[b"} {
+		if _, err := parseDenyPaths(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestDenyPaths(t *testing.T) {
+	var calls int
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		calls++
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.DenyPaths = "/auth/v2/login,/users/v1/*/password"
+	s := newTestServer(t, cfg, upstream)
+
+	for _, uri := range []string{"/auth/v2/login", "/auth/v2/login?x=1", "/users/v1/1/password"} {
+		resp := serveRaw(t, s, "POST "+uri+" HTTP/1.1\r\nHost: proxy\r\nContent-Length: 0\r\n\r\n")
+		if resp.StatusCode() != 403 || string(resp.Header.Peek("X-Proxy-Error")) != "path_denied" {
+			t.Errorf("%s: %d %q", uri, resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+		}
+	}
+	if calls != 0 {
+		t.Errorf("denied paths reached upstream %d times", calls)
+	}
+	if resp := serveRaw(t, s, "GET /auth/v2/logout HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 || calls != 1 {
+		t.Errorf("allowed path: %d with %d upstream calls", resp.StatusCode(), calls)
+	}
+}
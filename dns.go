@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resolver looks up the addresses of a host name. ttl is how long the
+// answer may be cached; 0 means the resolver doesn't know.
+type resolver interface {
+	lookup(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// netResolver resolves through a net.Resolver. The standard library doesn't
+// report record TTLs, so its answers are cached for DNS_CACHE_DEFAULT_TTL.
+type netResolver struct {
+	r *net.Resolver
+}
+
+func (n netResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := n.r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, 0, nil
+}
+
+// serversResolver queries DNS_SERVERS directly instead of the servers in
+// /etc/resolv.conf. Each lookup starts at the next server in turn
+// (round-robin) or always at the first (failover), and moves on to the
+// following server when one fails or times out. NXDOMAIN is an answer, not
+// a failure, so it is returned without asking the other servers.
+type serversResolver struct {
+	servers    []string
+	timeout    time.Duration // per server
+	roundRobin bool
+
+	next uint32
+}
+
+func (r *serversResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	start := 0
+	if r.roundRobin {
+		start = int(atomic.AddUint32(&r.next, 1)-1) % len(r.servers)
+	}
+	var err error
+	for i := range r.servers {
+		server := r.servers[(start+i)%len(r.servers)]
+		nr := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+		var ips []net.IP
+		lctx, cancel := context.WithTimeout(ctx, r.timeout)
+		ips, _, err = netResolver{nr}.lookup(lctx, host)
+		cancel()
+		if err == nil {
+			return ips, 0, nil
+		}
+		var de *net.DNSError
+		if errors.As(err, &de) && de.IsNotFound {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, err
+}
+
+// dnsLookupError is a failed upstream host lookup. category tells a name
+// that doesn't exist (dns_nxdomain) from a failing server (dns_servfail), a
+// timeout (dns_timeout) and anything else (dns_error); it is used as the
+// X-Proxy-Error code.
+type dnsLookupError struct {
+	host     string
+	category string
+	err      error
+}
+
+func newDNSLookupError(host string, err error) *dnsLookupError {
+	e := &dnsLookupError{host: host, category: "dns_error", err: err}
+	var de *net.DNSError
+	switch {
+	case errors.As(err, &de) && de.IsNotFound:
+		e.category = "dns_nxdomain"
+	case errors.As(err, &de) && de.IsTimeout, errors.Is(err, context.DeadlineExceeded):
+		e.category = "dns_timeout"
+	case errors.As(err, &de) && de.Err == "server misbehaving":
+		e.category = "dns_servfail"
+	}
+	return e
+}
+
+func (e *dnsLookupError) Error() string {
+	return "resolving " + e.host + " (" + e.category + "): " + e.err.Error()
+}
+
+func (e *dnsLookupError) Unwrap() error { return e.err }
+
+// dnsCache caches upstream host addresses (DNS_CACHE). Answers are kept for
+// their TTL clamped to [minTTL, maxTTL] and refreshed in the background
+// once 80% of it has passed, so busy hosts never wait on a lookup. When a
+// lookup fails, an expired answer is still served for up to staleGrace.
+type dnsCache struct {
+	resolver   resolver
+	timeout    time.Duration
+	defaultTTL time.Duration
+	minTTL     time.Duration
+	maxTTL     time.Duration
+	staleGrace time.Duration
+	now        func() time.Time
+
+	// family is FORCE_IP_FAMILY ("4", "6" or "" for both); fallbackDelay is
+	// how long dial waits on the preferred family before racing the other
+	fallbackDelay time.Duration
+	family        string
+	// dialContext dials a single address; a net.Dialer when nil
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+	// preferred is the IP family (4 or 6) that last connected to each host
+	preferred map[string]int
+
+	hits, misses, staleHits, refreshes, failures int64
+}
+
+type dnsEntry struct {
+	ips        []net.IP
+	expires    time.Time
+	refreshAt  time.Time
+	refreshing bool
+}
+
+// newDNSCache builds the cache over DNS_SERVERS when set, and over r
+// otherwise.
+func newDNSCache(cfg *Config, r resolver) *dnsCache {
+	timeout := cfg.DNSLookupTimeout.D()
+	if len(cfg.dnsServers) > 0 {
+		r = &serversResolver{
+			servers:    cfg.dnsServers,
+			timeout:    timeout,
+			roundRobin: cfg.DNSServerOrder == "round-robin",
+		}
+		timeout *= time.Duration(len(cfg.dnsServers))
+	}
+	return &dnsCache{
+		resolver:   r,
+		timeout:    timeout,
+		defaultTTL: cfg.DNSCacheDefaultTTL.D(),
+		minTTL:     cfg.DNSCacheMinTTL.D(),
+		maxTTL:     cfg.DNSCacheMaxTTL.D(),
+		staleGrace: cfg.DNSCacheStaleGrace.D(),
+		now:        time.Now,
+
+		fallbackDelay: cfg.HappyEyeballsDelay.D(),
+		family:        cfg.ForceIPFamily,
+
+		entries:   map[string]*dnsEntry{},
+		preferred: map[string]int{},
+	}
+}
+
+// lookup returns the addresses of host, from the cache when possible.
+func (c *dnsCache) lookup(host string) ([]net.IP, error) {
+	now := c.now()
+	c.mu.Lock()
+	if e := c.entries[host]; e != nil && now.Before(e.expires) {
+		c.hits++
+		if !e.refreshing && !now.Before(e.refreshAt) {
+			e.refreshing = true
+			go c.refresh(host)
+		}
+		ips := e.ips
+		c.mu.Unlock()
+		return ips, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	ips, err := c.resolve(host)
+	if err == nil {
+		return ips, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[host]; e != nil && now.Before(e.expires.Add(c.staleGrace)) {
+		c.staleHits++
+		return e.ips, nil
+	}
+	c.failures++
+	return nil, err
+}
+
+func (c *dnsCache) refresh(host string) {
+	if _, err := c.resolve(host); err != nil {
+		c.mu.Lock()
+		c.failures++
+		if e := c.entries[host]; e != nil {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// resolve looks host up and caches the answer.
+func (c *dnsCache) resolve(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	ips, ttl, err := c.resolver.lookup(ctx, host)
+	if err != nil {
+		return nil, newDNSLookupError(host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	if ttl <= 0 {
+		ttl = c.defaultTTL
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	now := c.now()
+	c.mu.Lock()
+	if _, ok := c.entries[host]; ok {
+		c.refreshes++
+	}
+	c.entries[host] = &dnsEntry{
+		ips:       ips,
+		expires:   now.Add(ttl),
+		refreshAt: now.Add(ttl * 8 / 10),
+	}
+	c.mu.Unlock()
+	return ips, nil
+}
+
+// dial connects to addr, resolving its host through the cache. With both
+// IPv4 and IPv6 addresses it dials happy-eyeballs style: the family that
+// last worked for the host (IPv4 at first) is tried, the other one joins
+// after fallbackDelay or as soon as the first fails, and whichever connects
+// first is used. A non-nil local is the egress IP to dial from; addresses
+// of the other family are skipped.
+func (c *dnsCache) dial(addr string, timeout time.Duration, local net.IP) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := c.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if local != nil && (ip.To4() == nil) != (local.To4() == nil) {
+			continue
+		}
+		if ip.To4() != nil {
+			if c.family != "6" {
+				v4 = append(v4, ip)
+			}
+		} else if c.family != "4" {
+			v6 = append(v6, ip)
+		}
+	}
+	primary, fallback := v4, v6
+	c.mu.Lock()
+	if len(v4) == 0 || (c.preferred[host] == 6 && len(v6) > 0) {
+		primary, fallback = v6, v4
+	}
+	c.mu.Unlock()
+	if len(primary) == 0 {
+		return nil, fmt.Errorf("no IPv%s addresses for %s", c.family, host)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		conn   net.Conn
+		family int
+		err    error
+	}
+	results := make(chan result, 2)
+	race := func(ips []net.IP) {
+		conn, err := c.dialSerial(ctx, ips, port, timeout, local)
+		family := 4
+		if ips[0].To4() == nil {
+			family = 6
+		}
+		results <- result{conn, family, err}
+	}
+	go race(primary)
+	pending := 1
+	var startFallback <-chan time.Time
+	if len(fallback) > 0 {
+		t := time.NewTimer(c.fallbackDelay)
+		defer t.Stop()
+		startFallback = t.C
+	}
+	for {
+		select {
+		case <-startFallback:
+			startFallback = nil
+			go race(fallback)
+			pending++
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				c.mu.Lock()
+				c.preferred[host] = r.family
+				c.mu.Unlock()
+				if pending > 0 {
+					// the loser is canceled, but may have connected already
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			err = r.err
+			if startFallback != nil {
+				startFallback = nil
+				go race(fallback)
+				pending++
+			} else if pending == 0 {
+				return nil, err
+			}
+		}
+	}
+}
+
+// dialSerial tries ips in turn until one connects.
+func (c *dnsCache) dialSerial(ctx context.Context, ips []net.IP, port string, timeout time.Duration, local net.IP) (net.Conn, error) {
+	dial := c.dialContext
+	if dial == nil {
+		d := &net.Dialer{Timeout: timeout}
+		if local != nil {
+			d.LocalAddr = &net.TCPAddr{IP: local}
+		}
+		dial = d.DialContext
+	}
+	var err error
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dial(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+type dnsEntrySnapshot struct {
+	Host       string   `json:"host"`
+	Addrs      []string `json:"addrs"`
+	TTLSeconds float64  `json:"ttlSeconds"`
+	Stale      bool     `json:"stale"`
+}
+
+type dnsCacheSnapshot struct {
+	Hits      int64              `json:"hits"`
+	Misses    int64              `json:"misses"`
+	StaleHits int64              `json:"staleHits"`
+	Refreshes int64              `json:"refreshes"`
+	Failures  int64              `json:"failures"`
+	Entries   []dnsEntrySnapshot `json:"entries"`
+}
+
+func (c *dnsCache) snapshot() dnsCacheSnapshot {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := dnsCacheSnapshot{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		StaleHits: c.staleHits,
+		Refreshes: c.refreshes,
+		Failures:  c.failures,
+		Entries:   make([]dnsEntrySnapshot, 0, len(c.entries)),
+	}
+	for host, e := range c.entries {
+		addrs := make([]string, len(e.ips))
+		for i, ip := range e.ips {
+			addrs[i] = ip.String()
+		}
+		s.Entries = append(s.Entries, dnsEntrySnapshot{
+			Host:       host,
+			Addrs:      addrs,
+			TTLSeconds: e.expires.Sub(now).Seconds(),
+			Stale:      !now.Before(e.expires),
+		})
+	}
+	sort.Slice(s.Entries, func(i, j int) bool { return s.Entries[i].Host < s.Entries[j].Host })
+	return s
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers every lookup with ips and ttl, or err when set, and
+// counts the calls.
+type fakeResolver struct {
+	mu    sync.Mutex
+	ips   []net.IP
+	ttl   time.Duration
+	err   error
+	calls int
+}
+
+func (f *fakeResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, 0, f.err
+	}
+	return f.ips, f.ttl, nil
+}
+
+func (f *fakeResolver) set(ips []net.IP, ttl time.Duration, err error) {
+	f.mu.Lock()
+	f.ips, f.ttl, f.err = ips, ttl, err
+	f.mu.Unlock()
+}
+
+func (f *fakeResolver) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// newTestDNSCache returns a cache over r with a clock the test moves by
+// assigning to *now.
+func newTestDNSCache(r resolver) (*dnsCache, *time.Time) {
+	now := time.Unix(1000000, 0)
+	c := newDNSCache(testConfig(), r)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+var (
+	ipA = net.ParseIP("10.0.0.1")
+	ipB = net.ParseIP("10.0.0.2")
+)
+
+func TestDNSCacheHonorsTTL(t *testing.T) {
+	r := &fakeResolver{ips: []net.IP{ipA}, ttl: 30 * time.Second}
+	c, now := newTestDNSCache(r)
+	c.minTTL, c.maxTTL = time.Second, time.Hour
+
+	for i := 0; i < 3; i++ {
+		if ips, err := c.lookup("users.roblox.com"); err != nil || !ips[0].Equal(ipA) {
+			t.Fatalf("lookup = %v, %v", ips, err)
+		}
+	}
+	if n := r.callCount(); n != 1 {
+		t.Errorf("resolver called %d times within the TTL, want 1", n)
+	}
+
+	*now = now.Add(31 * time.Second)
+	r.set([]net.IP{ipB}, 30*time.Second, nil)
+	if ips, _ := c.lookup("users.roblox.com"); !ips[0].Equal(ipB) {
+		t.Errorf("after expiry got %v, want %v", ips, ipB)
+	}
+	if n := r.callCount(); n != 2 {
+		t.Errorf("resolver called %d times, want 2", n)
+	}
+}
+
+func TestDNSCacheClampsTTL(t *testing.T) {
+	r := &fakeResolver{ips: []net.IP{ipA}, ttl: time.Second}
+	c, now := newTestDNSCache(r)
+	c.minTTL, c.maxTTL = 10*time.Second, time.Minute
+
+	c.lookup("users.roblox.com")
+	*now = now.Add(5 * time.Second)
+	c.lookup("users.roblox.com")
+	if n := r.callCount(); n != 1 {
+		t.Errorf("TTL below the floor: resolver called %d times, want 1", n)
+	}
+
+	r.set([]net.IP{ipA}, time.Hour, nil)
+	*now = now.Add(10 * time.Second)
+	c.lookup("users.roblox.com")
+	*now = now.Add(61 * time.Second)
+	c.lookup("users.roblox.com")
+	if n := r.callCount(); n != 3 {
+		t.Errorf("TTL above the ceiling: resolver called %d times, want 3", n)
+	}
+}
+
+func TestDNSCacheServesStaleOnError(t *testing.T) {
+	r := &fakeResolver{ips: []net.IP{ipA}, ttl: 10 * time.Second}
+	c, now := newTestDNSCache(r)
+	c.minTTL, c.staleGrace = time.Second, time.Minute
+
+	c.lookup("users.roblox.com")
+	r.set(nil, 0, errors.New("SERVFAIL"))
+
+	*now = now.Add(30 * time.Second)
+	ips, err := c.lookup("users.roblox.com")
+	if err != nil || !ips[0].Equal(ipA) {
+		t.Fatalf("within grace: lookup = %v, %v; want stale %v", ips, err, ipA)
+	}
+	if s := c.snapshot(); s.StaleHits != 1 || !s.Entries[0].Stale {
+		t.Errorf("snapshot = %+v, want one stale hit on a stale entry", s)
+	}
+
+	*now = now.Add(time.Minute)
+	if _, err := c.lookup("users.roblox.com"); err == nil {
+		t.Error("past the grace period the lookup error should surface")
+	}
+}
+
+func TestDNSCacheRefreshesBeforeExpiry(t *testing.T) {
+	r := &fakeResolver{ips: []net.IP{ipA}, ttl: 10 * time.Second}
+	c, now := newTestDNSCache(r)
+	c.minTTL = time.Second
+
+	c.lookup("users.roblox.com")
+	r.set([]net.IP{ipB}, 10*time.Second, nil)
+	*now = now.Add(9 * time.Second)
+	if ips, _ := c.lookup("users.roblox.com"); !ips[0].Equal(ipA) {
+		t.Fatalf("refresh window: got %v, want the cached %v without waiting", ips, ipA)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if ips, _ := c.lookup("users.roblox.com"); ips[0].Equal(ipB) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background refresh never replaced the entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := c.snapshot(); s.Refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", s.Refreshes)
+	}
+}
+
+// dnsStub is a local UDP DNS server. It answers A questions with ip, or
+// with rcode when set, and drops every query when drop is set. AAAA
+// questions get an empty answer.
+type dnsStub struct {
+	addr  string
+	ip    net.IP
+	rcode dnsmessage.RCode
+	drop  bool
+
+	mu      sync.Mutex
+	queries int
+}
+
+func startDNSStub(t *testing.T, stub *dnsStub) *dnsStub {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	stub.addr = pc.LocalAddr().String()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			stub.mu.Lock()
+			stub.queries++
+			stub.mu.Unlock()
+			if stub.drop {
+				continue
+			}
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			msg.Header.RecursionAvailable = true
+			msg.Header.RCode = stub.rcode
+			if stub.rcode == dnsmessage.RCodeSuccess && q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], stub.ip.To4())
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &a,
+				}}
+			}
+			if out, err := msg.Pack(); err == nil {
+				pc.WriteTo(out, from)
+			}
+		}
+	}()
+	return stub
+}
+
+func (s *dnsStub) queryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+// newServersDNSCache returns a cache resolving through the stubs in order.
+func newServersDNSCache(t *testing.T, order string, stubs ...*dnsStub) *dnsCache {
+	t.Helper()
+	cfg := testConfig()
+	cfg.DNSServerOrder = order
+	cfg.DNSLookupTimeout = Duration(200 * time.Millisecond)
+	addrs := make([]string, len(stubs))
+	for i, s := range stubs {
+		addrs[i] = s.addr
+	}
+	cfg.DNSServers = strings.Join(addrs, ",")
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return newDNSCache(cfg, nil)
+}
+
+func TestDNSServers(t *testing.T) {
+	tests := []struct {
+		name     string
+		stubs    []*dnsStub
+		want     net.IP
+		category string
+		queried  []bool
+	}{
+		{
+			name:    "answer",
+			stubs:   []*dnsStub{{ip: ipA}, {ip: ipB}},
+			want:    ipA,
+			queried: []bool{true, false},
+		},
+		{
+			name:    "failover past servfail",
+			stubs:   []*dnsStub{{rcode: dnsmessage.RCodeServerFailure}, {ip: ipB}},
+			want:    ipB,
+			queried: []bool{true, true},
+		},
+		{
+			name:    "failover past timeout",
+			stubs:   []*dnsStub{{drop: true}, {ip: ipB}},
+			want:    ipB,
+			queried: []bool{true, true},
+		},
+		{
+			name:     "nxdomain is final",
+			stubs:    []*dnsStub{{rcode: dnsmessage.RCodeNameError}, {ip: ipB}},
+			category: "dns_nxdomain",
+			queried:  []bool{true, false},
+		},
+		{
+			name:     "all servfail",
+			stubs:    []*dnsStub{{rcode: dnsmessage.RCodeServerFailure}, {rcode: dnsmessage.RCodeServerFailure}},
+			category: "dns_servfail",
+			queried:  []bool{true, true},
+		},
+		{
+			name:     "all time out",
+			stubs:    []*dnsStub{{drop: true}},
+			category: "dns_timeout",
+			queried:  []bool{true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, s := range tt.stubs {
+				startDNSStub(t, s)
+			}
+			c := newServersDNSCache(t, "failover", tt.stubs...)
+
+			ips, err := c.lookup("users.roblox.com")
+			if tt.category != "" {
+				var de *dnsLookupError
+				if !errors.As(err, &de) || de.category != tt.category {
+					t.Fatalf("lookup = %v, %v; want a %s error", ips, err, tt.category)
+				}
+			} else if err != nil || len(ips) == 0 || !ips[0].Equal(tt.want) {
+				t.Fatalf("lookup = %v, %v; want %v", ips, err, tt.want)
+			}
+			for i, s := range tt.stubs {
+				if got := s.queryCount() > 0; got != tt.queried[i] {
+					t.Errorf("server %d queried = %v, want %v", i, got, tt.queried[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDNSServersRoundRobin(t *testing.T) {
+	a := startDNSStub(t, &dnsStub{ip: ipA})
+	b := startDNSStub(t, &dnsStub{ip: ipB})
+	c := newServersDNSCache(t, "round-robin", a, b)
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		ips, _, err := c.resolver.lookup(context.Background(), "users.roblox.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[ips[0].String()] = true
+	}
+	if !seen[ipA.String()] || !seen[ipB.String()] {
+		t.Errorf("answers came from %v, want both servers", seen)
+	}
+}
+
+func TestDNSServersUpstreamError(t *testing.T) {
+	stub := startDNSStub(t, &dnsStub{rcode: dnsmessage.RCodeNameError})
+	cfg := testConfig()
+	cfg.DNSServers = stub.addr
+	s := newTestServerDirect(t, cfg)
+
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 502 {
+		t.Errorf("status = %d, want 502", resp.StatusCode())
+	}
+	if got := string(resp.Header.Peek("X-Proxy-Error")); got != "dns_nxdomain" {
+		t.Errorf("X-Proxy-Error = %q, want dns_nxdomain", got)
+	}
+}
+
+// dualStackCache returns a cache resolving every host to 127.0.0.1 and ::1
+// whose dials to the families in slow hang for a second, and the port
+// of listeners on both addresses.
+func dualStackCache(t *testing.T, slow map[int]bool) (*dnsCache, string) {
+	t.Helper()
+	ln4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln4.Close() })
+	_, port, _ := net.SplitHostPort(ln4.Addr().String())
+	ln6, err := net.Listen("tcp6", "[::1]:"+port)
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { ln6.Close() })
+
+	c, _ := newTestDNSCache(&fakeResolver{ips: []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}})
+	c.fallbackDelay = 20 * time.Millisecond
+	c.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		family := 4
+		if strings.HasPrefix(addr, "[") {
+			family = 6
+		}
+		if slow[family] {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+				return nil, errors.New("connect timeout")
+			}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	return c, port
+}
+
+// dialFamily dials addr through c and returns the IP family it connected
+// over.
+func dialFamily(t *testing.T, c *dnsCache, addr string) int {
+	t.Helper()
+	conn, err := c.dial(addr, time.Second, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().(*net.TCPAddr).IP.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func TestDNSCacheDualStackFallback(t *testing.T) {
+	slow := map[int]bool{4: true}
+	c, port := dualStackCache(t, slow)
+
+	start := time.Now()
+	if f := dialFamily(t, c, "users.roblox.com:"+port); f != 6 {
+		t.Errorf("connected over IPv%d with IPv4 hanging, want IPv6", f)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("dial took %v, want roughly the fallback delay", d)
+	}
+
+	// IPv6 won, so it is tried first from now on
+	slow[4] = false
+	if f := dialFamily(t, c, "users.roblox.com:"+port); f != 6 {
+		t.Errorf("second dial used IPv%d, want the remembered IPv6", f)
+	}
+	if f := dialFamily(t, c, "games.roblox.com:"+port); f != 4 {
+		t.Errorf("other host used IPv%d, want IPv4 first", f)
+	}
+}
+
+func TestDNSCacheForceIPFamily(t *testing.T) {
+	for _, family := range []int{4, 6} {
+		c, port := dualStackCache(t, map[int]bool{})
+		c.family = strconv.Itoa(family)
+		if f := dialFamily(t, c, "users.roblox.com:"+port); f != family {
+			t.Errorf("FORCE_IP_FAMILY=%d connected over IPv%d", family, f)
+		}
+	}
+
+	// a pinned family that is down isn't rescued by the other
+	c, port := dualStackCache(t, map[int]bool{4: true})
+	c.family = "4"
+	if _, err := c.dial("users.roblox.com:"+port, 100*time.Millisecond, nil); err == nil {
+		t.Error("FORCE_IP_FAMILY=4 fell back to IPv6")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+var dryRunHeader = reserveHeader("X-Proxy-Dry-Run",
+	"true to be answered with the upstream request as it would be sent, instead of sending it. Needs DRY_RUN_ENABLED or the ADMIN_KEY header.")
+
+const (
+	// dryRunKey is the ctx user value set on dry-run requests.
+	dryRunKey = "dryRun"
+
+	// dryRunMaxBody is how much of the upstream request body a dry run
+	// shows.
+	dryRunMaxBody = 64 << 10
+)
+
+// wantsDryRun reads the X-Proxy-Dry-Run request header, which is honored
+// with DRY_RUN_ENABLED or from a request carrying the ADMIN_KEY header. The
+// header is removed so it doesn't reach upstream.
+func wantsDryRun(cfg *Config, ctx *fasthttp.RequestCtx) bool {
+	v := ctx.Request.Header.Peek(dryRunHeader)
+	if len(v) == 0 {
+		return false
+	}
+	on, _ := strconv.ParseBool(string(v))
+	ctx.Request.Header.Del(dryRunHeader)
+	if !on {
+		return false
+	}
+	return cfg.DryRunEnabled || cfg.AdminKey != "" &&
+		subtle.ConstantTimeCompare(ctx.Request.Header.Peek(adminKeyHeader), []byte(cfg.AdminKey)) == 1
+}
+
+// dryRunRequest describes an upstream request as it would have been sent.
+type dryRunRequest struct {
+	Method        string              `json:"method"`
+	URL           string              `json:"url"`
+	Headers       map[string][]string `json:"headers"`
+	Body          string              `json:"body"`
+	BodyEncoding  string              `json:"bodyEncoding"` // text or base64
+	BodySize      int                 `json:"bodySize"`
+	BodyTruncated bool                `json:"bodyTruncated,omitempty"`
+	BodyStreamed  bool                `json:"bodyStreamed,omitempty"`
+
+	// ForwardClientIP is the FORWARD_CLIENT_IP policy the forwarding
+	// headers were written by.
+	ForwardClientIP string `json:"forwardClientIP"`
+}
+
+// dryRunResponse answers for upstream with a description of req, the fully
+// built upstream request. The headers are those written on the wire, so
+// Content-Length is the one sent. The proxy's and the Open Cloud keys are
+// masked, and so are EXTRA_UPSTREAM_SECRET_HEADERS. A streamed body isn't
+// read, so it's left out.
+func dryRunResponse(cfg *Config, req *fasthttp.Request) *fasthttp.Response {
+	d := dryRunRequest{
+		Method:          string(req.Header.Method()),
+		URL:             req.URI().String(),
+		Headers:         map[string][]string{},
+		BodyEncoding:    "text",
+		ForwardClientIP: cfg.ForwardClientIP,
+	}
+	header := &req.Header
+	if !req.IsBodyStream() {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		var wire fasthttp.Request
+		if req.Write(w) == nil && w.Flush() == nil && wire.Read(bufio.NewReader(&buf)) == nil {
+			header = &wire.Header
+		}
+	}
+	header.VisitAll(func(k, v []byte) {
+		key := string(k)
+		value := string(v)
+		if lower := strings.ToLower(key); lower == "proxykey" || lower == "admin_key" || lower == "x-api-key" || cfg.secretHeaders[lower] {
+			value = "REDACTED"
+		}
+		d.Headers[key] = append(d.Headers[key], value)
+	})
+	if req.IsBodyStream() {
+		d.BodyStreamed = true
+		d.BodySize = req.Header.ContentLength()
+	} else {
+		body := req.Body()
+		d.BodySize = len(body)
+		if len(body) > dryRunMaxBody {
+			body, d.BodyTruncated = body[:dryRunMaxBody], true
+		}
+		d.Body, d.BodyEncoding = encodeBody(body)
+	}
+	b, _ := json.Marshal(d)
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(200)
+	resp.Header.SetContentType("application/json")
+	resp.SetBody(b)
+	return resp
+}
+
+// encodeBody returns body for a JSON document: as it is when it's text,
+// otherwise base64-encoded. The encoding is "text" or "base64".
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) && bytes.IndexByte(body, 0) < 0 {
+		return string(body), "text"
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestDryRun(t *testing.T) {
+	var calls int32
+	var sawDryRun bool
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		sawDryRun = len(ctx.Request.Header.Peek(dryRunHeader)) > 0
+		ctx.SetBodyString("upstream")
+	}
+	cfg := testConfig()
+	cfg.Key = "secret"
+	cfg.AdminKey = "admin"
+	cfg.StripQueryParams = "debug"
+	cfg.BodyReplaceFrom = "sandbox"
+	cfg.BodyReplaceTo = "live"
+	cfg.UserAgentMode = "append"
+	cfg.OpenCloudKeys = SubdomainStrings{"ci": "cloud-k3y"}
+	s := newTestServer(t, cfg, upstream)
+	s.csrf.set("apis.roblox.com", "csrf-token")
+	dryRun := func(headers, uri, body string) (*fasthttp.Response, dryRunRequest) {
+		t.Helper()
+		resp := serveRaw(t, s, "POST "+uri+" HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: secret\r\n"+headers+
+			"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		var d dryRunRequest
+		if resp.StatusCode() == 200 && string(resp.Header.Peek(dryRunHeader)) == "true" {
+			if err := json.Unmarshal(resp.Body(), &d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, d
+	}
+
+	resp, d := dryRun("ADMIN_KEY: admin\r\nX-Proxy-Dry-Run: true\r\nX-Proxy-Cloud-Key: ci\r\nConnection: keep-alive\r\n"+
+		"Roblox-Id: 1\r\nUser-Agent: game/1\r\nX-Multi: a\r\nX-Multi: b\r\nContent-Type: application/json\r\n",
+		"/apis/cloud/v2/universes/1:publishMessage?debug=1&x=2", `{"env":"sandbox"}`)
+	if resp.StatusCode() != 200 || d.Method == "" {
+		t.Fatalf("dry run: %d %s", resp.StatusCode(), resp.Body())
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("upstream called %d times", n)
+	}
+	want := dryRunRequest{
+		Method: "POST",
+		URL:    "https://apis.roblox.com/cloud/v2/universes/1:publishMessage?x=2",
+		Headers: map[string][]string{
+			"Host":           {"apis.roblox.com"},
+			"User-Agent":     {"game/1 via RoProxy/1.0"},
+			"Content-Type":   {"application/json"},
+			"Content-Length": {"14"},
+			"Proxykey":       {"REDACTED"},
+			"Admin_key":      {"REDACTED"},
+			"X-Multi":        {"a", "b"},
+			"X-Api-Key":      {"REDACTED"},
+			"X-Csrf-Token":   {"csrf-token"},
+		},
+		Body:            `{"env":"live"}`,
+		BodyEncoding:    "text",
+		BodySize:        14,
+		ForwardClientIP: "strip",
+	}
+	got, _ := json.Marshal(d)
+	if exp, _ := json.Marshal(want); !bytes.Equal(got, exp) {
+		t.Errorf("dry run:\n got %s\nwant %s", got, exp)
+	}
+	if strings.Contains(string(resp.Body()), "cloud-k3y") {
+		t.Errorf("cloud key in the echo: %s", resp.Body())
+	}
+
+	// a gzipped body is shown as base64, and a large one is cut short
+	cfg.CompressUpstreamBody = true
+	cfg.CompressUpstreamSubdomains = "apis"
+	cfg.compile()
+	_, d = dryRun("ADMIN_KEY: admin\r\nX-Proxy-Dry-Run: 1\r\n", "/apis/v1/x", strings.Repeat("a", 2000))
+	if d.BodyEncoding != "base64" || d.BodyTruncated {
+		t.Fatalf("gzipped body: %+v", d)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(d.Body)
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, _ := ioutil.ReadAll(zr); string(plain) != strings.Repeat("a", 2000) || d.Headers["Content-Encoding"][0] != "gzip" {
+		t.Errorf("gzipped body decodes to %d bytes", len(plain))
+	}
+	cfg.CompressUpstreamBody = false
+	_, d = dryRun("ADMIN_KEY: admin\r\nX-Proxy-Dry-Run: true\r\n", "/apis/v1/x", strings.Repeat("b", dryRunMaxBody+10))
+	if !d.BodyTruncated || d.BodySize != dryRunMaxBody+10 || len(d.Body) != dryRunMaxBody {
+		t.Errorf("large body: truncated %v, size %d, shown %d", d.BodyTruncated, d.BodySize, len(d.Body))
+	}
+
+	// without ADMIN_KEY or DRY_RUN_ENABLED the request is sent as usual,
+	// without the header
+	if resp, _ := dryRun("X-Proxy-Dry-Run: true\r\n", "/apis/v1/x", ""); string(resp.Body()) != "upstream" || sawDryRun {
+		t.Errorf("not allowed: %q, upstream saw the header: %v", resp.Body(), sawDryRun)
+	}
+	cfg.DryRunEnabled = true
+	if resp, _ := dryRun("X-Proxy-Dry-Run: true\r\n", "/apis/v1/x", ""); string(resp.Header.Peek(dryRunHeader)) != "true" {
+		t.Errorf("with dry_run_enabled: %d %s", resp.StatusCode(), resp.Body())
+	}
+	// validation still runs first
+	if resp, _ := dryRun("X-Proxy-Dry-Run: true\r\nX-Proxy-Cloud-Key: nope\r\n", "/apis/cloud/v2/x", ""); resp.StatusCode() != 403 {
+		t.Errorf("unknown cloud key: %d", resp.StatusCode())
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// egressThrottleLimit is how many 429s in a row take an egress IP out of
+// rotation.
+const egressThrottleLimit = 3
+
+// egressPool rotates upstream connections over EGRESS_IPS, round-robin per
+// connection. An IP whose dials fail, or that collects egressThrottleLimit
+// 429s in a row, is skipped for EGRESS_PENALTY; when every IP is penalized
+// the rotation carries on over all of them.
+type egressPool struct {
+	ips     []*egressIP
+	penalty time.Duration
+	now     func() time.Time
+
+	next uint32
+}
+
+type egressIP struct {
+	ip net.IP
+
+	dials, dialErrors, responses, throttled int64
+
+	mu           sync.Mutex
+	throttleRun  int
+	penaltyUntil time.Time
+}
+
+func newEgressPool(ips []net.IP, penalty time.Duration) *egressPool {
+	p := &egressPool{penalty: penalty, now: time.Now}
+	for _, ip := range ips {
+		p.ips = append(p.ips, &egressIP{ip: ip})
+	}
+	return p
+}
+
+// pick returns the egress IP for the next connection.
+func (p *egressPool) pick() *egressIP {
+	start := int(atomic.AddUint32(&p.next, 1)-1) % len(p.ips)
+	now := p.now()
+	for i := range p.ips {
+		e := p.ips[(start+i)%len(p.ips)]
+		if !e.penalized(now) {
+			return e
+		}
+	}
+	return p.ips[start]
+}
+
+// dialed records the outcome of a dial from e.
+func (p *egressPool) dialed(e *egressIP, err error) {
+	atomic.AddInt64(&e.dials, 1)
+	if err != nil {
+		atomic.AddInt64(&e.dialErrors, 1)
+		e.mu.Lock()
+		e.penaltyUntil = p.now().Add(p.penalty)
+		e.mu.Unlock()
+	}
+}
+
+// observe records an upstream response with status received on a
+// connection from ip.
+func (p *egressPool) observe(ip net.IP, status int) {
+	e := p.lookup(ip)
+	if e == nil {
+		return
+	}
+	atomic.AddInt64(&e.responses, 1)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if status != 429 {
+		e.throttleRun = 0
+		return
+	}
+	atomic.AddInt64(&e.throttled, 1)
+	if e.throttleRun++; e.throttleRun >= egressThrottleLimit {
+		e.throttleRun = 0
+		e.penaltyUntil = p.now().Add(p.penalty)
+	}
+}
+
+func (p *egressPool) lookup(ip net.IP) *egressIP {
+	for _, e := range p.ips {
+		if e.ip.Equal(ip) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (e *egressIP) penalized(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return now.Before(e.penaltyUntil)
+}
+
+// localAddr is the address to dial from.
+func (e *egressIP) localAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: e.ip}
+}
+
+// network is tcp4 or tcp6, matching the egress IP.
+func (e *egressIP) network() string {
+	if e.ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+type egressSnapshot struct {
+	IP         string `json:"ip"`
+	Dials      int64  `json:"dials"`
+	DialErrors int64  `json:"dialErrors"`
+	Responses  int64  `json:"responses"`
+	Throttled  int64  `json:"throttled"`
+	Penalized  bool   `json:"penalized"`
+}
+
+func (p *egressPool) snapshot() []egressSnapshot {
+	now := p.now()
+	out := make([]egressSnapshot, len(p.ips))
+	for i, e := range p.ips {
+		out[i] = egressSnapshot{
+			IP:         e.ip.String(),
+			Dials:      atomic.LoadInt64(&e.dials),
+			DialErrors: atomic.LoadInt64(&e.dialErrors),
+			Responses:  atomic.LoadInt64(&e.responses),
+			Throttled:  atomic.LoadInt64(&e.throttled),
+			Penalized:  e.penalized(now),
+		}
+	}
+	return out
+}
+
+func (p *egressPool) writeMetrics(b *bytes.Buffer) {
+	snap := p.snapshot()
+	metric := func(name, typ, help string, value func(s egressSnapshot) interface{}) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range snap {
+			fmt.Fprintf(b, "%s{ip=%q} %v\n", name, s.IP, value(s))
+		}
+	}
+	metric("roproxy_egress_dials_total", "counter", "Upstream connections dialed from the egress IP.",
+		func(s egressSnapshot) interface{} { return s.Dials })
+	metric("roproxy_egress_dial_errors_total", "counter", "Upstream dials from the egress IP that failed.",
+		func(s egressSnapshot) interface{} { return s.DialErrors })
+	metric("roproxy_egress_responses_total", "counter", "Upstream responses received on the egress IP.",
+		func(s egressSnapshot) interface{} { return s.Responses })
+	metric("roproxy_egress_throttled_total", "counter", "Upstream 429 responses received on the egress IP.",
+		func(s egressSnapshot) interface{} { return s.Throttled })
+	metric("roproxy_egress_penalized", "gauge", "1 while the egress IP is skipped after failures.",
+		func(s egressSnapshot) interface{} {
+			if s.Penalized {
+				return 1
+			}
+			return 0
+		})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// startEgressListener accepts (and closes) TCP connections on 127.0.0.1.
+func startEgressListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return ln
+}
+
+func newEgressTestServer(t *testing.T, egressIPs string) *Server {
+	t.Helper()
+	cfg := testConfig()
+	cfg.EgressIPs = egressIPs
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return newServer(cfg)
+}
+
+func TestEgressRotation(t *testing.T) {
+	ln := startEgressListener(t)
+	s := newEgressTestServer(t, "127.0.0.2, 127.0.0.3")
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		conn, err := s.dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, conn.LocalAddr().(*net.TCPAddr).IP.String())
+		conn.Close()
+	}
+	want := []string{"127.0.0.2", "127.0.0.3", "127.0.0.2", "127.0.0.3"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("dialed from %v, want %v", got, want)
+		}
+	}
+}
+
+func TestEgressSkipsFailingIP(t *testing.T) {
+	ln := startEgressListener(t)
+	// 192.0.2.1 (TEST-NET-1) isn't a local address, so binding it fails
+	s := newEgressTestServer(t, "192.0.2.1,127.0.0.2")
+
+	for i := 0; i < 4; i++ {
+		conn, err := s.dial(ln.Addr().String())
+		if i == 0 {
+			if err == nil {
+				t.Fatal("dial from 192.0.2.1 succeeded")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("dial %d: %v; the failing IP should be skipped", i, err)
+		}
+		conn.Close()
+	}
+	snap := s.egress.snapshot()
+	if !snap[0].Penalized || snap[0].Dials != 1 || snap[1].Dials != 3 {
+		t.Errorf("snapshot = %+v, want 192.0.2.1 penalized after one dial", snap)
+	}
+}
+
+func TestEgressThrottlePenalty(t *testing.T) {
+	p := newEgressPool([]net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}, time.Minute)
+	now := time.Unix(1000000, 0)
+	p.now = func() time.Time { return now }
+	throttled := net.ParseIP("127.0.0.2")
+
+	p.observe(throttled, 429)
+	p.observe(throttled, 200)
+	p.observe(throttled, 429)
+	p.observe(throttled, 429)
+	if p.lookup(throttled).penalized(now) {
+		t.Fatal("penalized without 3 429s in a row")
+	}
+	p.observe(throttled, 429)
+	for i := 0; i < 4; i++ {
+		if e := p.pick(); e.ip.Equal(throttled) {
+			t.Fatal("picked the throttled IP during its penalty")
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if e1, e2 := p.pick(), p.pick(); !e1.ip.Equal(throttled) && !e2.ip.Equal(throttled) {
+		t.Error("throttled IP never came back after the penalty")
+	}
+}
+
+func TestEgressHeader(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	cert, key, err := fasthttp.GenerateTestCertificate("roblox.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&fasthttp.Server{Handler: okUpstream}).ServeTLSEmbed(ln, cert, key)
+
+	cfg := testConfig()
+	cfg.EgressIPs = "127.0.0.2"
+	s := newTestServerDirect(t, cfg)
+	// every upstream host is the local listener, dialed through the egress
+	// rotation
+	s.client.Dial = func(string) (net.Conn, error) { return s.dial(ln.Addr().String()) }
+
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 {
+		t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+	if got := string(resp.Header.Peek("X-Proxy-Egress-IP")); got != "127.0.0.2" {
+		t.Errorf("X-Proxy-Egress-IP = %q, want 127.0.0.2", got)
+	}
+	if snap := s.egress.snapshot(); snap[0].Responses != 1 {
+		t.Errorf("responses = %d, want 1", snap[0].Responses)
+	}
+}
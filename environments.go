@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+var envHeader = reserveHeader("X-Proxy-Env", "Name of an ENVIRONMENTS entry to send the request to instead of TARGET_DOMAIN. Needs ALLOW_ENV_OVERRIDE.")
+
+// envKey is the ctx user value holding the ENVIRONMENTS name a request is
+// sent to.
+const envKey = "env"
+
+// applyEnvironment handles X-Proxy-Env, which is stripped from every
+// request. With ALLOW_ENV_OVERRIDE the named ENVIRONMENTS entry replaces
+// TARGET_DOMAIN for this request; without it the header is ignored. It
+// reports whether the request may proceed; otherwise the error response
+// has been written.
+func applyEnvironment(cfg *Config, ctx *fasthttp.RequestCtx) bool {
+	name := strings.ToLower(strings.TrimSpace(string(ctx.Request.Header.Peek(envHeader))))
+	ctx.Request.Header.Del(envHeader)
+	if name == "" || !cfg.AllowEnvOverride {
+		return true
+	}
+	if _, ok := cfg.Environments[name]; !ok {
+		proxyError(ctx, 400, "unknown_environment", "No environment is configured as "+name+".")
+		return false
+	}
+	ctx.SetUserValue(envKey, name)
+	return true
+}
+
+// targetDomain is the apex domain ctx is proxied to: its X-Proxy-Env
+// environment's, or TARGET_DOMAIN.
+func targetDomain(cfg *Config, ctx *fasthttp.RequestCtx) string {
+	if name, ok := ctx.UserValue(envKey).(string); ok {
+		if domain, ok := cfg.Environments[name]; ok {
+			return domain
+		}
+	}
+	return cfg.TargetDomain
+}
+
+// envStats counts requests sent to an X-Proxy-Env environment, by name.
+type envStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newEnvStats() *envStats {
+	return &envStats{counts: map[string]int64{}}
+}
+
+func (e *envStats) add(name string) {
+	e.mu.Lock()
+	e.counts[name]++
+	e.mu.Unlock()
+}
+
+func (e *envStats) writeMetrics(b *bytes.Buffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, 0, len(e.counts))
+	for n := range e.counts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(b, "# HELP roproxy_env_requests_total Requests sent to an environment chosen with X-Proxy-Env, by environment.\n# TYPE roproxy_env_requests_total counter\n")
+	for _, n := range names {
+		fmt.Fprintf(b, "roproxy_env_requests_total{env=%q} %d\n", n, e.counts[n])
+	}
+}
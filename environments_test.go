@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestEnvironmentOverride(t *testing.T) {
+	var gotHost string
+	var sawEnv bool
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		gotHost = string(ctx.Host())
+		sawEnv = len(ctx.Request.Header.Peek(envHeader)) > 0
+		ctx.SetBodyString("from " + gotHost)
+	}
+	cfg := testConfig()
+	cfg.Environments = SubdomainStrings{"sitetest1": "sitetest1.robloxlabs.com"}
+	cfg.AllowEnvOverride = true
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	get := func(env string) *fasthttp.Response {
+		t.Helper()
+		gotHost, sawEnv = "", false
+		raw := "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"
+		if env != "" {
+			raw += "X-Proxy-Env: " + env + "\r\n"
+		}
+		return serveRaw(t, s, raw+"\r\n")
+	}
+
+	// production first, so a cached answer would be there to leak
+	if resp := get(""); gotHost != "users.roblox.com" || len(resp.Header.Peek("X-Proxy-Upstream")) > 0 {
+		t.Errorf("without X-Proxy-Env: sent to %q, X-Proxy-Upstream %q", gotHost, resp.Header.Peek("X-Proxy-Upstream"))
+	}
+	resp := get("SiteTest1")
+	if resp.StatusCode() != 200 || gotHost != "users.sitetest1.robloxlabs.com" || string(resp.Body()) != "from users.sitetest1.robloxlabs.com" {
+		t.Errorf("sitetest1: %d %q, sent to %q", resp.StatusCode(), resp.Body(), gotHost)
+	}
+	if got := string(resp.Header.Peek("X-Proxy-Upstream")); got != "users.sitetest1.robloxlabs.com" {
+		t.Errorf("X-Proxy-Upstream = %q", got)
+	}
+	if sawEnv {
+		t.Error("X-Proxy-Env was sent upstream")
+	}
+	// each environment has its own cache entries
+	if resp := get("sitetest1"); string(resp.Body()) != "from users.sitetest1.robloxlabs.com" || string(resp.Header.Peek("X-Proxy-Cache")) != "HIT" {
+		t.Errorf("sitetest1 again: %q, X-Proxy-Cache %q", resp.Body(), resp.Header.Peek("X-Proxy-Cache"))
+	}
+	if resp := get(""); string(resp.Body()) != "from users.roblox.com" {
+		t.Errorf("production again: %q", resp.Body())
+	}
+
+	resp = get("gametest9")
+	if resp.StatusCode() != 400 || string(resp.Header.Peek("X-Proxy-Error")) != "unknown_environment" || gotHost != "" {
+		t.Errorf("unknown environment: %d %q, sent to %q", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"), gotHost)
+	}
+
+	var b bytes.Buffer
+	s.envs.writeMetrics(&b)
+	if !strings.Contains(b.String(), `roproxy_env_requests_total{env="sitetest1"} 1`+"\n") {
+		t.Errorf("metrics:\n%s", b.String())
+	}
+
+	// without ALLOW_ENV_OVERRIDE the header is dropped and ignored
+	cfg.AllowEnvOverride = false
+	cfg.CacheTTL = 0
+	s = newTestServer(t, cfg, upstream)
+	for _, env := range []string{"sitetest1", "gametest9"} {
+		if resp := get(env); resp.StatusCode() != 200 || gotHost != "users.roblox.com" || sawEnv {
+			t.Errorf("%s without allow_env_override: %d, sent to %q, header sent: %v", env, resp.StatusCode(), gotHost, sawEnv)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/valyala/fasthttp"
+)
+
+// proxyError answers ctx with an error originating in the proxy itself. The
+// machine-readable code is sent in X-Proxy-Error so clients can tell proxy
+// errors apart from upstream responses with the same status. The body is
+// JSON, HTML or plain text depending on the request's Accept header.
+func proxyError(ctx *fasthttp.RequestCtx, status int, code, message string) {
+	ctx.SetStatusCode(status)
+	ctx.Response.Header.Set("X-Proxy-Error", code)
+	setErrorBody(ctx, status, code, message)
+}
+
+// setErrorBody writes the error body in the format negotiated from Accept.
+func setErrorBody(ctx *fasthttp.RequestCtx, status int, code, message string) {
+	switch negotiateErrorFormat(string(ctx.Request.Header.Peek("Accept"))) {
+	case "json":
+		b, _ := json.Marshal(map[string]interface{}{"status": status, "code": code, "message": message})
+		ctx.SetContentType("application/json")
+		ctx.SetBody(b)
+	case "html":
+		m := html.EscapeString(message)
+		title := strconv.Itoa(status) + " " + html.EscapeString(fasthttp.StatusMessage(status))
+		ctx.SetContentType("text/html; charset=utf-8")
+		ctx.SetBodyString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>" + title + "</title></head>\n" +
+			"<body><h1>" + title + "</h1><p>" + m + "</p><p><small>" + html.EscapeString(code) + "</small></p></body></html>\n")
+	default:
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.SetBodyString(message)
+	}
+}
+
+// negotiateErrorFormat picks "json", "html" or "text" for an Accept header:
+// whichever of JSON and HTML has the higher q-value, the earlier one on a
+// tie, and text when neither is acceptable.
+func negotiateErrorFormat(accept string) string {
+	best, bestQ := "text", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		format := ""
+		switch {
+		case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+			format = "json"
+		case mt == "text/html":
+			format = "html"
+		default:
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// errorResponse builds a proxy error as a standalone response, for code
+// paths that return a *fasthttp.Response instead of writing to ctx. The
+// caller owns the response and must release it. Its body is the plain
+// message; requestHandler negotiates the format when copying it out.
+func errorResponse(status int, code, message string) *fasthttp.Response {
+	r := fasthttp.AcquireResponse()
+	r.SetStatusCode(status)
+	r.Header.Set("X-Proxy-Error", code)
+	r.SetBody([]byte(message))
+	return r
+}
+
+// classifyError names what went wrong with a failed upstream attempt, so
+// the logs and metrics tell a slow upstream from an unreachable one or a
+// certificate problem:
+//
+//	timeout             connected, but no answer in time
+//	connect_timeout     the TCP connection wasn't established in time
+//	connection_refused  nothing listening
+//	connection_reset    the connection was closed or reset mid-request
+//	tls                 the TLS handshake failed or the certificate wasn't trusted
+//	dns                 the host didn't resolve
+//	proxy               the OUTBOUND_PROXY couldn't be reached or refused
+//	no_free_conns       the connection pool stayed full
+//	other               anything else
+func classifyError(err error) string {
+	var (
+		pe *outboundProxyError
+		de *dnsLookupError
+		ne net.Error
+	)
+	switch {
+	case errors.As(err, &pe):
+		return "proxy"
+	case errors.As(err, &de):
+		return "dns"
+	case isTLSError(err) || errors.Is(err, fasthttp.ErrTLSHandshakeTimeout) || strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	case errors.Is(err, fasthttp.ErrNoFreeConns):
+		return "no_free_conns"
+	case errors.Is(err, fasthttp.ErrDialTimeout):
+		return "connect_timeout"
+	case errors.Is(err, fasthttp.ErrTimeout) || errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, fasthttp.ErrConnectionClosed):
+		return "connection_reset"
+	}
+	return "other"
+}
+
+// failedResponse is the error response for a request whose last attempt
+// failed with err.
+func failedResponse(err error) *fasthttp.Response {
+	switch classifyError(err) {
+	case "proxy":
+		var pe *outboundProxyError
+		errors.As(err, &pe)
+		return errorResponse(502, "connect_error", "Could not connect through outbound proxy "+pe.proxy+".")
+	case "dns":
+		var de *dnsLookupError
+		errors.As(err, &de)
+		return errorResponse(502, de.category, "Could not resolve "+de.host+".")
+	case "tls":
+		return errorResponse(502, "tls_error", "Upstream TLS handshake failed or its certificate was not trusted.")
+	}
+	return errorResponse(500, "upstream_unreachable", "Proxy failed to connect. Please try again.")
+}
+
+// errorReasons counts failed upstream attempts by classifyError reason.
+type errorReasons struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newErrorReasons() *errorReasons {
+	return &errorReasons{counts: map[string]int64{}}
+}
+
+func (e *errorReasons) add(reason string) {
+	e.mu.Lock()
+	e.counts[reason]++
+	e.mu.Unlock()
+}
+
+func (e *errorReasons) reset() {
+	e.mu.Lock()
+	e.counts = map[string]int64{}
+	e.mu.Unlock()
+}
+
+func (e *errorReasons) writeMetrics(b *bytes.Buffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reasons := make([]string, 0, len(e.counts))
+	for r := range e.counts {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintf(b, "# HELP roproxy_upstream_errors_total Failed upstream attempts, by reason.\n# TYPE roproxy_upstream_errors_total counter\n")
+	for _, r := range reasons {
+		fmt.Fprintf(b, "roproxy_upstream_errors_total{reason=%q} %d\n", r, e.counts[r])
+	}
+}
+
+// upstreamError is one entry of a normalized upstream error's errors.
+type upstreamError struct {
+	Code    interface{} `json:"code"`
+	Message string      `json:"message"`
+}
+
+// errorMessageKeys are the keys single-error JSON bodies carry their
+// message in, in order of preference.
+var errorMessageKeys = []string{"message", "errorMessage", "error", "title"}
+
+// normalizeError rewrites an upstream error response, status 400 or more
+// with a JSON or plain text body of up to NORMALIZE_ERRORS_MAX_BYTES, into
+// {"upstream":true,"status":N,"errors":[{"code","message"}],"raw":...}
+// whatever shape the API answered in. raw is the original body, as JSON
+// when it parses and as a string otherwise. The status and headers are
+// kept. Errors from the proxy itself are left alone.
+func normalizeError(cfg *Config, resp *fasthttp.Response) {
+	status := resp.StatusCode()
+	if status < 400 || len(resp.Header.Peek("X-Proxy-Error")) > 0 || int64(len(resp.Body())) > cfg.NormalizeErrorsMaxBytes {
+		return
+	}
+	ct := resp.Header.ContentType()
+	isJSON := isJSONContentType(ct)
+	if !isJSON && !bytes.HasPrefix(bytes.ToLower(ct), []byte("text/plain")) && len(resp.Body()) > 0 {
+		return
+	}
+	body, err := decodedBody(resp)
+	if err != nil || int64(len(body)) > cfg.NormalizeErrorsMaxBytes {
+		return
+	}
+
+	var raw interface{} = string(body)
+	var errs []upstreamError
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && json.Valid(trimmed) {
+		raw = json.RawMessage(trimmed)
+		errs = jsonErrors(trimmed)
+	} else if !isJSON {
+		if m := strings.TrimSpace(string(body)); m != "" {
+			errs = []upstreamError{{Code: 0, Message: m}}
+		}
+	}
+	if len(errs) == 0 {
+		errs = []upstreamError{{Code: 0, Message: fasthttp.StatusMessage(status)}}
+	}
+
+	out, _ := json.Marshal(map[string]interface{}{"upstream": true, "status": status, "errors": errs, "raw": raw})
+	resp.Header.Del("Content-Encoding")
+	resp.Header.SetContentType("application/json")
+	resp.SetBody(out)
+	resp.Header.SetContentLength(len(out))
+	resp.Header.Set("X-Proxy-Normalized", "true")
+}
+
+// jsonErrors maps the known JSON error shapes, {"errors":[{code,message}]}
+// and {"code","message"} with the message under one of errorMessageKeys,
+// to error entries. It returns nil for anything else.
+func jsonErrors(body []byte) []upstreamError {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(body, &obj) != nil {
+		return nil
+	}
+	var list []map[string]interface{}
+	if json.Unmarshal(obj["errors"], &list) == nil && len(list) > 0 {
+		var errs []upstreamError
+		for _, e := range list {
+			errs = append(errs, errorEntry(e))
+		}
+		return errs
+	}
+	var single map[string]interface{}
+	json.Unmarshal(body, &single)
+	for _, k := range errorMessageKeys {
+		if _, ok := single[k].(string); ok {
+			return []upstreamError{errorEntry(single)}
+		}
+	}
+	return nil
+}
+
+func errorEntry(e map[string]interface{}) upstreamError {
+	out := upstreamError{Code: 0}
+	if code, ok := e["code"]; ok && code != nil {
+		out.Code = code
+	}
+	for _, k := range errorMessageKeys {
+		if m, ok := e[k].(string); ok {
+			out.Message = m
+			break
+		}
+	}
+	return out
+}
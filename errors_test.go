@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestErrorContentNegotiation(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"", "text/plain; charset=utf-8"},
+		{"*/*", "text/plain; charset=utf-8"},
+		{"application/json", "application/json"},
+		{"application/problem+json", "application/json"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"text/html;q=0.5, application/json", "application/json"},
+		{"application/json;q=0, text/html", "text/html; charset=utf-8"},
+		{"image/png", "text/plain; charset=utf-8"},
+	}
+	// one error written directly by the handler, one built by doRequest
+	requests := map[string]func(*Config) (*Server, string){
+		"invalid_key": func(cfg *Config) (*Server, string) {
+			cfg.Key = "secret"
+			return newTestServer(t, cfg, okUpstream), "Missing or invalid PROXYKEY header."
+		},
+		"upstream_unreachable": func(cfg *Config) (*Server, string) {
+			s := newTestServerDirect(t, cfg)
+			s.client.Dial = func(string) (net.Conn, error) { return nil, errors.New("refused") }
+			return s, "Proxy failed to connect. Please try again."
+		},
+	}
+	for code, setup := range requests {
+		for _, tt := range tests {
+			t.Run(code+"/"+tt.accept, func(t *testing.T) {
+				s, message := setup(testConfig())
+				header := ""
+				if tt.accept != "" {
+					header = "Accept: " + tt.accept + "\r\n"
+				}
+				resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"+header+"\r\n")
+
+				if got := string(resp.Header.ContentType()); got != tt.contentType {
+					t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+				}
+				if got := string(resp.Header.Peek("X-Proxy-Error")); got != code {
+					t.Errorf("X-Proxy-Error = %q, want %s", got, code)
+				}
+				body := string(resp.Body())
+				switch tt.contentType {
+				case "application/json":
+					var got struct {
+						Status  int    `json:"status"`
+						Code    string `json:"code"`
+						Message string `json:"message"`
+					}
+					if err := json.Unmarshal(resp.Body(), &got); err != nil || got.Code != code || got.Message != message || got.Status != resp.StatusCode() {
+						t.Errorf("JSON body = %s (%v)", body, err)
+					}
+				case "text/html; charset=utf-8":
+					if !strings.HasPrefix(body, "<!DOCTYPE html>") || !strings.Contains(body, message) {
+						t.Errorf("HTML body = %q", body)
+					}
+				default:
+					if body != message {
+						t.Errorf("body = %q, want %q", body, message)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestNormalizeErrors(t *testing.T) {
+	cfg := testConfig()
+	for _, tc := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        string
+	}{
+		{"errors list", 400, "application/json", `{"errors":[{"code":3,"message":"Invalid user id","userFacingMessage":"Something went wrong"},{"code":0,"message":"Second"}]}`,
+			`{"errors":[{"code":3,"message":"Invalid user id"},{"code":0,"message":"Second"}],"raw":{"errors":[{"code":3,"message":"Invalid user id","userFacingMessage":"Something went wrong"},{"code":0,"message":"Second"}]},"status":400,"upstream":true}`},
+		{"message", 404, "application/json; charset=utf-8", `{"message":"NotFound"}`,
+			`{"errors":[{"code":0,"message":"NotFound"}],"raw":{"message":"NotFound"},"status":404,"upstream":true}`},
+		{"open cloud", 403, "application/json", `{"code":"PERMISSION_DENIED","message":"Insufficient scope."}`,
+			`{"errors":[{"code":"PERMISSION_DENIED","message":"Insufficient scope."}],"raw":{"code":"PERMISSION_DENIED","message":"Insufficient scope."},"status":403,"upstream":true}`},
+		{"plain text", 500, "text/plain", "InternalServerError\n",
+			`{"errors":[{"code":0,"message":"InternalServerError"}],"raw":"InternalServerError\n","status":500,"upstream":true}`},
+		{"unparseable JSON", 502, "application/json", `{"errors":[`,
+			`{"errors":[{"code":0,"message":"Bad Gateway"}],"raw":"{\"errors\":[","status":502,"upstream":true}`},
+		{"unknown JSON shape", 429, "application/json", `[1,2]`,
+			`{"errors":[{"code":0,"message":"Too Many Requests"}],"raw":[1,2],"status":429,"upstream":true}`},
+		{"empty", 401, "", "",
+			`{"errors":[{"code":0,"message":"Unauthorized"}],"raw":"","status":401,"upstream":true}`},
+	} {
+		var resp fasthttp.Response
+		resp.SetStatusCode(tc.status)
+		resp.Header.SetContentType(tc.contentType)
+		resp.Header.Set("X-Csrf-Token", "abc")
+		resp.SetBodyString(tc.body)
+		normalizeError(cfg, &resp)
+		if string(resp.Body()) != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, resp.Body(), tc.want)
+		}
+		if resp.StatusCode() != tc.status || string(resp.Header.Peek("X-Csrf-Token")) != "abc" ||
+			string(resp.Header.ContentType()) != "application/json" || resp.Header.ContentLength() != len(resp.Body()) {
+			t.Errorf("%s: status %d, headers %s", tc.name, resp.StatusCode(), resp.Header.Header())
+		}
+	}
+
+	for _, tc := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		proxyError  bool
+	}{
+		{"success", 200, "application/json", `{"message":"ok"}`, false},
+		{"HTML", 404, "text/html", "<html></html>", false},
+		{"binary", 500, "application/octet-stream", "\x00\x01", false},
+		{"over the cap", 400, "application/json", `{"message":"` + strings.Repeat("x", 100) + `"}`, false},
+		{"proxy error", 502, "text/plain", "Upstream unreachable.", true},
+	} {
+		var resp fasthttp.Response
+		resp.SetStatusCode(tc.status)
+		resp.Header.SetContentType(tc.contentType)
+		resp.SetBodyString(tc.body)
+		if tc.proxyError {
+			resp.Header.Set("X-Proxy-Error", "upstream_error")
+		}
+		cfg.NormalizeErrorsMaxBytes = 64
+		normalizeError(cfg, &resp)
+		if string(resp.Body()) != tc.body {
+			t.Errorf("%s: rewritten to %s", tc.name, resp.Body())
+		}
+	}
+
+	var resp fasthttp.Response
+	resp.SetStatusCode(400)
+	resp.Header.SetContentType("application/json")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.SetBody(fasthttp.AppendGzipBytes(nil, []byte(`{"message":"Bad"}`)))
+	normalizeError(cfg, &resp)
+	if len(resp.Header.Peek("Content-Encoding")) > 0 || !strings.Contains(string(resp.Body()), `"message":"Bad"`) {
+		t.Errorf("gzipped: %s with Content-Encoding %q", resp.Body(), resp.Header.Peek("Content-Encoding"))
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	refused := func() error {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		_, err = fasthttp.DialTimeout(addr, time.Second)
+		return err
+	}
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", errno)}
+	}
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{fasthttp.ErrTimeout, "timeout"},
+		{fmt.Errorf("attempt 2: %w", fasthttp.ErrTimeout), "timeout"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{fasthttp.ErrDialTimeout, "connect_timeout"},
+		{refused(), "connection_refused"},
+		{opErr(syscall.ECONNREFUSED), "connection_refused"},
+		{opErr(syscall.ECONNRESET), "connection_reset"},
+		{io.EOF, "connection_reset"},
+		{fasthttp.ErrConnectionClosed, "connection_reset"},
+		{x509.UnknownAuthorityError{}, "tls"},
+		{fasthttp.ErrTLSHandshakeTimeout, "tls"},
+		{errors.New("remote error: tls: handshake failure"), "tls"},
+		{newDNSLookupError("games.roblox.com", &net.DNSError{Err: "no such host", IsNotFound: true}), "dns"},
+		{&outboundProxyError{proxy: "http://proxy:3128", err: opErr(syscall.ECONNREFUSED)}, "proxy"},
+		{fasthttp.ErrNoFreeConns, "no_free_conns"},
+		{errors.New("something else"), "other"},
+	} {
+		if got := classifyError(tc.err); got != tc.want {
+			t.Errorf("classifyError(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestUpstreamErrorReasons(t *testing.T) {
+	cfg := testConfig()
+	cfg.Retries = 2
+	s := newTestServerDirect(t, cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 500 || string(resp.Header.Peek("X-Proxy-Error")) != "upstream_unreachable" {
+		t.Errorf("status %d %q", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+	metrics := string(serveHandler(t, s, (*Server).metricsHandler, "GET /metrics HTTP/1.1\r\nHost: proxy\r\n\r\n").Body())
+	if !strings.Contains(metrics, `roproxy_upstream_errors_total{reason="connection_refused"} 2`) {
+		t.Errorf("metrics: %s", metrics)
+	}
+}
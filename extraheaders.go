@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// headerPair is one EXTRA_UPSTREAM_HEADERS entry.
+type headerPair struct {
+	name   string
+	value  string // empty removes the header, in an override
+	secret bool   // from EXTRA_UPSTREAM_SECRET_HEADERS
+}
+
+// envRef is a ${NAME} reference in an extra header value.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// parseHeaderList reads "Name: value; Name: value", filling in ${NAME}
+// references from the environment. An unset variable is an error, so a
+// header is never sent with a hole in it. Errors don't quote values, which
+// may be secret.
+func parseHeaderList(list string, secret bool) ([]headerPair, error) {
+	var out []headerPair
+	for i, entry := range strings.Split(list, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, ok := cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("entry %d is not Name: value", i+1)
+		}
+		if lower := strings.ToLower(name); lower == "host" || lower == "content-length" || isHopByHop(lower) {
+			return nil, fmt.Errorf("%s can't be set", name)
+		}
+		var missing []string
+		value = envRef.ReplaceAllStringFunc(strings.TrimSpace(value), func(ref string) string {
+			v, ok := os.LookupEnv(ref[2 : len(ref)-1])
+			if !ok {
+				missing = append(missing, ref)
+			}
+			return v
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("%s: %s not set", name, strings.Join(missing, ", "))
+		}
+		out = append(out, headerPair{name: name, value: value, secret: secret})
+	}
+	return out, nil
+}
+
+// compileExtraHeaders prepares EXTRA_UPSTREAM_HEADERS, the secret ones and
+// the per-subdomain overrides.
+func (c *Config) compileExtraHeaders() error {
+	plain, err := parseHeaderList(c.ExtraUpstreamHeaders, false)
+	if err != nil {
+		return fmt.Errorf("extra_upstream_headers: %v", err)
+	}
+	secret, err := parseHeaderList(c.ExtraUpstreamSecretHeaders, true)
+	if err != nil {
+		return fmt.Errorf("extra_upstream_secret_headers: %v", err)
+	}
+	c.extraHeaders = append(plain, secret...)
+	c.secretHeaders = map[string]bool{}
+	for _, h := range secret {
+		c.secretHeaders[strings.ToLower(h.name)] = true
+	}
+	c.extraHeaderOverrides = map[string][]headerPair{}
+	for sub, list := range c.ExtraUpstreamHeaderOverrides {
+		headers, err := parseHeaderList(list, false)
+		if err != nil {
+			return fmt.Errorf("extra_upstream_header_overrides: %s: %v", sub, err)
+		}
+		c.extraHeaderOverrides[sub] = headers
+	}
+	return nil
+}
+
+// extraHeadersHook sets EXTRA_UPSTREAM_HEADERS on the upstream request,
+// replacing any the client sent, and then the overrides for its subdomain,
+// or the default ones. An override with an empty value removes the header.
+func extraHeadersHook(cfg *Config, ctx *fasthttp.RequestCtx, req *fasthttp.Request) error {
+	for _, h := range cfg.extraHeaders {
+		req.Header.Set(h.name, h.value)
+	}
+	overrides, ok := cfg.extraHeaderOverrides[strings.ToLower(splitRequestURI(ctx)[0])]
+	if !ok {
+		overrides = cfg.extraHeaderOverrides["default"]
+	}
+	for _, h := range overrides {
+		if h.value == "" {
+			req.Header.Del(h.name)
+		} else {
+			req.Header.Set(h.name, h.value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestExtraUpstreamHeaders(t *testing.T) {
+	t.Setenv("ROPROXY_TEST_CONTACT", "ops@example.com")
+	t.Setenv("ROPROXY_TEST_TOKEN", "t0ken-value")
+	seen := map[string]string{}
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		for _, h := range []string{"X-Contact", "X-Correlation", "X-Token"} {
+			seen[h] = string(ctx.Request.Header.Peek(h))
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.ExtraUpstreamHeaders = "X-Contact: ${ROPROXY_TEST_CONTACT}; X-Correlation: roproxy-eu"
+	cfg.ExtraUpstreamSecretHeaders = "X-Token: Bearer ${ROPROXY_TEST_TOKEN}"
+	cfg.ExtraUpstreamHeaderOverrides = SubdomainStrings{"games": "X-Correlation: roproxy-games", "apis": "X-Contact:"}
+	cfg.DryRunEnabled = true
+	s := newTestServer(t, cfg, upstream)
+	get := func(uri, headers string) map[string]string {
+		t.Helper()
+		for k := range seen {
+			delete(seen, k)
+		}
+		if resp := serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\n"+headers+"\r\n"); resp.StatusCode() != 200 {
+			t.Fatalf("%s: status %d", uri, resp.StatusCode())
+		}
+		return seen
+	}
+
+	// the configured value wins over the client's
+	got := get("/users/v1/users/1", "X-Correlation: spoofed\r\nX-Token: mine\r\n")
+	if got["X-Contact"] != "ops@example.com" || got["X-Correlation"] != "roproxy-eu" || got["X-Token"] != "Bearer t0ken-value" {
+		t.Errorf("users: upstream got %v", got)
+	}
+	if got := get("/games/v1/games", ""); got["X-Correlation"] != "roproxy-games" || got["X-Contact"] != "ops@example.com" {
+		t.Errorf("games override: upstream got %v", got)
+	}
+	if got := get("/apis/v1/x", ""); got["X-Contact"] != "" || got["X-Correlation"] != "roproxy-eu" {
+		t.Errorf("apis override: upstream got %v", got)
+	}
+
+	// shown in dry runs, the secret one masked
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\nX-Proxy-Dry-Run: true\r\n\r\n")
+	var d dryRunRequest
+	if err := json.Unmarshal(resp.Body(), &d); err != nil {
+		t.Fatalf("dry run: %v %s", err, resp.Body())
+	}
+	if strings.Join(d.Headers["X-Contact"], ",") != "ops@example.com" || strings.Join(d.Headers["X-Token"], ",") != "REDACTED" {
+		t.Errorf("dry run headers: %v", d.Headers)
+	}
+
+	// and in the config dump
+	dump := cfg.dump()
+	settings, err := cfg.effective()
+	if err != nil {
+		t.Fatal(err)
+	}
+	effective, _ := json.Marshal(settings)
+	for _, out := range []string{dump, string(effective)} {
+		if !strings.Contains(out, "${ROPROXY_TEST_CONTACT}") || strings.Contains(out, "t0ken-value") || strings.Contains(out, "ROPROXY_TEST_TOKEN") {
+			t.Errorf("config dump: %s", out)
+		}
+	}
+}
+
+func TestExtraUpstreamHeadersInvalid(t *testing.T) {
+	for _, tc := range []struct{ plain, secret string }{
+		{plain: "X-Missing: ${ROPROXY_TEST_UNSET_VARIABLE}"},
+		{plain: "no colon"},
+		{plain: "Bad Name: x"},
+		{plain: "Host: example.com"},
+		{plain: "Connection: close"},
+		{secret: "sup3rsecret"},
+	} {
+		cfg := testConfig()
+		cfg.ExtraUpstreamHeaders, cfg.ExtraUpstreamSecretHeaders = tc.plain, tc.secret
+		err := cfg.compile()
+		if err == nil {
+			t.Errorf("%+v accepted", tc)
+		} else if strings.Contains(err.Error(), "sup3rsecret") {
+			t.Errorf("error shows the secret: %v", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fieldsParam is the reserved query parameter that asks for a JSON response
+// to be cut down to some of its fields: _fields=data.id,data.name. It is
+// never sent upstream.
+var fieldsParam = reserveQuery("_fields", "Comma-separated dotted JSON paths, e.g. data.id,data.name; the JSON response is cut down to them.")
+
+// fieldTree is a set of field paths by their first segment. A nil subtree
+// keeps the whole value.
+type fieldTree map[string]fieldTree
+
+// parseFields builds the tree of comma-separated dotted paths. Paths with
+// empty segments are ignored; nil is returned when none are left.
+func parseFields(list string) fieldTree {
+	var t fieldTree
+	for _, p := range strings.Split(list, ",") {
+		segs := strings.Split(strings.TrimSpace(p), ".")
+		valid := true
+		for _, seg := range segs {
+			valid = valid && seg != ""
+		}
+		if !valid {
+			continue
+		}
+		if t == nil {
+			t = fieldTree{}
+		}
+		t.add(segs)
+	}
+	return t
+}
+
+func (t fieldTree) add(segs []string) {
+	sub, seen := t[segs[0]]
+	switch {
+	case len(segs) == 1:
+		t[segs[0]] = nil
+	case seen && sub == nil:
+		// the whole value is already kept
+	default:
+		if sub == nil {
+			sub = fieldTree{}
+			t[segs[0]] = sub
+		}
+		sub.add(segs[1:])
+	}
+}
+
+// project returns raw with only the fields in t. Arrays are projected
+// element by element, keeping elements that aren't objects or arrays as
+// they are. nil is returned for a scalar, which no path can go into;
+// fields whose paths lead into one are dropped. Values that are kept are
+// copied as they were sent.
+func (t fieldTree) project(raw json.RawMessage) json.RawMessage {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil
+	}
+	switch raw[0] {
+	case '{':
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil {
+			return nil
+		}
+		out := make(map[string]json.RawMessage, len(t))
+		for k, sub := range t {
+			v, ok := obj[k]
+			switch {
+			case !ok:
+			case sub == nil:
+				out[k] = v
+			default:
+				if p := sub.project(v); p != nil {
+					out[k] = p
+				}
+			}
+		}
+		b, _ := json.Marshal(out)
+		return b
+	case '[':
+		var arr []json.RawMessage
+		if json.Unmarshal(raw, &arr) != nil {
+			return nil
+		}
+		for i, v := range arr {
+			if p := t.project(v); p != nil {
+				arr[i] = p
+			}
+		}
+		b, _ := json.Marshal(arr)
+		return b
+	}
+	return nil
+}
+
+// requestFields strips _fields from the request and returns the fields it
+// asked for, or nil.
+func requestFields(ctx *fasthttp.RequestCtx) fieldTree {
+	v, ok := queryParam(ctx, fieldsParam)
+	if !ok {
+		return nil
+	}
+	setQueryParam(ctx, fieldsParam, nil)
+	return parseFields(v)
+}
+
+// filterFields cuts a successful JSON response of up to FIELDS_MAX_BYTES
+// down to the fields in t and marks it with X-Proxy-Filtered. Anything
+// else is left alone.
+func filterFields(cfg *Config, resp *fasthttp.Response, t fieldTree) {
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 || !isJSONContentType(resp.Header.ContentType()) ||
+		len(resp.Header.Peek("Content-Encoding")) > 0 || int64(len(resp.Body())) > cfg.FieldsMaxBytes {
+		return
+	}
+	body := t.project(resp.Body())
+	if body == nil {
+		return
+	}
+	resp.SetBody(body)
+	resp.Header.SetContentLength(len(body))
+	resp.Header.Set("X-Proxy-Filtered", "true")
+}
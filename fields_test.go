@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestFieldProjection(t *testing.T) {
+	const catalog = `{
+		"previousPageCursor": null,
+		"nextPageCursor": "abc",
+		"data": [
+			{"id": 9007199254740993, "name": "Hat", "price": 100, "creator": {"id": 1, "name": "Roblox", "verified": true}},
+			{"id": 2, "name": "Face", "creator": {"id": 1, "name": "Roblox"}},
+			{"id": 3, "name": "Gear", "price": 5, "creator": null},
+			"oddity"
+		],
+		"meta": {"tags": [[{"k": "a", "v": 1}], [{"k": "b"}]], "count": 3}
+	}`
+	for _, tc := range []struct {
+		fields string
+		want   string
+	}{
+		{"data.id,data.name", `{"data":[{"id":9007199254740993,"name":"Hat"},{"id":2,"name":"Face"},{"id":3,"name":"Gear"},"oddity"]}`},
+		// missing keys are left out of each element
+		{"data.price", `{"data":[{"price":100},{},{"price":5},"oddity"]}`},
+		{"data.creator.name", `{"data":[{"creator":{"name":"Roblox"}},{"creator":{"name":"Roblox"}},{},"oddity"]}`},
+		// arrays nested in arrays
+		{"meta.tags.k", `{"meta":{"tags":[[{"k":"a"}],[{"k":"b"}]]}}`},
+		// a whole value wins over paths into it, whichever comes first
+		{"meta,meta.count", `{"meta":{"tags":[[{"k":"a","v":1}],[{"k":"b"}]],"count":3}}`},
+		{"meta.count,meta", `{"meta":{"tags":[[{"k":"a","v":1}],[{"k":"b"}]],"count":3}}`},
+		// paths into scalars or nothing are ignored
+		{"nextPageCursor.x,nope,nope.deeper,data.id.x", `{"data":[{},{},{},"oddity"]}`},
+		{"nextPageCursor, previousPageCursor", `{"nextPageCursor":"abc","previousPageCursor":null}`},
+	} {
+		tree := parseFields(tc.fields)
+		got := tree.project(json.RawMessage(catalog))
+		if compactJSON(t, string(got)) != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.fields, got, tc.want)
+		}
+	}
+
+	if tree := parseFields(" ,a..b,.c,d."); tree != nil {
+		t.Errorf("only invalid paths gave %v, want nil", tree)
+	}
+	if got := parseFields("id").project(json.RawMessage(`[{"id":1,"x":2},{"id":3}]`)); string(got) != `[{"id":1},{"id":3}]` {
+		t.Errorf("top-level array: %s", got)
+	}
+	if got := parseFields("id").project(json.RawMessage(`"just a string"`)); got != nil {
+		t.Errorf("scalar document: %s, want nil", got)
+	}
+}
+
+func compactJSON(t *testing.T, s string) string {
+	t.Helper()
+	var v json.RawMessage
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("%v in %s", err, s)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestFieldsParam(t *testing.T) {
+	var sawURI, sawEncoding string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		sawURI = string(ctx.RequestURI())
+		sawEncoding = string(ctx.Request.Header.Peek("Accept-Encoding"))
+		if string(ctx.Path()) == "/text" {
+			ctx.SetContentType("text/plain")
+			ctx.SetBodyString(`{"data":[{"id":1,"name":"x"}]}`)
+			return
+		}
+		ctx.SetContentType("application/json; charset=utf-8")
+		ctx.SetBodyString(`{"data":[{"id":1,"name":"Hat","description":"` + strings.Repeat("long ", 50) + `"}],"nextPageCursor":null}`)
+	}
+	cfg := testConfig()
+	s := newTestServer(t, cfg, upstream)
+	get := func(uri string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\nAccept-Encoding: gzip\r\n\r\n")
+	}
+
+	resp := get("/catalog/v1/search/items?keyword=hat&_fields=data.id,data.name")
+	if string(resp.Body()) != `{"data":[{"id":1,"name":"Hat"}]}` || string(resp.Header.Peek("X-Proxy-Filtered")) != "true" {
+		t.Errorf("filtered: %q, X-Proxy-Filtered %q", resp.Body(), resp.Header.Peek("X-Proxy-Filtered"))
+	}
+	if cl := resp.Header.ContentLength(); cl != len(resp.Body()) {
+		t.Errorf("Content-Length %d, body %d bytes", cl, len(resp.Body()))
+	}
+	if sawURI != "/v1/search/items?keyword=hat" || sawEncoding != "" {
+		t.Errorf("upstream got %s with Accept-Encoding %q", sawURI, sawEncoding)
+	}
+
+	for _, uri := range []string{
+		"/catalog/text?_fields=data.id",
+		"/catalog/v1/search/items?_fields=..",
+	} {
+		resp := get(uri)
+		if len(resp.Header.Peek("X-Proxy-Filtered")) > 0 || !strings.Contains(string(resp.Body()), `"name"`) {
+			t.Errorf("%s: filtered to %q", uri, resp.Body())
+		}
+	}
+
+	cfg.FieldsMaxBytes = 100
+	resp = get("/catalog/v1/search/items?_fields=data.id")
+	if len(resp.Header.Peek("X-Proxy-Filtered")) > 0 || !strings.Contains(string(resp.Body()), "description") {
+		t.Errorf("over fields_max_bytes: filtered to %q", resp.Body())
+	}
+	if cl := resp.Header.ContentLength(); cl != len(resp.Body()) {
+		t.Errorf("unfiltered Content-Length %d, body %d bytes", cl, len(resp.Body()))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// firstByteConn enforces FIRST_BYTE_TIMEOUT: once something has been
+// written, the reply has to start arriving within timeout. After the first
+// byte only the deadline set by the client applies, so a slow body is
+// allowed as long as it keeps coming within the read timeout.
+type firstByteConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu        sync.Mutex
+	deadline  time.Time // read deadline set by the client
+	firstByte time.Time // zero unless waiting for a reply
+}
+
+func newFirstByteConn(c net.Conn, timeout time.Duration) *firstByteConn {
+	return &firstByteConn{Conn: c, timeout: timeout}
+}
+
+// readDeadline is the earlier of the client's deadline and the first-byte
+// deadline. c.mu must be held.
+func (c *firstByteConn) readDeadline() time.Time {
+	if c.firstByte.IsZero() || (!c.deadline.IsZero() && c.deadline.Before(c.firstByte)) {
+		return c.deadline
+	}
+	return c.firstByte
+}
+
+func (c *firstByteConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.mu.Lock()
+		if c.firstByte.IsZero() {
+			c.firstByte = time.Now().Add(c.timeout)
+			c.Conn.SetReadDeadline(c.readDeadline())
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.firstByte.IsZero() {
+			c.firstByte = time.Time{}
+			c.Conn.SetReadDeadline(c.deadline)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *firstByteConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(c.readDeadline())
+}
+
+func (c *firstByteConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
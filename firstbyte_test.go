@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestFirstByteTimeout(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/stall":
+			// nothing is sent until well past the first-byte timeout
+			time.Sleep(2 * time.Second)
+			okUpstream(ctx)
+		case "/slow-body":
+			// headers at once, then a body that takes longer than the
+			// first-byte timeout to finish
+			ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+				for i := 0; i < 5; i++ {
+					w.WriteString("chunk")
+					w.Flush()
+					time.Sleep(80 * time.Millisecond)
+				}
+			})
+		}
+	}
+	cfg := testConfig()
+	cfg.FirstByteTimeout = Duration(150 * time.Millisecond)
+	ln := newTestUpstream(t, upstream)
+	s := newTestServerDirect(t, cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) {
+		c, err := ln.Dial()
+		if err != nil {
+			return nil, err
+		}
+		return newFirstByteConn(c, cfg.FirstByteTimeout.D()), nil
+	}
+
+	start := time.Now()
+	resp := serveRaw(t, s, "POST /users/stall HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if d := time.Since(start); resp.StatusCode() == 200 || d > time.Second {
+		t.Errorf("stalled upstream: status %d after %v, want a failure within the first-byte timeout", resp.StatusCode(), d)
+	}
+
+	start = time.Now()
+	resp = serveRaw(t, s, "POST /users/slow-body HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 || string(resp.Body()) != "chunkchunkchunkchunkchunk" {
+		t.Errorf("slow body: %d %q, want the whole body", resp.StatusCode(), resp.Body())
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("slow body took %v, want it slower than the first-byte timeout", d)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// forwardClientIPHook applies FORWARD_CLIENT_IP to the upstream request's
+// X-Forwarded-For, X-Real-IP and Forwarded headers, which are otherwise
+// copied from the client like any other:
+//
+//   - strip removes them, so upstream learns nothing about the client;
+//   - append adds the connection's remote address to the client's
+//     X-Forwarded-For and Forwarded chains, as any proxy on the way would;
+//   - set replaces them with the client's address alone, as clientIP sees
+//     it, so whatever chain the client sent never reaches upstream.
+//
+// X-Real-IP has no chain to extend: it's only sent by set.
+func forwardClientIPHook(cfg *Config, ctx *fasthttp.RequestCtx, req *fasthttp.Request) error {
+	xff := string(ctx.Request.Header.Peek("X-Forwarded-For"))
+	fwd := string(ctx.Request.Header.Peek("Forwarded"))
+	for _, h := range []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"} {
+		req.Header.Del(h)
+	}
+	var ip string
+	switch cfg.ForwardClientIP {
+	case "append":
+		ip = ctx.RemoteIP().String()
+		if xff != "" {
+			xff += ", "
+		}
+		req.Header.Set("X-Forwarded-For", xff+ip)
+	case "set":
+		ip, fwd = clientIP(cfg, ctx), ""
+		req.Header.Set("X-Forwarded-For", ip)
+		req.Header.Set("X-Real-IP", ip)
+	default:
+		return nil
+	}
+	proto := "http"
+	if ctx.IsTLS() {
+		proto = "https"
+	}
+	element := "for=" + forwardedNode(ip) + ";host=" + forwardedValue(string(ctx.Host())) + ";proto=" + proto
+	if fwd != "" {
+		element = fwd + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+	return nil
+}
+
+// forwardedNode is ip as an RFC 7239 node: IPv6 addresses are bracketed
+// and quoted.
+func forwardedNode(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue is v as an RFC 7239 value: a token as it is, anything
+// else quoted.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// isTokenChar reports whether c may appear in an HTTP token (RFC 7230).
+func isTokenChar(c rune) bool {
+	return c < 0x7f && c > ' ' && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+}
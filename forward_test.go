@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestForwardClientIP(t *testing.T) {
+	// a client claiming to be someone else, over a connection from
+	// 0.0.0.0, fasthttp's remote address for the test pipe
+	const spoofed = "X-Forwarded-For: 203.0.113.9, 198.51.100.1\r\nX-Real-IP: 203.0.113.9\r\nForwarded: for=203.0.113.9\r\n"
+	for _, tc := range []struct {
+		mode, trust            string
+		xff, realIP, forwarded string
+	}{
+		{mode: "strip"},
+		{mode: "append", xff: "203.0.113.9, 198.51.100.1, 0.0.0.0", forwarded: "for=203.0.113.9, for=0.0.0.0;host=proxy;proto=http"},
+		{mode: "set", xff: "0.0.0.0", realIP: "0.0.0.0", forwarded: "for=0.0.0.0;host=proxy;proto=http"},
+		// behind a trusted load balancer, set names the client it reports
+		{mode: "set", trust: "X-Forwarded-For", xff: "198.51.100.1", realIP: "198.51.100.1", forwarded: "for=198.51.100.1;host=proxy;proto=http"},
+	} {
+		var got [3]string
+		upstream := func(ctx *fasthttp.RequestCtx) {
+			for i, h := range []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"} {
+				got[i] = string(ctx.Request.Header.Peek(h))
+			}
+			okUpstream(ctx)
+		}
+		cfg := testConfig()
+		cfg.ForwardClientIP = tc.mode
+		cfg.TrustProxyHeader = tc.trust
+		cfg.DryRunEnabled = true
+		s := newTestServer(t, cfg, upstream)
+		serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"+spoofed+"\r\n")
+		if want := [3]string{tc.xff, tc.realIP, tc.forwarded}; got != want {
+			t.Errorf("%s (trusting %q): upstream got %q, want %q", tc.mode, tc.trust, got, want)
+		}
+
+		resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\nX-Proxy-Dry-Run: true\r\n"+spoofed+"\r\n")
+		var d dryRunRequest
+		if err := json.Unmarshal(resp.Body(), &d); err != nil {
+			t.Fatal(err)
+		}
+		if d.ForwardClientIP != tc.mode || strings.Join(d.Headers["X-Forwarded-For"], ",") != tc.xff {
+			t.Errorf("%s: dry run %q, X-Forwarded-For %q", tc.mode, d.ForwardClientIP, d.Headers["X-Forwarded-For"])
+		}
+	}
+
+	cfg := testConfig()
+	cfg.ForwardClientIP = "keep"
+	if err := cfg.validate(); err == nil {
+		t.Error("forward_client_ip keep accepted")
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	for in, want := range map[string]string{
+		"192.0.2.1":   "192.0.2.1",
+		"2001:db8::1": `"[2001:db8::1]"`,
+		"proxy":       "proxy",
+		"proxy:8080":  `"proxy:8080"`,
+		`we"ird`:      `"we\"ird"`,
+	} {
+		if got := forwardedNode(in); got != want {
+			t.Errorf("forwardedNode(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
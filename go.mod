@@ -2,11 +2,17 @@ module roproxy
 
 go 1.17
 
+require (
+	github.com/valyala/fasthttp v1.33.0
+	golang.org/x/net v0.0.0-20220111093109-d55c255bac03
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/klauspost/compress v1.14.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.33.0 // indirect
-	golang.org/x/net v0.0.0-20220111093109-d55c255bac03 // indirect
+	github.com/valyala/tcplisten v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20220111092808-5a964db01320 // indirect
 	golang.org/x/text v0.3.7 // indirect
-)
\ No newline at end of file
+)
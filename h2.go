@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+// h2Client sends upstream requests over HTTP/2 (UPSTREAM_HTTP2). It sits
+// behind the same fasthttp.Request/Response types as the fasthttp client,
+// so retries, header rewriting and the cache don't know which one was used.
+type h2Client struct {
+	client *fasthttp.Client
+	t      *http2.Transport
+}
+
+// newH2Client returns an HTTP/2 client that dials with client.Dial and
+// client.TLSConfig, and applies its response size limits.
+func newH2Client(client *fasthttp.Client) *h2Client {
+	c := &h2Client{client: client}
+	c.t = &http2.Transport{
+		DialTLS: c.dialTLS,
+		// bodies are passed through still encoded, as with fasthttp
+		DisableCompression: true,
+		MaxHeaderListSize:  uint32(client.ReadBufferSize),
+		ReadIdleTimeout:    client.MaxIdleConnDuration,
+	}
+	return c
+}
+
+func (c *h2Client) dialTLS(network, addr string, _ *tls.Config) (net.Conn, error) {
+	conn, err := c.client.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if c.client.TLSConfig != nil {
+		cfg = c.client.TLSConfig.Clone()
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p := tc.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		tc.Close()
+		return nil, errors.New("upstream " + addr + " did not negotiate HTTP/2")
+	}
+	return tc, nil
+}
+
+// do sends req and fills resp, like fasthttp.Client.DoDeadline. A zero
+// deadline means the client's ReadTimeout. The response body is read in
+// full before do returns; ErrBodyTooLarge is returned past the client's
+// MaxResponseBodySize.
+func (c *h2Client) do(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	if deadline.IsZero() {
+		deadline = time.Now().Add(c.client.ReadTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	hreq, err := toHTTPRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	hresp, err := c.t.RoundTrip(hreq)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+	defer hresp.Body.Close()
+	if err := fromHTTPResponse(hresp, resp, c.client.MaxResponseBodySize); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+	return nil
+}
+
+// toHTTPRequest converts req for net/http. Repeated headers are kept, and
+// a streamed body is streamed.
+func toHTTPRequest(ctx context.Context, req *fasthttp.Request) (*http.Request, error) {
+	var body io.Reader
+	var size int64
+	if req.IsBodyStream() {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(req.BodyWriteTo(pw)) }()
+		body = pr
+		size = int64(req.Header.ContentLength())
+		if size < 0 {
+			size = -1
+		}
+	} else if b := req.Body(); len(b) > 0 {
+		body = bytes.NewReader(b)
+		size = int64(len(b))
+	}
+	hreq, err := http.NewRequestWithContext(ctx, string(req.Header.Method()), req.URI().String(), body)
+	if err != nil {
+		return nil, err
+	}
+	hreq.ContentLength = size
+	hreq.Host = string(req.Header.Host())
+	req.Header.VisitAll(func(k, v []byte) {
+		switch key := strings.ToLower(string(k)); {
+		case key == "host", key == "content-length", isHopByHop(key):
+		default:
+			hreq.Header.Add(string(k), string(v))
+		}
+	})
+	return hreq, nil
+}
+
+// fromHTTPResponse copies hresp into resp. Repeated headers are kept; the
+// body is read to the end, failing with ErrBodyTooLarge once it grows past
+// maxBodySize (0 means no limit). Trailers, such as gRPC's grpc-status,
+// are added to the header once the body is read.
+func fromHTTPResponse(hresp *http.Response, resp *fasthttp.Response, maxBodySize int) error {
+	resp.Reset()
+	resp.SetStatusCode(hresp.StatusCode)
+	for k, vs := range hresp.Header {
+		if k == "Content-Length" || isHopByHop(strings.ToLower(k)) {
+			continue
+		}
+		for _, v := range vs {
+			resp.Header.Add(k, v)
+		}
+	}
+	if maxBodySize > 0 && hresp.ContentLength > int64(maxBodySize) {
+		return fasthttp.ErrBodyTooLarge
+	}
+	body := io.Reader(hresp.Body)
+	if maxBodySize > 0 {
+		body = io.LimitReader(hresp.Body, int64(maxBodySize)+1)
+	}
+	n, err := io.Copy(resp.BodyWriter(), body)
+	if err != nil {
+		return err
+	}
+	if maxBodySize > 0 && n > int64(maxBodySize) {
+		return fasthttp.ErrBodyTooLarge
+	}
+	for k, vs := range hresp.Trailer {
+		for _, v := range vs {
+			resp.Header.Add(k, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"golang.org/x/net/http2"
+)
+
+// newTestH2Upstream serves handler over HTTP/2 with TLS on an in-memory
+// listener.
+func newTestH2Upstream(t testing.TB, handler http.HandlerFunc) *fasthttputil.InmemoryListener {
+	t.Helper()
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("roblox.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{http2.NextProtoTLS}}
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { ln.Close() })
+	srv := &http2.Server{}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tc := tls.Server(c, tlsCfg)
+				if tc.Handshake() != nil {
+					tc.Close()
+					return
+				}
+				srv.ServeConn(tc, &http2.ServeConnOpts{Handler: handler})
+			}()
+		}
+	}()
+	return ln
+}
+
+// newTestH2Server returns a Server sending every request over HTTP/2 to
+// handler.
+func newTestH2Server(t testing.TB, handler http.HandlerFunc) *Server {
+	t.Helper()
+	ln := newTestH2Upstream(t, handler)
+	cfg := testConfig()
+	cfg.UpstreamHTTP2 = true
+	s := newTestServerDirect(t, cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) { return ln.Dial() }
+	return s
+}
+
+func TestHTTP2Upstream(t *testing.T) {
+	var proto string
+	ln := newTestH2Upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		io.WriteString(w, "upstream")
+	})
+	cfg := testConfig()
+	cfg.UpstreamHTTP2Subdomains = "Games"
+	s := newTestServerDirect(t, cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) { return ln.Dial() }
+
+	resp := serveRaw(t, s, "GET /games/v1/games?universeIds=1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 || string(resp.Body()) != "upstream" {
+		t.Fatalf("response = %d %q, want 200 upstream", resp.StatusCode(), resp.Body())
+	}
+	if proto != "HTTP/2.0" {
+		t.Errorf("upstream saw %q, want HTTP/2.0", proto)
+	}
+
+	// users isn't listed, so it goes through fasthttp, which can't talk to
+	// an HTTP/2-only upstream
+	if resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() == 200 {
+		t.Error("users was sent over HTTP/2")
+	}
+}
+
+func TestHTTP2Conversion(t *testing.T) {
+	s := newTestH2Server(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header()["X-Seen"] = r.Header["X-Multi"]
+		w.Header().Set("X-Body", string(body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.WriteHeader(201)
+		// flushed in pieces so the body arrives as several DATA frames
+		for _, chunk := range []string{`{"data":`, `[1,2,3]`, `}`} {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("https://games.roblox.com/v1/games")
+	req.Header.SetMethod("POST")
+	req.Header.Add("X-Multi", "one")
+	req.Header.Add("X-Multi", "two")
+	req.SetBodyStream(strings.NewReader("streamed body"), -1)
+	var resp fasthttp.Response
+	if err := s.h2.do(req, &resp, time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode() != 201 || string(resp.Body()) != `{"data":[1,2,3]}` {
+		t.Errorf("response = %d %q", resp.StatusCode(), resp.Body())
+	}
+	if got := string(resp.Header.ContentType()); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := string(resp.Header.Peek("X-Body")); got != "streamed body" {
+		t.Errorf("upstream read body %q, want the streamed body", got)
+	}
+	var seen, cookies []string
+	resp.Header.VisitAll(func(k, v []byte) {
+		switch string(k) {
+		case "X-Seen":
+			seen = append(seen, string(v))
+		case "Set-Cookie":
+			cookies = append(cookies, string(v))
+		}
+	})
+	if strings.Join(seen, ",") != "one,two" {
+		t.Errorf("upstream saw X-Multi %v, want [one two]", seen)
+	}
+	if len(cookies) != 2 {
+		t.Errorf("Set-Cookie = %v, want both cookies", cookies)
+	}
+}
+
+func TestHTTP2BodyLimit(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		s := newTestH2Server(t, func(w http.ResponseWriter, r *http.Request) {
+			if !streamed {
+				w.Header().Set("Content-Length", "100")
+			}
+			io.WriteString(w, strings.Repeat("x", 100))
+		})
+		s.client.MaxResponseBodySize = 10
+
+		req := fasthttp.AcquireRequest()
+		req.SetRequestURI("https://games.roblox.com/v1/games")
+		var resp fasthttp.Response
+		if err := s.h2.do(req, &resp, time.Now().Add(5*time.Second)); err != fasthttp.ErrBodyTooLarge {
+			t.Errorf("streamed=%v: err = %v, want ErrBodyTooLarge", streamed, err)
+		}
+		fasthttp.ReleaseRequest(req)
+	}
+}
+
+func benchmarkUpstream(b *testing.B, s *Server) {
+	var req fasthttp.Request
+	req.SetRequestURI("/games/v1/games?universeIds=1")
+	req.Header.SetHost("proxy")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var ctx fasthttp.RequestCtx
+		for pb.Next() {
+			ctx.Init(&req, nil, nil)
+			s.requestHandler(&ctx)
+			if ctx.Response.StatusCode() != 200 {
+				b.Fatalf("status %d", ctx.Response.StatusCode())
+			}
+		}
+	})
+}
+
+func BenchmarkUpstreamHTTP1(b *testing.B) {
+	benchmarkUpstream(b, newTestServer(b, testConfig(), okUpstream))
+}
+
+func BenchmarkUpstreamHTTP2(b *testing.B) {
+	benchmarkUpstream(b, newTestH2Server(b, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+}
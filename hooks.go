@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/valyala/fasthttp"
+)
+
+// requestHook changes an upstream request before it is sent. ctx is the
+// client's request. An error fails the request with a 502, without
+// retrying.
+type requestHook struct {
+	name string
+	run  func(cfg *Config, ctx *fasthttp.RequestCtx, req *fasthttp.Request) error
+}
+
+// responseHook changes an upstream response before the proxy works on it.
+// An error fails the request with a 502.
+type responseHook struct {
+	name string
+	run  func(cfg *Config, ctx *fasthttp.RequestCtx, resp *fasthttp.Response) error
+}
+
+// requestHooks run in order on every upstream request, mirrored copies
+// included, after the client's headers and body are copied. Features add
+// theirs with registerRequestHook from an init function.
+var requestHooks = []requestHook{
+	{"upstream_headers", upstreamHeadersHook},
+	{"forward_client_ip", forwardClientIPHook},
+	{"extra_headers", extraHeadersHook},
+	{"body_replace", bodyReplaceHook},
+}
+
+// responseHooks run in order on every upstream response makeRequest
+// returns, replayed ones included, but not on the proxy's own errors or
+// dry runs.
+var responseHooks []responseHook
+
+func registerRequestHook(name string, run func(*Config, *fasthttp.RequestCtx, *fasthttp.Request) error) {
+	requestHooks = append(requestHooks, requestHook{name, run})
+}
+
+func registerResponseHook(name string, run func(*Config, *fasthttp.RequestCtx, *fasthttp.Response) error) {
+	responseHooks = append(responseHooks, responseHook{name, run})
+}
+
+// runRequestHooks runs the request hooks on req, stopping at the first
+// that fails.
+func runRequestHooks(cfg *Config, ctx *fasthttp.RequestCtx, req *fasthttp.Request) error {
+	for _, h := range requestHooks {
+		if err := h.run(cfg, ctx, req); err != nil {
+			return fmt.Errorf("request hook %s: %v", h.name, err)
+		}
+	}
+	return nil
+}
+
+// runResponseHooks runs the response hooks on resp, stopping at the first
+// that fails.
+func runResponseHooks(cfg *Config, ctx *fasthttp.RequestCtx, resp *fasthttp.Response) error {
+	for _, h := range responseHooks {
+		if err := h.run(cfg, ctx, resp); err != nil {
+			return fmt.Errorf("response hook %s: %v", h.name, err)
+		}
+	}
+	return nil
+}
+
+// hookFailed logs a hook's error and answers for upstream with a 502.
+func hookFailed(ctx *fasthttp.RequestCtx, err error) *fasthttp.Response {
+	log.Printf("WARN %s %s: %v", ctx.Method(), ctx.Path(), err)
+	return errorResponse(502, "hook_failed", "A proxy hook failed.")
+}
+
+// upstreamHeadersHook sets the headers the proxy owns: the User-Agent by
+// USER_AGENT_MODE, and no Roblox-Id, which might interfere.
+func upstreamHeadersHook(cfg *Config, ctx *fasthttp.RequestCtx, req *fasthttp.Request) error {
+	req.Header.Set("User-Agent", cfg.userAgent(string(ctx.Request.Header.UserAgent())))
+	req.Header.Del("Roblox-Id")
+	return nil
+}
+
+// bodyReplaceHook applies BODY_REPLACE_FROM/BODY_REPLACE_TO to a buffered
+// body. A streamed one is passed on as sent.
+func bodyReplaceHook(cfg *Config, ctx *fasthttp.RequestCtx, req *fasthttp.Request) error {
+	if !req.IsBodyStream() && cfg.bodyReplace != nil {
+		req.SetBody(rewriteRequestBody(cfg, req.Header.ContentType(), req.Body()))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestHooks(t *testing.T) {
+	savedReq, savedResp := requestHooks, responseHooks
+	defer func() { requestHooks, responseHooks = savedReq, savedResp }()
+
+	var calls int32
+	var sawHeader, sawUA string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		sawHeader = string(ctx.Request.Header.Peek("X-Test-Hook"))
+		sawUA = string(ctx.Request.Header.UserAgent())
+		okUpstream(ctx)
+	}
+	registerRequestHook("test", func(cfg *Config, ctx *fasthttp.RequestCtx, req *fasthttp.Request) error {
+		if string(ctx.Request.Header.Peek("X-Fail")) != "" {
+			return errors.New("refused")
+		}
+		req.Header.Set("X-Test-Hook", string(req.Header.UserAgent()))
+		return nil
+	})
+	registerResponseHook("test", func(cfg *Config, ctx *fasthttp.RequestCtx, resp *fasthttp.Response) error {
+		resp.Header.Set("X-Test-Response-Hook", "ran")
+		return nil
+	})
+	cfg := testConfig()
+	cfg.UserAgent = "HookTest/1"
+	s := newTestServer(t, cfg, upstream)
+
+	// the hook runs after the built-in ones, so it sees USER_AGENT
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 || sawHeader != sawUA || sawUA == "" {
+		t.Errorf("request hook: %d, upstream got X-Test-Hook %q, User-Agent %q", resp.StatusCode(), sawHeader, sawUA)
+	}
+	if got := string(resp.Header.Peek("X-Test-Response-Hook")); got != "ran" {
+		t.Errorf("response hook: X-Test-Response-Hook %q", got)
+	}
+
+	resp = serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\nX-Fail: 1\r\n\r\n")
+	if resp.StatusCode() != 502 || string(resp.Header.Peek("X-Proxy-Error")) != "hook_failed" {
+		t.Errorf("failing hook: %d %q", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+}
+
+func TestBodyReplaceHook(t *testing.T) {
+	cfg := testConfig()
+	cfg.BodyReplaceFrom = `"token":"PLACEHOLDER"`
+	cfg.BodyReplaceTo = `"token":"real-value"`
+	cfg.BodyReplaceMaxBytes = 64
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, contentType, body, want string
+	}{
+		{"json", "application/json; charset=utf-8", `{"token":"PLACEHOLDER"}`, `{"token":"real-value"}`},
+		{"text", "text/plain", `"token":"PLACEHOLDER"`, `"token":"real-value"`},
+		{"form", "application/x-www-form-urlencoded", `"token":"PLACEHOLDER"`, `"token":"PLACEHOLDER"`},
+		{"over limit", "application/json", `{"token":"PLACEHOLDER","pad":"` + strings.Repeat("x", 64) + `"}`, `{"token":"PLACEHOLDER","pad":"` + strings.Repeat("x", 64) + `"}`},
+	}
+	for _, tt := range tests {
+		var req fasthttp.Request
+		req.SetRequestURI("https://games.roblox.com/v1/test")
+		req.Header.SetMethod("POST")
+		req.Header.SetContentType(tt.contentType)
+		req.SetBodyString(tt.body)
+		if err := bodyReplaceHook(cfg, nil, &req); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := string(req.Body()); got != tt.want {
+			t.Errorf("%s: body %q, want %q", tt.name, got, tt.want)
+		}
+		// Content-Length follows the body once the request is written
+		var wire fasthttp.Request
+		if err := wire.Read(bufio.NewReader(strings.NewReader(req.String()))); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if wire.Header.ContentLength() != len(tt.want) {
+			t.Errorf("%s: Content-Length %d, want %d", tt.name, wire.Header.ContentLength(), len(tt.want))
+		}
+	}
+
+	// a streamed body isn't buffered, so it's passed on as sent
+	var req fasthttp.Request
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	body := `{"token":"PLACEHOLDER"}`
+	req.SetBodyStream(strings.NewReader(body), len(body))
+	if err := bodyReplaceHook(cfg, nil, &req); err != nil {
+		t.Fatal(err)
+	}
+	if !req.IsBodyStream() {
+		t.Fatal("streamed body was buffered")
+	}
+	if got := string(req.Body()); got != body {
+		t.Errorf("streamed body %q, want %q", got, body)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "sync"
+
+// inflightLimiter enforces SUBDOMAIN_MAX_INFLIGHT and PER_IP_MAX_INFLIGHT
+// with a counting semaphore per subdomain or client IP. Acquiring never
+// blocks: a key at its limit is refused so one slow subdomain or one busy
+// client can't hold every connection. Keys with nothing in flight are
+// dropped, so the map only holds the keys in use.
+type inflightLimiter struct {
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+func newInflightLimiter() *inflightLimiter {
+	return &inflightLimiter{inflight: map[string]int{}}
+}
+
+// acquire takes a slot for key unless limit are already taken.
+func (l *inflightLimiter) acquire(key string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight[key] >= limit {
+		return false
+	}
+	l.inflight[key]++
+	return true
+}
+
+func (l *inflightLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight[key]--; l.inflight[key] <= 0 {
+		delete(l.inflight, key)
+	}
+}
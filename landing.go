@@ -0,0 +1,53 @@
+package main
+
+import (
+	"html"
+
+	"github.com/valyala/fasthttp"
+)
+
+// proxyVersion is reported on the landing page and in the default
+// User-Agent.
+const proxyVersion = "1.0"
+
+// isSitePath reports whether path is one browsers and crawlers ask every
+// site for. They're answered before authentication and, like the internal
+// endpoints, aren't logged or counted in the recent requests, so they don't
+// show up as failed proxy requests.
+func isSitePath(path string) bool {
+	switch path {
+	case "/", "/favicon.ico", "/robots.txt":
+		return true
+	}
+	return false
+}
+
+// siteHandler answers the isSitePath paths: no favicon, a robots.txt that
+// keeps crawlers out, and a landing page at / saying what the proxy is and
+// how to use it, unless LANDING_PAGE is off. The page is JSON when the
+// client prefers it, HTML otherwise.
+func siteHandler(cfg *Config, ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Path()) {
+	case "/favicon.ico":
+		ctx.SetStatusCode(204)
+	case "/robots.txt":
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.SetBodyString("User-agent: *\nDisallow: /\n")
+	case "/":
+		if !cfg.LandingPage {
+			proxyError(ctx, 404, "not_found", "Not found.")
+			return
+		}
+		usage := "Send requests to /{subdomain}/{path} to reach https://{subdomain}." + cfg.TargetDomain + "/{path}, e.g. /users/v1/users/1."
+		if cfg.Key != "" {
+			usage += " Requests need the PROXYKEY header."
+		}
+		if negotiateErrorFormat(string(ctx.Request.Header.Peek("Accept"))) == "json" {
+			writeJSON(ctx, 200, map[string]string{"name": "RoProxy", "version": proxyVersion, "usage": usage})
+			return
+		}
+		ctx.SetContentType("text/html; charset=utf-8")
+		ctx.SetBodyString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>RoProxy</title></head>\n" +
+			"<body><h1>RoProxy " + proxyVersion + "</h1><p>" + html.EscapeString(usage) + "</p></body></html>\n")
+	}
+}
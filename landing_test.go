@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSitePaths(t *testing.T) {
+	for _, key := range []string{"", "secret"} {
+		cfg := testConfig()
+		cfg.Key = key
+		s := newTestServer(t, cfg, okUpstream)
+		get := func(path, accept string) (int, string, string) {
+			t.Helper()
+			resp := serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\nAccept: "+accept+"\r\n\r\n")
+			return resp.StatusCode(), string(resp.Header.ContentType()), string(resp.Body())
+		}
+
+		// none of them needs PROXYKEY
+		if status, _, body := get("/favicon.ico", "*/*"); status != 204 || body != "" {
+			t.Errorf("key %q: favicon: %d %q", key, status, body)
+		}
+		if status, _, body := get("/robots.txt", "*/*"); status != 200 || body != "User-agent: *\nDisallow: /\n" {
+			t.Errorf("key %q: robots.txt: %d %q", key, status, body)
+		}
+		status, ct, body := get("/", "text/html")
+		if status != 200 || !strings.HasPrefix(ct, "text/html") || !strings.Contains(body, "RoProxy "+proxyVersion) ||
+			!strings.Contains(body, "/users/v1/users/1") {
+			t.Errorf("key %q: landing page: %d %s %q", key, status, ct, body)
+		}
+		if strings.Contains(body, "PROXYKEY") != (key != "") || (key != "" && strings.Contains(body, key)) {
+			t.Errorf("key %q: landing page: %q", key, body)
+		}
+		status, _, body = get("/", "application/json")
+		var page map[string]string
+		if err := json.Unmarshal([]byte(body), &page); err != nil || status != 200 || page["name"] != "RoProxy" || page["version"] != proxyVersion || page["usage"] == "" {
+			t.Errorf("key %q: JSON landing page: %d %q", key, status, body)
+		}
+		// the proxy itself still needs the key
+		if status, _, _ := get("/users/v1/users/1", "*/*"); status != map[bool]int{true: 407, false: 200}[key != ""] {
+			t.Errorf("key %q: proxied request: %d", key, status)
+		}
+
+		// not recorded as requests, failed or not
+		recent := s.recent.snapshot()
+		if len(recent) != 1 || recent[0].Path != "/users/v1/users/1" {
+			t.Errorf("key %q: recent requests: %+v", key, recent)
+		}
+	}
+
+	cfg := testConfig()
+	cfg.LandingPage = false
+	s := newTestServer(t, cfg, okUpstream)
+	if resp := serveRaw(t, s, "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 404 {
+		t.Errorf("landing_page off: %d", resp.StatusCode())
+	}
+	if resp := serveRaw(t, s, "GET /robots.txt HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("landing_page off: robots.txt %d", resp.StatusCode())
+	}
+	if n := len(s.recent.snapshot()); n != 0 {
+		t.Errorf("landing_page off: %d recent requests", n)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultLegacyRoutes translates well-known api.roblox.com endpoints, which
+// now 404 or redirect, to the service APIs that replaced them. Entries are
+// written as LEGACY_ROUTES entries are.
+var defaultLegacyRoutes = []string{
+	"api/users/{id} -> users/v1/users/{id}",
+	"api/users/{id}/friends -> friends/v1/users/{id}/friends",
+	"api/users/{id}/groups -> groups/v1/users/{id}/groups/roles",
+	"api/groups/{id} -> groups/v1/groups/{id}",
+	"api/marketplace/productinfo?assetId={id} -> economy/v2/assets/{id}/details",
+	"api/marketplace/game-pass-product-info?gamePassId={id} -> economy/v1/game-passes/{id}/game-pass-product-info",
+	"api/ownership/hasasset?userId={user}&assetId={asset} -> inventory/v1/users/{user}/items/Asset/{asset}/is-owned",
+	"api/universes/get-universe-containing-place?placeId={id} -> apis/universes/v1/places/{id}/universe",
+	"api/currency/balance -> economy/v1/user/currency",
+}
+
+var placeholderRe = regexp.MustCompile(`\{[^{}/]+\}`)
+
+// legacyRoute rewrites client paths matching a pattern, written
+// path?param={name}&..., to a target where {name} is filled in. Legacy
+// routes take IDs, so a {name} path segment matches a segment of digits,
+// and the listed query parameters must be present with digits; they are
+// moved into the target, and other parameters are kept. Paths and
+// parameter names match case-insensitively.
+type legacyRoute struct {
+	name   string      // the pattern, reported in X-Proxy-Translated
+	segs   []string    // lower-case path segments
+	params [][2]string // lower-case query parameter and placeholder
+	to     string
+}
+
+// parseLegacyRoutes builds the translation table: the built-in routes,
+// replaced or, with an empty target, removed by LEGACY_ROUTES entries
+// with the same pattern. Routes are indexed by first path segment.
+func parseLegacyRoutes(list string) (map[string][]legacyRoute, error) {
+	var entries []string
+	entries = append(entries, defaultLegacyRoutes...)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	byName := map[string]legacyRoute{}
+	var order []string
+	for _, entry := range entries {
+		from, to, ok := cut(entry, "->")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" {
+			return nil, fmt.Errorf("%q is not pattern -> target", entry)
+		}
+		r, err := newLegacyRoute(from, to)
+		if err != nil {
+			return nil, err
+		}
+		if _, seen := byName[r.name]; !seen {
+			order = append(order, r.name)
+		}
+		byName[r.name] = r
+	}
+	routes := map[string][]legacyRoute{}
+	for _, name := range order {
+		if r := byName[name]; r.to != "" {
+			routes[r.segs[0]] = append(routes[r.segs[0]], r)
+		}
+	}
+	return routes, nil
+}
+
+func newLegacyRoute(from, to string) (legacyRoute, error) {
+	path, query, _ := cut(from, "?")
+	r := legacyRoute{name: from, to: strings.TrimPrefix(to, "/")}
+	r.segs = strings.Split(strings.ToLower(strings.Trim(path, "/")), "/")
+	if len(r.segs) < 2 || isPlaceholder(r.segs[0]) {
+		return r, fmt.Errorf("%q needs a subdomain and a path", from)
+	}
+	captured := map[string]bool{}
+	for _, seg := range r.segs {
+		if seg == "" {
+			return r, fmt.Errorf("%q has an empty path segment", from)
+		}
+		if isPlaceholder(seg) {
+			captured[seg] = true
+		}
+	}
+	if query != "" {
+		for _, pair := range strings.Split(query, "&") {
+			k, v, _ := cut(pair, "=")
+			if k == "" || !isPlaceholder(v) {
+				return r, fmt.Errorf("%q: query parameter %q must be name={placeholder}", from, pair)
+			}
+			r.params = append(r.params, [2]string{strings.ToLower(k), strings.ToLower(v)})
+			captured[strings.ToLower(v)] = true
+		}
+	}
+	for _, p := range placeholderRe.FindAllString(strings.ToLower(r.to), -1) {
+		if !captured[p] {
+			return r, fmt.Errorf("%q: target uses %s, which the pattern doesn't capture", from, p)
+		}
+	}
+	return r, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isPlaceholder(s string) bool {
+	return len(s) > 2 && s[0] == '{' && s[len(s)-1] == '}'
+}
+
+// translate returns the rewritten request URI, without its leading slash,
+// if the request path and query match the route.
+func (r legacyRoute) translate(path, query string) (string, bool) {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segs) != len(r.segs) {
+		return "", false
+	}
+	values := map[string]string{}
+	for i, seg := range r.segs {
+		switch {
+		case isPlaceholder(seg) && isDigits(segs[i]):
+			values[seg] = segs[i]
+		case !strings.EqualFold(seg, segs[i]):
+			return "", false
+		}
+	}
+	var rest []string
+	if query != "" {
+		for _, pair := range strings.Split(query, "&") {
+			k, v, _ := cut(pair, "=")
+			if key, err := url.QueryUnescape(k); err == nil {
+				k = key
+			}
+			moved := false
+			for _, p := range r.params {
+				if strings.EqualFold(k, p[0]) && isDigits(v) {
+					values[p[1]], moved = v, true
+				}
+			}
+			if !moved && pair != "" {
+				rest = append(rest, pair)
+			}
+		}
+	}
+	for _, p := range r.params {
+		if _, ok := values[p[1]]; !ok {
+			return "", false
+		}
+	}
+	uri := placeholderRe.ReplaceAllStringFunc(r.to, func(p string) string { return values[strings.ToLower(p)] })
+	if len(rest) > 0 {
+		sep := "?"
+		if strings.Contains(uri, "?") {
+			sep = "&"
+		}
+		uri += sep + strings.Join(rest, "&")
+	}
+	return uri, true
+}
+
+// translateLegacy returns the request URI, without its leading slash, that
+// the first matching route rewrites uri to, and the route's name.
+func (c *Config) translateLegacy(uri string) (string, string, bool) {
+	path, query, _ := cut(uri, "?")
+	first, _, _ := cut(path, "/")
+	for _, r := range c.legacyRoutes[strings.ToLower(first)] {
+		if out, ok := r.translate(path, query); ok {
+			return out, r.name, true
+		}
+	}
+	return "", "", false
+}
+
+// legacyStats counts translated requests by route, so what's left of the
+// legacy traffic shows up in /metrics.
+type legacyStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newLegacyStats() *legacyStats {
+	return &legacyStats{counts: map[string]int64{}}
+}
+
+// add counts a request translated by route and returns the route's total.
+func (l *legacyStats) add(route string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[route]++
+	return l.counts[route]
+}
+
+func (l *legacyStats) reset() {
+	l.mu.Lock()
+	l.counts = map[string]int64{}
+	l.mu.Unlock()
+}
+
+func (l *legacyStats) writeMetrics(b *bytes.Buffer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	routes := make([]string, 0, len(l.counts))
+	for r := range l.counts {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+	fmt.Fprintf(b, "# HELP roproxy_legacy_translated_total Legacy API requests translated, by route.\n# TYPE roproxy_legacy_translated_total counter\n")
+	for _, r := range routes {
+		fmt.Fprintf(b, "roproxy_legacy_translated_total{route=%q} %d\n", r, l.counts[r])
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestLegacyRoutes(t *testing.T) {
+	cfg := testConfig()
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		uri, want, route string
+	}{
+		{"api/users/1", "users/v1/users/1", "api/users/{id}"},
+		{"API/Users/1/", "users/v1/users/1", "api/users/{id}"},
+		{"api/users/1/friends", "friends/v1/users/1/friends", "api/users/{id}/friends"},
+		{"api/users/1/groups", "groups/v1/users/1/groups/roles", "api/users/{id}/groups"},
+		{"api/groups/7", "groups/v1/groups/7", "api/groups/{id}"},
+		{"api/marketplace/productinfo?assetId=1818", "economy/v2/assets/1818/details", "api/marketplace/productinfo?assetId={id}"},
+		// parameter names are case-insensitive and other parameters are kept
+		{"api/marketplace/productinfo?x=1&assetid=1818", "economy/v2/assets/1818/details?x=1", "api/marketplace/productinfo?assetId={id}"},
+		{"api/marketplace/game-pass-product-info?gamePassId=5", "economy/v1/game-passes/5/game-pass-product-info", "api/marketplace/game-pass-product-info?gamePassId={id}"},
+		{"api/ownership/hasasset?assetId=2&userId=1", "inventory/v1/users/1/items/Asset/2/is-owned", "api/ownership/hasasset?userId={user}&assetId={asset}"},
+		{"api/universes/get-universe-containing-place?placeid=1818", "apis/universes/v1/places/1818/universe", "api/universes/get-universe-containing-place?placeId={id}"},
+		{"api/currency/balance", "economy/v1/user/currency", "api/currency/balance"},
+	} {
+		got, route, ok := cfg.translateLegacy(tc.uri)
+		if !ok || got != tc.want || route != tc.route {
+			t.Errorf("%s: %q by %q (%v), want %q by %q", tc.uri, got, route, ok, tc.want, tc.route)
+		}
+	}
+	for _, uri := range []string{
+		"api/users/get-by-username?username=roblox",
+		"api/marketplace/productinfo",
+		"api/marketplace/productinfo?assetId=abc",
+		"api/ownership/hasasset?userId=1",
+		"api/users/1/friends/online",
+		"users/v1/users/1",
+	} {
+		if got, _, ok := cfg.translateLegacy(uri); ok {
+			t.Errorf("%s translated to %q", uri, got)
+		}
+	}
+
+	cfg.LegacyRoutes = "api/users/{id} -> users/v1/users/{id}/x, api/currency/balance ->, api/game/{id} -> games/v1/games?universeIds={id}"
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for uri, want := range map[string]string{
+		"api/users/1":          "users/v1/users/1/x",
+		"api/currency/balance": "",
+		"api/game/9?a=b":       "games/v1/games?universeIds=9&a=b",
+		"api/groups/7":         "groups/v1/groups/7",
+	} {
+		if got, _, _ := cfg.translateLegacy(uri); got != want {
+			t.Errorf("overridden %s: %q, want %q", uri, got, want)
+		}
+	}
+
+	for _, bad := range []string{"api/users/{id}", "api -> users/v1", "api/users/{id} -> users/v1/users/{userId}", "api/x?id=1 -> y/z"} {
+		cfg.LegacyRoutes = bad
+		if err := cfg.compile(); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestLegacyTranslation(t *testing.T) {
+	var sawHost, sawURI string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		sawHost, sawURI = string(ctx.Host()), string(ctx.RequestURI())
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	s := newTestServer(t, cfg, upstream)
+	get := func(uri string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	}
+
+	resp := get("/api/marketplace/productinfo?assetId=1818")
+	if sawHost != "economy.roblox.com" || sawURI != "/v2/assets/1818/details" {
+		t.Errorf("upstream got %s%s", sawHost, sawURI)
+	}
+	if got := string(resp.Header.Peek("X-Proxy-Translated")); got != "api/marketplace/productinfo?assetId={id}" {
+		t.Errorf("X-Proxy-Translated = %q", got)
+	}
+
+	resp = get("/api/users/get-by-username?username=roblox")
+	if sawHost != "api.roblox.com" || sawURI != "/users/get-by-username?username=roblox" || len(resp.Header.Peek("X-Proxy-Translated")) > 0 {
+		t.Errorf("untranslatable: upstream got %s%s, X-Proxy-Translated %q", sawHost, sawURI, resp.Header.Peek("X-Proxy-Translated"))
+	}
+
+	var b bytes.Buffer
+	s.legacy.writeMetrics(&b)
+	if want := `roproxy_legacy_translated_total{route="api/marketplace/productinfo?assetId={id}"} 1`; !strings.Contains(b.String(), want) {
+		t.Errorf("metrics missing %s:\n%s", want, b.String())
+	}
+
+	cfg.LegacyTranslation = false
+	if get("/api/users/1"); sawHost != "api.roblox.com" || sawURI != "/users/1" {
+		t.Errorf("translation off: upstream got %s%s", sawHost, sawURI)
+	}
+}
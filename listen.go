@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// endpoint is one listener together with the server answering on it.
+type endpoint struct {
+	addr    string
+	ln      net.Listener
+	server  *fasthttp.Server
+	handler fasthttp.RequestHandler
+}
+
+// listenAddrs returns the public listen addresses: LISTEN if set, otherwise
+// :PORT.
+func (c *Config) listenAddrs() []string {
+	if c.Listen == "" {
+		return []string{":" + c.Port}
+	}
+	var addrs []string
+	for _, a := range strings.Split(c.Listen, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// listen opens addr, which is either a TCP address or unix:/path/to/socket.
+// A stale socket file left behind by a previous process is removed first and
+// the new one gets UNIX_SOCKET_MODE permissions.
+//
+// With reusePort, TCP listeners are opened with SO_REUSEPORT so that a new
+// process can bind the same port while the old one is still running. A
+// zero-downtime restart then goes:
+//
+//  1. start the new binary with REUSEPORT=true; it binds alongside the old
+//     process and the kernel spreads new connections across both;
+//  2. once the new process answers /readyz, send SIGTERM to the PID in the
+//     old process's -pidfile;
+//  3. the old process closes its listener (new connections now only reach the
+//     new process), drains in-flight requests and exits.
+func listen(addr string, socketMode os.FileMode, reusePort bool) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		if reusePort {
+			return listenReusePort(addr)
+		}
+		return net.Listen("tcp4", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("removing stale socket %s: %v", path, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("setting socket permissions on %s: %v", path, err)
+	}
+	return ln, nil
+}
+
+// writePidFile records the process ID for restart wrapper scripts.
+func writePidFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile deletes the pid file unless a newer process has already
+// replaced it with its own PID.
+func removePidFile(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(path)
+}
+
+// serverTimeouts describes the client connection timeouts newHTTPServer
+// sets, for the startup log.
+func serverTimeouts(cfg *Config) string {
+	show := func(d Duration) string {
+		if d == 0 {
+			return "none"
+		}
+		return d.D().String()
+	}
+	idle := cfg.ServerIdleTimeout
+	if idle == 0 {
+		idle = cfg.ServerReadTimeout
+	}
+	return fmt.Sprintf("read %s, write %s, idle %s", show(cfg.ServerReadTimeout), show(cfg.ServerWriteTimeout), show(idle))
+}
+
+// newHTTPServer builds a fasthttp.Server for handler from the startup config.
+// Past SERVER_CONCURRENCY connections the server answers new ones with a
+// 503 and closes them itself, without running handler.
+func newHTTPServer(cfg *Config, handler fasthttp.RequestHandler) *fasthttp.Server {
+	return &fasthttp.Server{
+		Handler:            requestBodyHandler(cfg, handler),
+		ReadTimeout:        cfg.ServerReadTimeout.D(),
+		WriteTimeout:       cfg.ServerWriteTimeout.D(),
+		IdleTimeout:        cfg.ServerIdleTimeout.D(),
+		Concurrency:        cfg.ServerConcurrency,
+		ReadBufferSize:     cfg.ReadBufferSize,
+		WriteBufferSize:    cfg.WriteBufferSize,
+		MaxRequestBodySize: cfg.RequestBodyBufferBytes,
+		StreamRequestBody:  true,
+		// multipart bodies are passed on byte for byte rather than
+		// parsed into a form and written out again
+		DisablePreParseMultipartForm: true,
+	}
+}
+
+// openEndpoints opens every configured listener. When ADMIN_LISTEN is set
+// the internal endpoints are only served there and the public listeners
+// answer 404 for them.
+func (s *Server) openEndpoints() ([]endpoint, error) {
+	cfg := s.config()
+	mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix_socket_mode %q: %v", cfg.UnixSocketMode, err)
+	}
+
+	public := fasthttp.RequestHandler(s.requestHandler)
+	if cfg.AdminListen != "" {
+		public = s.publicOnly
+	}
+
+	var eps []endpoint
+	open := func(addr string, handler fasthttp.RequestHandler) error {
+		ln, err := listen(addr, os.FileMode(mode), cfg.ReusePort)
+		if errors.Is(err, syscall.EADDRINUSE) && cfg.BindRetryDelay > 0 {
+			// during an overlapping deploy the old instance may be about
+			// to release the port
+			log.Printf("%s is in use, retrying in %v", addr, cfg.BindRetryDelay)
+			time.Sleep(cfg.BindRetryDelay.D())
+			ln, err = listen(addr, os.FileMode(mode), cfg.ReusePort)
+		}
+		if err != nil {
+			return listenError(addr, err)
+		}
+		eps = append(eps, endpoint{addr: addr, ln: ln, server: newHTTPServer(cfg, handler), handler: handler})
+		return nil
+	}
+	for _, addr := range cfg.listenAddrs() {
+		if err := open(addr, public); err != nil {
+			closeEndpoints(eps)
+			return nil, err
+		}
+	}
+	if cfg.AdminListen != "" {
+		if err := open(cfg.AdminListen, s.adminOnly); err != nil {
+			closeEndpoints(eps)
+			return nil, err
+		}
+	}
+	return eps, nil
+}
+
+// reopen replaces ep's listener and server with new ones. The old server
+// is left to finish whatever it is still serving.
+func (s *Server) reopen(ep *endpoint) error {
+	cfg := s.config()
+	mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid unix_socket_mode %q: %v", cfg.UnixSocketMode, err)
+	}
+	ep.ln.Close()
+	ln, err := listen(ep.addr, os.FileMode(mode), cfg.ReusePort)
+	if err != nil {
+		return err
+	}
+	ep.ln = ln
+	ep.server = newHTTPServer(cfg, ep.handler)
+	return nil
+}
+
+// listenError explains a failed bind, singling out the common causes.
+func listenError(addr string, err error) error {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Errorf("%s is already in use by another process; if an old instance is still shutting down, set REUSEPORT=true to bind alongside it (%v)", addr, err)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Errorf("permission denied listening on %s; ports below 1024 need extra privileges (%v)", addr, err)
+	}
+	return fmt.Errorf("listening on %s: %v", addr, err)
+}
+
+func closeEndpoints(eps []endpoint) {
+	for _, ep := range eps {
+		ep.ln.Close()
+	}
+}
+
+// publicOnly serves public listeners when a separate admin listener exists.
+func (s *Server) publicOnly(ctx *fasthttp.RequestCtx) {
+	if isAdminPath(string(ctx.Path())) {
+		proxyError(ctx, 404, "not_found", "Not found.")
+		return
+	}
+	s.requestHandler(ctx)
+}
+
+// adminOnly serves the admin listener: internal endpoints and health probes
+// only, never proxied traffic.
+func (s *Server) adminOnly(ctx *fasthttp.RequestCtx) {
+	if !isInternalPath(string(ctx.Path())) {
+		proxyError(ctx, 404, "not_found", "Not found.")
+		return
+	}
+	s.requestHandler(ctx)
+}
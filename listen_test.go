@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestServerConcurrency(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		arrived <- struct{}{}
+		<-release
+		ctx.SetBodyString("ok")
+	}
+	cfg := testConfig()
+	cfg.ServerConcurrency = 1
+	s := newTestServer(t, cfg, upstream)
+	client := serveFront(t, cfg, s)
+	send := func() *fasthttp.Response {
+		conn, err := client.Dial("proxy")
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET /games/v1/games HTTP/1.1\r\nHost: proxy\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp := &fasthttp.Response{}
+		if err := resp.Read(bufio.NewReader(conn)); err != nil {
+			t.Error(err)
+			return nil
+		}
+		return resp
+	}
+
+	first := make(chan *fasthttp.Response)
+	go func() { first <- send() }()
+	<-arrived
+	// the one connection allowed is taken, so the next is turned away
+	// before the proxy sees it
+	if resp := send(); resp == nil || resp.StatusCode() != 503 || len(resp.Header.Peek("X-Proxy-Error")) > 0 {
+		t.Errorf("over server_concurrency: %v", resp)
+	}
+	close(release)
+	if resp := <-first; resp == nil || resp.StatusCode() != 200 {
+		t.Errorf("first connection: %v", resp)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.ServerIdleTimeout = Duration(100 * time.Millisecond)
+	s := newTestServer(t, cfg, okUpstream)
+	client := serveFront(t, cfg, s)
+	conn, err := client.Dial("proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	conn.Write([]byte("GET /games/v1/games HTTP/1.1\r\nHost: proxy\r\n\r\n"))
+	resp := &fasthttp.Response{}
+	if err := resp.Read(br); err != nil || resp.StatusCode() != 200 {
+		t.Fatalf("first request: %v %v", resp.StatusCode(), err)
+	}
+
+	// the kept-alive connection is closed once it has been idle too long
+	start := time.Now()
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatal("idle connection sent more data")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 2*time.Second {
+		t.Errorf("idle connection closed after %v, want about 100ms", d)
+	}
+
+	if got, want := serverTimeouts(cfg), "read 1m0s, write none, idle 100ms"; got != want {
+		t.Errorf("serverTimeouts = %q, want %q", got, want)
+	}
+	cfg.ServerIdleTimeout = 0
+	if got, want := serverTimeouts(cfg), "read 1m0s, write none, idle 1m0s"; got != want {
+		t.Errorf("serverTimeouts = %q, want %q", got, want)
+	}
+}
+
+func TestListenTCPAndUnix(t *testing.T) {
+	dir := t.TempDir()
+	public, admin := filepath.Join(dir, "proxy.sock"), filepath.Join(dir, "admin.sock")
+	// a socket left behind by an earlier process is replaced
+	if err := os.WriteFile(public, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.Key = "k"
+	cfg.Listen = "127.0.0.1:0, unix:" + public
+	cfg.AdminListen = "unix:" + admin
+	cfg.UnixSocketMode = "0600"
+	s := newTestServer(t, cfg, okUpstream)
+	eps, err := s.openEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeEndpoints(eps) })
+	if len(eps) != 3 {
+		t.Fatalf("opened %d endpoints, want 3", len(eps))
+	}
+	for _, ep := range eps {
+		go ep.server.Serve(ep.ln)
+	}
+	if info, err := os.Stat(public); err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket file: %v %v, want a socket with mode 0600", info.Mode(), err)
+	}
+
+	get := func(network, addr, path string) *fasthttp.Response {
+		client := &fasthttp.Client{Dial: func(string) (net.Conn, error) { return net.Dial(network, addr) }}
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.SetRequestURI("http://proxy" + path)
+		req.Header.Set("PROXYKEY", "k")
+		resp := &fasthttp.Response{}
+		if err := client.DoTimeout(req, resp, 5*time.Second); err != nil {
+			t.Fatalf("%s %s: %v", addr, path, err)
+		}
+		return resp
+	}
+	tests := []struct {
+		network, addr, path string
+		want                int
+	}{
+		{"tcp", eps[0].ln.Addr().String(), "/games/v1/games", 200},
+		{"unix", public, "/games/v1/games", 200},
+		{"unix", public, "/metrics", 404},
+		{"unix", public, "/healthz", 200},
+		{"unix", admin, "/metrics", 200},
+		{"unix", admin, "/games/v1/games", 404},
+	}
+	for _, tt := range tests {
+		if got := get(tt.network, tt.addr, tt.path).StatusCode(); got != tt.want {
+			t.Errorf("%s %s: %d, want %d", tt.addr, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	var calls int32
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.ServerReadTimeout = Duration(100 * time.Millisecond)
+	s := newTestServer(t, cfg, upstream)
+	client := serveFront(t, cfg, s)
+	conn, err := client.Dial("proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// a client that stops half way through its headers is cut off
+	start := time.Now()
+	conn.Write([]byte("GET /games/v1/games HTTP/1.1\r\nHost: pro"))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 2*time.Second {
+		t.Errorf("stalled connection closed after %v, want about 100ms", d)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("upstream called %d times for an unfinished request", n)
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	path := t.TempDir() + "/roproxy.pid"
+	if err := writePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+	removePidFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("own pid file left behind: %v", err)
+	}
+
+	// a newer process has taken over the file; it isn't ours to remove
+	if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	removePidFile(path)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("newer process's pid file removed: %v", err)
+	}
+}
+
+func TestOpenEndpointsInUse(t *testing.T) {
+	held, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	addr := held.Addr().String()
+
+	cfg := testConfig()
+	cfg.Listen = addr
+	cfg.BindRetryDelay = Duration(50 * time.Millisecond)
+	s := newTestServer(t, cfg, okUpstream)
+	start := time.Now()
+	_, err = s.openEndpoints()
+	if err == nil || !strings.Contains(err.Error(), addr+" is already in use") {
+		t.Errorf("port taken: %v, want an already in use error", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("gave up after %v, without waiting bind_retry_delay", d)
+	}
+
+	// released during the delay, as an old instance finishing its shutdown
+	// would, the port is bound on the retry
+	time.AfterFunc(10*time.Millisecond, func() { held.Close() })
+	eps, err := s.openEndpoints()
+	if err != nil {
+		t.Fatalf("port released before the retry: %v", err)
+	}
+	closeEndpoints(eps)
+
+	if err := listenError(":80", syscall.EACCES); !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("EACCES: %v", err)
+	}
+	if err := listenError(":80", errors.New("boom")); err.Error() != "listening on :80: boom" {
+		t.Errorf("other error: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// logWriter is the asynchronous writer behind the standard logger when
+// LOG_FILE is set; nil when logging goes straight to stderr.
+var logWriter *asyncWriter
+
+// setupLogging points the standard logger at LOG_FILE, if configured. The
+// file is rotated once it grows past LOG_MAX_SIZE_MB and on SIGHUP, keeping at
+// most LOG_MAX_BACKUPS old files.
+func setupLogging(path string, maxSizeMB, maxBackups int) {
+	if path == "" {
+		return
+	}
+	if maxSizeMB <= 0 {
+		log.Fatalf("LOG_MAX_SIZE_MB must be positive, got %d", maxSizeMB)
+	}
+	if maxBackups < 0 {
+		log.Fatalf("LOG_MAX_BACKUPS must not be negative, got %d", maxBackups)
+	}
+	rf, err := openRotatingFile(path, int64(maxSizeMB)<<20, maxBackups)
+	if err != nil {
+		log.Fatalf("Cannot open LOG_FILE: %v", err)
+	}
+	logWriter = newAsyncWriter(rf, 4096)
+	log.SetOutput(logWriter)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logWriter.Flush()
+			if err := rf.Rotate(); err != nil {
+				log.Printf("Log rotation failed: %v", err)
+			}
+		}
+	}()
+}
+
+// logRequest reports whether a finished request is logged under
+// LOG_SAMPLE_RATE. Failed requests (an upstream error or a 5xx) and ones
+// slower than LOG_SLOW_THRESHOLD are always logged.
+func logRequest(cfg *Config, status int, failed bool, d time.Duration) bool {
+	if failed || status >= 500 || (cfg.LogSlowThreshold > 0 && d >= cfg.LogSlowThreshold.D()) {
+		return true
+	}
+	return cfg.LogSampleRate >= 1 || rand.Float64() < cfg.LogSampleRate
+}
+
+// flushLogs blocks until every buffered log line has been written.
+func flushLogs() {
+	if logWriter != nil {
+		logWriter.Flush()
+	}
+}
+
+// rotatingFile is an io.Writer appending to path that renames the file to
+// path.1 (shifting older backups to path.2, path.3, ...) once it would grow
+// past maxSize, deleting backups beyond maxBackups.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rotateErr error
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// A failed rotation leaves the current file open; keep appending to it
+		// rather than dropping the line.
+		rotateErr = r.rotateLocked()
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Rotate shifts the backups and starts a new file.
+func (r *rotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotateLocked()
+}
+
+// rotateLocked keeps the current file open until its replacement is, so on
+// any error r.f is still writable.
+func (r *rotatingFile) rotateLocked() error {
+	if r.maxBackups == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		backup := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+		if err := os.Remove(backup(r.maxBackups)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(r.path, backup(1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// asyncWriter hands writes to a background goroutine so that logging never
+// blocks the request path. When the queue is full, lines are dropped and
+// counted rather than waited on.
+type asyncWriter struct {
+	w       io.Writer
+	ch      chan asyncMsg
+	dropped int64
+}
+
+type asyncMsg struct {
+	b       []byte
+	flushed chan struct{}
+}
+
+func newAsyncWriter(w io.Writer, queue int) *asyncWriter {
+	a := &asyncWriter{w: w, ch: make(chan asyncMsg, queue)}
+	go a.run()
+	return a
+}
+
+func (a *asyncWriter) run() {
+	for m := range a.ch {
+		if m.flushed != nil {
+			close(m.flushed)
+			continue
+		}
+		a.w.Write(m.b)
+	}
+}
+
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+	select {
+	case a.ch <- asyncMsg{b: b}:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// Flush waits until everything queued before the call has been written.
+func (a *asyncWriter) Flush() {
+	done := make(chan struct{})
+	a.ch <- asyncMsg{flushed: done}
+	<-done
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogRequestSampling(t *testing.T) {
+	cfg := testConfig()
+	cfg.LogSampleRate = 0
+	cfg.LogSlowThreshold = Duration(time.Second)
+	tests := []struct {
+		name   string
+		status int
+		failed bool
+		d      time.Duration
+		want   bool
+	}{
+		{"success", 200, false, time.Millisecond, false},
+		{"client error", 404, false, time.Millisecond, false},
+		{"upstream 5xx", 503, false, time.Millisecond, true},
+		{"upstream error", 500, true, time.Millisecond, true},
+		{"slow", 200, false, 2 * time.Second, true},
+	}
+	for _, tt := range tests {
+		if got := logRequest(cfg, tt.status, tt.failed, tt.d); got != tt.want {
+			t.Errorf("%s: logged = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	cfg.LogSampleRate = 0.5
+	logged := 0
+	for i := 0; i < 1000; i++ {
+		if logRequest(cfg, 200, false, time.Millisecond) {
+			logged++
+		}
+	}
+	if logged < 400 || logged > 600 {
+		t.Errorf("rate 0.5 logged %d of 1000 requests", logged)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	rf, err := openRotatingFile(path, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { rf.f.Close() }()
+
+	// Every line after the first fills the 2-byte file, so each one rotates.
+	for _, line := range []string{"a\n", "b\n", "c\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("writing %q: %v", line, err)
+		}
+	}
+	for name, want := range map[string]string{path: "c\n", path + ".1": "b\n"} {
+		if b, err := os.ReadFile(name); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v; want %q", filepath.Base(name), b, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("backup beyond LOG_MAX_BACKUPS kept: %v", err)
+	}
+
+	// A backup that can't be removed fails the rotation, but logging carries
+	// on in the current file.
+	os.Remove(path + ".1")
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Rotate(); err == nil {
+		t.Error("rotation over a non-empty directory succeeded")
+	}
+	if _, err := rf.Write([]byte("d\n")); err == nil {
+		t.Error("write after a failed rotation reported no error")
+	}
+	if b, _ := os.ReadFile(path); string(b) != "c\nd\n" {
+		t.Errorf("after failed rotation file = %q, want %q", b, "c\nd\n")
+	}
+}
@@ -1,76 +1,366 @@
 package main
 
 import (
-	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
-func getenvInt(name string, def int) int {
-	v := os.Getenv(name)
-	if v == "" {
-		return def
+// Server is the proxy: its configuration, the upstream client and the state
+// shared between requests.
+type Server struct {
+	// cfg holds the *Config handlers read. It is replaced as a whole on
+	// reload, so a request that grabbed config() once sees a consistent view.
+	cfg    atomic.Value
+	client *fasthttp.Client
+
+	// response cache for GET/HEAD; nil unless cache_ttl > 0
+	cache *responseCache
+
+	// thumbCache holds /_proxy/thumbnails answers; nil unless
+	// thumbnail_cache_ttl > 0
+	thumbCache *responseCache
+
+	// profileCache holds /_proxy/users/{id}/profile answers; nil unless
+	// profile_cache_ttl > 0
+	profileCache *responseCache
+
+	// universes maps place IDs to universe IDs for /_proxy/universe
+	universes *universeCache
+
+	// recent keeps the last recent_buffer_size requests for /admin/recent
+	recent *recentBuffer
+
+	pool *poolStats
+
+	// sizes counts proxied response body bytes for /metrics
+	sizes *responseSizes
+
+	// h2 sends requests for UPSTREAM_HTTP2 subdomains; it shares client's
+	// dialer, TLS config and limits
+	h2 *h2Client
+
+	// sse sends requests that may be answered with an event stream
+	// (SSE_ENABLED), likewise
+	sse *sseClient
+
+	// bandwidth paces response bodies under BANDWIDTH_LIMIT and
+	// BANDWIDTH_LIMIT_OVERRIDES
+	bandwidth *bandwidthLimiter
+
+	// csrf caches upstream X-CSRF-TOKENs per host
+	csrf *csrfTokens
+
+	// retries enforces GLOBAL_RETRY_RATE_LIMIT
+	retries *retryBudget
+
+	// inflight enforces SUBDOMAIN_MAX_INFLIGHT
+	inflight *inflightLimiter
+
+	// ipInflight enforces PER_IP_MAX_INFLIGHT
+	ipInflight *inflightLimiter
+
+	// concurrency enforces MAX_CONCURRENT_REQUESTS
+	concurrency *priorityLimiter
+
+	// challenges catches upstream HTML challenge and maintenance pages
+	challenges *challengeDetector
+
+	// cloudKeys rate-limits OPENCLOUD_KEYS use per name
+	cloudKeys *cloudKeyLimiter
+
+	// legacy counts requests translated by LEGACY_ROUTES
+	legacy *legacyStats
+
+	// envs counts requests sent to X-Proxy-Env environments
+	envs *envStats
+
+	// transforms counts TRANSFORMS outcomes
+	transforms *transformStats
+
+	// upstreamErrors counts failed upstream attempts by classifyError reason
+	upstreamErrors *errorReasons
+
+	// presence runs the polls behind /_proxy/presence/watch
+	presence *presenceWatch
+
+	// mirror copies requests to MIRROR_UPSTREAM_DOMAIN; nil when unset
+	mirror *mirror
+
+	// egress rotates upstream connections over EGRESS_IPS; nil when unset
+	egress *egressPool
+
+	// dns caches upstream lookups; nil unless DNS_CACHE is set
+	dns *dnsCache
+
+	// cassettes records upstream responses to RECORD_DIR, or replays them
+	// with REPLAY; nil when RECORD_DIR is unset
+	cassettes *cassetteStore
+
+	// maintenance holds the current *maintenanceState
+	maintenance atomic.Value
+
+	// warm is set to 1 once startup warmup has finished (or was skipped)
+	warm int32
+
+	// draining is set to 1 once SIGTERM/SIGINT has been received. From then
+	// on /readyz fails and new proxied requests are refused.
+	draining int32
+}
+
+// newServer builds a Server and its upstream client from cfg.
+func newServer(cfg *Config) *Server {
+	s := &Server{
+		cache:          newResponseCache(cfg.CacheTTL.D(), cfg.CacheMaxEntries),
+		thumbCache:     newResponseCache(cfg.ThumbnailCacheTTL.D(), cfg.CacheMaxEntries),
+		profileCache:   newResponseCache(cfg.ProfileCacheTTL.D(), cfg.CacheMaxEntries),
+		universes:      newUniverseCache(),
+		recent:         newRecentBuffer(cfg.RecentBufferSize),
+		pool:           newPoolStats(),
+		sizes:          newResponseSizes(),
+		inflight:       newInflightLimiter(),
+		ipInflight:     newInflightLimiter(),
+		concurrency:    &priorityLimiter{},
+		challenges:     newChallengeDetector(),
+		cloudKeys:      newCloudKeyLimiter(),
+		legacy:         newLegacyStats(),
+		envs:           newEnvStats(),
+		transforms:     newTransformStats(),
+		upstreamErrors: newErrorReasons(),
+		bandwidth:      newBandwidthLimiter(cfg),
+		retries:        newRetryBudget(cfg.GlobalRetryRateLimit),
+		csrf:           newCSRFTokens(),
 	}
-	i, err := strconv.Atoi(v)
-	if err != nil {
-		return def
+	s.presence = newPresenceWatch(s)
+	s.setConfig(cfg)
+	if len(cfg.egressIPs) > 0 {
+		s.egress = newEgressPool(cfg.egressIPs, cfg.EgressPenalty.D())
+	}
+	if cfg.MirrorUpstreamDomain != "" || cfg.MirrorShadows != "" {
+		s.mirror = newMirror(s, cfg.MirrorWorkers, cfg.MirrorQueueSize, cfg.MirrorShadowDiffs)
+	}
+	if cfg.DNSCache || cfg.DNSServers != "" {
+		s.dns = newDNSCache(cfg, netResolver{net.DefaultResolver})
+	}
+	if cfg.RecordDir != "" {
+		s.cassettes = newCassetteStore(cfg.RecordDir)
 	}
-	return i
+	s.setMaintenance(maintenanceState{
+		Enabled:           cfg.Maintenance,
+		Message:           cfg.MaintenanceMessage,
+		RetryAfterSeconds: int(cfg.MaintenanceRetryAfter.D().Seconds()),
+	})
+
+	// create HTTP client with reasonable defaults
+	s.client = &fasthttp.Client{
+		ReadTimeout:         cfg.clientReadTimeout(),
+		WriteTimeout:        cfg.clientWriteTimeout(),
+		MaxIdleConnDuration: cfg.MaxIdleConnDuration.D(),
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+		MaxConnWaitTimeout:  cfg.MaxConnWaitTimeout.D(),
+		Dial:                s.dial,
+		ReadBufferSize:      cfg.clientReadBufferSize(),
+		WriteBufferSize:     cfg.WriteBufferSize,
+		TLSConfig:           cfg.upstreamTLSConfig(),
+	}
+	s.h2 = newH2Client(s.client)
+	s.sse = newSSEClient(s.client)
+	return s
 }
 
-func getenv(name, def string) string {
-	v := os.Getenv(name)
-	if v == "" {
-		return def
+func (s *Server) config() *Config {
+	return s.cfg.Load().(*Config)
+}
+
+func (s *Server) setConfig(c *Config) {
+	s.cfg.Store(c)
+}
+
+// dial is used as the fasthttp.Client Dial function. Connections go through
+// the outbound proxy configured for the host, if any.
+func (s *Server) dial(addr string) (net.Conn, error) {
+	cfg := s.config()
+	if cfg.Replay {
+		// everything upstream comes from the cassettes, and nothing else,
+		// such as the mirror or warmup, gets through either
+		return nil, errors.New("upstream connections are disabled in replay mode")
 	}
-	return v
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	var conn net.Conn
+	if p := cfg.outboundProxyFor(host); p != nil {
+		conn, err = s.pool.dial(addr, p.dialer())
+	} else {
+		conn, err = s.pool.dial(addr, func(addr string) (net.Conn, error) {
+			if s.egress == nil {
+				return s.dialFrom(cfg, addr, nil)
+			}
+			e := s.egress.pick()
+			conn, err := s.dialFrom(cfg, addr, e)
+			s.egress.dialed(e, err)
+			return conn, err
+		})
+	}
+	if err != nil || cfg.FirstByteTimeout <= 0 {
+		return conn, err
+	}
+	return newFirstByteConn(conn, cfg.FirstByteTimeout.D()), nil
 }
 
-var (
-	timeout = getenvInt("TIMEOUT", 10)   // seconds
-	retries = getenvInt("RETRIES", 3)    // retry attempts
-	port    = getenv("PORT", "10000")    // Render supplies PORT; default fallback
-	client  *fasthttp.Client
-)
+// dialFrom connects directly to addr, from the egress IP e when not nil.
+func (s *Server) dialFrom(cfg *Config, addr string, e *egressIP) (net.Conn, error) {
+	timeout := cfg.DialTimeout.D()
+	if s.dns != nil {
+		var local net.IP
+		if e != nil {
+			local = e.ip
+		}
+		return s.dns.dial(addr, timeout, local)
+	}
+	switch {
+	case e != nil:
+		d := net.Dialer{Timeout: timeout, LocalAddr: e.localAddr()}
+		return d.Dial(e.network(), addr)
+	case cfg.ForceIPFamily == "6":
+		return net.DialTimeout("tcp6", addr, timeout)
+	}
+	return fasthttp.DialTimeout(addr, timeout)
+}
 
 func main() {
-	// create HTTP client with reasonable defaults
-	client = &fasthttp.Client{
-		ReadTimeout:        time.Duration(timeout) * time.Second,
-		MaxIdleConnDuration: 60 * time.Second,
-		MaxConnsPerHost:     100,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
+	cfg, validateOnly, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if validateOnly {
+		fmt.Print(cfg.dump())
+		return
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	setupLogging(cfg.LogFile, cfg.LogMaxSizeMB, cfg.LogMaxBackups)
+	s := newServer(cfg)
+	if cfg.InsecureSkipVerify {
+		go warnInsecure(cfg.TargetDomain)
 	}
 
-	h := requestHandler
-	if err := fasthttp.ListenAndServe(":"+port, h); err != nil {
-		log.Fatalf("ListenAndServe error: %v", err)
+	eps, err := s.openEndpoints()
+	if err != nil {
+		log.Fatalf("Listen error: %v", err)
 	}
+	if cfg.PidFile != "" {
+		if err := writePidFile(cfg.PidFile); err != nil {
+			log.Fatalf("Cannot write pid file: %v", err)
+		}
+		defer removePidFile(cfg.PidFile)
+	}
+	go s.watchReload()
+	go s.warmup()
+	s.serve(eps, cfg.ShutdownTimeout.D())
 }
 
-func requestHandler(ctx *fasthttp.RequestCtx) {
-	// If KEY is set, require PROXYKEY header
-	if val, ok := os.LookupEnv("KEY"); ok {
-		if string(ctx.Request.Header.Peek("PROXYKEY")) != val {
-			ctx.SetStatusCode(407)
-			ctx.SetBody([]byte("Missing or invalid PROXYKEY header."))
+var proxyKeyHeader = reserveHeader("PROXYKEY", "The KEY setting, or a PROXYKEY_PRIORITIES key; required when KEY is set on every request but the health checks, the landing page and the management API.")
+
+func (s *Server) requestHandler(ctx *fasthttp.RequestCtx) {
+	cfg := s.config()
+	internal := isInternalPath(string(ctx.Path())) || isSitePath(string(ctx.Path()))
+	start := time.Now()
+	if cfg.InsecureSkipVerify {
+		// deferred so it survives handlers that reset the response
+		defer ctx.Response.Header.Set("X-Proxy-Insecure", "true")
+	}
+	var reqErr error
+	defer func() {
+		if internal {
+			return
+		}
+		e := recentEntry{
+			Time:       start,
+			Method:     string(ctx.Method()),
+			Path:       string(ctx.Path()),
+			Status:     ctx.Response.StatusCode(),
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if reqErr != nil {
+			e.Error = reqErr.Error()
+		}
+		s.recent.add(e)
+		if d := time.Since(start); logRequest(cfg, e.Status, reqErr != nil, d) {
+			log.Printf("%s %s -> %d in %v", e.Method, ctx.RequestURI(), e.Status, d.Round(time.Microsecond))
+		}
+	}()
+
+	// Health probes are answered before authentication so platform checks
+	// don't need the key, and so are browsers and crawlers
+	switch path := string(ctx.Path()); {
+	case path == "/healthz" || path == "/readyz":
+		s.healthHandler(ctx)
+		return
+	case isSitePath(path):
+		siteHandler(cfg, ctx)
+		return
+	}
+
+	// Refuse new work while draining for shutdown
+	if s.isDraining() {
+		ctx.SetConnectionClose()
+		proxyError(ctx, 503, "shutting_down", "Proxy is shutting down.")
+		return
+	}
+
+	// Maintenance mode answers everything but the proxy's own endpoints
+	if m := s.maintenanceState(); m.Enabled && !internal {
+		writeMaintenance(ctx, m)
+		return
+	}
+
+	// If KEY is set, require PROXYKEY header; the management API and the
+	// other admin routes check ADMIN_KEY instead
+	if cfg.Key != "" && !isAdminAPIPath(string(ctx.Path())) {
+		if key := string(ctx.Request.Header.Peek(proxyKeyHeader)); key != cfg.Key && !cfg.hasKeyPriority(key) {
+			proxyError(ctx, 407, "invalid_key", "Missing or invalid PROXYKEY header.")
 			return
 		}
 	}
 
+	if internal {
+		s.internalHandler(ctx)
+		return
+	}
+
+	// Keep one client from taking every connection; clientIP only trusts
+	// what TRUST_PROXY_HOPS proxies appended, so forged addresses in front
+	// of it share their sender's limit
+	if limit := cfg.PerIPMaxInflight; limit > 0 {
+		ip := clientIP(cfg, ctx)
+		if !s.ipInflight.acquire(ip, limit) {
+			proxyError(ctx, 429, "client_busy", "Too many requests in flight from your address. Please try again.")
+			return
+		}
+		defer s.ipInflight.release(ip)
+	}
+
 	// Must have at least two parts after first slash: e.g. marketplace/asset/ID
 	raw := string(ctx.Request.Header.RequestURI())
 	// raw usually starts with path like "/marketplace/asset/123?x=1"
 	if len(raw) == 0 {
-		ctx.SetStatusCode(400)
-		ctx.SetBody([]byte("URL format invalid."))
+		proxyError(ctx, 400, "invalid_url", "URL format invalid.")
 		return
 	}
 	// remove leading slash
@@ -79,92 +369,698 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 	}
 	parts := strings.SplitN(raw, "/", 2)
 	if len(parts) < 2 {
-		ctx.SetStatusCode(400)
-		ctx.SetBody([]byte("URL format invalid."))
+		proxyError(ctx, 400, "invalid_url", "URL format invalid.")
+		return
+	}
+
+	// Deeply nested paths are counted as sent, before fasthttp's
+	// normalization folds away any ../ segments
+	if n := pathSegments(raw); cfg.MaxPathSegments > 0 && n > cfg.MaxPathSegments {
+		proxyError(ctx, 400, "path_too_deep", "Path has "+strconv.Itoa(n)+" segments; the limit is "+strconv.Itoa(cfg.MaxPathSegments)+".")
+		return
+	}
+
+	// Retired api.roblox.com endpoints go to the APIs that replaced them;
+	// other api/ paths are proxied as they are
+	if cfg.LegacyTranslation {
+		if uri, route, ok := cfg.translateLegacy(raw); ok {
+			n := s.legacy.add(route)
+			log.Printf("Translated legacy /%s to /%s by %s (%d so far)", raw, uri, route, n)
+			// logged as the client sent it
+			defer ctx.Request.SetRequestURI("/" + raw)
+			ctx.Request.SetRequestURI("/" + uri)
+			ctx.Response.Header.Set("X-Proxy-Translated", route)
+			raw, parts = uri, strings.SplitN(uri, "/", 2)
+		}
+	}
+
+	// Answer unknown subdomains without a lookup and retries
+	if cfg.StrictSubdomain && !cfg.knownSubdomains[strings.ToLower(parts[0])] {
+		proxyError(ctx, 404, "unknown_subdomain", "Unknown subdomain "+parts[0]+".")
+		return
+	}
+
+	// DENY_PATHS are never proxied
+	if cfg.denyPaths.match("/" + strings.SplitN(raw, "?", 2)[0]) {
+		proxyError(ctx, 403, "path_denied", "This path is not allowed through the proxy.")
+		return
+	}
+
+	if cfg.MethodOverrideEnabled && !applyMethodOverride(ctx) {
+		proxyError(ctx, 400, "invalid_method_override", "Unsupported X-HTTP-Method-Override method.")
+		return
+	}
+
+	method := string(ctx.Method())
+	if cfg.RejectGetBody {
+		switch method {
+		case "GET", "HEAD", "DELETE":
+			if len(ctx.Request.Body()) > 0 {
+				proxyError(ctx, 400, "body_not_allowed", "Request body not allowed for "+method+".")
+				return
+			}
+		}
+	}
+
+	// Failure injection for resilience testing: answer without contacting
+	// upstream for FAULT_INJECT_RATE of requests
+	if cfg.FaultInjectRate > 0 && rand.Float64() < cfg.FaultInjectRate {
+		proxyError(ctx, cfg.FaultInjectStatus, "fault_injected", "Injected fault.")
+		ctx.Response.Header.Set("X-Proxy-Fault-Injected", "true")
+		return
+	}
+
+	// X-Proxy-Cloud-Key attaches an OPENCLOUD_KEYS key to Open Cloud
+	// requests; those answers are per key and aren't cached
+	if !s.applyCloudKey(cfg, ctx, strings.ToLower(parts[0]), parts[1]) {
+		return
+	}
+	_, cloudKey := ctx.UserValue(cloudAPIKeyKey).(string)
+
+	// X-Proxy-Env sends the request to another ENVIRONMENTS domain
+	if !applyEnvironment(cfg, ctx) {
+		return
+	}
+	_, env := ctx.UserValue(envKey).(string)
+
+	// X-Proxy-Timeout tightens the deadline for this request
+	if !applyTimeout(cfg, ctx) {
+		return
+	}
+
+	// X-Proxy-Dry-Run answers with the upstream request instead of sending
+	// it; everything else runs as usual, but nothing is cached or mirrored
+	dryRun := wantsDryRun(cfg, ctx)
+	if dryRun {
+		ctx.SetUserValue(dryRunKey, true)
+	}
+
+	// Pages are merged from the uncompressed JSON, and the merged response
+	// isn't cached
+	clientURI := string(ctx.Request.Header.RequestURI())
+	pages := paginatePages(cfg, ctx)
+	if pages < 0 {
+		proxyError(ctx, 400, "invalid_paginate", "_paginate must be all or a positive number of pages.")
+		return
+	}
+	if pages > 0 {
+		ctx.Request.Header.Del("Accept-Encoding")
+		// logged as the client sent it, not with the last page's cursor
+		defer ctx.Request.SetRequestURI(clientURI)
+	}
+
+	// _fields responses are cut down from the uncompressed JSON and aren't
+	// cached either
+	fields := requestFields(ctx)
+	if fields != nil {
+		ctx.Request.Header.Del("Accept-Encoding")
+		defer ctx.Request.SetRequestURI(clientURI)
+	}
+
+	// TRANSFORMS work on the uncompressed JSON too; the transformed
+	// response is what's cached
+	transformed := matchTransform(cfg, ctx)
+	if transformed != nil {
+		ctx.Request.Header.Del("Accept-Encoding")
+	}
+
+	// X-Proxy-Decompress picks compressed or plain bytes over whatever the
+	// client's Accept-Encoding would give; it's applied before the cache
+	// lookup so each choice has its own cache variant
+	decompress, forceEncoding := wantsDecompress(cfg, ctx)
+	if forceEncoding {
+		applyDecompress(ctx, decompress)
+	}
+
+	// _follow=true answers with the asset itself rather than its location
+	if wantsAssetFollow(ctx, strings.ToLower(parts[0])) && !dryRun {
+		defer ctx.Request.SetRequestURI(clientURI)
+		s.followAsset(cfg, ctx, ctx)
+		setBodyChecksum(cfg, ctx)
+		s.throttleBody(cfg, ctx, "assetdelivery")
+		return
+	}
+
+	// Serve GET/HEAD from the response cache when enabled; requests that
+	// may be answered with an event stream, or that carry the client's
+	// credentials, always go upstream
+	events := wantsEventStream(cfg, ctx)
+	cacheable := s.cache != nil && (method == "GET" || method == "HEAD") && pages == 0 && fields == nil && !cloudKey && !events && !dryRun &&
+		!hasCredentials(ctx)
+	var cacheKeyStr string
+	if cacheable {
+		_, targetURL := routedTarget(cfg, ctx, targetDomain(cfg, ctx))
+		acceptEncoding := string(ctx.Request.Header.Peek("Accept-Encoding"))
+		if cached, headersOnly := s.cache.lookup(method, acceptEncoding, targetURL); cached != nil {
+			cached.writeTo(ctx, headersOnly || method == "HEAD")
+			setBodyChecksum(cfg, ctx)
+			s.throttleBody(cfg, ctx, strings.ToLower(parts[0]))
+			return
+		}
+		cacheKeyStr = cacheKey(method, acceptEncoding, targetURL)
+	}
+
+	// A subdomain that keeps answering with challenge pages is left alone
+	// for CHALLENGE_BREAKER_COOLDOWN
+	subdomain := strings.ToLower(parts[0])
+	if left := s.challenges.open(subdomain); left > 0 {
+		proxyError(ctx, 503, "circuit_open", "Upstream "+subdomain+" is answering with challenge pages. Please try again later.")
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
 		return
 	}
 
-	// Perform the proxied request with retries
-	resp := makeRequest(ctx, 1)
+	// Over MAX_CONCURRENT_REQUESTS, requests wait their turn by PROXYKEY
+	// priority
+	if limit := cfg.MaxConcurrentRequests; limit > 0 {
+		priority := cfg.keyPriority(string(ctx.Request.Header.Peek(proxyKeyHeader)))
+		if code := s.concurrency.acquire(limit, cfg.ConcurrencyQueueSize, priority, cfg.ConcurrencyQueueTimeout.D()); code != "" {
+			proxyError(ctx, 503, code, "Too many requests in flight. Please try again.")
+			return
+		}
+		defer s.concurrency.release(limit)
+	}
+
+	// Keep one subdomain from taking every upstream connection
+	if limit, ok := cfg.SubdomainMaxInflight.lookup(subdomain); ok {
+		if !s.inflight.acquire(subdomain, limit) {
+			proxyError(ctx, 503, "subdomain_busy", "Too many requests in flight to "+subdomain+". Please try again.")
+			return
+		}
+		defer s.inflight.release(subdomain)
+	}
+
+	// Shadow copies are compared with the primary's answer, so they are
+	// sent only once the client has it
+	var shadow *shadowJob
+	if s.mirror != nil && !dryRun {
+		s.mirror.maybeMirror(cfg, ctx)
+		if !events && !env {
+			shadow = s.mirror.prepareShadow(cfg, ctx, subdomain)
+		}
+	}
+	upstreamStart := time.Now()
+
+	// Perform the proxied request with retries, split up when it is a batch
+	// over its endpoint's ID limit
+	var resp *fasthttp.Response
+	var err error
+	if b := oversizedBatch(cfg, ctx); b != nil && !dryRun {
+		resp, err = s.splitBatch(cfg, ctx, b)
+	} else {
+		resp, err = s.makeRequest(ctx, 1)
+	}
+	reqErr = err
 	defer fasthttp.ReleaseResponse(resp)
+	if shadow != nil {
+		shadow.setPrimary(resp, err, time.Since(upstreamStart))
+		defer s.mirror.queueShadow(shadow)
+	}
+	if stream, ok := ctx.UserValue(eventStreamKey).(*eventStream); ok && err == nil {
+		writeEventStream(cfg, ctx, resp, stream)
+		return
+	}
+	if dryRun && err == nil {
+		ctx.SetStatusCode(200)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(resp.Body())
+		ctx.Response.Header.Set(dryRunHeader, "true")
+		return
+	}
+	if forceEncoding && decompress {
+		decodeBody(resp)
+	}
+	if err == nil {
+		upstreamPath := "/" + strings.SplitN(parts[1], "?", 2)[0]
+		switch code := s.challenges.check(cfg, ctx, subdomain, upstreamPath, resp); code {
+		case "upstream_challenge":
+			proxyError(ctx, 503, code, "Upstream answered with a challenge page instead of an API response.")
+			return
+		case "upstream_maintenance":
+			proxyError(ctx, 503, code, "Upstream is down for maintenance.")
+			return
+		}
+	}
+	if pages > 1 && err == nil {
+		s.paginate(cfg, ctx, resp, pages)
+	}
+	if fields != nil && err == nil {
+		filterFields(cfg, resp, fields)
+	}
+	if transformed != nil && err == nil {
+		s.applyTransform(cfg, resp, transformed)
+	}
+	if cfg.NormalizeErrors && err == nil {
+		normalizeError(cfg, resp)
+	}
+
+	if cfg.MaxResponseHeaderBytes > 0 && cfg.MaxResponseHeaderAction == "reject" &&
+		responseHeaderSize(&resp.Header) > cfg.MaxResponseHeaderBytes {
+		log.Printf("WARN upstream response headers over %d bytes for %s %s", cfg.MaxResponseHeaderBytes, method, ctx.Path())
+		proxyError(ctx, 502, "response_headers_too_large", "Upstream response headers were too large.")
+		return
+	}
 
 	// Copy response body and status back to client
 	ctx.SetStatusCode(resp.StatusCode())
-	ctx.SetBody(resp.Body())
+	if wantsPrettyJSON(cfg, ctx) && isJSONContentType(resp.Header.ContentType()) {
+		ctx.SetBody(prettyJSON(resp.Body()))
+	} else {
+		ctx.SetBody(resp.Body())
+	}
+	if n := len(ctx.Response.Body()); s.sizes.observe(n, cfg.LargeResponseWarnBytes) {
+		log.Printf("WARN large response: %d bytes for %s %s", n, method, ctx.Path())
+	}
 
-	// Copy response headers (avoid hop-by-hop headers)
+	// Copy response headers (avoid hop-by-hop headers), up to
+	// MAX_RESPONSE_HEADER_BYTES. Repeated headers stay repeated, and
+	// chunked trailers such as grpc-status, which fasthttp reads into the
+	// header, are passed on as headers of the buffered response.
+	headerBytes, dropped := 0, 0
 	resp.Header.VisitAll(func(k, v []byte) {
-		key := strings.ToLower(string(k))
-		switch key {
-		case "connection", "proxy-connection", "keep-alive", "transfer-encoding", "upgrade", "proxy-authenticate", "proxy-authorization", "te", "trailer", "trailers":
-			// skip hop-by-hop
-		default:
-			ctx.Response.Header.Set(string(k), string(v))
+		if isHopByHop(strings.ToLower(string(k))) {
+			return
+		}
+		if headerBytes += headerLineSize(k, v); cfg.MaxResponseHeaderBytes > 0 && headerBytes > cfg.MaxResponseHeaderBytes {
+			dropped++
+			return
 		}
+		ctx.Response.Header.Add(string(k), string(v))
 	})
+	if dropped > 0 {
+		log.Printf("WARN dropped %d upstream response headers over %d bytes for %s %s", dropped, cfg.MaxResponseHeaderBytes, method, ctx.Path())
+		ctx.Response.Header.Set("X-Proxy-Headers-Dropped", strconv.Itoa(dropped))
+	}
+	if code := resp.Header.Peek("X-Proxy-Error"); err != nil && len(code) > 0 {
+		setErrorBody(ctx, resp.StatusCode(), string(code), string(resp.Body()))
+	}
+	setTimingHeaders(cfg, ctx)
+	setBodyChecksum(cfg, ctx)
+
+	if cacheable {
+		ctx.Response.Header.Set("X-Proxy-Cache", "MISS")
+		// canary responses are never cached under the primary's key
+		canary := len(resp.Header.Peek("X-Proxy-Canary")) > 0
+		if err == nil && cacheableStatus(cfg, resp.StatusCode()) && sharedResponse(resp) && !canary {
+			s.cache.set(cacheKeyStr, newCachedResponse(resp))
+		}
+	}
+	s.throttleBody(cfg, ctx, subdomain)
 }
 
-func makeRequest(ctx *fasthttp.RequestCtx, attempt int) *fasthttp.Response {
-	if attempt > retries {
-		r := fasthttp.AcquireResponse()
-		r.SetStatusCode(500)
-		r.SetBody([]byte("Proxy failed to connect. Please try again."))
-		return r
+// upstreamDomain is the default TARGET_DOMAIN.
+const upstreamDomain = "roblox.com"
+
+// robloxSubdomains is the default KNOWN_SUBDOMAINS: the Roblox web API
+// services that STRICT_SUBDOMAIN lets through.
+const robloxSubdomains = "accountinformation,accountsettings,adconfiguration,apis,assetdelivery,auth," +
+	"avatar,badges,billing,catalog,chat,clientsettings,contacts,develop,economy,engagementpayouts," +
+	"followings,friends,gamejoin,games,groups,inventory,itemconfiguration,locale,localization," +
+	"notifications,points,premiumfeatures,presence,privatemessages,publish,search,thumbnails," +
+	"trades,translations,twostepverification,users,voice,www"
+
+// buildTarget maps the client request URI onto the upstream:
+// /{subdomain}/{rest} -> https://{subdomain}.{domain}{base path}/{rest}
+func buildTarget(cfg *Config, ctx *fasthttp.RequestCtx, domain string) (host, url string) {
+	parts := splitRequestURI(ctx)
+	host = parts[0] + "." + domain
+	path := ""
+	if len(parts) > 1 {
+		path = parts[1]
+	}
+	query := ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], rewriteQuery(cfg, path[i:])
+	}
+	return host, "https://" + host + cfg.basePath + "/" + normalizeTrailingSlash(cfg.NormalizeTrailingSlash, path) + query
+}
+
+// clientIP is the address of the client. With TRUST_PROXY_HEADER it is the
+// address TRUST_PROXY_HOPS entries from the right of that header, the one
+// the outermost trusted proxy appended; the entries to its left came from
+// the client and can be anything. Otherwise, or when the header is missing
+// or too short, it is the connection's remote IP.
+func clientIP(cfg *Config, ctx *fasthttp.RequestCtx) string {
+	if cfg.TrustProxyHeader != "" {
+		// repeated headers form one list, in order
+		var chain []string
+		ctx.Request.Header.VisitAll(func(k, v []byte) {
+			if strings.EqualFold(string(k), cfg.TrustProxyHeader) {
+				chain = append(chain, strings.Split(string(v), ",")...)
+			}
+		})
+		if i := len(chain) - cfg.TrustProxyHops; cfg.TrustProxyHops > 0 && i >= 0 {
+			if v := strings.TrimSpace(chain[i]); v != "" {
+				return v
+			}
+		}
 	}
+	return ctx.RemoteIP().String()
+}
 
-	// Build target URL: https://{subdomain}.roblox.com/{rest}
+// splitRequestURI splits the request URI, without its leading slash, into
+// the subdomain and the rest.
+func splitRequestURI(ctx *fasthttp.RequestCtx) []string {
 	raw := string(ctx.Request.Header.RequestURI())
 	if raw != "" && raw[0] == '/' {
 		raw = raw[1:]
 	}
-	parts := strings.SplitN(raw, "/", 2)
-	targetHost := parts[0] + ".roblox.com"
-	targetPath := ""
-	if len(parts) > 1 {
-		targetPath = parts[1]
+	return strings.SplitN(raw, "/", 2)
+}
+
+// rewriteQuery applies QUERY_PARAM_ALLOWLIST and STRIP_QUERY_PARAMS to the
+// query string (including its leading "?"). The query is passed through
+// untouched when neither is configured.
+func rewriteQuery(cfg *Config, query string) string {
+	if cfg.stripQuery == nil && cfg.queryAllow == nil {
+		return query
 	}
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	args.Parse(strings.TrimPrefix(query, "?"))
+	var drop []string
+	args.VisitAll(func(k, _ []byte) {
+		key := string(k)
+		if cfg.stripQuery[key] || (cfg.queryAllow != nil && !cfg.queryAllow[key]) {
+			drop = append(drop, key)
+		}
+	})
+	for _, k := range drop {
+		args.Del(k)
+	}
+	if args.Len() == 0 {
+		return ""
+	}
+	return "?" + string(args.QueryString())
+}
 
-	targetURL := "https://" + targetHost + "/" + targetPath
-	log.Printf("Proxy attempt %d -> %s", attempt, targetURL)
+// normalizeTrailingSlash applies NORMALIZE_TRAILING_SLASH to the upstream
+// path (without its leading slash or query string).
+func normalizeTrailingSlash(mode, path string) string {
+	switch mode {
+	case "strip":
+		return strings.TrimRight(path, "/")
+	case "add":
+		if path != "" && !strings.HasSuffix(path, "/") {
+			return path + "/"
+		}
+	}
+	return path
+}
 
-	// Create request
-	req := fasthttp.AcquireRequest()
+var methodOverrideHeader = reserveHeader("X-HTTP-Method-Override",
+	"Method to send upstream instead of the request's, for clients that can only send GET and POST. Needs METHOD_OVERRIDE_ENABLED.")
+
+// overridableMethods are the methods X-HTTP-Method-Override may name.
+var overridableMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+// applyMethodOverride replaces the request method with the one named in
+// X-HTTP-Method-Override, if any, and drops the header so it isn't sent
+// upstream. It reports false when the header names an unknown method.
+func applyMethodOverride(ctx *fasthttp.RequestCtx) bool {
+	o := ctx.Request.Header.Peek(methodOverrideHeader)
+	if len(o) == 0 {
+		return true
+	}
+	method := strings.ToUpper(strings.TrimSpace(string(o)))
+	if !overridableMethods[method] {
+		return false
+	}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.Header.Del(methodOverrideHeader)
+	return true
+}
+
+// pathSegments counts the /-separated segments in the path of raw, a
+// request URI without its leading slash. Empty segments count too.
+func pathSegments(raw string) int {
+	path := strings.SplitN(raw, "?", 2)[0]
+	return strings.Count(path, "/") + 1
+}
+
+// isHopByHop reports whether the lower-cased header key is a hop-by-hop
+// header that must not be forwarded in either direction.
+func isHopByHop(key string) bool {
+	switch key {
+	case "connection", "proxy-connection", "keep-alive", "transfer-encoding", "upgrade", "proxy-authenticate", "proxy-authorization", "te", "trailer", "trailers":
+		return true
+	}
+	return false
+}
+
+// makeRequest forwards the request upstream, retrying up to RETRIES times
+// (never for NO_RETRY_SUBDOMAINS).
+// The returned response is always non-nil; when every attempt failed it is a
+// synthetic 500 and err holds the last upstream error.
+//
+// When a canary upstream is configured, CANARY_PERCENT of requests are sent
+// to it instead (retries included) and tagged with X-Proxy-Canary: true.
+// Requests for an X-Proxy-Env environment go to its domain instead, never
+// the canary, and are tagged with the host in X-Proxy-Upstream.
+//
+// ACCEPT_ROUTING may send the request to another subdomain or host by its
+// Accept header, on whichever domain it would have gone to.
+//
+// An X-Proxy-Timeout header, or else a TIMEOUT_OVERRIDES entry for the
+// subdomain, sets a deadline shared by all attempts: no attempt or backoff
+// runs past it, and a request that hits it is answered with a 504.
+//
+// The request hooks run on the request of every attempt, and the response
+// hooks on the answer, unless it's a dry run's.
+func (s *Server) makeRequest(ctx *fasthttp.RequestCtx, attempt int) (*fasthttp.Response, error) {
+	cfg := s.config()
+	domain := targetDomain(cfg, ctx)
+	env, _ := ctx.UserValue(envKey).(string)
+	canary := env == "" && cfg.CanaryPercent > 0 && rand.Float64()*100 < cfg.CanaryPercent
+	if canary {
+		domain = cfg.CanaryUpstreamDomain
+	}
+	deadline := requestDeadline(cfg, ctx)
+	resp, err := s.doRequest(cfg, ctx, domain, deadline, attempt, nil)
+	if cfg.HeadFallbackGet && err == nil && resp.StatusCode() == 405 && ctx.IsHead() {
+		// the endpoint has no HEAD: ask with GET and pass on only the
+		// headers, Content-Length included
+		fasthttp.ReleaseResponse(resp)
+		ctx.Request.Header.SetMethod("GET")
+		resp, err = s.doRequest(cfg, ctx, domain, deadline, attempt, nil)
+		ctx.Request.Header.SetMethod("HEAD")
+		resp.ResetBody()
+		resp.Header.Set("X-Proxy-Head-Fallback", "GET")
+	}
+	if err == nil && ctx.UserValue(dryRunKey) == nil {
+		if err = runResponseHooks(cfg, ctx, resp); err != nil {
+			fasthttp.ReleaseResponse(resp)
+			resp = hookFailed(ctx, err)
+		}
+	}
+	if canary {
+		resp.Header.Set("X-Proxy-Canary", "true")
+	}
+	if env != "" {
+		s.envs.add(env)
+		resp.Header.Set("X-Proxy-Upstream", splitRequestURI(ctx)[0]+"."+domain)
+	}
+	return resp, err
+}
+
+func (s *Server) doRequest(cfg *Config, ctx *fasthttp.RequestCtx, domain string, deadline time.Time, attempt int, lastErr error) (*fasthttp.Response, error) {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return timeoutResponse(ctx), fasthttp.ErrTimeout
+	}
+	if attempt > cfg.attempts(splitRequestURI(ctx)[0]) {
+		return failedResponse(lastErr), lastErr
+	}
+
+	targetHost, targetURL := routedTarget(cfg, ctx, domain)
+	if attempt > 1 {
+		// the first attempt is covered by the request log line
+		log.Printf("Proxy attempt %d -> %s", attempt, targetURL)
+	}
+
+	req, err := upstreamRequest(cfg, ctx, targetHost, targetURL)
 	defer fasthttp.ReleaseRequest(req)
+	if err != nil {
+		return hookFailed(ctx, err), err
+	}
+	if key, ok := ctx.UserValue(cloudAPIKeyKey).(string); ok {
+		// only here, so the key never reaches the mirror
+		req.Header.Set("x-api-key", key)
+	}
+	s.addCSRFToken(cfg, targetHost, req)
+	if ctx.UserValue(dryRunKey) != nil {
+		return dryRunResponse(cfg, req), nil
+	}
+	if s.cassettes != nil && cfg.Replay {
+		return s.cassettes.replay(req)
+	}
+
+	// Acquire response and do the request
+	resp := fasthttp.AcquireResponse()
+	send := func() error {
+		start := time.Now()
+		defer func() { addUpstreamDuration(ctx, time.Since(start)) }()
+		if wantsEventStream(cfg, ctx) {
+			stream, err := s.sse.do(req, resp, deadline)
+			if stream != nil {
+				ctx.SetUserValue(eventStreamKey, stream)
+			}
+			return err
+		}
+		if cfg.upstreamHTTP2(splitRequestURI(ctx)[0]) {
+			return s.h2.do(req, resp, deadline)
+		}
+		return s.pool.do(s.client, targetHost, req, resp, deadline, time.Duration(cfg.ConnWaitWarnMs)*time.Millisecond)
+	}
+	// a streamed body is sent once; it can't be sent again
+	streamed := ctx.Request.IsBodyStream()
+	err = send()
+	if err == nil && s.csrfChallenged(cfg, targetHost, req, resp) && !streamed {
+		// answering the challenge isn't a failure, so it doesn't use up
+		// an attempt
+		log.Printf("Retrying %s with a new X-CSRF-TOKEN", targetURL)
+		resp.Reset()
+		if err = send(); err == nil {
+			// cache the token if this one was turned down too
+			s.csrfChallenged(cfg, targetHost, req, resp)
+		}
+	}
+	if err == fasthttp.ErrNoFreeConns && s.client.MaxConnWaitTimeout > 0 {
+		// the pool stayed full for MAX_CONN_WAIT_TIMEOUT; retrying would
+		// only wait again
+		log.Printf("No free connection to %s after %v", targetHost, s.client.MaxConnWaitTimeout)
+		fasthttp.ReleaseResponse(resp)
+		return errorResponse(503, "no_free_conns", "Proxy is overloaded. Please try again."), err
+	}
+	if err != nil {
+		// log full error so Render shows the reason
+		reason := classifyError(err)
+		s.upstreamErrors.add(reason)
+		log.Printf("Request error (attempt %d, reason=%s): %v", attempt, reason, err)
+		fasthttp.ReleaseResponse(resp)
+		if streamed {
+			return failedResponse(err), err
+		}
+		if attempt < cfg.attempts(splitRequestURI(ctx)[0]) && !s.retries.allow() {
+			log.Printf("Retry budget used up, not retrying %s", targetURL)
+			return failedResponse(err), err
+		}
+		// simple backoff before retrying, cut short by the deadline
+		backoff := time.Duration(attempt) * 300 * time.Millisecond
+		if !deadline.IsZero() {
+			if left := time.Until(deadline); left < backoff {
+				backoff = left
+			}
+		}
+		time.Sleep(backoff)
+		return s.doRequest(cfg, ctx, domain, deadline, attempt+1, err)
+	}
+	if s.egress != nil {
+		if a, ok := resp.LocalAddr().(*net.TCPAddr); ok {
+			s.egress.observe(a.IP, resp.StatusCode())
+			ctx.Response.Header.Set("X-Proxy-Egress-IP", a.IP.String())
+		}
+	}
+	if s.cassettes != nil && ctx.UserValue(eventStreamKey) == nil {
+		s.cassettes.record(req, resp)
+	}
+
+	return resp, nil
+}
+
+// upstreamRequest builds the request sent to targetURL for the client
+// request in ctx and runs the request hooks on it. The caller releases
+// it, also when a hook failed.
+func upstreamRequest(cfg *Config, ctx *fasthttp.RequestCtx, targetHost, targetURL string) (*fasthttp.Request, error) {
+	req := fasthttp.AcquireRequest()
 	req.SetRequestURI(targetURL)
 	req.Header.SetMethod(string(ctx.Method()))
-	// Copy headers from client request but skip hop-by-hop and proxy headers
+	// Copy headers from client request but skip hop-by-hop and proxy
+	// headers; repeated headers stay repeated
 	ctx.Request.Header.VisitAll(func(k, v []byte) {
 		key := strings.ToLower(string(k))
-		switch key {
-		case "connection", "proxy-connection", "keep-alive", "transfer-encoding", "upgrade", "proxy-authenticate", "proxy-authorization", "te", "trailer", "trailers":
+		switch {
+		case isHopByHop(key):
 			// skip
-		case "host":
+		case key == "host":
 			// we'll set host explicitly below
 		default:
-			req.Header.Set(string(k), string(v))
+			req.Header.Add(string(k), string(v))
 		}
 	})
 	// set Host correctly
 	req.Header.Set("Host", targetHost)
-	// set a sensible user agent
-	req.Header.Set("User-Agent", "RoProxy/1.0")
-	// remove any Roblox-Id header that might interfere
-	req.Header.Del("Roblox-Id")
 
+	// a multipart upload past REQUEST_BODY_BUFFER_BYTES is passed on as it
+	// arrives, as sent
+	if ctx.Request.IsBodyStream() {
+		req.SetBodyStream(ctx.RequestBodyStream(), ctx.Request.Header.ContentLength())
+		return req, runRequestHooks(cfg, ctx, req)
+	}
 	// copy body (works for GET with empty body too)
+	// (Content-Length is recomputed from the body when the request is written)
 	req.SetBody(ctx.Request.Body())
+	if err := runRequestHooks(cfg, ctx, req); err != nil {
+		return req, err
+	}
+	compressRequestBody(cfg, splitRequestURI(ctx)[0], req)
+	return req, nil
+}
 
-	// Acquire response and do the request
-	resp := fasthttp.AcquireResponse()
-	err := client.Do(req, resp)
-	if err != nil {
-		// log full error so Render shows the reason
-		log.Printf("Request error (attempt %d): %v", attempt, err)
-		fasthttp.ReleaseResponse(resp)
-		// simple backoff before retrying
-		time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
-		return makeRequest(ctx, attempt+1)
+// internalCtx returns a request context for an upstream request the proxy
+// makes on its own while serving ctx, as for the /_proxy/ routes. uri is
+// in the client-facing /{subdomain}/{path} form.
+func internalCtx(ctx *fasthttp.RequestCtx, method, uri string, body []byte) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.SetContentType("application/json")
+		req.SetBody(body)
 	}
+	c := &fasthttp.RequestCtx{}
+	c.Init(&req, ctx.RemoteAddr(), nil)
+	return c
+}
+
+// callError is a failed upstream call made by one of the /_proxy/ routes,
+// in the shape of the proxy's JSON error body.
+type callError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// callJSON sends method uri upstream on behalf of ctx, with body as JSON
+// when not nil, and decodes the JSON reply into v. Upstream 5xx answers
+// are reported as 502.
+func (s *Server) callJSON(ctx *fasthttp.RequestCtx, method, uri string, body []byte, v interface{}) *callError {
+	resp, err := s.makeRequest(internalCtx(ctx, method, uri, body), 1)
+	defer fasthttp.ReleaseResponse(resp)
+	switch {
+	case err != nil:
+		return &callError{resp.StatusCode(), string(resp.Header.Peek("X-Proxy-Error")), string(resp.Body())}
+	case resp.StatusCode() != 200:
+		status := resp.StatusCode()
+		if status >= 500 {
+			status = 502
+		}
+		return &callError{status, "upstream_error", "Upstream answered " + strconv.Itoa(resp.StatusCode()) + " for " + uri + "."}
+	case json.Unmarshal(resp.Body(), v) != nil:
+		return &callError{502, "upstream_error", "Upstream answer for " + uri + " was not understood."}
+	}
+	return nil
+}
+
+// headerLineSize is the size of a header line as sent: "k: v\r\n".
+func headerLineSize(k, v []byte) int {
+	return len(k) + len(v) + 4
+}
 
-	return resp
+// responseHeaderSize is the size of h's header lines.
+func responseHeaderSize(h *fasthttp.ResponseHeader) int {
+	n := 0
+	h.VisitAll(func(k, v []byte) { n += headerLineSize(k, v) })
+	return n
 }
@@ -0,0 +1,1021 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// testConfig returns the defaults with a single attempt per request so that
+// failing tests don't sit in retry backoff.
+func testConfig() *Config {
+	cfg := defaultConfig()
+	cfg.Retries = 1
+	return cfg
+}
+
+// newTestServer returns a Server whose upstream client reaches upstream, a
+// TLS server on an in-memory listener, for every host it dials.
+func newTestServer(t testing.TB, cfg *Config, upstream fasthttp.RequestHandler) *Server {
+	t.Helper()
+	ln := newTestUpstream(t, upstream)
+	s := newTestServerDirect(t, cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) { return ln.Dial() }
+	return s
+}
+
+// newTestServerDirect returns a Server that dials upstream hosts with its
+// own Dial function but accepts any upstream certificate.
+func newTestServerDirect(t testing.TB, cfg *Config) *Server {
+	t.Helper()
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg)
+	s.client.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	return s
+}
+
+// newTestUpstream serves upstream over TLS on an in-memory listener.
+func newTestUpstream(t testing.TB, upstream fasthttp.RequestHandler) *fasthttputil.InmemoryListener {
+	t.Helper()
+	cert, key, err := fasthttp.GenerateTestCertificate("roblox.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { ln.Close() })
+	go (&fasthttp.Server{Handler: upstream}).ServeTLSEmbed(ln, cert, key)
+	return ln
+}
+
+// serveRaw runs requestHandler on the raw HTTP/1.1 request.
+func serveRaw(t testing.TB, s *Server, raw string) *fasthttp.Response {
+	t.Helper()
+	var req fasthttp.Request
+	if err := req.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		t.Fatalf("parsing request: %v", err)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	s.requestHandler(&ctx)
+	resp := &fasthttp.Response{}
+	ctx.Response.CopyTo(resp)
+	return resp
+}
+
+// serveHandler is serveRaw for one route handler, passing over the routing
+// and its key checks.
+func serveHandler(t testing.TB, s *Server, handler func(*Server, *fasthttp.RequestCtx), raw string) *fasthttp.Response {
+	t.Helper()
+	var req fasthttp.Request
+	if err := req.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		t.Fatalf("parsing request: %v", err)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	handler(s, &ctx)
+	resp := &fasthttp.Response{}
+	ctx.Response.CopyTo(resp)
+	return resp
+}
+
+func okUpstream(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(200)
+	ctx.SetBodyString("upstream")
+}
+
+func TestProxyKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		header string
+		status int
+		code   string
+	}{
+		{"no key configured", "", "", 200, ""},
+		{"missing header", "secret", "", 407, "invalid_key"},
+		{"wrong key", "secret", "PROXYKEY: nope\r\n", 407, "invalid_key"},
+		{"right key", "secret", "PROXYKEY: secret\r\n", 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Key = tt.key
+			s := newTestServer(t, cfg, okUpstream)
+			resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"+tt.header+"\r\n")
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode(), tt.status)
+			}
+			if got := string(resp.Header.Peek("X-Proxy-Error")); got != tt.code {
+				t.Errorf("X-Proxy-Error = %q, want %q", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, uri := range []string{"/favicon.png", "/users", "/users?x=1"} {
+		t.Run(uri, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), okUpstream)
+			resp := serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+			if resp.StatusCode() != 400 {
+				t.Errorf("status = %d, want 400", resp.StatusCode())
+			}
+			if got := string(resp.Header.Peek("X-Proxy-Error")); got != "invalid_url" {
+				t.Errorf("X-Proxy-Error = %q, want invalid_url", got)
+			}
+		})
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	var gotHost, gotURI, gotUA, gotRobloxID, gotBody string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		gotHost = string(ctx.Host())
+		gotURI = string(ctx.RequestURI())
+		gotUA = string(ctx.UserAgent())
+		gotRobloxID = string(ctx.Request.Header.Peek("Roblox-Id"))
+		gotBody = string(ctx.PostBody())
+		ctx.SetStatusCode(201)
+		ctx.Response.Header.Set("X-Upstream", "yes")
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"id":1}`)
+	}
+	s := newTestServer(t, testConfig(), upstream)
+	body := `{"name":"x"}`
+	resp := serveRaw(t, s, "POST /users/v1/users?limit=10 HTTP/1.1\r\nHost: proxy\r\n"+
+		"Roblox-Id: 42\r\nContent-Type: application/json\r\nContent-Length: 12\r\n\r\n"+body)
+
+	if gotHost != "users.roblox.com" {
+		t.Errorf("upstream Host = %q", gotHost)
+	}
+	if gotURI != "/v1/users?limit=10" {
+		t.Errorf("upstream URI = %q", gotURI)
+	}
+	if gotUA != "RoProxy/1.0" {
+		t.Errorf("upstream User-Agent = %q", gotUA)
+	}
+	if gotRobloxID != "" {
+		t.Errorf("Roblox-Id forwarded: %q", gotRobloxID)
+	}
+	if gotBody != body {
+		t.Errorf("upstream body = %q, want %q", gotBody, body)
+	}
+	if resp.StatusCode() != 201 {
+		t.Errorf("status = %d, want 201", resp.StatusCode())
+	}
+	if got := string(resp.Header.Peek("X-Upstream")); got != "yes" {
+		t.Errorf("X-Upstream = %q", got)
+	}
+	if got := string(resp.Body()); got != `{"id":1}` {
+		t.Errorf("body = %q", got)
+	}
+}
+
+func TestRejectGetBody(t *testing.T) {
+	var calls int32
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		okUpstream(ctx)
+	}
+	send := func(s *Server, method string) *fasthttp.Response {
+		return serveRaw(t, s, method+" /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\nContent-Length: 2\r\n\r\n{}")
+	}
+
+	s := newTestServer(t, testConfig(), upstream)
+	if resp := send(s, "GET"); resp.StatusCode() != 200 {
+		t.Errorf("off: GET with a body = %d, want it forwarded", resp.StatusCode())
+	}
+
+	cfg := testConfig()
+	cfg.RejectGetBody = true
+	s = newTestServer(t, cfg, upstream)
+	atomic.StoreInt32(&calls, 0)
+	for _, method := range []string{"GET", "HEAD", "DELETE"} {
+		resp := send(s, method)
+		if resp.StatusCode() != 400 || string(resp.Header.Peek("X-Proxy-Error")) != "body_not_allowed" {
+			t.Errorf("%s with a body: %d %q, want 400 body_not_allowed", method, resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("rejected requests reached upstream %d times", n)
+	}
+	if resp := send(s, "POST"); resp.StatusCode() != 200 {
+		t.Errorf("POST with a body = %d, want 200", resp.StatusCode())
+	}
+	if resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("GET without a body = %d, want 200", resp.StatusCode())
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	var calls int32
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.FaultInjectRate = 0.3
+	cfg.FaultInjectStatus = 502
+	s := newTestServer(t, cfg, upstream)
+
+	const n = 1000
+	injected := 0
+	for i := 0; i < n; i++ {
+		resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		if string(resp.Header.Peek("X-Proxy-Fault-Injected")) != "true" {
+			if resp.StatusCode() != 200 {
+				t.Fatalf("untouched request: status %d", resp.StatusCode())
+			}
+			continue
+		}
+		injected++
+		if resp.StatusCode() != 502 || string(resp.Header.Peek("X-Proxy-Error")) != "fault_injected" {
+			t.Fatalf("injected fault: %d %q, want 502 fault_injected", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+		}
+	}
+	// 30% of 1000 has a standard deviation of about 15
+	if injected < 230 || injected > 370 {
+		t.Errorf("%d of %d requests failed, want about 300", injected, n)
+	}
+	if got := int(atomic.LoadInt32(&calls)); got != n-injected {
+		t.Errorf("upstream saw %d requests, want the %d not failed", got, n-injected)
+	}
+}
+
+func TestTimeoutOverrides(t *testing.T) {
+	slow := func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(300 * time.Millisecond)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.TimeoutOverrides = TimeoutOverrides{
+		"users":   Duration(100 * time.Millisecond),
+		"default": Duration(2 * time.Second),
+	}
+	s := newTestServer(t, cfg, slow)
+
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 504 {
+		t.Errorf("users: status = %d, want 504", resp.StatusCode())
+	}
+	resp = serveRaw(t, s, "GET /assetdelivery/v1/asset HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 {
+		t.Errorf("assetdelivery: status = %d, want 200", resp.StatusCode())
+	}
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	slow := func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(500 * time.Millisecond)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.Timeout = Duration(5 * time.Second)
+	cfg.ClientReadTimeout = Duration(100 * time.Millisecond)
+	s := newTestServer(t, cfg, slow)
+
+	// timeout alone would have waited for the answer
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 500 || string(resp.Header.Peek("X-Proxy-Error")) != "upstream_unreachable" {
+		t.Errorf("slow upstream: %d %q, want 500 upstream_unreachable", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+	metrics := string(serveHandler(t, s, (*Server).metricsHandler, "GET /metrics HTTP/1.1\r\nHost: proxy\r\n\r\n").Body())
+	if !strings.Contains(metrics, `roproxy_upstream_errors_total{reason="timeout"} 1`) {
+		t.Error("upstream error not counted as a timeout")
+	}
+}
+
+func TestCanaryDistribution(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Upstream-Host", string(ctx.Host()))
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.CanaryUpstreamDomain = "canary.example.com"
+	cfg.CanaryPercent = 20
+	s := newTestServer(t, cfg, upstream)
+
+	const n = 1000
+	canaries := 0
+	for i := 0; i < n; i++ {
+		resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		host := string(resp.Header.Peek("X-Upstream-Host"))
+		tagged := string(resp.Header.Peek("X-Proxy-Canary")) == "true"
+		if tagged {
+			canaries++
+		}
+		if want := map[bool]string{true: "users.canary.example.com", false: "users.roblox.com"}[tagged]; host != want {
+			t.Fatalf("canary %v went to %q, want %q", tagged, host, want)
+		}
+	}
+	// 20% of 1000 has a standard deviation of about 13
+	if canaries < 150 || canaries > 250 {
+		t.Errorf("%d of %d requests went to the canary, want about 200", canaries, n)
+	}
+}
+
+func TestNormalizeTrailingSlash(t *testing.T) {
+	var gotURI string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		gotURI = string(ctx.RequestURI())
+		okUpstream(ctx)
+	}
+	tests := []struct {
+		mode, uri, want string
+	}{
+		{"", "/users/v1/users/", "/v1/users/"},
+		{"", "/users/v1/users", "/v1/users"},
+		{"strip", "/users/v1/users/", "/v1/users"},
+		{"strip", "/users/v1/users//?next=a/", "/v1/users?next=a/"},
+		{"strip", "/users/v1/users", "/v1/users"},
+		{"add", "/users/v1/users", "/v1/users/"},
+		{"add", "/users/v1/users?next=a", "/v1/users/?next=a"},
+		{"add", "/users/v1/users/", "/v1/users/"},
+	}
+	for _, tt := range tests {
+		cfg := testConfig()
+		cfg.NormalizeTrailingSlash = tt.mode
+		s := newTestServer(t, cfg, upstream)
+		gotURI = ""
+		if resp := serveRaw(t, s, "GET "+tt.uri+" HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+			t.Errorf("%q %s: status %d", tt.mode, tt.uri, resp.StatusCode())
+		}
+		if gotURI != tt.want {
+			t.Errorf("%q %s: upstream got %q, want %q", tt.mode, tt.uri, gotURI, tt.want)
+		}
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		override string
+		status   int
+		method   string
+	}{
+		{"disabled", false, "DELETE", 200, "POST"},
+		{"delete", true, "DELETE", 200, "DELETE"},
+		{"lower case patch", true, "patch", 200, "PATCH"},
+		{"unknown method", true, "FROB", 400, ""},
+		{"no header", true, "", 200, "POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotMethod, gotHeader string
+			upstream := func(ctx *fasthttp.RequestCtx) {
+				gotMethod = string(ctx.Method())
+				gotHeader = string(ctx.Request.Header.Peek("X-HTTP-Method-Override"))
+				okUpstream(ctx)
+			}
+			cfg := testConfig()
+			cfg.MethodOverrideEnabled = tt.enabled
+			s := newTestServer(t, cfg, upstream)
+			header := ""
+			if tt.override != "" {
+				header = "X-HTTP-Method-Override: " + tt.override + "\r\n"
+			}
+			resp := serveRaw(t, s, "POST /friends/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"+header+"Content-Length: 0\r\n\r\n")
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode(), tt.status)
+			}
+			if tt.status == 400 {
+				if got := string(resp.Header.Peek("X-Proxy-Error")); got != "invalid_method_override" {
+					t.Errorf("X-Proxy-Error = %q", got)
+				}
+				return
+			}
+			if gotMethod != tt.method {
+				t.Errorf("upstream method = %q, want %q", gotMethod, tt.method)
+			}
+			if tt.enabled && gotHeader != "" {
+				t.Errorf("override header forwarded upstream: %q", gotHeader)
+			}
+		})
+	}
+}
+
+func TestSubdomainMaxInflight(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if strings.HasPrefix(string(ctx.Host()), "thumbnails.") {
+			entered <- struct{}{}
+			<-release
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.SubdomainMaxInflight = SubdomainLimits{"thumbnails": 1}
+	s := newTestServer(t, cfg, upstream)
+
+	done := make(chan int)
+	go func() {
+		done <- serveRaw(t, s, "GET /thumbnails/v1/a HTTP/1.1\r\nHost: proxy\r\n\r\n").StatusCode()
+	}()
+	<-entered
+
+	resp := serveRaw(t, s, "GET /thumbnails/v1/b HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 503 {
+		t.Errorf("second thumbnails request: status = %d, want 503", resp.StatusCode())
+	}
+	if got := string(resp.Header.Peek("X-Proxy-Error")); got != "subdomain_busy" {
+		t.Errorf("X-Proxy-Error = %q, want subdomain_busy", got)
+	}
+	if resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("users request: status = %d, want 200", resp.StatusCode())
+	}
+
+	close(release)
+	if status := <-done; status != 200 {
+		t.Errorf("first thumbnails request: status = %d, want 200", status)
+	}
+	go func() { <-entered }()
+	if resp := serveRaw(t, s, "GET /thumbnails/v1/c HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("thumbnails after release: status = %d, want 200", resp.StatusCode())
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trust   string
+		hops    int
+		headers string
+		want    string
+	}{
+		{"untrusted header", "", 1, "X-Forwarded-For: 203.0.113.7\r\n", "0.0.0.0"},
+		{"one hop", "X-Forwarded-For", 1, "X-Forwarded-For: 203.0.113.7\r\n", "203.0.113.7"},
+		{"forged prefix", "X-Forwarded-For", 1, "X-Forwarded-For: 198.51.100.66, 203.0.113.7\r\n", "203.0.113.7"},
+		{"two hops", "X-Forwarded-For", 2, "X-Forwarded-For: 198.51.100.66, 203.0.113.7, 10.0.0.1\r\n", "203.0.113.7"},
+		{"repeated header", "X-Forwarded-For", 1, "X-Forwarded-For: 198.51.100.66\r\nX-Forwarded-For: 203.0.113.7\r\n", "203.0.113.7"},
+		{"chain too short", "X-Forwarded-For", 2, "X-Forwarded-For: 203.0.113.7\r\n", "0.0.0.0"},
+		{"no header", "X-Forwarded-For", 1, "", "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.TrustProxyHeader = tt.trust
+			cfg.TrustProxyHops = tt.hops
+			var req fasthttp.Request
+			if err := req.Read(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: proxy\r\n" + tt.headers + "\r\n"))); err != nil {
+				t.Fatal(err)
+			}
+			var ctx fasthttp.RequestCtx
+			ctx.Init(&req, nil, nil)
+			if got := clientIP(cfg, &ctx); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerIPMaxInflight(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/v1/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.PerIPMaxInflight = 2
+	cfg.TrustProxyHeader = "X-Forwarded-For"
+	s := newTestServer(t, cfg, upstream)
+	from := func(ip, path string) *fasthttp.Response {
+		return serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\nX-Forwarded-For: "+ip+"\r\n\r\n")
+	}
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- from("10.0.0.1", "/games/v1/slow").StatusCode() }()
+		<-entered
+	}
+	resp := from("10.0.0.1", "/games/v1/fast")
+	if resp.StatusCode() != 429 || string(resp.Header.Peek("X-Proxy-Error")) != "client_busy" {
+		t.Errorf("third request from 10.0.0.1: %d %q, want 429 client_busy", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+	if resp := from("10.0.0.2", "/games/v1/fast"); resp.StatusCode() != 200 {
+		t.Errorf("request from 10.0.0.2: status = %d, want 200", resp.StatusCode())
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if status := <-done; status != 200 {
+			t.Errorf("slow request: status = %d, want 200", status)
+		}
+	}
+	if resp := from("10.0.0.1", "/games/v1/fast"); resp.StatusCode() != 200 {
+		t.Errorf("after release: status = %d, want 200", resp.StatusCode())
+	}
+	// addresses with nothing in flight aren't kept
+	s.ipInflight.mu.Lock()
+	n := len(s.ipInflight.inflight)
+	s.ipInflight.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d addresses tracked with nothing in flight", n)
+	}
+}
+
+func TestPerIPMaxInflightForgedPrefix(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/v1/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.PerIPMaxInflight = 1
+	cfg.TrustProxyHeader = "X-Forwarded-For"
+	s := newTestServer(t, cfg, upstream)
+	// the load balancer appends 10.0.0.1, the real peer, after whatever
+	// the client sent
+	from := func(forged, path string) *fasthttp.Response {
+		return serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\nX-Forwarded-For: "+forged+", 10.0.0.1\r\n\r\n")
+	}
+
+	done := make(chan int)
+	go func() { done <- from("198.51.100.1", "/games/v1/slow").StatusCode() }()
+	<-entered
+	if resp := from("198.51.100.2", "/games/v1/fast"); resp.StatusCode() != 429 {
+		t.Errorf("different forged prefix: status = %d, want 429", resp.StatusCode())
+	}
+	close(release)
+	if status := <-done; status != 200 {
+		t.Errorf("slow request: status = %d, want 200", status)
+	}
+}
+
+func TestQueryParamRewrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		strip     string
+		allowlist string
+		query     string
+		want      string
+	}{
+		{"nothing configured", "", "", "?b=2&a=1&a=3", "/v1/x?b=2&a=1&a=3"},
+		{"strip", "limit, debug", "", "?limit=1000&cursor=abc&debug", "/v1/x?cursor=abc"},
+		{"strip everything", "limit", "", "?limit=1000", "/v1/x"},
+		{"allowlist", "", "cursor,sortOrder", "?limit=1000&cursor=abc&sortOrder=Asc&x=1", "/v1/x?cursor=abc&sortOrder=Asc"},
+		{"allowlist and strip", "cursor", "cursor,limit", "?limit=10&cursor=abc&x=1", "/v1/x?limit=10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotURI string
+			upstream := func(ctx *fasthttp.RequestCtx) {
+				gotURI = string(ctx.RequestURI())
+				okUpstream(ctx)
+			}
+			cfg := testConfig()
+			cfg.StripQueryParams = tt.strip
+			cfg.QueryParamAllowlist = tt.allowlist
+			s := newTestServer(t, cfg, upstream)
+			serveRaw(t, s, "GET /games/v1/x"+tt.query+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+			if gotURI != tt.want {
+				t.Errorf("upstream URI = %q, want %q", gotURI, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseSizeMetrics(t *testing.T) {
+	big := strings.Repeat("x", 2048)
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if strings.HasSuffix(string(ctx.Path()), "/big") {
+			ctx.SetBodyString(big)
+			return
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.LargeResponseWarnBytes = 1024
+	s := newTestServer(t, cfg, upstream)
+	serveRaw(t, s, "GET /games/v1/small HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	serveRaw(t, s, "GET /games/v1/big HTTP/1.1\r\nHost: proxy\r\n\r\n")
+
+	body := string(serveHandler(t, s, (*Server).metricsHandler, "GET /metrics HTTP/1.1\r\nHost: proxy\r\n\r\n").Body())
+	for _, want := range []string{
+		`roproxy_response_body_bytes_bucket{le="1024"} 1`,
+		`roproxy_response_body_bytes_bucket{le="10240"} 2`,
+		"roproxy_response_body_bytes_sum " + strconv.Itoa(len("upstream")+len(big)),
+		"roproxy_response_body_bytes_count 2",
+		"roproxy_large_responses_total 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestCompressUpstreamBody(t *testing.T) {
+	large := `{"ids":[` + strings.Repeat("1,", 1000) + `1]}`
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		encoding string
+		wantGzip bool
+	}{
+		{"compressed", "/catalog/v1/details", large, "", true},
+		{"under threshold", "/catalog/v1/details", `{"ids":[1]}`, "", false},
+		{"subdomain not listed", "/users/v1/users", large, "", false},
+		{"already encoded", "/catalog/v1/details", large, "identity", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encoding, contentLength string
+			var body []byte
+			upstream := func(ctx *fasthttp.RequestCtx) {
+				encoding = string(ctx.Request.Header.Peek("Content-Encoding"))
+				contentLength = string(ctx.Request.Header.Peek("Content-Length"))
+				body = append([]byte(nil), ctx.Request.Body()...)
+				okUpstream(ctx)
+			}
+			cfg := testConfig()
+			cfg.CompressUpstreamBody = true
+			cfg.CompressUpstreamSubdomains = "catalog"
+			s := newTestServer(t, cfg, upstream)
+
+			header := ""
+			if tt.encoding != "" {
+				header = "Content-Encoding: " + tt.encoding + "\r\n"
+			}
+			serveRaw(t, s, "POST "+tt.path+" HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/json\r\n"+header+
+				"Content-Length: "+strconv.Itoa(len(tt.body))+"\r\n\r\n"+tt.body)
+
+			if contentLength != strconv.Itoa(len(body)) {
+				t.Errorf("Content-Length = %s for a %d byte body", contentLength, len(body))
+			}
+			if !tt.wantGzip {
+				if encoding == "gzip" || string(body) != tt.body {
+					t.Errorf("body was rewritten (Content-Encoding %q)", encoding)
+				}
+				return
+			}
+			if encoding != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+			}
+			plain, err := fasthttp.AppendGunzipBytes(nil, body)
+			if err != nil || string(plain) != tt.body {
+				t.Errorf("gunzipped body = %q, %v; want the original", plain, err)
+			}
+		})
+	}
+}
+
+func TestNoRetrySubdomains(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	failing := func(ctx *fasthttp.RequestCtx) {
+		mu.Lock()
+		calls[string(ctx.Host())]++
+		mu.Unlock()
+		// a malformed response, which fasthttp itself doesn't retry for POST
+		ctx.Conn().Write([]byte("garbage\r\n\r\n"))
+		ctx.Conn().Close()
+	}
+	cfg := testConfig()
+	cfg.Retries = 2
+	cfg.NoRetrySubdomains = "Economy"
+	s := newTestServer(t, cfg, failing)
+
+	serveRaw(t, s, "POST /economy/v1/purchases HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	serveRaw(t, s, "POST /users/v1/users HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	mu.Lock()
+	defer mu.Unlock()
+	if n := calls["economy.roblox.com"]; n != 1 {
+		t.Errorf("economy attempted %d times, want 1", n)
+	}
+	if n := calls["users.roblox.com"]; n != 2 {
+		t.Errorf("users attempted %d times, want 2", n)
+	}
+}
+
+func TestUserAgentMode(t *testing.T) {
+	var gotUA string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		gotUA = string(ctx.Request.Header.UserAgent())
+		okUpstream(ctx)
+	}
+	for _, tc := range []struct {
+		mode, client, want string
+	}{
+		{"override", "Roblox/WinInet", "RoProxy/2.0"},
+		{"passthrough", "Roblox/WinInet", "Roblox/WinInet"},
+		{"passthrough", "", "RoProxy/2.0"},
+		{"append", "Roblox/WinInet", "Roblox/WinInet via RoProxy/2.0"},
+		{"append", "", "RoProxy/2.0"},
+	} {
+		cfg := testConfig()
+		cfg.UserAgentMode = tc.mode
+		cfg.UserAgent = "RoProxy/2.0"
+		s := newTestServer(t, cfg, upstream)
+		raw := "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"
+		if tc.client != "" {
+			raw += "User-Agent: " + tc.client + "\r\n"
+		}
+		gotUA = ""
+		serveRaw(t, s, raw+"\r\n")
+		if gotUA != tc.want {
+			t.Errorf("%s mode with client User-Agent %q: upstream got %q, want %q", tc.mode, tc.client, gotUA, tc.want)
+		}
+	}
+}
+
+func TestUpstreamBasePath(t *testing.T) {
+	var gotURI string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		gotURI = string(ctx.RequestURI())
+		okUpstream(ctx)
+	}
+	for _, tc := range []struct {
+		base, path, want string
+	}{
+		{"", "/users/v1/users/1", "/v1/users/1"},
+		{"/", "/users/v1/users/1", "/v1/users/1"},
+		{"roblox", "/users/v1/users/1", "/roblox/v1/users/1"},
+		{"/roblox", "/users/v1/users/1", "/roblox/v1/users/1"},
+		{"roblox/", "/users/v1/users/1", "/roblox/v1/users/1"},
+		{"/gateway/roblox/", "/users/v1/users/1?limit=10", "/gateway/roblox/v1/users/1?limit=10"},
+		{"/roblox", "/users/", "/roblox/"},
+	} {
+		cfg := testConfig()
+		cfg.UpstreamBasePath = tc.base
+		s := newTestServer(t, cfg, upstream)
+		gotURI = ""
+		serveRaw(t, s, "GET "+tc.path+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		if gotURI != tc.want {
+			t.Errorf("base path %q, request %s: upstream URI = %q, want %q", tc.base, tc.path, gotURI, tc.want)
+		}
+	}
+}
+
+func TestStrictSubdomain(t *testing.T) {
+	var calls int32
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.StrictSubdomain = true
+	s := newTestServer(t, cfg, upstream)
+
+	if resp := serveRaw(t, s, "GET /Users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("known subdomain: status = %d, want 200", resp.StatusCode())
+	}
+	resp := serveRaw(t, s, "GET /nosuchservice/v1/x HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 404 || string(resp.Header.Peek("X-Proxy-Error")) != "unknown_subdomain" {
+		t.Errorf("unknown subdomain: got %d %q, want 404 unknown_subdomain", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+
+	// The list can be replaced
+	cfg = testConfig()
+	cfg.StrictSubdomain = true
+	cfg.KnownSubdomains = "nosuchservice"
+	s = newTestServer(t, cfg, upstream)
+	if resp := serveRaw(t, s, "GET /nosuchservice/v1/x HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("overridden list: status = %d, want 200", resp.StatusCode())
+	}
+	if resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 404 {
+		t.Errorf("overridden list: users status = %d, want 404", resp.StatusCode())
+	}
+}
+
+func TestMaxPathSegments(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxPathSegments = 4
+	s := newTestServer(t, cfg, okUpstream)
+	for uri, want := range map[string]int{
+		"/users/v1/users/1":        200,
+		"/users/v1/users/1?a=/b/c": 200, // the query isn't counted
+		"/users/v1/users/1/x":      400,
+		"/users/v1/users/1/":       400, // nor are empty segments skipped
+		"/users/v1/../../../x":     400, // counted before normalization
+	} {
+		resp := serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		if resp.StatusCode() != want {
+			t.Errorf("%s: status = %d, want %d", uri, resp.StatusCode(), want)
+		}
+		if want == 400 && string(resp.Header.Peek("X-Proxy-Error")) != "path_too_deep" {
+			t.Errorf("%s: X-Proxy-Error = %q, want path_too_deep", uri, resp.Header.Peek("X-Proxy-Error"))
+		}
+	}
+
+	// 0 disables the check
+	cfg = testConfig()
+	cfg.MaxPathSegments = 0
+	s = newTestServer(t, cfg, okUpstream)
+	if resp := serveRaw(t, s, "GET /users"+strings.Repeat("/a", 100)+" HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("disabled: status = %d, want 200", resp.StatusCode())
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Small", "1")
+		for i := 0; i < 20; i++ {
+			ctx.Response.Header.Set("X-Big-"+strconv.Itoa(i), strings.Repeat("v", 500))
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.ReadBufferSize = 16 << 10
+	cfg.MaxResponseHeaderBytes = 2048
+	s := newTestServer(t, cfg, upstream)
+
+	// Headers past the cap are dropped; the ones that fit get through
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 || string(resp.Header.Peek("X-Small")) != "1" {
+		t.Fatalf("drop: got %d with X-Small %q", resp.StatusCode(), resp.Header.Peek("X-Small"))
+	}
+	if len(resp.Header.Peek("X-Big-0")) == 0 || len(resp.Header.Peek("X-Big-19")) > 0 {
+		t.Error("drop: want the first big headers kept and the last dropped")
+	}
+	if n, _ := strconv.Atoi(string(resp.Header.Peek("X-Proxy-Headers-Dropped"))); n < 10 {
+		t.Errorf("X-Proxy-Headers-Dropped = %q", resp.Header.Peek("X-Proxy-Headers-Dropped"))
+	}
+
+	cfg = testConfig()
+	cfg.ReadBufferSize = 16 << 10
+	cfg.MaxResponseHeaderBytes = 2048
+	cfg.MaxResponseHeaderAction = "reject"
+	s = newTestServer(t, cfg, upstream)
+	resp = serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 502 || string(resp.Header.Peek("X-Proxy-Error")) != "response_headers_too_large" {
+		t.Errorf("reject: got %d %q", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+}
+
+func TestHeadFallbackGet(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		mu.Lock()
+		methods = append(methods, string(ctx.Method()))
+		mu.Unlock()
+		if ctx.IsHead() {
+			ctx.Error("Method Not Allowed", 405)
+			return
+		}
+		ctx.Response.Header.Set("ETag", `"v1"`)
+		ctx.SetBodyString(`{"id":1,"name":"x"}`)
+	}
+	head := "HEAD /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"
+
+	s := newTestServer(t, testConfig(), upstream)
+	if resp := serveRaw(t, s, head); resp.StatusCode() != 405 {
+		t.Errorf("without fallback: status = %d, want 405", resp.StatusCode())
+	}
+
+	cfg := testConfig()
+	cfg.HeadFallbackGet = true
+	s = newTestServer(t, cfg, upstream)
+	methods = nil
+	resp := serveRaw(t, s, head)
+	if resp.StatusCode() != 200 || string(resp.Header.Peek("ETag")) != `"v1"` {
+		t.Errorf("fallback: got %d with ETag %q", resp.StatusCode(), resp.Header.Peek("ETag"))
+	}
+	if len(resp.Body()) != 0 || resp.Header.ContentLength() != len(`{"id":1,"name":"x"}`) {
+		t.Errorf("fallback: body %q, Content-Length %d; want no body and the GET's length", resp.Body(), resp.Header.ContentLength())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(methods, ",") != "HEAD,GET" {
+		t.Errorf("upstream saw %v, want HEAD then GET", methods)
+	}
+}
+
+func TestBinaryPassthrough(t *testing.T) {
+	// a gRPC-Web body: a message frame holding every byte value, CRLFs and
+	// NULs included, then the trailer frame
+	var payload []byte
+	for i := 0; i < 3*256; i++ {
+		payload = append(payload, byte(i))
+	}
+	frame := func(flag byte, b []byte) []byte {
+		n := len(b)
+		return append([]byte{flag, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, b...)
+	}
+	body := append(frame(0x00, payload), frame(0x80, []byte("grpc-status:0\r\ngrpc-message:OK\r\n"))...)
+
+	var gotBody []byte
+	var gotEncoding string
+	var gotMeta []string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		gotBody = append([]byte(nil), ctx.PostBody()...)
+		gotEncoding = string(ctx.Request.Header.Peek("Content-Encoding"))
+		gotMeta = nil
+		ctx.Request.Header.VisitAll(func(k, v []byte) {
+			if string(k) == "X-Meta" {
+				gotMeta = append(gotMeta, string(v))
+			}
+		})
+		ctx.SetContentType("application/grpc-web+proto")
+		ctx.Response.Header.Add("X-Meta", "one")
+		ctx.Response.Header.Add("X-Meta", "two")
+		if string(ctx.Path()) == "/trailers" {
+			// grpc-status as real HTTP/1.1 trailers after a chunked body
+			ctx.Response.Header.SetTrailer("Grpc-Status, Grpc-Message")
+			ctx.Response.Header.Set("Grpc-Status", "0")
+			ctx.Response.Header.Set("Grpc-Message", "OK")
+			ctx.SetBodyStreamWriter(func(w *bufio.Writer) { w.Write(gotBody) })
+			return
+		}
+		ctx.Response.Header.Set("Grpc-Status", "0")
+		ctx.Response.Header.Set("Grpc-Message", "OK")
+		ctx.SetBody(gotBody)
+	}
+	cfg := testConfig()
+	cfg.CompressUpstreamBody = true
+	cfg.CompressUpstreamSubdomains = "grpc"
+	cfg.CompressUpstreamMinBytes = 0
+	s := newTestServer(t, cfg, upstream)
+
+	for _, path := range []string{"/grpc/roblox.Service/Call", "/grpc/trailers"} {
+		resp := serveRaw(t, s, "POST "+path+" HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/grpc-web+proto\r\n"+
+			"X-Grpc-Web: 1\r\nX-Meta: a\r\nX-Meta: b\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+		if string(gotBody) != string(body) || gotEncoding != "" {
+			t.Errorf("%s: upstream got %d bytes with Content-Encoding %q, want the %d bytes sent", path, len(gotBody), gotEncoding, len(body))
+		}
+		if strings.Join(gotMeta, ",") != "a,b" {
+			t.Errorf("%s: upstream got X-Meta %v, want [a b]", path, gotMeta)
+		}
+		if resp.StatusCode() != 200 || string(resp.Body()) != string(body) {
+			t.Errorf("%s: %d with %d bytes, want the body back unchanged", path, resp.StatusCode(), len(resp.Body()))
+		}
+		if ct := string(resp.Header.ContentType()); ct != "application/grpc-web+proto" {
+			t.Errorf("%s: Content-Type %q", path, ct)
+		}
+		if st, msg := string(resp.Header.Peek("Grpc-Status")), string(resp.Header.Peek("Grpc-Message")); st != "0" || msg != "OK" {
+			t.Errorf("%s: grpc-status %q, grpc-message %q", path, st, msg)
+		}
+		var meta []string
+		resp.Header.VisitAll(func(k, v []byte) {
+			if string(k) == "X-Meta" {
+				meta = append(meta, string(v))
+			}
+		})
+		if strings.Join(meta, ",") != "one,two" {
+			t.Errorf("%s: X-Meta %v, want [one two]", path, meta)
+		}
+	}
+}
+
+// TestValidateFlag runs main in a child process, since it exits.
+func TestValidateFlag(t *testing.T) {
+	if os.Getenv("ROPROXY_TEST_MAIN") == "1" {
+		os.Args = append([]string{"roproxy"}, strings.Fields(os.Getenv("ROPROXY_TEST_ARGS"))...)
+		main()
+		return
+	}
+	// Holding the port shows up any attempt to listen on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	run := func(args string, env ...string) (string, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestValidateFlag$")
+		cmd.Env = append(os.Environ(), "ROPROXY_TEST_MAIN=1", "ROPROXY_TEST_ARGS="+args, "PORT="+port)
+		cmd.Env = append(cmd.Env, env...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := run("-validate", "TIMEOUT=0")
+	if exit, ok := err.(*exec.ExitError); !ok || exit.Success() {
+		t.Errorf("-validate with a bad config: %v, want a non-zero exit", err)
+	}
+	if !strings.Contains(out, "timeout must be positive") || strings.Contains(out, "Listening") || strings.Contains(out, "in use") {
+		t.Errorf("-validate with a bad config printed:\n%s", out)
+	}
+
+	out, err = run("-validate")
+	if err != nil || !strings.Contains(out, "port: \""+port+"\"") || strings.Contains(out, "Listening") {
+		t.Errorf("-validate with a good config: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maintenanceState is the maintenance mode switch. It starts out from
+// MAINTENANCE* in the config and is flipped at runtime through
+// POST /_proxy/maintenance.
+type maintenanceState struct {
+	Enabled           bool   `json:"enabled"`
+	Message           string `json:"message"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds"`
+}
+
+func (s *Server) maintenanceState() maintenanceState {
+	return *s.maintenance.Load().(*maintenanceState)
+}
+
+func (s *Server) setMaintenance(m maintenanceState) {
+	s.maintenance.Store(&m)
+}
+
+// writeMaintenance answers a request refused because maintenance mode is on.
+func writeMaintenance(ctx *fasthttp.RequestCtx, m maintenanceState) {
+	proxyError(ctx, 503, "maintenance", m.Message)
+	if m.RetryAfterSeconds > 0 {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(m.RetryAfterSeconds))
+	}
+}
+
+var adminKeyHeader = reserveHeader("ADMIN_KEY", "The ADMIN_KEY setting, for the management API under /_proxy/admin/, /_proxy/maintenance and /admin/maintenance.")
+
+// checkAdminKey guards state-changing management endpoints with the
+// ADMIN_KEY request header. When ADMIN_KEY is not configured the endpoint
+// doesn't exist. It reports whether the request may proceed; otherwise the
+// error response has been written.
+func (s *Server) checkAdminKey(ctx *fasthttp.RequestCtx) bool {
+	key := s.config().AdminKey
+	if key == "" {
+		proxyError(ctx, 404, "not_found", "Not found.")
+		return false
+	}
+	if subtle.ConstantTimeCompare(ctx.Request.Header.Peek(adminKeyHeader), []byte(key)) != 1 {
+		proxyError(ctx, 403, "invalid_admin_key", "Missing or invalid ADMIN_KEY header.")
+		return false
+	}
+	return true
+}
+
+// maintenanceHandler serves /_proxy/maintenance and its aliases under
+// /_proxy/admin/ and /admin/: GET returns the current state and POST
+// updates it from a JSON body. Fields left out of the body keep their
+// current value. All of them need only the ADMIN_KEY header, whether or not
+// KEY is set.
+func (s *Server) maintenanceHandler(ctx *fasthttp.RequestCtx) {
+	if !s.checkAdminKey(ctx) {
+		return
+	}
+	switch string(ctx.Method()) {
+	case "GET":
+	case "POST":
+		m := s.maintenanceState()
+		if err := json.Unmarshal(ctx.PostBody(), &m); err != nil {
+			proxyError(ctx, 400, "invalid_body", "Invalid JSON body: "+err.Error())
+			return
+		}
+		if m.RetryAfterSeconds < 0 {
+			proxyError(ctx, 400, "invalid_body", "retryAfterSeconds must not be negative.")
+			return
+		}
+		s.setMaintenance(m)
+		log.Printf("Maintenance mode set: enabled=%v", m.Enabled)
+	default:
+		proxyError(ctx, 405, "method_not_allowed", "Use GET or POST.")
+		return
+	}
+	writeJSON(ctx, 200, s.maintenanceState())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMaintenanceToggle(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminKey = "admin"
+	s := newTestServer(t, cfg, okUpstream)
+	proxied := "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"
+	toggle := func(body string) int {
+		resp := serveRaw(t, s, "POST /_proxy/maintenance HTTP/1.1\r\nHost: proxy\r\nADMIN_KEY: admin\r\n"+
+			"Content-Type: application/json\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		return resp.StatusCode()
+	}
+
+	if resp := serveRaw(t, s, proxied); resp.StatusCode() != 200 {
+		t.Fatalf("before toggle: status = %d, want 200", resp.StatusCode())
+	}
+
+	if status := toggle(`{"enabled":true,"message":"Back soon.","retryAfterSeconds":120}`); status != 200 {
+		t.Fatalf("enabling: status = %d, want 200", status)
+	}
+	resp := serveRaw(t, s, proxied)
+	if resp.StatusCode() != 503 {
+		t.Errorf("enabled: status = %d, want 503", resp.StatusCode())
+	}
+	if got := string(resp.Body()); got != "Back soon." {
+		t.Errorf("enabled: body = %q", got)
+	}
+	if got := string(resp.Header.Peek("Retry-After")); got != "120" {
+		t.Errorf("enabled: Retry-After = %q, want 120", got)
+	}
+	resp = serveRaw(t, s, "GET /readyz HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 || string(resp.Body()) != "maintenance" {
+		t.Errorf("readyz: %d %q, want 200 maintenance", resp.StatusCode(), resp.Body())
+	}
+	resp = serveHandler(t, s, (*Server).runtimeConfigHandler, "GET /_proxy/config HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if want := `{"maintenance":{"enabled":true,"message":"Back soon.","retryAfterSeconds":120}}`; string(resp.Body()) != want {
+		t.Errorf("config = %s, want %s", resp.Body(), want)
+	}
+
+	if status := toggle(`{"enabled":false}`); status != 200 {
+		t.Fatalf("disabling: status = %d, want 200", status)
+	}
+	if resp := serveRaw(t, s, proxied); resp.StatusCode() != 200 {
+		t.Errorf("after disabling: status = %d, want 200", resp.StatusCode())
+	}
+}
+
+func TestMaintenanceAdminKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		adminKey string
+		header   string
+		status   int
+	}{
+		{"admin key unset", "", "ADMIN_KEY: x\r\n", 404},
+		{"missing header", "admin", "", 403},
+		{"wrong key", "admin", "ADMIN_KEY: x\r\n", 403},
+		{"right key", "admin", "ADMIN_KEY: admin\r\n", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.AdminKey = tt.adminKey
+			s := newTestServer(t, cfg, okUpstream)
+			resp := serveRaw(t, s, "GET /_proxy/maintenance HTTP/1.1\r\nHost: proxy\r\n"+tt.header+"\r\n")
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode(), tt.status)
+			}
+		})
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	env := map[string]string{"MAINTENANCE_MODE": "true", "MAINTENANCE_RETRY_AFTER": "30s"}
+	// /admin/maintenance needs only ADMIN_KEY, like the management API,
+	// whether or not KEY is set
+	for _, key := range []string{"", "secret"} {
+		cfg, _, err := loadConfig(nil, func(name string) string { return env[name] })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.Maintenance {
+			t.Fatal("MAINTENANCE_MODE=true did not enable maintenance")
+		}
+		cfg.Key = key
+		cfg.AdminKey = "admin"
+		s := newTestServer(t, cfg, okUpstream)
+		proxied := "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: secret\r\n\r\n"
+
+		resp := serveRaw(t, s, proxied)
+		if resp.StatusCode() != 503 || string(resp.Header.Peek("Retry-After")) != "30" {
+			t.Errorf("KEY %q: proxied: %d, Retry-After %q, want 503 and 30", key, resp.StatusCode(), resp.Header.Peek("Retry-After"))
+		}
+		for _, req := range []string{
+			"GET /healthz HTTP/1.1\r\nHost: proxy\r\n\r\n",
+			"GET /admin/maintenance HTTP/1.1\r\nHost: proxy\r\nADMIN_KEY: admin\r\n\r\n",
+			"GET /_proxy/admin/maintenance HTTP/1.1\r\nHost: proxy\r\nADMIN_KEY: admin\r\n\r\n",
+		} {
+			if resp := serveRaw(t, s, req); resp.StatusCode() != 200 {
+				t.Errorf("KEY %q: %q: status = %d, want 200", key, req, resp.StatusCode())
+			}
+		}
+		if resp := serveRaw(t, s, "GET /admin/maintenance HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 403 {
+			t.Errorf("KEY %q: without ADMIN_KEY: status = %d, want 403", key, resp.StatusCode())
+		}
+
+		body := `{"enabled":false}`
+		resp = serveRaw(t, s, "POST /admin/maintenance HTTP/1.1\r\nHost: proxy\r\nADMIN_KEY: admin\r\n"+
+			"Content-Type: application/json\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		if resp.StatusCode() != 200 {
+			t.Fatalf("KEY %q: disabling: status = %d, want 200", key, resp.StatusCode())
+		}
+		if resp := serveRaw(t, s, proxied); resp.StatusCode() != 200 {
+			t.Errorf("KEY %q: after disabling: status = %d, want 200", key, resp.StatusCode())
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// metricsHandler serves /metrics in the Prometheus text exposition format.
+func (s *Server) metricsHandler(ctx *fasthttp.RequestCtx) {
+	var b bytes.Buffer
+	s.pool.writeMetrics(&b, s.client.MaxConnsPerHost)
+	s.sizes.writeMetrics(&b)
+	s.retries.writeMetrics(&b)
+	s.challenges.writeMetrics(&b)
+	s.legacy.writeMetrics(&b)
+	s.envs.writeMetrics(&b)
+	s.transforms.writeMetrics(&b)
+	s.upstreamErrors.writeMetrics(&b)
+	if s.egress != nil {
+		s.egress.writeMetrics(&b)
+	}
+	if s.mirror != nil {
+		s.mirror.writeMetrics(&b)
+	}
+	fmt.Fprintf(&b, "# HELP roproxy_queue_waiting Requests waiting for max_concurrent_requests.\n# TYPE roproxy_queue_waiting gauge\nroproxy_queue_waiting %d\n",
+		s.concurrency.waiting())
+	if logWriter != nil {
+		fmt.Fprintf(&b, "# HELP roproxy_log_dropped_total Log lines dropped because the log queue was full.\n# TYPE roproxy_log_dropped_total counter\nroproxy_log_dropped_total %d\n",
+			atomic.LoadInt64(&logWriter.dropped))
+	}
+	ctx.SetStatusCode(200)
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.SetBody(b.Bytes())
+}
+
+// statsHandler serves /_proxy/stats as JSON.
+func (s *Server) statsHandler(ctx *fasthttp.RequestCtx) {
+	stats := map[string]interface{}{
+		"pool": s.pool.snapshot(s.client.MaxConnsPerHost),
+	}
+	if s.dns != nil {
+		stats["dns"] = s.dns.snapshot()
+	}
+	if s.egress != nil {
+		stats["egress"] = s.egress.snapshot()
+	}
+	writeJSON(ctx, 200, stats)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// mirror sends copies of proxied requests to MIRROR_UPSTREAM_DOMAIN and to
+// the MIRROR_SHADOWS hosts from a fixed set of workers. Replies from
+// MIRROR_UPSTREAM_DOMAIN are discarded; shadow replies are compared with
+// the primary's. When the queue is full the copy is dropped, so the mirror
+// can never slow down or fail a client request.
+type mirror struct {
+	s     *Server
+	jobs  chan mirrorJob
+	diffs *shadowDiffs
+
+	clientOnce sync.Once
+	client     *fasthttp.Client // see httpClient
+
+	sent, failed, dropped int64
+
+	// shadow comparisons by result, and the upstream time they took
+	shadowMatch, shadowStatus, shadowBody, shadowFailed, shadowDropped int64
+	primaryNanos, shadowNanos                                          int64
+}
+
+// mirrorJob is a queued copy: a plain MIRROR_UPSTREAM_DOMAIN one, or a
+// shadow request to compare with the primary.
+type mirrorJob struct {
+	req    *fasthttp.Request
+	shadow *shadowJob
+}
+
+func newMirror(s *Server, workers, queue, diffs int) *mirror {
+	m := &mirror{s: s, jobs: make(chan mirrorJob, queue), diffs: newShadowDiffs(diffs)}
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+	return m
+}
+
+// httpClient returns the client copies are sent with: s.client's settings
+// as of the first copy, but without its retries, so a copy reaches the
+// mirror or shadow host at most once.
+func (m *mirror) httpClient() *fasthttp.Client {
+	m.clientOnce.Do(func() {
+		c := m.s.client
+		m.client = &fasthttp.Client{
+			ReadTimeout:         c.ReadTimeout,
+			WriteTimeout:        c.WriteTimeout,
+			MaxIdleConnDuration: c.MaxIdleConnDuration,
+			MaxConnsPerHost:     c.MaxConnsPerHost,
+			ReadBufferSize:      c.ReadBufferSize,
+			WriteBufferSize:     c.WriteBufferSize,
+			TLSConfig:           c.TLSConfig,
+			Dial:                c.Dial,
+			// fasthttp retries idempotent requests on its own
+			MaxIdemponentCallAttempts: 1,
+			RetryIf:                   func(*fasthttp.Request) bool { return false },
+		}
+	})
+	return m.client
+}
+
+// maybeMirror queues a copy of the request in ctx for MIRROR_PERCENT of
+// requests.
+func (m *mirror) maybeMirror(cfg *Config, ctx *fasthttp.RequestCtx) {
+	// a streamed body can only be read once, by the real request
+	if cfg.MirrorUpstreamDomain == "" || ctx.Request.IsBodyStream() || rand.Float64()*100 >= cfg.MirrorPercent {
+		return
+	}
+	host, url := buildTarget(cfg, ctx, cfg.MirrorUpstreamDomain)
+	req, err := mirrorRequest(cfg, ctx, host, url)
+	if err != nil {
+		return
+	}
+	select {
+	case m.jobs <- mirrorJob{req: req}:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+		fasthttp.ReleaseRequest(req)
+	}
+}
+
+// mirrorRequest builds a copy of the request in ctx for host, another
+// party than upstream: without the proxy's keys, the client's cookies and
+// Authorization, or the EXTRA_UPSTREAM_SECRET_HEADERS. The request is
+// released when it fails.
+func mirrorRequest(cfg *Config, ctx *fasthttp.RequestCtx, host, url string) (*fasthttp.Request, error) {
+	req, err := upstreamRequest(cfg, ctx, host, url)
+	if err != nil {
+		fasthttp.ReleaseRequest(req)
+		return nil, err
+	}
+	for _, h := range []string{proxyKeyHeader, adminKeyHeader, "Cookie", "Authorization"} {
+		req.Header.Del(h)
+	}
+	for name := range cfg.secretHeaders {
+		req.Header.Del(name)
+	}
+	return req, nil
+}
+
+func (m *mirror) work() {
+	for job := range m.jobs {
+		if job.shadow != nil {
+			m.compareShadow(job.shadow)
+			continue
+		}
+		req := job.req
+		resp := fasthttp.AcquireResponse()
+		if err := m.httpClient().DoDeadline(req, resp, time.Now().Add(m.s.config().Timeout.D())); err != nil {
+			atomic.AddInt64(&m.failed, 1)
+			log.Printf("Mirror request to %s failed: %v", req.Host(), err)
+		} else {
+			atomic.AddInt64(&m.sent, 1)
+		}
+		fasthttp.ReleaseResponse(resp)
+		fasthttp.ReleaseRequest(req)
+	}
+}
+
+func (m *mirror) writeMetrics(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP roproxy_mirror_requests_total Requests copied to the mirror upstream, by result.\n# TYPE roproxy_mirror_requests_total counter\n")
+	fmt.Fprintf(b, "roproxy_mirror_requests_total{result=\"sent\"} %d\n", atomic.LoadInt64(&m.sent))
+	fmt.Fprintf(b, "roproxy_mirror_requests_total{result=\"failed\"} %d\n", atomic.LoadInt64(&m.failed))
+	fmt.Fprintf(b, "roproxy_mirror_requests_total{result=\"dropped\"} %d\n", atomic.LoadInt64(&m.dropped))
+	fmt.Fprintf(b, "# HELP roproxy_mirror_shadow_total Requests copied to a shadow upstream, by how the reply compared with the primary's.\n# TYPE roproxy_mirror_shadow_total counter\n")
+	fmt.Fprintf(b, "roproxy_mirror_shadow_total{result=\"match\"} %d\n", atomic.LoadInt64(&m.shadowMatch))
+	fmt.Fprintf(b, "roproxy_mirror_shadow_total{result=\"status_mismatch\"} %d\n", atomic.LoadInt64(&m.shadowStatus))
+	fmt.Fprintf(b, "roproxy_mirror_shadow_total{result=\"body_mismatch\"} %d\n", atomic.LoadInt64(&m.shadowBody))
+	fmt.Fprintf(b, "roproxy_mirror_shadow_total{result=\"failed\"} %d\n", atomic.LoadInt64(&m.shadowFailed))
+	fmt.Fprintf(b, "roproxy_mirror_shadow_total{result=\"dropped\"} %d\n", atomic.LoadInt64(&m.shadowDropped))
+	fmt.Fprintf(b, "# HELP roproxy_mirror_shadow_seconds_total Upstream time of the compared requests, on the primary and on the shadow.\n# TYPE roproxy_mirror_shadow_seconds_total counter\n")
+	fmt.Fprintf(b, "roproxy_mirror_shadow_seconds_total{upstream=\"primary\"} %g\n", time.Duration(atomic.LoadInt64(&m.primaryNanos)).Seconds())
+	fmt.Fprintf(b, "roproxy_mirror_shadow_seconds_total{upstream=\"shadow\"} %g\n", time.Duration(atomic.LoadInt64(&m.shadowNanos)).Seconds())
+}
+
+// shadowRoute is one MIRROR_SHADOWS entry, written
+// subdomain=host:percent. The subdomain is matched with path.Match, and
+// host may carry a port.
+type shadowRoute struct {
+	pattern string
+	host    string
+	percent float64
+}
+
+func parseMirrorShadows(list string) ([]shadowRoute, error) {
+	var out []shadowRoute
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, target, ok := cut(entry, "=")
+		i := strings.LastIndexByte(target, ':')
+		if !ok || i <= 0 {
+			return nil, fmt.Errorf("%q is not subdomain=host:percent", entry)
+		}
+		percent, err := strconv.ParseFloat(target[i+1:], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("%q: percent must be between 0 and 100", entry)
+		}
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		out = append(out, shadowRoute{pattern: pattern, host: strings.ToLower(target[:i]), percent: percent})
+	}
+	return out, nil
+}
+
+// shadowResult is how one upstream answered a compared request.
+type shadowResult struct {
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	SHA256     string  `json:"sha256,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func newShadowResult(resp *fasthttp.Response, err error, d time.Duration) shadowResult {
+	r := shadowResult{Status: resp.StatusCode(), DurationMs: float64(d.Microseconds()) / 1000}
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	sum := sha256.Sum256(resp.Body())
+	r.SHA256 = hex.EncodeToString(sum[:])
+	return r
+}
+
+// shadowJob is a request copied to a shadow host, with the primary's
+// answer once there is one.
+type shadowJob struct {
+	req     *fasthttp.Request
+	diff    shadowDiff
+	primary time.Duration
+}
+
+// shadowDiff is a compared request whose shadow reply differed from the
+// primary's, as shown at /_proxy/admin/mirror.
+type shadowDiff struct {
+	Time    time.Time    `json:"time"`
+	Method  string       `json:"method"`
+	Path    string       `json:"path"`
+	Host    string       `json:"shadowHost"`
+	Result  string       `json:"result"` // status_mismatch, body_mismatch or failed
+	Primary shadowResult `json:"primary"`
+	Shadow  shadowResult `json:"shadow"`
+}
+
+// prepareShadow copies the request in ctx for the first MIRROR_SHADOWS
+// entry matching subdomain, for its percent of requests. It returns nil
+// when the request isn't shadowed: MIRROR_SHADOW_METHODS leaves out the
+// methods that change something by default, and a streamed body can only
+// be read by the real request. The copy is built before the primary is
+// sent, from the request as the client sent it.
+func (m *mirror) prepareShadow(cfg *Config, ctx *fasthttp.RequestCtx, subdomain string) *shadowJob {
+	if len(cfg.mirrorShadows) == 0 || ctx.Request.IsBodyStream() || !cfg.shadowMethods[string(ctx.Method())] {
+		return nil
+	}
+	for _, r := range cfg.mirrorShadows {
+		if ok, _ := path.Match(r.pattern, strings.ToLower(subdomain)); !ok {
+			continue
+		}
+		if rand.Float64()*100 >= r.percent {
+			return nil
+		}
+		host, url := buildTarget(cfg, ctx, cfg.TargetDomain)
+		url = "https://" + r.host + strings.TrimPrefix(url, "https://"+host)
+		req, err := mirrorRequest(cfg, ctx, r.host, url)
+		if err != nil {
+			return nil
+		}
+		return &shadowJob{
+			req:  req,
+			diff: shadowDiff{Time: time.Now(), Method: string(ctx.Method()), Path: string(ctx.Path()), Host: r.host},
+		}
+	}
+	return nil
+}
+
+// setPrimary records the primary's answer to the shadowed request.
+func (j *shadowJob) setPrimary(resp *fasthttp.Response, err error, d time.Duration) {
+	j.diff.Primary = newShadowResult(resp, err, d)
+	j.primary = d
+}
+
+// queueShadow hands j to the workers. It's called once the client has its
+// answer.
+func (m *mirror) queueShadow(j *shadowJob) {
+	select {
+	case m.jobs <- mirrorJob{shadow: j}:
+	default:
+		atomic.AddInt64(&m.shadowDropped, 1)
+		fasthttp.ReleaseRequest(j.req)
+	}
+}
+
+// compareShadow sends j to its shadow host and compares the reply with
+// the primary's by status and body hash. Differences are kept in the diff
+// buffer; latency only goes to the metrics, as it always differs.
+func (m *mirror) compareShadow(j *shadowJob) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	defer fasthttp.ReleaseRequest(j.req)
+	start := time.Now()
+	err := m.httpClient().DoDeadline(j.req, resp, time.Now().Add(m.s.config().Timeout.D()))
+	d := time.Since(start)
+	j.diff.Shadow = newShadowResult(resp, err, d)
+	atomic.AddInt64(&m.primaryNanos, int64(j.primary))
+	atomic.AddInt64(&m.shadowNanos, int64(d))
+	switch {
+	case err != nil:
+		atomic.AddInt64(&m.shadowFailed, 1)
+		j.diff.Result = "failed"
+	case j.diff.Shadow.Status != j.diff.Primary.Status:
+		atomic.AddInt64(&m.shadowStatus, 1)
+		j.diff.Result = "status_mismatch"
+	case j.diff.Shadow.SHA256 != j.diff.Primary.SHA256:
+		atomic.AddInt64(&m.shadowBody, 1)
+		j.diff.Result = "body_mismatch"
+	default:
+		atomic.AddInt64(&m.shadowMatch, 1)
+		return
+	}
+	m.diffs.add(j.diff)
+}
+
+// shadowDiffs is a fixed-size ring buffer of the last shadow differences.
+// It is safe for concurrent use.
+type shadowDiffs struct {
+	mu      sync.Mutex
+	entries []shadowDiff
+	next    int
+	full    bool
+}
+
+func newShadowDiffs(size int) *shadowDiffs {
+	if size < 1 {
+		size = 1
+	}
+	return &shadowDiffs{entries: make([]shadowDiff, size)}
+}
+
+// add records d, overwriting the oldest difference once the buffer is full.
+func (b *shadowDiffs) add(d shadowDiff) {
+	b.mu.Lock()
+	b.entries[b.next] = d
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+	b.mu.Unlock()
+}
+
+// snapshot returns a copy of the buffered differences, oldest first.
+func (b *shadowDiffs) snapshot() []shadowDiff {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]shadowDiff{}, b.entries[:b.next]...)
+	}
+	out := make([]shadowDiff, 0, len(b.entries))
+	out = append(out, b.entries[b.next:]...)
+	return append(out, b.entries[:b.next]...)
+}
+
+// mirrorHandler serves GET /_proxy/admin/mirror: the shadow comparison
+// counts and the last differences, oldest first.
+func (s *Server) mirrorHandler(ctx *fasthttp.RequestCtx) {
+	m := s.mirror
+	if m == nil || s.config().MirrorShadows == "" {
+		proxyError(ctx, 404, "no_mirror", "MIRROR_SHADOWS is not set.")
+		return
+	}
+	writeJSON(ctx, 200, map[string]interface{}{
+		"match":          atomic.LoadInt64(&m.shadowMatch),
+		"statusMismatch": atomic.LoadInt64(&m.shadowStatus),
+		"bodyMismatch":   atomic.LoadInt64(&m.shadowBody),
+		"failed":         atomic.LoadInt64(&m.shadowFailed),
+		"dropped":        atomic.LoadInt64(&m.shadowDropped),
+		"diffs":          m.diffs.snapshot(),
+	})
+}
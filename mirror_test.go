@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan string, 10)
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if strings.HasSuffix(string(ctx.Host()), ".mirror.test") {
+			mirrored <- string(ctx.Method()) + " " + string(ctx.Host()) + string(ctx.RequestURI()) + " " + string(ctx.PostBody())
+			// a failing, slow mirror doesn't touch the client's answer
+			time.Sleep(200 * time.Millisecond)
+			ctx.Error("mirror down", 500)
+			return
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.MirrorUpstreamDomain = "mirror.test"
+	s := newTestServer(t, cfg, upstream)
+
+	start := time.Now()
+	resp := serveRaw(t, s, "POST /users/v1/users?x=1 HTTP/1.1\r\nHost: proxy\r\nContent-Length: 2\r\n\r\n{}")
+	if resp.StatusCode() != 200 || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("client got %d after %v, want the primary's 200 without waiting for the mirror", resp.StatusCode(), time.Since(start))
+	}
+	select {
+	case got := <-mirrored:
+		if want := "POST users.mirror.test/v1/users?x=1 {}"; got != want {
+			t.Errorf("mirror got %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// MIRROR_PERCENT=0 turns the copies off
+	cfg = testConfig()
+	cfg.MirrorUpstreamDomain = "mirror.test"
+	cfg.MirrorPercent = 0
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	s.setConfig(cfg)
+	serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	select {
+	case got := <-mirrored:
+		t.Errorf("mirrored %q with mirror_percent 0", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestMirrorCredentials(t *testing.T) {
+	t.Setenv("TEST_MIRROR_TOKEN", "s3cret")
+	headers := make(chan *fasthttp.RequestHeader, 1)
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if strings.HasSuffix(string(ctx.Host()), ".mirror.test") {
+			h := &fasthttp.RequestHeader{}
+			ctx.Request.Header.CopyTo(h)
+			headers <- h
+		}
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.Key = "secret"
+	cfg.MirrorUpstreamDomain = "mirror.test"
+	cfg.ExtraUpstreamHeaders = "X-Public: yes"
+	cfg.ExtraUpstreamSecretHeaders = "X-Token: ${TEST_MIRROR_TOKEN}"
+	s := newTestServer(t, cfg, upstream)
+
+	serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: secret\r\nADMIN_KEY: admin\r\n"+
+		"Cookie: .ROBLOSECURITY=abc\r\nAuthorization: Bearer abc\r\nX-Client: kept\r\n\r\n")
+	var h *fasthttp.RequestHeader
+	select {
+	case h = <-headers:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+	for _, name := range []string{"PROXYKEY", "ADMIN_KEY", "Cookie", "Authorization", "X-Token"} {
+		if v := h.Peek(name); len(v) > 0 {
+			t.Errorf("mirror got %s: %q", name, v)
+		}
+	}
+	if string(h.Peek("X-Client")) != "kept" || string(h.Peek("X-Public")) != "yes" {
+		t.Errorf("mirror got X-Client %q, X-Public %q; want the other headers kept", h.Peek("X-Client"), h.Peek("X-Public"))
+	}
+}
+
+func TestMirrorShadows(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var shadowed []string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Host()) != "games-eu.shadow.test" {
+			ctx.SetBodyString("primary " + string(ctx.Path()))
+			if string(ctx.Path()) == "/v1/same" {
+				ctx.SetBodyString("same")
+			}
+			return
+		}
+		mu.Lock()
+		shadowed = append(shadowed, string(ctx.Method())+" "+string(ctx.RequestURI()))
+		mu.Unlock()
+		switch string(ctx.Path()) {
+		case "/v1/hang":
+			<-release
+		case "/v1/same":
+			ctx.SetBodyString("same")
+		case "/v1/status":
+			ctx.Error("shadow down", 500)
+		default:
+			ctx.SetBodyString("shadow " + string(ctx.Path()))
+		}
+	}
+	cfg := testConfig()
+	cfg.AdminKey = "admin"
+	cfg.Timeout = Duration(300 * time.Millisecond)
+	cfg.MirrorShadows = "gam*=games-eu.shadow.test:100"
+	s := newTestServer(t, cfg, upstream)
+	t.Cleanup(func() { close(release) })
+
+	// a hanging shadow doesn't hold up the client
+	start := time.Now()
+	resp := serveRaw(t, s, "GET /games/v1/hang HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 200 || string(resp.Body()) != "primary /v1/hang" || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("client got %d %q after %v, want the primary's answer without waiting for the shadow", resp.StatusCode(), resp.Body(), time.Since(start))
+	}
+	for _, raw := range []string{
+		"GET /games/v1/same?x=1 HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"GET /games/v1/differs HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"GET /games/v1/status HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		// not shadowed: a POST, and a subdomain without an entry
+		"POST /games/v1/differs HTTP/1.1\r\nHost: proxy\r\nContent-Length: 2\r\n\r\n{}",
+		"GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n",
+	} {
+		if resp := serveRaw(t, s, raw); resp.StatusCode() != 200 || strings.HasPrefix(string(resp.Body()), "shadow") {
+			t.Errorf("%s: client got %d %q", strings.SplitN(raw, " HTTP", 2)[0], resp.StatusCode(), resp.Body())
+		}
+	}
+
+	m := s.mirror
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt64(&m.shadowMatch)+atomic.LoadInt64(&m.shadowStatus)+atomic.LoadInt64(&m.shadowBody)+atomic.LoadInt64(&m.shadowFailed) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("shadow requests were not compared")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	// each copy is sent once, the hanging one included
+	sort.Strings(shadowed)
+	if got, want := strings.Join(shadowed, ","), "GET /v1/differs,GET /v1/hang,GET /v1/same?x=1,GET /v1/status"; got != want {
+		t.Errorf("shadow got %s, want %s", got, want)
+	}
+	mu.Unlock()
+
+	resp = serveRaw(t, s, "GET /_proxy/admin/mirror HTTP/1.1\r\nHost: proxy\r\nADMIN_KEY: admin\r\n\r\n")
+	var out struct {
+		Match, StatusMismatch, BodyMismatch, Failed int
+		Diffs                                       []shadowDiff
+	}
+	if err := json.Unmarshal(resp.Body(), &out); err != nil || resp.StatusCode() != 200 {
+		t.Fatalf("admin mirror: %d %s", resp.StatusCode(), resp.Body())
+	}
+	if out.Match != 1 || out.StatusMismatch != 1 || out.BodyMismatch != 1 || out.Failed != 1 || len(out.Diffs) != 3 {
+		t.Errorf("admin mirror: %s", resp.Body())
+	}
+	for _, d := range out.Diffs {
+		want := map[string]string{"/games/v1/hang": "failed", "/games/v1/differs": "body_mismatch", "/games/v1/status": "status_mismatch"}[d.Path]
+		if d.Result != want || d.Host != "games-eu.shadow.test" || d.Primary.Status != 200 || d.Primary.SHA256 == "" {
+			t.Errorf("diff for %s: %+v", d.Path, d)
+		}
+		if want == "body_mismatch" && (d.Shadow.SHA256 == d.Primary.SHA256 || d.Shadow.Status != 200) {
+			t.Errorf("body mismatch: %+v", d)
+		}
+	}
+
+	var b bytes.Buffer
+	m.writeMetrics(&b)
+	if !strings.Contains(b.String(), `roproxy_mirror_shadow_total{result="body_mismatch"} 1`) {
+		t.Errorf("metrics:\n%s", b.String())
+	}
+
+	for _, list := range []string{"games", "games=host", "games=host:101", "[=host:10"} {
+		if _, err := parseMirrorShadows(list); err == nil {
+			t.Errorf("%q accepted", list)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// requestBodyHandler reads request bodies for next. The server streams
+// bodies over REQUEST_BODY_BUFFER_BYTES rather than refusing them so that
+// multipart uploads, such as asset publishing, of up to
+// MULTIPART_MAX_BYTES can be passed upstream as they arrive. Every other
+// body is read into memory here, and refused past the limit as before.
+func requestBodyHandler(cfg *Config, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	limit := cfg.RequestBodyBufferBytes
+	return func(ctx *fasthttp.RequestCtx) {
+		if !ctx.Request.IsBodyStream() {
+			next(ctx)
+			return
+		}
+		n := ctx.Request.Header.ContentLength()
+		switch {
+		case n >= 0 && n <= limit:
+			// the rest of a body under the limit is read now, so no
+			// handler leaves part of it on the connection
+			ctx.Request.Body()
+		case isMultipart(ctx.Request.Header.ContentType()):
+			// whatever the upstream request doesn't read of the body
+			// can't be skipped, so the connection isn't reused
+			ctx.SetConnectionClose()
+			if int64(n) > cfg.MultipartMaxBytes {
+				proxyError(ctx, 413, "body_too_large", "Multipart body over "+strconv.FormatInt(cfg.MultipartMaxBytes, 10)+" bytes.")
+				return
+			}
+		default:
+			// a chunked body under the limit is buffered like any other
+			body, err := ioutil.ReadAll(io.LimitReader(ctx.RequestBodyStream(), int64(limit)+1))
+			if err != nil {
+				ctx.SetConnectionClose()
+				proxyError(ctx, 400, "invalid_body", "Request body could not be read.")
+				return
+			}
+			if len(body) > limit {
+				ctx.SetConnectionClose()
+				proxyError(ctx, 413, "body_too_large", "Request body over "+strconv.Itoa(limit)+" bytes.")
+				return
+			}
+			ctx.Request.SetBody(body)
+		}
+		next(ctx)
+	}
+}
+
+// isMultipart reports whether contentType is multipart/form-data or
+// another multipart type.
+func isMultipart(contentType []byte) bool {
+	mt, _, err := mime.ParseMediaType(string(contentType))
+	return err == nil && strings.HasPrefix(mt, "multipart/")
+}
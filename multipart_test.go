@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// multipartUpload is a publish-style body: a JSON request part and a
+// binary file part.
+func multipartUpload(t *testing.T, fileSize int) (body []byte, contentType string, file []byte) {
+	t.Helper()
+	file = make([]byte, fileSize)
+	for i := range file {
+		file[i] = byte(i * 7)
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	w.WriteField("request", `{"assetType":"Model","displayName":"Chair"}`)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="fileContent"; filename="chair.rbxm"`)
+	h.Set("Content-Type", "model/x-rbxm")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(file)
+	w.Close()
+	return b.Bytes(), w.FormDataContentType(), file
+}
+
+// serveFront serves s on an in-memory listener through the server the
+// proxy listens with, so request bodies are read as in production.
+func serveFront(t *testing.T, cfg *Config, s *Server) *fasthttp.Client {
+	t.Helper()
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { ln.Close() })
+	go newHTTPServer(cfg, s.requestHandler).Serve(ln)
+	return &fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}
+}
+
+func TestMultipartPassthrough(t *testing.T) {
+	var calls int32
+	var sawContentType string
+	var sawRequest, sawPartType string
+	var sawFile []byte
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		if string(ctx.Path()) == "/v1/flaky" {
+			ctx.HijackSetNoResponse(true)
+			ctx.Hijack(func(c net.Conn) {})
+			return
+		}
+		sawContentType = string(ctx.Request.Header.ContentType())
+		form, err := ctx.MultipartForm()
+		if err != nil {
+			ctx.Error(err.Error(), 400)
+			return
+		}
+		sawRequest = form.Value["request"][0]
+		sawPartType = form.File["fileContent"][0].Header.Get("Content-Type")
+		f, err := form.File["fileContent"][0].Open()
+		if err != nil {
+			ctx.Error(err.Error(), 400)
+			return
+		}
+		sawFile, _ = ioutil.ReadAll(f)
+		f.Close()
+		ctx.SetBodyString(`{"path":"operations/1"}`)
+	}
+	cfg := testConfig()
+	cfg.Retries = 2
+	cfg.RequestBodyBufferBytes = 16 << 10
+	cfg.MultipartMaxBytes = 1 << 20
+	s := newTestServer(t, cfg, upstream)
+	client := serveFront(t, cfg, s)
+	post := func(path string, body []byte, contentType string) *fasthttp.Response {
+		t.Helper()
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.SetRequestURI("http://proxy" + path)
+		req.Header.SetMethod("POST")
+		req.Header.SetContentType(contentType)
+		req.SetBody(body)
+		resp := &fasthttp.Response{}
+		if err := client.DoTimeout(req, resp, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, tc := range []struct {
+		name     string
+		fileSize int
+	}{
+		{"buffered", 4 << 10},
+		{"streamed", 200 << 10},
+	} {
+		sawContentType, sawRequest, sawPartType, sawFile = "", "", "", nil
+		body, contentType, file := multipartUpload(t, tc.fileSize)
+		resp := post("/publish/v1/assets", body, contentType)
+		if resp.StatusCode() != 200 {
+			t.Fatalf("%s: %d %s", tc.name, resp.StatusCode(), resp.Body())
+		}
+		if sawContentType != contentType || sawRequest != `{"assetType":"Model","displayName":"Chair"}` ||
+			sawPartType != "model/x-rbxm" || !bytes.Equal(sawFile, file) {
+			t.Errorf("%s: upstream got Content-Type %q, request %q, file part %q with %d bytes (equal: %v)",
+				tc.name, sawContentType, sawRequest, sawPartType, len(sawFile), bytes.Equal(sawFile, file))
+		}
+	}
+
+	// a buffered body is retried, a streamed one can't be
+	for _, tc := range []struct {
+		fileSize int
+		retried  bool
+	}{{4 << 10, true}, {200 << 10, false}} {
+		atomic.StoreInt32(&calls, 0)
+		body, contentType, _ := multipartUpload(t, tc.fileSize)
+		if resp := post("/publish/v1/flaky", body, contentType); resp.StatusCode() != 500 {
+			t.Errorf("%d byte upload to a failing upstream: %d", tc.fileSize, resp.StatusCode())
+		}
+		if n := atomic.LoadInt32(&calls); (n > 1) != tc.retried {
+			t.Errorf("%d byte upload: %d upstream attempts, retried should be %v", tc.fileSize, n, tc.retried)
+		}
+	}
+
+	body, contentType, _ := multipartUpload(t, 2<<20)
+	if resp := post("/publish/v1/assets", body, contentType); resp.StatusCode() != 413 {
+		t.Errorf("over multipart_max_bytes: %d", resp.StatusCode())
+	}
+	if resp := post("/publish/v1/assets", bytes.Repeat([]byte("x"), 32<<10), "application/octet-stream"); resp.StatusCode() != 413 {
+		t.Errorf("large non-multipart body: %d", resp.StatusCode())
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// openAPIDoc is the subset of an OpenAPI 3.0 document the proxy writes.
+type openAPIDoc struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       openAPIInfo                     `json:"info"`
+	Paths      map[string]map[string]openAPIOp `json:"paths"`
+	Components openAPIComponents               `json:"components"`
+	Security   []map[string][]string           `json:"security,omitempty"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIOp struct {
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []openAPIParam             `json:"parameters,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+}
+
+// openAPIParam is a parameter, or with Ref set a reference to one in
+// components.parameters.
+type openAPIParam struct {
+	Ref         string         `json:"$ref,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	In          string         `json:"in,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema,omitempty"`
+}
+
+// openAPIResponse is a response, or with Ref set a reference to one in
+// components.responses.
+type openAPIResponse struct {
+	Ref         string                   `json:"$ref,omitempty"`
+	Description string                   `json:"description,omitempty"`
+	Headers     map[string]openAPIHeader `json:"headers,omitempty"`
+	Content     map[string]openAPIMedia  `json:"content,omitempty"`
+}
+
+type openAPIHeader struct {
+	Description string         `json:"description,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIMedia struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref        string                    `json:"$ref,omitempty"`
+	Type       string                    `json:"type,omitempty"`
+	Properties map[string]*openAPISchema `json:"properties,omitempty"`
+}
+
+type openAPIComponents struct {
+	Parameters      map[string]openAPIParam          `json:"parameters"`
+	Responses       map[string]openAPIResponse       `json:"responses"`
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// proxiedMethods are the operations documented on the proxied path. Any
+// other method is forwarded too.
+var proxiedMethods = []string{"get", "post", "put", "patch", "delete"}
+
+// openAPIDocument describes the proxy: the proxied path with every
+// reserved header and query parameter, and the proxy's own endpoints from
+// the route tables. It's built on each request, so it follows the
+// configuration, and nothing in it can drift from what is served.
+func openAPIDocument(cfg *Config) *openAPIDoc {
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:   "RoProxy",
+			Version: proxyVersion,
+			Description: "A proxy for the Roblox web APIs. /{subdomain}/{rest} is forwarded to https://{subdomain}." +
+				cfg.TargetDomain + "/{rest}; the other paths are the proxy's own.",
+		},
+		Paths: map[string]map[string]openAPIOp{},
+		Components: openAPIComponents{
+			Parameters: map[string]openAPIParam{},
+			Responses: map[string]openAPIResponse{
+				"Error": {
+					Description: "An error from the proxy itself, as JSON, HTML or plain text by the Accept header.",
+					Headers: map[string]openAPIHeader{
+						"X-Proxy-Error": {Description: "The machine-readable error code.", Schema: &openAPISchema{Type: "string"}},
+					},
+					Content: map[string]openAPIMedia{
+						"application/json": {Schema: &openAPISchema{Ref: "#/components/schemas/Error"}},
+						"text/html":        {Schema: &openAPISchema{Type: "string"}},
+						"text/plain":       {Schema: &openAPISchema{Type: "string"}},
+					},
+				},
+			},
+			Schemas: map[string]*openAPISchema{
+				"Error": {Type: "object", Properties: map[string]*openAPISchema{
+					"status":  {Type: "integer"},
+					"code":    {Type: "string"},
+					"message": {Type: "string"},
+				}},
+			},
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"proxyKey": {Type: "apiKey", In: "header", Name: proxyKeyHeader, Description: "The KEY setting."},
+				"adminKey": {Type: "apiKey", In: "header", Name: adminKeyHeader, Description: "The ADMIN_KEY setting."},
+			},
+		},
+	}
+	if cfg.Key != "" {
+		doc.Security = []map[string][]string{{"proxyKey": {}}}
+	}
+
+	var refs []openAPIParam
+	for _, p := range sortedReservedParams() {
+		name := p.In + "." + p.Name
+		doc.Components.Parameters[name] = openAPIParam{Name: p.Name, In: p.In, Description: p.Description, Schema: &openAPISchema{Type: "string"}}
+		refs = append(refs, openAPIParam{Ref: "#/components/parameters/" + name})
+	}
+	description := "Forwarded upstream; the reserved headers and query parameters below are acted on by the proxy."
+	if cfg.BatchEndpoints != "" {
+		description += " POSTs to the BATCH_ENDPOINTS (" + cfg.BatchEndpoints + ") carrying too many IDs are split and their answers merged."
+	}
+	proxied := map[string]openAPIOp{}
+	for _, m := range proxiedMethods {
+		proxied[m] = openAPIOp{
+			Summary:     "Forward to https://{subdomain}." + cfg.TargetDomain + "/{rest}.",
+			Description: description,
+			Tags:        []string{"proxy"},
+			Parameters: append([]openAPIParam{
+				{Name: "subdomain", In: "path", Required: true, Schema: &openAPISchema{Type: "string"}},
+				{Name: "rest", In: "path", Required: true, Description: "The rest of the upstream path, slashes included.", Schema: &openAPISchema{Type: "string"}},
+			}, refs...),
+			Responses: map[string]openAPIResponse{
+				"default": {Description: "The upstream response."},
+				"4XX":     {Ref: "#/components/responses/Error"},
+				"5XX":     {Ref: "#/components/responses/Error"},
+			},
+		}
+	}
+	doc.Paths["/{subdomain}/{rest}"] = proxied
+
+	for _, table := range [][]internalRoute{internalRoutes, adminAPIRoutes, adminRoutes} {
+		for _, r := range table {
+			if r.summary == "" {
+				continue
+			}
+			addRoute(doc, r)
+		}
+	}
+	return doc
+}
+
+// addRoute documents r in doc, with a parameter for every {name} in its
+// path.
+func addRoute(doc *openAPIDoc, r internalRoute) {
+	path := r.doc
+	if path == "" {
+		path = r.path
+	}
+	var params []openAPIParam
+	for rest := path; ; {
+		i := strings.IndexByte(rest, '{')
+		j := strings.IndexByte(rest, '}')
+		if i < 0 || j < i {
+			break
+		}
+		params = append(params, openAPIParam{Name: rest[i+1 : j], In: "path", Required: true, Schema: &openAPISchema{Type: "string"}})
+		rest = rest[j+1:]
+	}
+	tag := "internal"
+	switch {
+	case r.admin:
+		tag = "admin"
+	case r.client:
+		tag = "client"
+	}
+	ops := map[string]openAPIOp{}
+	for _, m := range r.methods {
+		op := openAPIOp{
+			Summary:    r.summary,
+			Tags:       []string{tag},
+			Parameters: params,
+			Responses: map[string]openAPIResponse{
+				"200":     {Description: "OK."},
+				"default": {Ref: "#/components/responses/Error"},
+			},
+		}
+		if r.admin {
+			op.Security = []map[string][]string{{"adminKey": {}}}
+		}
+		ops[strings.ToLower(m)] = op
+	}
+	doc.Paths[path] = ops
+}
+
+// openAPIHandler serves /_proxy/openapi: the OpenAPI document as JSON.
+func (s *Server) openAPIHandler(ctx *fasthttp.RequestCtx) {
+	writeJSON(ctx, 200, openAPIDocument(s.config()))
+}
+
+// docsHandler serves /_proxy/docs: the OpenAPI document as a plain HTML
+// page. It's written here rather than by a viewer script, so it works
+// offline and needs nothing from a CDN.
+func (s *Server) docsHandler(ctx *fasthttp.RequestCtx) {
+	doc := openAPIDocument(s.config())
+	var b strings.Builder
+	e := html.EscapeString
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>RoProxy " + e(doc.Info.Version) + "</title></head>\n<body>\n")
+	b.WriteString("<h1>RoProxy " + e(doc.Info.Version) + "</h1>\n<p>" + e(doc.Info.Description) + " <a href=\"/_proxy/openapi\">OpenAPI document</a></p>\n")
+
+	paths := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	b.WriteString("<h2>Endpoints</h2>\n<table>\n<tr><th>Method</th><th>Path</th><th>Summary</th></tr>\n")
+	for _, p := range paths {
+		ops := doc.Paths[p]
+		for _, m := range []string{"get", "post", "put", "patch", "delete"} {
+			op, ok := ops[m]
+			if !ok {
+				continue
+			}
+			summary := op.Summary
+			if op.Security != nil {
+				summary += " Needs " + adminKeyHeader + "."
+			}
+			b.WriteString("<tr><td>" + strings.ToUpper(m) + "</td><td><code>" + e(p) + "</code></td><td>" + e(summary) + "</td></tr>\n")
+		}
+	}
+	b.WriteString("</table>\n")
+
+	b.WriteString("<h2>Reserved headers and query parameters</h2>\n<p>Acted on by the proxy itself on proxied requests.</p>\n<table>\n<tr><th>In</th><th>Name</th><th>Description</th></tr>\n")
+	for _, p := range sortedReservedParams() {
+		b.WriteString("<tr><td>" + e(p.In) + "</td><td><code>" + e(p.Name) + "</code></td><td>" + e(p.Description) + "</td></tr>\n")
+	}
+	b.WriteString("</table>\n</body></html>\n")
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetBodyString(b.String())
+}
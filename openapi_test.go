@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	reserveHeader("X-Proxy-Test-Only", "Registered by the test.")
+	defer func() { reservedParams = reservedParams[:len(reservedParams)-1] }()
+
+	cfg := testConfig()
+	cfg.AdminKey = "admin"
+	s := newTestServer(t, cfg, okUpstream)
+	resp := serveRaw(t, s, "GET /_proxy/openapi HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	var doc map[string]interface{}
+	if err := json.Unmarshal(resp.Body(), &doc); err != nil || resp.StatusCode() != 200 {
+		t.Fatalf("openapi: %d %v %s", resp.StatusCode(), err, resp.Body())
+	}
+	validateOpenAPI(t, doc)
+
+	paths := doc["paths"].(map[string]interface{})
+	for _, p := range []string{"/{subdomain}/{rest}", "/metrics", "/_proxy/asset/{assetId}", "/_proxy/admin/cache/purge", "/admin/cache/warm", "/_proxy/openapi"} {
+		if paths[p] == nil {
+			t.Errorf("%s not documented", p)
+		}
+	}
+	for _, p := range []string{"/_proxy/admin/", "/admin/"} {
+		if paths[p] != nil {
+			t.Errorf("dispatch prefix %s documented", p)
+		}
+	}
+	if purge := paths["/_proxy/admin/cache/purge"].(map[string]interface{}); purge["get"] != nil || purge["post"] == nil {
+		t.Errorf("cache/purge methods: %v", purge)
+	}
+	params := doc["components"].(map[string]interface{})["parameters"].(map[string]interface{})
+	for _, name := range []string{"header.X-Proxy-Test-Only", "header." + dryRunHeader, "query." + fieldsParam} {
+		if params[name] == nil {
+			t.Errorf("reserved parameter %s not documented", name)
+		}
+	}
+
+	resp = serveRaw(t, s, "GET /_proxy/docs HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	body := string(resp.Body())
+	if resp.StatusCode() != 200 || !strings.HasPrefix(string(resp.Header.ContentType()), "text/html") ||
+		!strings.Contains(body, "X-Proxy-Test-Only") || !strings.Contains(body, "/_proxy/universe/{placeId}") ||
+		strings.Contains(body, "<script") {
+		t.Errorf("docs: %d %s", resp.StatusCode(), body)
+	}
+
+	// the routes are still dispatched from the same tables
+	resp = serveRaw(t, s, "GET /_proxy/admin/cache/purge HTTP/1.1\r\nHost: proxy\r\nADMIN_KEY: admin\r\n\r\n")
+	if resp.StatusCode() != 405 || string(resp.Header.Peek("Allow")) != "POST" {
+		t.Errorf("GET cache/purge: %d, Allow %q", resp.StatusCode(), resp.Header.Peek("Allow"))
+	}
+	if resp = serveRaw(t, s, "GET /_proxy/nope HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 404 {
+		t.Errorf("unknown internal path: %d", resp.StatusCode())
+	}
+	if !isClientRoute("/_proxy/docs") || !isClientRoute("/_proxy/asset/1") || isClientRoute("/_proxy/stats") {
+		t.Error("client routes")
+	}
+}
+
+// validateOpenAPI checks the parts of the OpenAPI 3.0 schema the proxy's
+// document uses, and that every $ref resolves.
+func validateOpenAPI(t *testing.T, doc map[string]interface{}) {
+	t.Helper()
+	if v, _ := doc["openapi"].(string); !strings.HasPrefix(v, "3.0.") {
+		t.Errorf("openapi version %q", v)
+	}
+	info, _ := doc["info"].(map[string]interface{})
+	if info["title"] == nil || info["version"] == nil {
+		t.Errorf("info: %v", info)
+	}
+	paths, _ := doc["paths"].(map[string]interface{})
+	for p, item := range paths {
+		if !strings.HasPrefix(p, "/") {
+			t.Errorf("path %q", p)
+		}
+		for method, raw := range item.(map[string]interface{}) {
+			op := raw.(map[string]interface{})
+			if r, _ := op["responses"].(map[string]interface{}); len(r) == 0 {
+				t.Errorf("%s %s: no responses", method, p)
+			}
+			params, _ := op["parameters"].([]interface{})
+			for _, raw := range params {
+				param := raw.(map[string]interface{})
+				if ref, ok := param["$ref"].(string); ok {
+					param = resolveRef(t, doc, ref)
+				}
+				if param["name"] == nil || param["schema"] == nil {
+					t.Errorf("%s %s: parameter %v", method, p, param)
+				}
+				switch param["in"] {
+				case "path":
+					if param["required"] != true || !strings.Contains(p, "{"+param["name"].(string)+"}") {
+						t.Errorf("%s %s: path parameter %v", method, p, param)
+					}
+				case "header", "query":
+				default:
+					t.Errorf("%s %s: parameter in %v", method, p, param["in"])
+				}
+			}
+		}
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				resolveRef(t, doc, ref)
+			}
+			for _, e := range v {
+				walk(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(doc)
+}
+
+func resolveRef(t *testing.T, doc map[string]interface{}, ref string) map[string]interface{} {
+	t.Helper()
+	if !strings.HasPrefix(ref, "#/") {
+		t.Errorf("$ref %q", ref)
+		return nil
+	}
+	v := interface{}(doc)
+	for _, part := range strings.Split(ref[2:], "/") {
+		m, _ := v.(map[string]interface{})
+		if v = m[part]; v == nil {
+			t.Errorf("$ref %q does not resolve", ref)
+			return nil
+		}
+	}
+	m, _ := v.(map[string]interface{})
+	return m
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cloudKeyHeader names the OPENCLOUD_KEYS entry whose API key a request
+// wants attached. It is never sent upstream.
+var cloudKeyHeader = reserveHeader("X-Proxy-Cloud-Key", "Name of an OPENCLOUD_KEYS entry; its key is sent as x-api-key on /apis/cloud/ requests.")
+
+// cloudAPIKeyKey is the RequestCtx user value holding the Open Cloud API
+// key doRequest sends as x-api-key.
+const cloudAPIKeyKey = "cloudAPIKey"
+
+// cloudKeyLimiter enforces OPENCLOUD_RATE_LIMIT per key name.
+type cloudKeyLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newCloudKeyLimiter() *cloudKeyLimiter {
+	return &cloudKeyLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+func (l *cloudKeyLimiter) allow(name string, rate float64) bool {
+	if rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	b := l.buckets[name]
+	if b == nil || b.rate != rate {
+		b = newTokenBucket(rate)
+		l.buckets[name] = b
+	}
+	l.mu.Unlock()
+	return b.take()
+}
+
+// applyCloudKey handles X-Proxy-Cloud-Key, which is stripped from every
+// request. On an Open Cloud path (apis/cloud/...) the named key from
+// OPENCLOUD_KEYS is attached for doRequest and its use is logged by name.
+// It reports whether the request may proceed; otherwise the error
+// response has been written.
+func (s *Server) applyCloudKey(cfg *Config, ctx *fasthttp.RequestCtx, subdomain, path string) bool {
+	name := strings.ToLower(strings.TrimSpace(string(ctx.Request.Header.Peek(cloudKeyHeader))))
+	ctx.Request.Header.Del(cloudKeyHeader)
+	if name == "" || subdomain != "apis" || !strings.HasPrefix(path, "cloud/") {
+		return true
+	}
+	key, ok := cfg.OpenCloudKeys[name]
+	if !ok {
+		proxyError(ctx, 403, "unknown_cloud_key", "No Open Cloud key is configured as "+name+".")
+		return false
+	}
+	if !s.cloudKeys.allow(name, cfg.OpenCloudRateLimit) {
+		proxyError(ctx, 429, "cloud_key_rate_limited", "Too many requests with Open Cloud key "+name+". Please slow down.")
+		return false
+	}
+	log.Printf("AUDIT Open Cloud key %q used by %s for %s /%s/%s", name, clientIP(cfg, ctx), ctx.Method(), subdomain, splitPath(path))
+	ctx.SetUserValue(cloudAPIKeyKey, key)
+	return true
+}
+
+// splitPath is path without its query string.
+func splitPath(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestOpenCloudKeys(t *testing.T) {
+	var sawKey, sawName string
+	var sawKeyHeader bool
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		sawKey = string(ctx.Request.Header.Peek("x-api-key"))
+		sawKeyHeader = len(ctx.Request.Header.Peek("x-api-key")) > 0
+		sawName = string(ctx.Request.Header.Peek(cloudKeyHeader))
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"path":"universes/1"}`)
+	}
+	const secret = "sk-live-0123456789abcdef"
+	cfg := testConfig()
+	cfg.OpenCloudKeys = SubdomainStrings{"publisher": secret}
+	s := newTestServer(t, cfg, upstream)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	get := func(path, name string) *fasthttp.Response {
+		t.Helper()
+		raw := "GET " + path + " HTTP/1.1\r\nHost: proxy\r\n"
+		if name != "" {
+			raw += cloudKeyHeader + ": " + name + "\r\n"
+		}
+		return serveRaw(t, s, raw+"\r\n")
+	}
+
+	resp := get("/apis/cloud/v2/universes/1", "Publisher")
+	if resp.StatusCode() != 200 || sawKey != secret || sawName != "" {
+		t.Errorf("injection: %d, upstream x-api-key %q, %s %q", resp.StatusCode(), sawKey, cloudKeyHeader, sawName)
+	}
+	if !strings.Contains(logs.String(), `AUDIT Open Cloud key "publisher"`) {
+		t.Errorf("no audit line in logs:\n%s", logs.String())
+	}
+
+	resp = get("/apis/cloud/v2/universes/1", "nope")
+	if resp.StatusCode() != 403 || string(resp.Header.Peek("X-Proxy-Error")) != "unknown_cloud_key" {
+		t.Errorf("unknown name: %d %q", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+
+	// the name header is stripped everywhere, but only Open Cloud paths get a key
+	sawKeyHeader = true
+	if get("/apis/v1/universes/1", "publisher"); sawKeyHeader || sawName != "" {
+		t.Errorf("outside apis/cloud: x-api-key %q, %s %q", sawKey, cloudKeyHeader, sawName)
+	}
+	sawKeyHeader = true
+	if resp := get("/apis/cloud/v2/universes/1", ""); resp.StatusCode() != 200 || sawKeyHeader {
+		t.Errorf("no header: %d, x-api-key %q", resp.StatusCode(), sawKey)
+	}
+
+	cfg.OpenCloudRateLimit = 1
+	codes := map[int]int{}
+	for i := 0; i < 5; i++ {
+		codes[get("/apis/cloud/v2/universes/1", "publisher").StatusCode()]++
+	}
+	if codes[429] == 0 || codes[200] == 0 {
+		t.Errorf("rate limit: %v", codes)
+	}
+	if resp := get("/apis/cloud/v2/universes/1", "publisher"); string(resp.Header.Peek("X-Proxy-Error")) != "cloud_key_rate_limited" {
+		t.Errorf("over limit: %d %q", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+
+	if strings.Contains(logs.String(), secret) {
+		t.Errorf("key logged:\n%s", logs.String())
+	}
+	settings, err := cfg.effective()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(fmt.Sprint(settings), secret) {
+		t.Errorf("key in effective config: %v", settings["opencloud_keys"])
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpproxy"
+)
+
+// outboundProxy is a proxy upstream connections are tunneled through
+// (OUTBOUND_PROXY and OUTBOUND_PROXY_OVERRIDES).
+type outboundProxy struct {
+	// host is the proxy's host:port, without credentials, for logs and
+	// error messages
+	host string
+	dial fasthttp.DialFunc
+}
+
+// newOutboundProxy parses a socks5:// or http:// proxy URL. Credentials
+// are taken from the URL's user info.
+func newOutboundProxy(raw string, timeout time.Duration) (*outboundProxy, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", redactProxyURL(raw))
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %s has no host", redactProxyURL(raw))
+	}
+	p := &outboundProxy{host: u.Host}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		p.dial = fasthttpproxy.FasthttpSocksDialer(raw)
+	case "http":
+		addr := u.Host
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			addr = u.User.Username() + ":" + pass + "@" + addr
+		}
+		p.dial = fasthttpproxy.FasthttpHTTPDialerTimeout(addr, timeout)
+	default:
+		return nil, fmt.Errorf("proxy URL %s must be socks5:// or http://", redactProxyURL(raw))
+	}
+	return p, nil
+}
+
+// dialer returns a DialFunc tunneling through the proxy. Its errors are
+// *outboundProxyError.
+func (p *outboundProxy) dialer() fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		c, err := p.dial(addr)
+		if err != nil {
+			return nil, &outboundProxyError{proxy: p.host, err: err}
+		}
+		return c, nil
+	}
+}
+
+// outboundProxyError is a failure to connect to or through the outbound
+// proxy, including rejected proxy credentials.
+type outboundProxyError struct {
+	proxy string
+	err   error
+}
+
+func (e *outboundProxyError) Error() string {
+	return "outbound proxy " + e.proxy + ": " + e.err.Error()
+}
+
+func (e *outboundProxyError) Unwrap() error { return e.err }
+
+// redactProxyURL masks the password in a proxy URL.
+func redactProxyURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		if i := strings.LastIndexByte(raw, '@'); i >= 0 {
+			return "REDACTED@" + raw[i+1:]
+		}
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return u.String()
+}
+
+// outboundProxyFor returns the proxy connections to host go through, or nil
+// to dial directly. A subdomain listed in OUTBOUND_PROXY_OVERRIDES uses its
+// own proxy ("direct" for none); hosts matching NO_PROXY are always dialed
+// directly.
+func (c *Config) outboundProxyFor(host string) *outboundProxy {
+	if c.noProxy(host) {
+		return nil
+	}
+	raw := c.OutboundProxy
+	sub := host
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		sub = host[:i]
+	}
+	if v, ok := c.OutboundProxyOverrides[strings.ToLower(sub)]; ok {
+		raw = v
+	}
+	if raw == "" || raw == "direct" {
+		return nil
+	}
+	return c.outboundProxies[raw]
+}
+
+// noProxy reports whether host matches a NO_PROXY entry: a full host name,
+// a domain suffix such as roblox.com or .roblox.com, or a bare subdomain
+// such as users.
+func (c *Config) noProxy(host string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(c.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(entry), "."))
+		if entry == "" {
+			continue
+		}
+		if host == entry || strings.HasSuffix(host, "."+entry) || strings.HasPrefix(host, entry+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// stubProxy is a local outbound proxy that tunnels every connection to the
+// in-memory upstream and records the address each client asked for.
+type stubProxy struct {
+	ln       net.Listener
+	upstream *fasthttputil.InmemoryListener
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func startStubProxy(t *testing.T, upstream *fasthttputil.InmemoryListener, handshake func(p *stubProxy, c net.Conn, br *bufio.Reader) bool) *stubProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &stubProxy{ln: ln, upstream: upstream}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				if !handshake(p, c, br) {
+					return
+				}
+				up, err := p.upstream.Dial()
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				go io.Copy(up, br)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return p
+}
+
+func (p *stubProxy) record(target string) {
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+}
+
+func (p *stubProxy) seen() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// connectHandshake answers an HTTP CONNECT, requiring Basic credentials
+// user:pass when auth is set.
+func connectHandshake(auth string) func(p *stubProxy, c net.Conn, br *bufio.Reader) bool {
+	return func(p *stubProxy, c net.Conn, br *bufio.Reader) bool {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			return false
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return false
+		}
+		p.record(req.Host)
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return true
+	}
+}
+
+// socks5Handshake answers a no-auth SOCKS5 CONNECT for a domain name.
+func socks5Handshake(p *stubProxy, c net.Conn, br *bufio.Reader) bool {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil || hdr[0] != 5 {
+		return false
+	}
+	if _, err := io.ReadFull(br, make([]byte, hdr[1])); err != nil {
+		return false
+	}
+	c.Write([]byte{5, 0})
+
+	req := make([]byte, 5)
+	if _, err := io.ReadFull(br, req); err != nil || req[1] != 1 || req[3] != 3 {
+		return false
+	}
+	name := make([]byte, int(req[4])+2)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return false
+	}
+	port := binary.BigEndian.Uint16(name[len(name)-2:])
+	p.record(string(name[:len(name)-2]) + ":" + strconv.Itoa(int(port)))
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return true
+}
+
+func TestOutboundProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake func(p *stubProxy, c net.Conn, br *bufio.Reader) bool
+		url       func(addr string) string
+	}{
+		{"socks5", socks5Handshake, func(addr string) string { return "socks5://" + addr }},
+		{"http connect", connectHandshake("user:pa55"), func(addr string) string { return "http://user:pa55@" + addr }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startStubProxy(t, newTestUpstream(t, okUpstream), tt.handshake)
+			cfg := testConfig()
+			cfg.OutboundProxy = tt.url(p.ln.Addr().String())
+			s := newTestServerDirect(t, cfg)
+
+			resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+			if resp.StatusCode() != 200 || string(resp.Body()) != "upstream" {
+				t.Fatalf("response = %d %q, want 200 upstream", resp.StatusCode(), resp.Body())
+			}
+			if got := p.seen(); len(got) != 1 || got[0] != "users.roblox.com:443" {
+				t.Errorf("proxy saw %v, want [users.roblox.com:443]", got)
+			}
+		})
+	}
+}
+
+func TestOutboundProxyAuthFailure(t *testing.T) {
+	p := startStubProxy(t, newTestUpstream(t, okUpstream), connectHandshake("user:right"))
+	cfg := testConfig()
+	cfg.OutboundProxy = "http://user:wrong@" + p.ln.Addr().String()
+	s := newTestServerDirect(t, cfg)
+
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 502 {
+		t.Errorf("status = %d, want 502", resp.StatusCode())
+	}
+	if got := string(resp.Header.Peek("X-Proxy-Error")); got != "connect_error" {
+		t.Errorf("X-Proxy-Error = %q, want connect_error", got)
+	}
+	body := string(resp.Body())
+	if !strings.Contains(body, p.ln.Addr().String()) {
+		t.Errorf("body %q doesn't name the proxy", body)
+	}
+	if strings.Contains(body, "wrong") {
+		t.Errorf("body %q leaks the proxy password", body)
+	}
+}
+
+func TestOutboundProxyFor(t *testing.T) {
+	cfg := testConfig()
+	cfg.OutboundProxy = "socks5://main:1080"
+	cfg.OutboundProxyOverrides = SubdomainStrings{"thumbnails": "http://thumbs:3128", "assetdelivery": "direct"}
+	cfg.NoProxy = "economy, .example.com"
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"users.roblox.com", "main:1080"},
+		{"thumbnails.roblox.com", "thumbs:3128"},
+		{"assetdelivery.roblox.com", ""},
+		{"economy.roblox.com", ""},
+		{"users.example.com", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if p := cfg.outboundProxyFor(tt.host); p != nil {
+			got = p.host
+		}
+		if got != tt.want {
+			t.Errorf("outboundProxyFor(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// paginateParam is the reserved query parameter that asks for cursor pages
+// to be followed by the proxy: _paginate=all, or _paginate=N for at most N
+// pages. It is never sent upstream.
+var paginateParam = reserveQuery("_paginate", "all, or a number of pages, on a cursor-paginated GET: the proxy follows nextPageCursor and merges the pages' data.")
+
+// cursorPage is the part of a Roblox cursor-paginated response the proxy
+// follows.
+type cursorPage struct {
+	Data           []json.RawMessage `json:"data"`
+	NextPageCursor *string           `json:"nextPageCursor"`
+}
+
+// paginatePages strips _paginate from a GET request and returns how many
+// pages to fetch, capped at PAGINATE_MAX_PAGES. It returns 0 when the
+// request didn't ask for pagination and -1 when the value is invalid.
+func paginatePages(cfg *Config, ctx *fasthttp.RequestCtx) int {
+	if !ctx.IsGet() {
+		return 0
+	}
+	v, ok := queryParam(ctx, paginateParam)
+	if !ok {
+		return 0
+	}
+	setQueryParam(ctx, paginateParam, nil)
+	if v == "all" {
+		return cfg.PaginateMaxPages
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return -1
+	}
+	if n > cfg.PaginateMaxPages {
+		n = cfg.PaginateMaxPages
+	}
+	return n
+}
+
+// paginate follows nextPageCursor from the first page in resp, up to
+// maxPages pages and PAGINATE_MAX_BYTES of data, and replaces resp's body
+// with one page holding all of the data. Every page is fetched through
+// makeRequest, with its own retries and limits. When a page fails, resp
+// becomes a 502 carrying the data so far, the cursor that failed and an
+// error object. Responses that aren't cursor pages are left alone.
+func (s *Server) paginate(cfg *Config, ctx *fasthttp.RequestCtx, resp *fasthttp.Response, maxPages int) {
+	if resp.StatusCode() != 200 || !isJSONContentType(resp.Header.ContentType()) {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Body(), &fields); err != nil {
+		return
+	}
+	var page cursorPage
+	if _, ok := fields["nextPageCursor"]; !ok || json.Unmarshal(resp.Body(), &page) != nil || page.Data == nil {
+		return
+	}
+
+	data := page.Data
+	size := len(resp.Body())
+	pages := 1
+	cursor := page.NextPageCursor
+	var pageErr map[string]interface{}
+	for cursor != nil && *cursor != "" && pages < maxPages && int64(size) < cfg.PaginateMaxBytes {
+		setQueryParam(ctx, "cursor", cursor)
+		next, err := s.makeRequest(ctx, 1)
+		page = cursorPage{}
+		switch {
+		case err != nil || next.StatusCode() != 200:
+			pageErr = map[string]interface{}{
+				"code":    "page_failed",
+				"message": "Fetching page " + strconv.Itoa(pages+1) + " failed.",
+				"status":  next.StatusCode(),
+			}
+		case json.Unmarshal(next.Body(), &page) != nil:
+			pageErr = map[string]interface{}{
+				"code":    "page_invalid",
+				"message": "Page " + strconv.Itoa(pages+1) + " was not a cursor page.",
+				"status":  next.StatusCode(),
+			}
+		}
+		size += len(next.Body())
+		fasthttp.ReleaseResponse(next)
+		if pageErr != nil {
+			break
+		}
+		data = append(data, page.Data...)
+		pages++
+		cursor = page.NextPageCursor
+	}
+
+	fields["data"], _ = json.Marshal(data)
+	// the cursor is kept when a cap or a failure stopped the walk, so the
+	// client can carry on from there
+	fields["nextPageCursor"] = json.RawMessage("null")
+	if cursor != nil && *cursor != "" {
+		fields["nextPageCursor"], _ = json.Marshal(*cursor)
+	}
+	if pageErr != nil {
+		fields["error"], _ = json.Marshal(pageErr)
+		resp.SetStatusCode(502)
+		resp.Header.Set("X-Proxy-Error", pageErr["code"].(string))
+	}
+	body, _ := json.Marshal(fields)
+	resp.SetBody(body)
+	resp.Header.Set("X-Proxy-Pages", strconv.Itoa(pages))
+}
+
+// queryParam returns the value of key in the raw request URI's query.
+func queryParam(ctx *fasthttp.RequestCtx, key string) (string, bool) {
+	raw := string(ctx.Request.Header.RequestURI())
+	i := strings.IndexByte(raw, '?')
+	if i < 0 {
+		return "", false
+	}
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	args.Parse(raw[i+1:])
+	if !args.Has(key) {
+		return "", false
+	}
+	return string(args.Peek(key)), true
+}
+
+// setQueryParam sets key in the raw request URI's query to *value, or
+// deletes it when value is nil. The rest of the URI is kept as sent.
+func setQueryParam(ctx *fasthttp.RequestCtx, key string, value *string) {
+	raw := string(ctx.Request.Header.RequestURI())
+	path, query := raw, ""
+	if i := strings.IndexByte(raw, '?'); i >= 0 {
+		path, query = raw[:i], raw[i+1:]
+	}
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	args.Parse(query)
+	if value == nil {
+		args.Del(key)
+	} else {
+		args.Set(key, *value)
+	}
+	if args.Len() > 0 {
+		path += "?" + string(args.QueryString())
+	}
+	ctx.Request.SetRequestURI(path)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// pagedUpstream serves /v1/items as three cursor pages, and /v1/plain
+// without cursors. failCursor makes one page fail.
+func pagedUpstream(t *testing.T, failCursor string) (fasthttp.RequestHandler, func() []string) {
+	var mu sync.Mutex
+	var uris []string
+	pages := map[string]string{
+		"":   `{"previousPageCursor":null,"nextPageCursor":"c2","data":[1,2]}`,
+		"c2": `{"previousPageCursor":"c1","nextPageCursor":"c3","data":[3,4]}`,
+		"c3": `{"previousPageCursor":"c2","nextPageCursor":null,"data":[5]}`,
+	}
+	handler := func(ctx *fasthttp.RequestCtx) {
+		mu.Lock()
+		uris = append(uris, string(ctx.RequestURI()))
+		mu.Unlock()
+		ctx.SetContentType("application/json")
+		if string(ctx.Path()) == "/v1/plain" {
+			ctx.SetBodyString(`{"id":1}`)
+			return
+		}
+		cursor := string(ctx.QueryArgs().Peek("cursor"))
+		if failCursor != "" && cursor == failCursor {
+			ctx.Error(`{"errors":[]}`, 500)
+			return
+		}
+		ctx.SetBodyString(pages[cursor])
+	}
+	seen := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		out := uris
+		uris = nil
+		return out
+	}
+	return handler, seen
+}
+
+type mergedPage struct {
+	Data           []int   `json:"data"`
+	NextPageCursor *string `json:"nextPageCursor"`
+	Error          *struct {
+		Code string `json:"code"`
+	} `json:"error"`
+}
+
+func getPaged(t *testing.T, s *Server, uri string) (*fasthttp.Response, mergedPage) {
+	t.Helper()
+	resp := serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\nAccept-Encoding: gzip\r\n\r\n")
+	var page mergedPage
+	if err := json.Unmarshal(resp.Body(), &page); err != nil {
+		t.Fatalf("%s: %v in %q", uri, err, resp.Body())
+	}
+	return resp, page
+}
+
+func cursorString(c *string) string {
+	if c == nil {
+		return "null"
+	}
+	return *c
+}
+
+func TestPaginate(t *testing.T) {
+	upstream, seen := pagedUpstream(t, "")
+	cfg := testConfig()
+	s := newTestServer(t, cfg, upstream)
+
+	resp, page := getPaged(t, s, "/games/v1/items?_paginate=all&limit=2")
+	if resp.StatusCode() != 200 || len(page.Data) != 5 || page.NextPageCursor != nil {
+		t.Errorf("all pages: %d with data %v, cursor %s", resp.StatusCode(), page.Data, cursorString(page.NextPageCursor))
+	}
+	if n := string(resp.Header.Peek("X-Proxy-Pages")); n != "3" {
+		t.Errorf("X-Proxy-Pages = %q, want 3", n)
+	}
+	uris := seen()
+	if len(uris) != 3 {
+		t.Fatalf("upstream saw %d requests, want 3", len(uris))
+	}
+	for _, uri := range uris {
+		if strings.Contains(uri, paginateParam) || !strings.Contains(uri, "limit=2") {
+			t.Errorf("upstream URI %q", uri)
+		}
+	}
+	if !strings.Contains(uris[2], "cursor=c3") {
+		t.Errorf("last upstream URI %q, want cursor=c3", uris[2])
+	}
+
+	// A page limit stops early and hands back the cursor to carry on from
+	resp, page = getPaged(t, s, "/games/v1/items?_paginate=2")
+	if len(page.Data) != 4 || cursorString(page.NextPageCursor) != "c3" || string(resp.Header.Peek("X-Proxy-Pages")) != "2" {
+		t.Errorf("two pages: data %v, cursor %s, X-Proxy-Pages %q", page.Data, cursorString(page.NextPageCursor), resp.Header.Peek("X-Proxy-Pages"))
+	}
+	seen()
+
+	// Endpoints without cursors pass through untouched
+	resp = serveRaw(t, s, "GET /games/v1/plain?_paginate=all HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if string(resp.Body()) != `{"id":1}` || len(resp.Header.Peek("X-Proxy-Pages")) > 0 {
+		t.Errorf("plain endpoint: %q with X-Proxy-Pages %q", resp.Body(), resp.Header.Peek("X-Proxy-Pages"))
+	}
+	if uris := seen(); len(uris) != 1 || uris[0] != "/v1/plain" {
+		t.Errorf("plain endpoint: upstream saw %q", uris)
+	}
+
+	if resp := serveRaw(t, s, "GET /games/v1/items?_paginate=0 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 400 {
+		t.Errorf("_paginate=0: status = %d, want 400", resp.StatusCode())
+	}
+}
+
+func TestPaginateCaps(t *testing.T) {
+	upstream, seen := pagedUpstream(t, "")
+	cfg := testConfig()
+	cfg.PaginateMaxPages = 2
+	s := newTestServer(t, cfg, upstream)
+	if _, page := getPaged(t, s, "/games/v1/items?_paginate=all"); len(page.Data) != 4 || cursorString(page.NextPageCursor) != "c3" {
+		t.Errorf("page cap: data %v, cursor %s", page.Data, cursorString(page.NextPageCursor))
+	}
+	if n := len(seen()); n != 2 {
+		t.Errorf("page cap: upstream saw %d requests, want 2", n)
+	}
+
+	cfg = testConfig()
+	cfg.PaginateMaxBytes = 10
+	s = newTestServer(t, cfg, upstream)
+	if _, page := getPaged(t, s, "/games/v1/items?_paginate=all"); len(page.Data) != 2 || cursorString(page.NextPageCursor) != "c2" {
+		t.Errorf("byte cap: data %v, cursor %s", page.Data, cursorString(page.NextPageCursor))
+	}
+}
+
+func TestPaginatePageFailure(t *testing.T) {
+	upstream, _ := pagedUpstream(t, "c3")
+	s := newTestServer(t, testConfig(), upstream)
+
+	resp, page := getPaged(t, s, "/games/v1/items?_paginate=all")
+	if resp.StatusCode() != 502 || string(resp.Header.Peek("X-Proxy-Error")) != "page_failed" {
+		t.Errorf("status %d, X-Proxy-Error %q, want 502 page_failed", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+	if len(page.Data) != 4 || cursorString(page.NextPageCursor) != "c3" || page.Error == nil || page.Error.Code != "page_failed" {
+		t.Errorf("partial result: data %v, cursor %s, error %+v", page.Data, cursorString(page.NextPageCursor), page.Error)
+	}
+}
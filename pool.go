@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fasthttp does not expose the state of the Client's per-host connection
+// pools, so it is tracked from the outside:
+//
+//   - dials, dial latency and open connections are exact: the client's Dial
+//     function is wrapped and every connection it hands out is wrapped so
+//     that Close is observed.
+//   - in-flight and pending requests are counted around client.Do. A request
+//     is considered pending when it started while the host already had
+//     MaxConnsPerHost requests in flight; its whole Do duration is recorded
+//     as connection wait, so wait times are an upper bound.
+//   - peaks are the highest open connection and in-flight counts seen since
+//     start, so they inherit the precision of the counts above: exact for
+//     open connections, approximate for in-flight requests.
+type hostPoolStats struct {
+	dials      int64
+	dialErrors int64
+	dialNanos  int64
+	open       int64
+	inflight   int64
+	pending    int64
+	waits      int64
+	waitNanos  int64
+	noFree     int64
+
+	peakOpen     int64
+	peakInflight int64
+}
+
+// raisePeak sets *peak to n if n is higher.
+func raisePeak(peak *int64, n int64) {
+	for {
+		old := atomic.LoadInt64(peak)
+		if n <= old || atomic.CompareAndSwapInt64(peak, old, n) {
+			return
+		}
+	}
+}
+
+type poolStats struct {
+	mu    sync.Mutex
+	hosts map[string]*hostPoolStats
+}
+
+func newPoolStats() *poolStats {
+	return &poolStats{hosts: map[string]*hostPoolStats{}}
+}
+
+func (p *poolStats) host(name string) *hostPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.hosts[name]
+	if !ok {
+		h = &hostPoolStats{}
+		p.hosts[name] = h
+	}
+	return h
+}
+
+// dial opens a counted connection to addr with dial on behalf of the
+// client's Dial function.
+func (p *poolStats) dial(addr string, dial fasthttp.DialFunc) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	h := p.host(host)
+	start := time.Now()
+	c, err := dial(addr)
+	atomic.AddInt64(&h.dials, 1)
+	atomic.AddInt64(&h.dialNanos, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddInt64(&h.dialErrors, 1)
+		return nil, err
+	}
+	raisePeak(&h.peakOpen, atomic.AddInt64(&h.open, 1))
+	return &countedConn{Conn: c, h: h}, nil
+}
+
+// do runs client.Do for host while keeping the in-flight and wait counters
+// up to date. A non-zero deadline bounds the request. Waits longer than
+// warnAfter are logged.
+func (p *poolStats) do(client *fasthttp.Client, host string, req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time, warnAfter time.Duration) error {
+	h := p.host(host)
+	inflight := atomic.AddInt64(&h.inflight, 1)
+	raisePeak(&h.peakInflight, inflight)
+	waiting := inflight > int64(client.MaxConnsPerHost)
+	if waiting {
+		atomic.AddInt64(&h.pending, 1)
+	}
+	start := time.Now()
+	var err error
+	if deadline.IsZero() {
+		err = client.Do(req, resp)
+	} else {
+		err = client.DoDeadline(req, resp, deadline)
+	}
+	elapsed := time.Since(start)
+	atomic.AddInt64(&h.inflight, -1)
+	if waiting {
+		atomic.AddInt64(&h.pending, -1)
+		atomic.AddInt64(&h.waits, 1)
+		atomic.AddInt64(&h.waitNanos, int64(elapsed))
+		if elapsed > warnAfter {
+			log.Printf("WARN waited %v for a free connection to %s", elapsed, host)
+		}
+	}
+	if err == fasthttp.ErrNoFreeConns {
+		atomic.AddInt64(&h.noFree, 1)
+	}
+	return err
+}
+
+// reset zeroes the counters and brings the peaks down to the current
+// counts, for POST /_proxy/admin/stats/reset. Open connections and
+// requests in flight are left alone.
+func (p *poolStats) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.hosts {
+		for _, n := range []*int64{&h.dials, &h.dialErrors, &h.dialNanos, &h.waits, &h.waitNanos, &h.noFree} {
+			atomic.StoreInt64(n, 0)
+		}
+		atomic.StoreInt64(&h.peakOpen, atomic.LoadInt64(&h.open))
+		atomic.StoreInt64(&h.peakInflight, atomic.LoadInt64(&h.inflight))
+	}
+}
+
+type hostPoolSnapshot struct {
+	Host            string  `json:"host"`
+	Dials           int64   `json:"dials"`
+	DialErrors      int64   `json:"dialErrors"`
+	DialSeconds     float64 `json:"dialSeconds"`
+	Open            int64   `json:"openConns"`
+	PeakOpen        int64   `json:"peakOpenConns"`
+	InFlight        int64   `json:"inFlight"`
+	PeakInFlight    int64   `json:"peakInFlight"`
+	Pending         int64   `json:"pending"`
+	Waits           int64   `json:"waits"`
+	WaitSeconds     float64 `json:"waitSeconds"`
+	NoFreeConns     int64   `json:"noFreeConns"`
+	MaxConnsPerHost int     `json:"maxConnsPerHost"`
+}
+
+func (p *poolStats) snapshot(maxConnsPerHost int) []hostPoolSnapshot {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.hosts))
+	for name := range p.hosts {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	sort.Strings(names)
+
+	out := make([]hostPoolSnapshot, 0, len(names))
+	for _, name := range names {
+		h := p.host(name)
+		out = append(out, hostPoolSnapshot{
+			Host:            name,
+			Dials:           atomic.LoadInt64(&h.dials),
+			DialErrors:      atomic.LoadInt64(&h.dialErrors),
+			DialSeconds:     time.Duration(atomic.LoadInt64(&h.dialNanos)).Seconds(),
+			Open:            atomic.LoadInt64(&h.open),
+			PeakOpen:        atomic.LoadInt64(&h.peakOpen),
+			InFlight:        atomic.LoadInt64(&h.inflight),
+			PeakInFlight:    atomic.LoadInt64(&h.peakInflight),
+			Pending:         atomic.LoadInt64(&h.pending),
+			Waits:           atomic.LoadInt64(&h.waits),
+			WaitSeconds:     time.Duration(atomic.LoadInt64(&h.waitNanos)).Seconds(),
+			NoFreeConns:     atomic.LoadInt64(&h.noFree),
+			MaxConnsPerHost: maxConnsPerHost,
+		})
+	}
+	return out
+}
+
+// writeMetrics appends the pool stats in Prometheus text format.
+func (p *poolStats) writeMetrics(b *bytes.Buffer, maxConnsPerHost int) {
+	snap := p.snapshot(maxConnsPerHost)
+	metric := func(name, typ, help string, value func(s hostPoolSnapshot) string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range snap {
+			fmt.Fprintf(b, "%s{host=%q} %s\n", name, s.Host, value(s))
+		}
+	}
+	metric("roproxy_upstream_dials_total", "counter", "Upstream connections dialed.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.Dials) })
+	metric("roproxy_upstream_dial_errors_total", "counter", "Upstream dials that failed.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.DialErrors) })
+	metric("roproxy_upstream_dial_seconds_total", "counter", "Time spent dialing upstream.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.DialSeconds) })
+	metric("roproxy_upstream_open_conns", "gauge", "Upstream connections currently open.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.Open) })
+	metric("roproxy_upstream_open_conns_peak", "gauge", "Most upstream connections open at once since start.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.PeakOpen) })
+	metric("roproxy_upstream_inflight", "gauge", "Upstream requests currently in flight.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.InFlight) })
+	metric("roproxy_upstream_inflight_peak", "gauge", "Most upstream requests in flight at once since start (approximate).",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.PeakInFlight) })
+	metric("roproxy_upstream_pending", "gauge", "Upstream requests waiting for a free connection.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.Pending) })
+	metric("roproxy_upstream_conn_waits_total", "counter", "Upstream requests that had to wait for a free connection.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.Waits) })
+	metric("roproxy_upstream_conn_wait_seconds_total", "counter", "Upper bound of time spent waiting for a free connection.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.WaitSeconds) })
+	metric("roproxy_upstream_no_free_conns_total", "counter", "Upstream requests rejected with ErrNoFreeConns.",
+		func(s hostPoolSnapshot) string { return fmt.Sprint(s.NoFreeConns) })
+	fmt.Fprintf(b, "# HELP roproxy_upstream_max_conns_per_host Connection limit per upstream host (MAX_CONNS_PER_HOST).\n# TYPE roproxy_upstream_max_conns_per_host gauge\nroproxy_upstream_max_conns_per_host %d\n", maxConnsPerHost)
+}
+
+// countedConn decrements the host's open connection count on Close.
+type countedConn struct {
+	net.Conn
+	h      *hostPoolStats
+	closed int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.h.open, -1)
+	}
+	return c.Conn.Close()
+}
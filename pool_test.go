@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestPoolStatsPeak(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(3)
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		started.Done()
+		<-release
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.Timeout = Duration(5 * time.Second)
+	s := newTestServer(t, cfg, upstream)
+
+	var done sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		}()
+	}
+	started.Wait()
+	close(release)
+	done.Wait()
+
+	snap := s.pool.snapshot(s.client.MaxConnsPerHost)
+	if len(snap) != 1 || snap[0].InFlight != 0 || snap[0].PeakInFlight != 3 {
+		t.Fatalf("snapshot = %+v, want 0 in flight and a peak of 3", snap)
+	}
+	body := string(serveHandler(t, s, (*Server).metricsHandler, "GET /metrics HTTP/1.1\r\nHost: proxy\r\n\r\n").Body())
+	for _, want := range []string{
+		`roproxy_upstream_inflight_peak{host="users.roblox.com"} 3`,
+		"roproxy_upstream_max_conns_per_host 100",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestPoolStatsSaturation(t *testing.T) {
+	entered := make(chan struct{}, 3)
+	release := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		entered <- struct{}{}
+		<-release
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.Timeout = Duration(5 * time.Second)
+	cfg.MaxConnsPerHost = 1
+	cfg.MaxConnWaitTimeout = Duration(5 * time.Second)
+	s := newTestServer(t, cfg, upstream)
+
+	var done sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			if resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+				t.Errorf("status = %d, want 200", resp.StatusCode())
+			}
+		}()
+	}
+	<-entered
+	// one request holds the only connection; the other two wait for it
+	deadline := time.Now().Add(2 * time.Second)
+	for s.pool.snapshot(1)[0].Pending != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot = %+v, want 2 pending", s.pool.snapshot(1))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	snap := s.pool.snapshot(1)[0]
+	if snap.Pending != 0 || snap.Waits != 2 || snap.WaitSeconds < 0.02 {
+		t.Errorf("snapshot = %+v, want 0 pending and 2 waits of at least 20ms", snap)
+	}
+	body := string(serveHandler(t, s, (*Server).metricsHandler, "GET /metrics HTTP/1.1\r\nHost: proxy\r\n\r\n").Body())
+	for _, want := range []string{
+		`roproxy_upstream_conn_waits_total{host="users.roblox.com"} 2`,
+		`roproxy_upstream_pending{host="users.roblox.com"} 0`,
+		"roproxy_upstream_max_conns_per_host 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestPoolFull(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		entered <- struct{}{}
+		<-release
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.Timeout = Duration(5 * time.Second)
+	cfg.MaxConnsPerHost = 1
+	cfg.MaxConnWaitTimeout = Duration(50 * time.Millisecond)
+	s := newTestServer(t, cfg, upstream)
+
+	first := make(chan struct{})
+	go func() {
+		serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		close(first)
+	}()
+	<-entered
+	start := time.Now()
+	resp := serveRaw(t, s, "GET /users/v1/users/2 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 503 || string(resp.Header.Peek("X-Proxy-Error")) != "no_free_conns" {
+		t.Errorf("full pool: %d %q, want 503 no_free_conns", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"))
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 2*time.Second {
+		t.Errorf("answered after %v, want about max_conn_wait_timeout", d)
+	}
+	close(release)
+	<-first
+}
+
+func TestPrivateRoutes(t *testing.T) {
+	for _, path := range []string{"/metrics", "/_proxy/stats", "/_proxy/config"} {
+		cfg := testConfig()
+		s := newTestServer(t, cfg, okUpstream)
+		if resp := serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 404 {
+			t.Errorf("%s without KEY: status = %d, want 404", path, resp.StatusCode())
+		}
+
+		cfg = testConfig()
+		cfg.Key = "secret"
+		s = newTestServer(t, cfg, okUpstream)
+		if resp := serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 407 {
+			t.Errorf("%s without PROXYKEY: status = %d, want 407", path, resp.StatusCode())
+		}
+		if resp := serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: secret\r\n\r\n"); resp.StatusCode() != 200 {
+			t.Errorf("%s with PROXYKEY: status = %d, want 200", path, resp.StatusCode())
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// presenceWatchMaxUsers is how many users one watch may cover.
+	presenceWatchMaxUsers = 100
+
+	// presenceWatchTimeout is how long a watch waits for a change when the
+	// request doesn't say.
+	presenceWatchTimeout = 25 * time.Second
+)
+
+// presenceWatch runs the upstream presence polls behind
+// /_proxy/presence/watch. Watchers of the same set of users share one
+// poll, which runs while any of them is waiting.
+type presenceWatch struct {
+	s *Server
+
+	mu    sync.Mutex
+	polls map[string]*presencePoll // by sorted user IDs
+}
+
+// presencePoll is the shared poll of one set of users. Its fields are
+// guarded by presenceWatch.mu.
+type presencePoll struct {
+	ids      []int64
+	watchers int
+	stop     chan struct{}
+
+	snapshot map[int64]json.RawMessage // nil until the first fetch succeeds
+	err      *callError                // the first fetch's error
+	updated  chan struct{}             // closed when snapshot changes or err is set
+}
+
+func newPresenceWatch(s *Server) *presenceWatch {
+	return &presenceWatch{s: s, polls: map[string]*presencePoll{}}
+}
+
+// presenceWatchHandler serves GET /_proxy/presence/watch?userIds=1,2,3:
+// it answers as soon as any of the users' presence differs from when the
+// request came in, or after timeout (25s, up to PRESENCE_WATCH_MAX_TIMEOUT),
+// with the current presence of every user and the IDs that changed.
+func (s *Server) presenceWatchHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		proxyError(ctx, 405, "method_not_allowed", "Use GET.")
+		return
+	}
+	cfg := s.config()
+	args := ctx.QueryArgs()
+	seen := map[int64]bool{}
+	var ids []int64
+	for _, v := range strings.Split(string(args.Peek("userIds")), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			proxyError(ctx, 400, "invalid_user_ids", "userIds must be a comma-separated list of user IDs.")
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > presenceWatchMaxUsers {
+		proxyError(ctx, 400, "invalid_user_ids", "userIds must list 1 to "+strconv.Itoa(presenceWatchMaxUsers)+" user IDs.")
+		return
+	}
+	timeout := presenceWatchTimeout
+	if v := string(args.Peek("timeout")); v != "" {
+		d, err := time.ParseDuration(v)
+		if n, nerr := strconv.Atoi(v); nerr == nil {
+			d, err = time.Duration(n)*time.Second, nil
+		}
+		if err != nil || d <= 0 {
+			proxyError(ctx, 400, "invalid_timeout", "timeout must be a duration such as 25s.")
+			return
+		}
+		timeout = d
+	}
+	if max := cfg.PresenceWatchMaxTimeout.D(); timeout > max {
+		timeout = max
+	}
+
+	snapshot, changed, e := s.presence.watch(cfg, ids, timeout)
+	if e != nil {
+		writeJSON(ctx, e.Status, map[string]interface{}{"error": e})
+		return
+	}
+	presences := make([]json.RawMessage, 0, len(ids))
+	for _, id := range ids {
+		if p, ok := snapshot[id]; ok {
+			presences = append(presences, p)
+		}
+	}
+	writeJSON(ctx, 200, map[string]interface{}{"userPresences": presences, "changed": changed})
+}
+
+// watch waits up to timeout for the presence of ids to change from the
+// snapshot current when it's called. It returns the latest snapshot and
+// the IDs that changed, in the order given; none when it timed out.
+func (w *presenceWatch) watch(cfg *Config, ids []int64, timeout time.Duration) (map[int64]json.RawMessage, []int64, *callError) {
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	key := ""
+	for _, id := range sorted {
+		key += strconv.FormatInt(id, 10) + ","
+	}
+
+	w.mu.Lock()
+	p := w.polls[key]
+	if p == nil {
+		p = &presencePoll{ids: sorted, stop: make(chan struct{}), updated: make(chan struct{})}
+		w.polls[key] = p
+		go w.run(p, cfg.PresenceWatchInterval.D())
+	}
+	p.watchers++
+	w.mu.Unlock()
+	defer w.release(key, p)
+
+	expired := time.NewTimer(timeout)
+	defer expired.Stop()
+	var base map[int64]json.RawMessage
+	for {
+		w.mu.Lock()
+		snapshot, e, updated := p.snapshot, p.err, p.updated
+		w.mu.Unlock()
+		switch {
+		case snapshot == nil && e != nil:
+			return nil, nil, e
+		case base == nil:
+			base = snapshot
+		default:
+			if changed := changedPresences(ids, base, snapshot); len(changed) > 0 {
+				return snapshot, changed, nil
+			}
+		}
+		select {
+		case <-updated:
+		case <-expired.C:
+			if snapshot == nil {
+				return nil, nil, &callError{504, "upstream_timeout", "Presence did not load in time."}
+			}
+			return snapshot, []int64{}, nil
+		}
+	}
+}
+
+// release drops a watcher, stopping the poll after the last one.
+func (w *presenceWatch) release(key string, p *presencePoll) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p.watchers--; p.watchers == 0 {
+		close(p.stop)
+		delete(w.polls, key)
+	}
+}
+
+// run fetches p's presence every interval until it's stopped.
+func (w *presenceWatch) run(p *presencePoll, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		snapshot, e := w.s.fetchPresence(p.ids)
+		w.mu.Lock()
+		switch {
+		case e != nil && p.snapshot == nil:
+			p.err = e
+			close(p.updated)
+			p.updated = make(chan struct{})
+		case e != nil:
+			// watchers keep the last snapshot through a failed poll
+		case p.snapshot == nil || len(changedPresences(p.ids, p.snapshot, snapshot)) > 0:
+			p.snapshot, p.err = snapshot, nil
+			close(p.updated)
+			p.updated = make(chan struct{})
+		}
+		w.mu.Unlock()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchPresence gets the presence of ids from the presence batch endpoint,
+// by user ID. The call isn't made for any one client request, so it has
+// no client address.
+func (s *Server) fetchPresence(ids []int64) (map[int64]json.RawMessage, *callError) {
+	body, _ := json.Marshal(map[string][]int64{"userIds": ids})
+	var out struct {
+		UserPresences []json.RawMessage `json:"userPresences"`
+	}
+	if e := s.callJSON(&fasthttp.RequestCtx{}, "POST", "/presence/v1/presence/users", body, &out); e != nil {
+		return nil, e
+	}
+	snapshot := map[int64]json.RawMessage{}
+	for _, p := range out.UserPresences {
+		var u struct {
+			UserID int64 `json:"userId"`
+		}
+		if json.Unmarshal(p, &u) == nil {
+			snapshot[u.UserID] = p
+		}
+	}
+	return snapshot, nil
+}
+
+// changedPresences returns the ids whose presence differs between a and b.
+// lastOnline is ignored: it moves while nothing else does.
+func changedPresences(ids []int64, a, b map[int64]json.RawMessage) []int64 {
+	var changed []int64
+	for _, id := range ids {
+		if presenceState(a[id]) != presenceState(b[id]) {
+			changed = append(changed, id)
+		}
+	}
+	return changed
+}
+
+func presenceState(raw json.RawMessage) string {
+	var m map[string]interface{}
+	if json.Unmarshal(raw, &m) != nil {
+		return string(raw)
+	}
+	delete(m, "lastOnline")
+	b, _ := json.Marshal(m)
+	return string(b)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type presenceAnswer struct {
+	UserPresences []map[string]interface{} `json:"userPresences"`
+	Changed       []int64                  `json:"changed"`
+}
+
+func TestPresenceWatch(t *testing.T) {
+	var mu sync.Mutex
+	state := map[int64]int{1: 0, 2: 1}
+	var calls int32
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		n := atomic.AddInt32(&calls, 1)
+		var req struct{ UserIDs []int64 }
+		json.Unmarshal(ctx.PostBody(), &req)
+		var out presenceAnswer
+		mu.Lock()
+		for _, id := range req.UserIDs {
+			out.UserPresences = append(out.UserPresences, map[string]interface{}{
+				"userId": id, "userPresenceType": state[id], "lastOnline": strconv.Itoa(int(n)),
+			})
+		}
+		mu.Unlock()
+		b, _ := json.Marshal(out)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(b)
+	}
+	cfg := testConfig()
+	cfg.PresenceWatchInterval = Duration(20 * time.Millisecond)
+	s := newTestServer(t, cfg, upstream)
+	watch := func(query string) (*fasthttp.Response, presenceAnswer) {
+		resp := serveRaw(t, s, "GET /_proxy/presence/watch?"+query+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		var out presenceAnswer
+		json.Unmarshal(resp.Body(), &out)
+		return resp, out
+	}
+
+	// nothing changes: answered at the timeout with the snapshot
+	start := time.Now()
+	resp, out := watch("userIds=1,2&timeout=150ms")
+	if resp.StatusCode() != 200 || len(out.UserPresences) != 2 || out.Changed == nil || len(out.Changed) != 0 {
+		t.Fatalf("timeout: %d %s", resp.StatusCode(), resp.Body())
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("answered after %v, before the timeout", d)
+	}
+	if atomic.LoadInt32(&calls) < 3 {
+		t.Errorf("polled %d times in 150ms", calls)
+	}
+
+	// two watchers of the same users share a poll, and both return as
+	// soon as one of them changes
+	var wg sync.WaitGroup
+	answers := make([]presenceAnswer, 2)
+	for i, query := range []string{"userIds=1,2&timeout=5s", "userIds=2,1,2&timeout=5"} {
+		wg.Add(1)
+		go func(i int, query string) {
+			defer wg.Done()
+			_, answers[i] = watch(query)
+		}(i, query)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.presence.mu.Lock()
+		shared := len(s.presence.polls) == 1 && s.presence.polls["1,2,"] != nil && s.presence.polls["1,2,"].watchers == 2
+		s.presence.mu.Unlock()
+		if shared {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watchers of the same users don't share a poll")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// a few polls with only lastOnline moving
+	time.Sleep(60 * time.Millisecond)
+	flipped := time.Now()
+	mu.Lock()
+	state[2] = 2
+	mu.Unlock()
+	wg.Wait()
+	if d := time.Since(flipped); d > time.Second {
+		t.Errorf("answered %v after the change", d)
+	}
+	for i, a := range answers {
+		if len(a.Changed) != 1 || a.Changed[0] != 2 || len(a.UserPresences) != 2 {
+			t.Errorf("watcher %d: %+v", i, a)
+		}
+	}
+
+	// the poll stops with its last watcher
+	s.presence.mu.Lock()
+	left := len(s.presence.polls)
+	s.presence.mu.Unlock()
+	before := atomic.LoadInt32(&calls)
+	time.Sleep(60 * time.Millisecond)
+	if after := atomic.LoadInt32(&calls); left != 0 || after > before+1 {
+		t.Errorf("after the watchers left: %d polls, %d more upstream calls", left, after-before)
+	}
+
+	for _, query := range []string{"userIds=", "userIds=1,x", "userIds=1&timeout=soon", "userIds=1&timeout=-1s"} {
+		if resp, _ := watch(query); resp.StatusCode() != 400 {
+			t.Errorf("%s: %d", query, resp.StatusCode())
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+var prettyJSONHeader = reserveHeader("PRETTY_JSON", "true to have JSON responses reindented. Needs PRETTY_JSON_ENABLED.")
+
+// wantsPrettyJSON reports whether the client asked for reindented JSON with
+// the PRETTY_JSON request header and the feature is enabled.
+func wantsPrettyJSON(cfg *Config, ctx *fasthttp.RequestCtx) bool {
+	if !cfg.PrettyJSONEnabled {
+		return false
+	}
+	v, err := strconv.ParseBool(string(ctx.Request.Header.Peek(prettyJSONHeader)))
+	return err == nil && v
+}
+
+// isJSONContentType reports whether contentType is application/json,
+// ignoring parameters such as charset.
+func isJSONContentType(contentType []byte) bool {
+	mt, _, err := mime.ParseMediaType(string(contentType))
+	return err == nil && mt == "application/json"
+}
+
+// prettyJSON reindents body, returning it unchanged if it isn't valid JSON
+// (including when it is still compressed).
+func prettyJSON(body []byte) []byte {
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return body
+	}
+	return out.Bytes()
+}
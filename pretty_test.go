@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/v1/json":
+			ctx.SetContentType("application/json; charset=utf-8")
+			ctx.SetBodyString(`{"id":1,"tags":["a"]}`)
+		case "/v1/broken":
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{"id":`)
+		default:
+			ctx.SetContentType("text/plain")
+			ctx.SetBodyString(`{"id":1}`)
+		}
+	}
+	const pretty = "{\n  \"id\": 1,\n  \"tags\": [\n    \"a\"\n  ]\n}"
+	tests := []struct {
+		name    string
+		enabled bool
+		path    string
+		header  string
+		want    string
+	}{
+		{"reindented", true, "/v1/json", "true", pretty},
+		{"not asked", true, "/v1/json", "", `{"id":1,"tags":["a"]}`},
+		{"asked for false", true, "/v1/json", "false", `{"id":1,"tags":["a"]}`},
+		{"disabled", false, "/v1/json", "true", `{"id":1,"tags":["a"]}`},
+		{"not JSON", true, "/v1/text", "true", `{"id":1}`},
+		{"invalid JSON", true, "/v1/broken", "true", `{"id":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.PrettyJSONEnabled = tt.enabled
+			s := newTestServer(t, cfg, upstream)
+			raw := "GET /users" + tt.path + " HTTP/1.1\r\nHost: proxy\r\n"
+			if tt.header != "" {
+				raw += prettyJSONHeader + ": " + tt.header + "\r\n"
+			}
+			resp := serveRaw(t, s, raw+"\r\n")
+			if got := string(resp.Body()); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
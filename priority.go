@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseKeyPriorities parses PROXYKEY_PRIORITIES, written key=priority,...
+// Keys are kept as written: unlike subdomains they are case-sensitive.
+func parseKeyPriorities(list string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, v, ok := cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || strings.TrimSpace(key) == "" || err != nil {
+			// the entry holds a key, so it isn't quoted back
+			return nil, fmt.Errorf("entry %d is not key=priority", len(out)+1)
+		}
+		out[strings.TrimSpace(key)] = n
+	}
+	return out, nil
+}
+
+// hasKeyPriority reports whether key is listed in PROXYKEY_PRIORITIES,
+// which makes it a valid PROXYKEY.
+func (c *Config) hasKeyPriority(key string) bool {
+	_, ok := c.keyPriorities[key]
+	return ok
+}
+
+// keyPriority is the queue priority of a request carrying PROXYKEY key:
+// its PROXYKEY_PRIORITIES entry, or 0.
+func (c *Config) keyPriority(key string) int {
+	return c.keyPriorities[key]
+}
+
+// priorityLimiter enforces MAX_CONCURRENT_REQUESTS. Requests over the
+// limit wait in a queue of at most CONCURRENCY_QUEUE_SIZE and are admitted
+// highest priority first, oldest first within a priority. When the queue
+// is full, the lowest-priority waiter is turned away to make room, or the
+// newcomer when nobody waiting ranks below it.
+type priorityLimiter struct {
+	mu       sync.Mutex
+	inflight int
+	queue    waitQueue
+	seq      uint64
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	index    int       // in the queue; -1 once out of it
+	admitted chan bool // receives once: true when admitted, false when evicted
+}
+
+// waitQueue is a max-heap of waiters by priority, then arrival.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// acquire takes one of limit slots for a request of the given priority,
+// waiting up to timeout in the queue. It returns "" once admitted, or the
+// error code the request should be refused with: queue_full or
+// queue_timeout. Each admitted request must call release.
+func (l *priorityLimiter) acquire(limit, queueSize, priority int, timeout time.Duration) string {
+	l.mu.Lock()
+	if l.inflight < limit && l.queue.Len() == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return ""
+	}
+	if l.queue.Len() >= queueSize {
+		lowest := l.lowest()
+		if lowest < 0 || l.queue[lowest].priority >= priority {
+			l.mu.Unlock()
+			return "queue_full"
+		}
+		heap.Remove(&l.queue, lowest).(*waiter).admitted <- false
+	}
+	l.seq++
+	w := &waiter{priority: priority, seq: l.seq, admitted: make(chan bool, 1)}
+	heap.Push(&l.queue, w)
+	l.admit(limit)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-w.admitted:
+		return admittedCode(ok)
+	case <-timer.C:
+	}
+	l.mu.Lock()
+	if w.index >= 0 {
+		heap.Remove(&l.queue, w.index)
+		l.mu.Unlock()
+		return "queue_timeout"
+	}
+	// admitted or evicted just as the timer fired
+	l.mu.Unlock()
+	return admittedCode(<-w.admitted)
+}
+
+func admittedCode(ok bool) string {
+	if ok {
+		return ""
+	}
+	return "queue_full"
+}
+
+// release frees a slot and hands it to the best waiter.
+func (l *priorityLimiter) release(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.admit(limit)
+}
+
+// admit lets waiters in while there are free slots. l.mu must be held.
+func (l *priorityLimiter) admit(limit int) {
+	for l.inflight < limit && l.queue.Len() > 0 {
+		l.inflight++
+		heap.Pop(&l.queue).(*waiter).admitted <- true
+	}
+}
+
+// lowest is the queue index of the waiter to evict first: the lowest
+// priority, newest within it. l.mu must be held.
+func (l *priorityLimiter) lowest() int {
+	i := -1
+	for j, w := range l.queue {
+		if i < 0 || w.priority < l.queue[i].priority ||
+			(w.priority == l.queue[i].priority && w.seq > l.queue[i].seq) {
+			i = j
+		}
+	}
+	return i
+}
+
+// waiting is how many requests are queued.
+func (l *priorityLimiter) waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queue.Len()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// queueUp starts a request of each priority in turn against l, waiting for
+// each to be queued before the next, and returns the codes they got in
+// the order they were answered.
+func queueUp(t *testing.T, l *priorityLimiter, limit, queueSize int, priorities ...int) <-chan [2]interface{} {
+	t.Helper()
+	out := make(chan [2]interface{}, len(priorities))
+	for _, p := range priorities {
+		before := l.waiting()
+		go func(p int) {
+			out <- [2]interface{}{p, l.acquire(limit, queueSize, p, 5*time.Second)}
+		}(p)
+		deadline := time.Now().Add(time.Second)
+		for l.waiting() == before && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return out
+}
+
+func TestPriorityLimiterOrder(t *testing.T) {
+	var l priorityLimiter
+	if code := l.acquire(1, 10, 0, time.Second); code != "" {
+		t.Fatalf("first acquire: %q", code)
+	}
+	answers := queueUp(t, &l, 1, 10, 1, 10, 5, 10, 0)
+	if n := l.waiting(); n != 5 {
+		t.Fatalf("%d waiting, want 5", n)
+	}
+	var order []int
+	for range []int{1, 10, 5, 10, 0} {
+		l.release(1)
+		a := <-answers
+		if a[1] != "" {
+			t.Fatalf("priority %v: %q", a[0], a[1])
+		}
+		order = append(order, a[0].(int))
+	}
+	want := []int{10, 10, 5, 1, 0}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("admitted %v, want %v", order, want)
+		}
+	}
+}
+
+func TestPriorityLimiterQueueFull(t *testing.T) {
+	var l priorityLimiter
+	l.acquire(1, 2, 0, time.Second)
+	answers := queueUp(t, &l, 1, 2, 1, 5)
+
+	// a lower priority than everyone waiting is turned away at once
+	if code := l.acquire(1, 2, 1, time.Second); code != "queue_full" {
+		t.Errorf("low priority into a full queue: %q, want queue_full", code)
+	}
+	// a higher one takes the place of the lowest waiter
+	high := queueUp(t, &l, 1, 2, 10)
+	if a := <-answers; a[0] != 1 || a[1] != "queue_full" {
+		t.Errorf("evicted %v, want priority 1 with queue_full", a)
+	}
+	l.release(1)
+	if a := <-high; a[1] != "" {
+		t.Errorf("high priority: %q", a[1])
+	}
+	l.release(1)
+	if a := <-answers; a[0] != 5 || a[1] != "" {
+		t.Errorf("then %v, want priority 5 admitted", a)
+	}
+}
+
+func TestPriorityLimiterTimeout(t *testing.T) {
+	var l priorityLimiter
+	l.acquire(1, 2, 0, time.Second)
+	start := time.Now()
+	if code := l.acquire(1, 2, 0, 50*time.Millisecond); code != "queue_timeout" {
+		t.Errorf("got %q, want queue_timeout", code)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("gave up after %v", d)
+	}
+	if n := l.waiting(); n != 0 {
+		t.Errorf("%d still waiting after the timeout", n)
+	}
+	l.release(1)
+	if code := l.acquire(1, 2, 0, time.Second); code != "" {
+		t.Errorf("after release: %q", code)
+	}
+}
+
+func TestProxyKeyPriorities(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		<-release
+		ctx.SetBodyString(string(ctx.Request.Header.Peek("X-Job")))
+	}
+	cfg := testConfig()
+	cfg.Key = "shared"
+	cfg.ProxyKeyPriorities = "prod=10, batch=1"
+	cfg.MaxConcurrentRequests = 1
+	s := newTestServer(t, cfg, upstream)
+	defer once.Do(func() { close(release) })
+
+	get := func(key, job string) *fasthttp.Response {
+		return serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\nPROXYKEY: "+key+"\r\nX-Job: "+job+"\r\n\r\n")
+	}
+	if resp := get("other", ""); resp.StatusCode() != 407 {
+		t.Errorf("unlisted key: %d, want 407", resp.StatusCode())
+	}
+
+	done := make(chan string, 4)
+	go func() { done <- string(get("shared", "first").Body()) }()
+	// wait for the first request to hold the only slot
+	for inflight(s.concurrency) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, job := range [][2]string{{"batch", "batch"}, {"shared", "default"}, {"prod", "prod"}} {
+		before := s.concurrency.waiting()
+		go func(key, job string) { done <- string(get(key, job).Body()) }(job[0], job[1])
+		for s.concurrency.waiting() == before {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	once.Do(func() { close(release) })
+	var order []string
+	for range []int{0, 1, 2, 3} {
+		order = append(order, <-done)
+	}
+	want := []string{"first", "prod", "batch", "default"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("answered %v, want %v", order, want)
+		}
+	}
+}
+
+func inflight(l *priorityLimiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// profileSections are the parts of a /_proxy/users/{id}/profile answer.
+var profileSections = []string{"info", "presence", "friends", "avatar"}
+
+// profileHandler serves GET /_proxy/users/{id}/profile: the user's info,
+// presence, friend count and avatar headshot, fetched concurrently and
+// returned as one document with a section each. A section whose upstream
+// call fails holds an error object instead, and the rest are still
+// returned; only when every section fails is the status 502.
+// fields=info,presence limits which sections are fetched. Complete answers
+// are cached for PROFILE_CACHE_TTL.
+func (s *Server) profileHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		proxyError(ctx, 405, "method_not_allowed", "Use GET.")
+		return
+	}
+	path := string(ctx.Path())
+	userID, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path, "/_proxy/users/"), "/profile"), 10, 64)
+	if !strings.HasSuffix(path, "/profile") || err != nil || userID < 1 {
+		proxyError(ctx, 400, "invalid_user_id", "Use /_proxy/users/{userId}/profile.")
+		return
+	}
+	key := cacheKey("GET", "", string(ctx.RequestURI()))
+	if s.profileCache != nil {
+		if cached := s.profileCache.get(key); cached != nil {
+			cached.writeTo(ctx, false)
+			return
+		}
+	}
+
+	sections := profileSections
+	if v := string(ctx.QueryArgs().Peek("fields")); v != "" {
+		sections = nil
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); !isProfileSection(f) {
+				proxyError(ctx, 400, "invalid_fields", "fields must be a comma-separated list of "+strings.Join(profileSections, ", ")+".")
+				return
+			}
+			sections = append(sections, f)
+		}
+	}
+
+	id := strconv.FormatInt(userID, 10)
+	profile := map[string]interface{}{"userId": userID}
+	var mu sync.Mutex
+	failed := 0
+	var wg sync.WaitGroup
+	for _, section := range sections {
+		if _, ok := profile[section]; ok {
+			continue
+		}
+		profile[section] = nil
+		wg.Add(1)
+		go func(section string) {
+			defer wg.Done()
+			v, e := s.profileSection(ctx, section, id)
+			mu.Lock()
+			defer mu.Unlock()
+			if e != nil {
+				failed++
+				profile[section] = map[string]interface{}{"error": e}
+				return
+			}
+			profile[section] = v
+		}(section)
+	}
+	wg.Wait()
+
+	if failed == len(profile)-1 {
+		writeJSON(ctx, 502, profile)
+		ctx.Response.Header.Set("X-Proxy-Error", "profile_failed")
+		return
+	}
+	writeJSON(ctx, 200, profile)
+	if s.profileCache != nil && failed == 0 {
+		ctx.Response.Header.Set("X-Proxy-Cache", "MISS")
+		s.profileCache.set(key, newCachedResponse(&ctx.Response))
+	}
+}
+
+// profileSection fetches one section of a profile. Presence and avatar
+// come from batch endpoints and are unwrapped to the user's entry, or null
+// when there is none.
+func (s *Server) profileSection(ctx *fasthttp.RequestCtx, section, id string) (json.RawMessage, *callError) {
+	var v json.RawMessage
+	switch section {
+	case "info":
+		return v, s.callJSON(ctx, "GET", "/users/v1/users/"+id, nil, &v)
+	case "friends":
+		return v, s.callJSON(ctx, "GET", "/friends/v1/users/"+id+"/friends/count", nil, &v)
+	case "presence":
+		var body struct {
+			UserPresences []json.RawMessage `json:"userPresences"`
+		}
+		e := s.callJSON(ctx, "POST", "/presence/v1/presence/users", []byte(`{"userIds":[`+id+`]}`), &body)
+		return firstEntry(body.UserPresences), e
+	default: // avatar
+		var body struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		e := s.callJSON(ctx, "GET", "/thumbnails/v1/users/avatar-headshot?userIds="+id+"&size=150x150&format=Png", nil, &body)
+		return firstEntry(body.Data), e
+	}
+}
+
+func firstEntry(entries []json.RawMessage) json.RawMessage {
+	if len(entries) == 0 {
+		return json.RawMessage("null")
+	}
+	return entries[0]
+}
+
+func isProfileSection(name string) bool {
+	for _, s := range profileSections {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
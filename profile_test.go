@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestProfile(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	failFriends := false
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		host := string(ctx.Host())
+		mu.Lock()
+		calls[host]++
+		fail := failFriends
+		mu.Unlock()
+		ctx.SetContentType("application/json")
+		switch host + string(ctx.Path()) {
+		case "users.roblox.com/v1/users/1":
+			ctx.SetBodyString(`{"id":1,"name":"Roblox","displayName":"Roblox"}`)
+		case "presence.roblox.com/v1/presence/users":
+			if string(ctx.PostBody()) != `{"userIds":[1]}` {
+				ctx.Error("bad body "+string(ctx.PostBody()), 400)
+				return
+			}
+			ctx.SetBodyString(`{"userPresences":[{"userId":1,"userPresenceType":2}]}`)
+		case "friends.roblox.com/v1/users/1/friends/count":
+			if fail {
+				ctx.Error(`{"errors":[]}`, 503)
+				return
+			}
+			ctx.SetBodyString(`{"count":7}`)
+		case "thumbnails.roblox.com/v1/users/avatar-headshot":
+			ctx.SetBodyString(`{"data":[{"targetId":1,"state":"Completed","imageUrl":"https://tr.rbxcdn.com/a.png"}]}`)
+		default:
+			ctx.Error("unexpected "+host+string(ctx.RequestURI()), 404)
+		}
+	}
+	cfg := testConfig()
+	cfg.ProfileCacheTTL = 0
+	s := newTestServer(t, cfg, upstream)
+	get := func(uri string) (*fasthttp.Response, map[string]json.RawMessage) {
+		t.Helper()
+		mu.Lock()
+		calls = map[string]int{}
+		mu.Unlock()
+		resp := serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\nAccept: application/json\r\n\r\n")
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(resp.Body(), &body); err != nil {
+			t.Fatalf("%s: %v in %q", uri, err, resp.Body())
+		}
+		return resp, body
+	}
+
+	resp, body := get("/_proxy/users/1/profile")
+	if resp.StatusCode() != 200 || len(body) != 5 {
+		t.Fatalf("full: %d %s", resp.StatusCode(), resp.Body())
+	}
+	for section, want := range map[string]string{
+		"userId":   `1`,
+		"info":     `{"id":1,"name":"Roblox","displayName":"Roblox"}`,
+		"presence": `{"userId":1,"userPresenceType":2}`,
+		"friends":  `{"count":7}`,
+		"avatar":   `{"targetId":1,"state":"Completed","imageUrl":"https://tr.rbxcdn.com/a.png"}`,
+	} {
+		if got := string(body[section]); got != want {
+			t.Errorf("%s = %s, want %s", section, got, want)
+		}
+	}
+
+	mu.Lock()
+	failFriends = true
+	mu.Unlock()
+	resp, body = get("/_proxy/users/1/profile")
+	if resp.StatusCode() != 200 || string(body["info"]) == "" || string(body["avatar"]) == "" {
+		t.Fatalf("partial: %d %s", resp.StatusCode(), resp.Body())
+	}
+	var friends struct {
+		Error callError `json:"error"`
+	}
+	if err := json.Unmarshal(body["friends"], &friends); err != nil || friends.Error.Status != 502 || friends.Error.Code != "upstream_error" {
+		t.Errorf("failed section = %s", body["friends"])
+	}
+
+	resp, body = get("/_proxy/users/1/profile?fields=info,presence")
+	if resp.StatusCode() != 200 || len(body) != 3 || body["info"] == nil || body["presence"] == nil {
+		t.Errorf("fields: %d %s", resp.StatusCode(), resp.Body())
+	}
+	mu.Lock()
+	if calls["friends.roblox.com"] != 0 || calls["thumbnails.roblox.com"] != 0 || calls["users.roblox.com"] != 1 {
+		t.Errorf("fields made calls %v", calls)
+	}
+	mu.Unlock()
+
+	resp, _ = get("/_proxy/users/1/profile?fields=friends")
+	if resp.StatusCode() != 502 {
+		t.Errorf("every section failed: %d %s", resp.StatusCode(), resp.Body())
+	}
+
+	for uri, code := range map[string]string{
+		"/_proxy/users/1/profile?fields=info,email": "invalid_fields",
+		"/_proxy/users/abc/profile":                 "invalid_user_id",
+		"/_proxy/users/1":                           "invalid_user_id",
+	} {
+		resp, body := get(uri)
+		if resp.StatusCode() != 400 || string(body["code"]) != `"`+code+`"` {
+			t.Errorf("%s: %d %s, want 400 %s", uri, resp.StatusCode(), resp.Body(), code)
+		}
+	}
+}
+
+func TestProfileCache(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	fail := true
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if fail {
+			ctx.Error("down", 503)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"id":1}`)
+	}
+	s := newTestServer(t, testConfig(), upstream)
+	get := func() *fasthttp.Response {
+		return serveRaw(t, s, "GET /_proxy/users/1/profile?fields=info HTTP/1.1\r\nHost: proxy\r\nAccept: application/json\r\n\r\n")
+	}
+
+	// failed sections aren't cached
+	if resp := get(); resp.StatusCode() != 502 {
+		t.Fatalf("failing upstream: %d %s", resp.StatusCode(), resp.Body())
+	}
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if resp := get(); resp.StatusCode() != 200 || string(resp.Header.Peek("X-Proxy-Cache")) != "MISS" {
+		t.Fatalf("first: %d %q", resp.StatusCode(), resp.Header.Peek("X-Proxy-Cache"))
+	}
+	resp := get()
+	if string(resp.Header.Peek("X-Proxy-Cache")) != "HIT" || string(resp.Body()) != `{"info":{"id":1},"userId":1}` {
+		t.Errorf("second: %q %s", resp.Header.Peek("X-Proxy-Cache"), resp.Body())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Errorf("upstream called %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentEntry is a single proxied request as kept in the recent buffer.
+type recentEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// recentBuffer is a fixed-size ring buffer of the last N requests. It is
+// safe for concurrent use.
+type recentBuffer struct {
+	mu      sync.Mutex
+	entries []recentEntry
+	next    int
+	full    bool
+}
+
+func newRecentBuffer(size int) *recentBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &recentBuffer{entries: make([]recentEntry, size)}
+}
+
+// add records e, overwriting the oldest entry once the buffer is full.
+func (b *recentBuffer) add(e recentEntry) {
+	b.mu.Lock()
+	b.entries[b.next] = e
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+	b.mu.Unlock()
+}
+
+// reset empties the buffer.
+func (b *recentBuffer) reset() {
+	b.mu.Lock()
+	b.entries = make([]recentEntry, len(b.entries))
+	b.next, b.full = 0, false
+	b.mu.Unlock()
+}
+
+// snapshot returns a copy of the buffered entries, oldest first.
+func (b *recentBuffer) snapshot() []recentEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		out := make([]recentEntry, b.next)
+		copy(out, b.entries[:b.next])
+		return out
+	}
+	out := make([]recentEntry, 0, len(b.entries))
+	out = append(out, b.entries[b.next:]...)
+	out = append(out, b.entries[:b.next]...)
+	return out
+}
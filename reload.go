@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// watchReload reloads the configuration every time SIGHUP is received.
+func (s *Server) watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := s.reloadConfig(os.Args[1:], os.Getenv); err != nil {
+			log.Printf("Config reload failed, keeping previous config: %v", err)
+		}
+	}
+}
+
+// reloadConfig re-reads the config file and key file and swaps in the
+// result. Settings tagged restart are only read at startup; if they changed
+// the old value is kept and a restart is requested in the log.
+func (s *Server) reloadConfig(args []string, getenv func(string) string) error {
+	next, _, err := loadConfig(args, getenv)
+	if err != nil {
+		return err
+	}
+	prev := s.config()
+
+	nv := reflect.ValueOf(next).Elem()
+	pv := reflect.ValueOf(prev).Elem()
+	forEachField(next, func(f reflect.StructField, v reflect.Value) {
+		old := pv.FieldByName(f.Name)
+		if reflect.DeepEqual(v.Interface(), old.Interface()) {
+			return
+		}
+		if f.Tag.Get("restart") == "true" {
+			log.Printf("Config reload: %s changed but requires a restart to take effect", f.Tag.Get("yaml"))
+			nv.FieldByName(f.Name).Set(old)
+			return
+		}
+		log.Printf("Config reload: %s updated", f.Tag.Get("yaml"))
+	})
+
+	// the upstream read timeout was raised to the longest override at
+	// startup, and still caps them
+	if d := next.clientReadTimeout(); d > s.client.ReadTimeout {
+		log.Printf("Config reload: timeout_overrides past %v are cut short by the upstream read timeout until a restart", s.client.ReadTimeout)
+	}
+
+	if s.cache != nil {
+		s.cache.configure(next.CacheTTL.D(), next.CacheMaxEntries)
+	} else if next.CacheTTL > 0 {
+		log.Printf("Config reload: the response cache was disabled at startup; restart to enable it")
+		next.CacheTTL = 0
+	}
+
+	s.setConfig(next)
+	log.Printf("Config reloaded")
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestReloadTimeoutOverrides(t *testing.T) {
+	slow := func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(300 * time.Millisecond)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.TimeoutOverrides = TimeoutOverrides{"users": Duration(100 * time.Millisecond)}
+	s := newTestServer(t, cfg, slow)
+	get := func() int {
+		return serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n").StatusCode()
+	}
+	if status := get(); status != 504 {
+		t.Fatalf("before reload: status = %d, want 504", status)
+	}
+
+	env := map[string]string{"TIMEOUT_OVERRIDES": "users=2s"}
+	if err := s.reloadConfig(nil, func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.config().requestTimeout("users"); got != 2*time.Second {
+		t.Errorf("reloaded users timeout = %v, want 2s", got)
+	}
+	if status := get(); status != 200 {
+		t.Errorf("after reload: status = %d, want 200", status)
+	}
+}
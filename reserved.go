@@ -0,0 +1,41 @@
+package main
+
+import "sort"
+
+// reservedParam is a request header or query parameter the proxy reads
+// itself instead of only passing it upstream.
+type reservedParam struct {
+	Name        string
+	In          string // header or query
+	Description string
+}
+
+// reservedParams holds every reserveHeader and reserveQuery registration.
+// Features register their names where they declare them, and
+// /_proxy/openapi lists them from here.
+var reservedParams []reservedParam
+
+// reserveHeader registers a reserved request header and returns its name.
+func reserveHeader(name, description string) string {
+	reservedParams = append(reservedParams, reservedParam{Name: name, In: "header", Description: description})
+	return name
+}
+
+// reserveQuery registers a reserved query parameter and returns its name.
+func reserveQuery(name, description string) string {
+	reservedParams = append(reservedParams, reservedParam{Name: name, In: "query", Description: description})
+	return name
+}
+
+// sortedReservedParams returns the registrations, headers first, each
+// sorted by name.
+func sortedReservedParams() []reservedParam {
+	out := append([]reservedParam(nil), reservedParams...)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].In != out[j].In {
+			return out[i].In < out[j].In
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
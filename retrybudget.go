@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// retryBudget caps upstream retries across all requests at
+// GLOBAL_RETRY_RATE_LIMIT per second, so an outage can't multiply the
+// traffic sent upstream. First attempts are never limited.
+type retryBudget struct {
+	bucket *tokenBucket // nil when retries are unlimited
+
+	retries, denied int64
+}
+
+func newRetryBudget(rate float64) *retryBudget {
+	b := &retryBudget{}
+	if rate > 0 {
+		b.bucket = newTokenBucket(rate)
+	}
+	return b
+}
+
+// allow reports whether a retry may be sent now, and counts it.
+func (b *retryBudget) allow() bool {
+	if b.bucket != nil && !b.bucket.take() {
+		atomic.AddInt64(&b.denied, 1)
+		return false
+	}
+	atomic.AddInt64(&b.retries, 1)
+	return true
+}
+
+func (b *retryBudget) writeMetrics(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP roproxy_retries_total Upstream retries sent.\n# TYPE roproxy_retries_total counter\nroproxy_retries_total %d\n",
+		atomic.LoadInt64(&b.retries))
+	fmt.Fprintf(buf, "# HELP roproxy_retries_denied_total Upstream retries skipped because GLOBAL_RETRY_RATE_LIMIT was used up.\n# TYPE roproxy_retries_denied_total counter\nroproxy_retries_denied_total %d\n",
+		atomic.LoadInt64(&b.denied))
+	if b.bucket == nil {
+		return
+	}
+	fmt.Fprintf(buf, "# HELP roproxy_retry_rate_limit Upstream retries allowed per second.\n# TYPE roproxy_retry_rate_limit gauge\nroproxy_retry_rate_limit %v\n",
+		b.bucket.rate)
+	fmt.Fprintf(buf, "# HELP roproxy_retry_tokens Upstream retries that may be sent right now.\n# TYPE roproxy_retry_tokens gauge\nroproxy_retry_tokens %v\n",
+		b.bucket.available())
+}
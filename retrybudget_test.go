@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestGlobalRetryRateLimit(t *testing.T) {
+	var calls int32
+	failing := func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&calls, 1)
+		// a malformed response, which fasthttp itself doesn't retry for POST
+		ctx.Conn().Write([]byte("garbage\r\n\r\n"))
+		ctx.Conn().Close()
+	}
+	cfg := testConfig()
+	cfg.Retries = 3
+	// one retry up front, then effectively none
+	cfg.GlobalRetryRateLimit = 0.001
+	s := newTestServer(t, cfg, failing)
+
+	resp := serveRaw(t, s, "POST /users/v1/users HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("first request attempted %d times, want 2", n)
+	}
+	if code := string(resp.Header.Peek("X-Proxy-Error")); code != "upstream_unreachable" {
+		t.Errorf("X-Proxy-Error = %q, want upstream_unreachable", code)
+	}
+	serveRaw(t, s, "POST /users/v1/users HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("second request attempted %d times, want 1", n-2)
+	}
+
+	body := string(serveHandler(t, s, (*Server).metricsHandler, "GET /metrics HTTP/1.1\r\nHost: proxy\r\n\r\n").Body())
+	for _, want := range []string{
+		"roproxy_retries_total 1\n",
+		"roproxy_retries_denied_total 2\n",
+		"roproxy_retry_rate_limit 0.001\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+
+	"github.com/valyala/fasthttp/reuseport"
+)
+
+// listenReusePort opens a TCP listener with SO_REUSEPORT set.
+func listenReusePort(addr string) (net.Listener, error) {
+	return reuseport.Listen("tcp4", addr)
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	first, err := listen("127.0.0.1:0", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.Addr().String()
+
+	// a new process started with REUSEPORT=true binds alongside the old one
+	second, err := listen(addr, 0, true)
+	if err != nil {
+		t.Fatalf("second REUSEPORT listener: %v", err)
+	}
+	for _, ln := range []net.Listener{first, second} {
+		go func(ln net.Listener) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}(ln)
+	}
+	// closing the old listener leaves the port served
+	first.Close()
+	c, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Errorf("dialing after the first listener closed: %v", err)
+	} else {
+		c.Close()
+	}
+	second.Close()
+
+	// without it the port stays taken
+	held, err := listen("127.0.0.1:0", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	ln, err := listen(held.Addr().String(), 0, false)
+	if err == nil {
+		ln.Close()
+		t.Fatal("second listener bound without REUSEPORT")
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("second bind: %v, want EADDRINUSE", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort is unavailable on Windows, which has no SO_REUSEPORT.
+func listenReusePort(addr string) (net.Listener, error) {
+	return nil, errors.New("REUSEPORT is not supported on Windows")
+}
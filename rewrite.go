@@ -0,0 +1,47 @@
+package main
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// rewriteRequestBody applies BODY_REPLACE_FROM/BODY_REPLACE_TO to an
+// outgoing JSON or text body. Bodies over BODY_REPLACE_MAX_BYTES and other
+// content types are returned unchanged.
+func rewriteRequestBody(cfg *Config, contentType, body []byte) []byte {
+	if cfg.bodyReplace == nil || len(body) == 0 || len(body) > cfg.BodyReplaceMaxBytes {
+		return body
+	}
+	mt, _, err := mime.ParseMediaType(string(contentType))
+	if err != nil || !(mt == "application/json" || strings.HasPrefix(mt, "text/")) {
+		return body
+	}
+	return cfg.bodyReplace.ReplaceAll(body, []byte(cfg.BodyReplaceTo))
+}
+
+// compressRequestBody gzips req's body for COMPRESS_UPSTREAM_BODY when
+// subdomain accepts it, the body is over COMPRESS_UPSTREAM_MIN_BYTES and the
+// client hasn't encoded it already. gRPC bodies are left alone: their
+// messages carry their own compression flag. Content-Length follows the
+// new body.
+func compressRequestBody(cfg *Config, subdomain string, req *fasthttp.Request) {
+	if !cfg.CompressUpstreamBody || !cfg.gzipSubdomains[strings.ToLower(subdomain)] {
+		return
+	}
+	body := req.Body()
+	if len(body) <= cfg.CompressUpstreamMinBytes || len(req.Header.Peek("Content-Encoding")) > 0 ||
+		isGRPCContentType(req.Header.ContentType()) {
+		return
+	}
+	req.SetBody(fasthttp.AppendGzipBytes(nil, body))
+	req.Header.Set("Content-Encoding", "gzip")
+}
+
+// isGRPCContentType reports whether contentType is gRPC or gRPC-Web, such
+// as application/grpc-web+proto.
+func isGRPCContentType(contentType []byte) bool {
+	mt, _, err := mime.ParseMediaType(string(contentType))
+	return err == nil && strings.HasPrefix(mt, "application/grpc")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// serve runs every endpoint until SIGTERM or SIGINT, then drains: the
+// listeners are closed, in-flight requests get up to timeout to finish, and
+// the log is flushed before returning.
+//
+// With WATCHDOG_INTERVAL set the listeners are health-checked meanwhile; a
+// tripped watchdog either exits the process or reopens every listener,
+// depending on WATCHDOG_ACTION.
+func (s *Server) serve(eps []endpoint, timeout time.Duration) {
+	errc := make(chan error, len(eps))
+	log.Printf("Client connection timeouts: %s", serverTimeouts(s.config()))
+	start := func(ep endpoint) {
+		log.Printf("Listening on %s", ep.addr)
+		go func() {
+			if err := ep.server.Serve(ep.ln); err != nil {
+				errc <- fmt.Errorf("%s: %v", ep.addr, err)
+			}
+		}()
+	}
+	for _, ep := range eps {
+		start(ep)
+	}
+
+	restart := make(chan struct{})
+	stop := make(chan struct{})
+	if s.config().WatchdogInterval > 0 {
+		probes := make([]*fasthttp.HostClient, len(eps))
+		for i, ep := range eps {
+			probes[i] = newHealthProbe(ep.addr)
+		}
+		go s.watchdog(probes, func(reason string) {
+			log.Printf("Watchdog tripped: %s", reason)
+			dumpGoroutines()
+			if s.config().WatchdogAction == "exit" {
+				flushLogs()
+				os.Exit(1)
+			}
+			select {
+			case restart <- struct{}{}:
+			case <-stop:
+			}
+		}, stop)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+loop:
+	for {
+		select {
+		case err := <-errc:
+			log.Fatalf("Serve error: %v", err)
+		case <-restart:
+			for i := range eps {
+				if err := s.reopen(&eps[i]); err != nil {
+					log.Fatalf("Watchdog could not reopen %s: %v", eps[i].addr, err)
+				}
+				start(eps[i])
+			}
+		case sg := <-sig:
+			log.Printf("Received %v, draining in-flight requests (up to %v)", sg, timeout)
+			break loop
+		}
+	}
+	close(stop)
+
+	atomic.StoreInt32(&s.draining, 1)
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, ep := range eps {
+			wg.Add(1)
+			go func(ep endpoint) {
+				defer wg.Done()
+				if err := ep.server.Shutdown(); err != nil {
+					log.Printf("Shutdown error on %s: %v", ep.addr, err)
+				}
+			}(ep)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("Shutdown complete")
+	case <-time.After(timeout):
+		log.Printf("Shutdown timed out after %v, exiting with requests in flight", timeout)
+	}
+	flushLogs()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// testEndpoint serves s on an in-memory listener.
+func testEndpoint(cfg *Config, s *Server) (*fasthttputil.InmemoryListener, []endpoint) {
+	ln := fasthttputil.NewInmemoryListener()
+	return ln, []endpoint{{addr: "test", ln: ln, server: newHTTPServer(cfg, s.requestHandler), handler: s.requestHandler}}
+}
+
+// sigterm sends SIGTERM until serve has started draining s.
+func sigterm(t *testing.T, s *Server) {
+	t.Helper()
+	// Our own registration keeps the signal from killing the test binary
+	// should one land before serve's.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	for deadline := time.Now().Add(5 * time.Second); !s.isDraining(); {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGTERM didn't start the drain")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/v1/slow" {
+			close(arrived)
+			<-release
+		}
+		ctx.SetBodyString("ok")
+	}
+	cfg := testConfig()
+	s := newTestServer(t, cfg, upstream)
+	ln, eps := testEndpoint(cfg, s)
+
+	served := make(chan struct{})
+	go func() {
+		s.serve(eps, 5*time.Second)
+		close(served)
+	}()
+
+	client := &fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}
+	slow := make(chan *fasthttp.Response)
+	go func() {
+		req := fasthttp.AcquireRequest()
+		req.SetRequestURI("http://proxy/games/v1/slow")
+		resp := &fasthttp.Response{}
+		if err := client.DoTimeout(req, resp, 5*time.Second); err != nil {
+			t.Error(err)
+			resp = nil
+		}
+		slow <- resp
+	}()
+	<-arrived
+
+	sigterm(t, s)
+
+	resp := serveRaw(t, s, "GET /games/v1/games HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if resp.StatusCode() != 503 || string(resp.Header.Peek("X-Proxy-Error")) != "shutting_down" || !resp.ConnectionClose() {
+		t.Errorf("new request while draining: %d %q, close %v", resp.StatusCode(), resp.Header.Peek("X-Proxy-Error"), resp.ConnectionClose())
+	}
+	if resp := serveRaw(t, s, "GET /readyz HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 503 {
+		t.Errorf("/readyz while draining: %d", resp.StatusCode())
+	}
+	select {
+	case <-served:
+		t.Fatal("serve returned with a request in flight")
+	default:
+	}
+
+	close(release)
+	if resp := <-slow; resp == nil || resp.StatusCode() != 200 || string(resp.Body()) != "ok" {
+		t.Errorf("in-flight request: %v", resp)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after the last request finished")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		close(arrived)
+		<-release
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.Timeout = Duration(10 * time.Second)
+	s := newTestServer(t, cfg, upstream)
+	ln, eps := testEndpoint(cfg, s)
+
+	served := make(chan struct{})
+	go func() {
+		s.serve(eps, 100*time.Millisecond)
+		close(served)
+	}()
+	client := &fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}
+	go func() {
+		req := fasthttp.AcquireRequest()
+		req.SetRequestURI("http://proxy/games/v1/stuck")
+		client.DoTimeout(req, &fasthttp.Response{}, 10*time.Second)
+	}()
+	<-arrived
+
+	start := time.Now()
+	sigterm(t, s)
+	select {
+	case <-served:
+		if d := time.Since(start); d < 100*time.Millisecond {
+			t.Errorf("serve returned after %v, before shutdown_timeout", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve kept waiting for a stuck request past shutdown_timeout")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// responseSizeBuckets are the upper bounds, in bytes, of the
+// roproxy_response_body_bytes histogram buckets.
+var responseSizeBuckets = []int64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+
+// responseSizes counts the body bytes of proxied responses.
+type responseSizes struct {
+	buckets []int64 // cumulative, parallel to responseSizeBuckets
+	count   int64
+	sum     int64
+	large   int64
+}
+
+func newResponseSizes() *responseSizes {
+	return &responseSizes{buckets: make([]int64, len(responseSizeBuckets))}
+}
+
+// observe records a response body of n bytes. It reports whether n is over
+// warnBytes (LARGE_RESPONSE_WARN_BYTES; 0 never warns).
+func (r *responseSizes) observe(n int, warnBytes int64) bool {
+	size := int64(n)
+	for i, le := range responseSizeBuckets {
+		if size <= le {
+			atomic.AddInt64(&r.buckets[i], 1)
+		}
+	}
+	atomic.AddInt64(&r.count, 1)
+	atomic.AddInt64(&r.sum, size)
+	if warnBytes > 0 && size > warnBytes {
+		atomic.AddInt64(&r.large, 1)
+		return true
+	}
+	return false
+}
+
+// reset zeroes the histogram and the large response count.
+func (r *responseSizes) reset() {
+	for i := range r.buckets {
+		atomic.StoreInt64(&r.buckets[i], 0)
+	}
+	atomic.StoreInt64(&r.count, 0)
+	atomic.StoreInt64(&r.sum, 0)
+	atomic.StoreInt64(&r.large, 0)
+}
+
+func (r *responseSizes) writeMetrics(b *bytes.Buffer) {
+	const name = "roproxy_response_body_bytes"
+	fmt.Fprintf(b, "# HELP %s Body size of proxied responses.\n# TYPE %s histogram\n", name, name)
+	for i, le := range responseSizeBuckets {
+		fmt.Fprintf(b, "%s_bucket{le=\"%d\"} %d\n", name, le, atomic.LoadInt64(&r.buckets[i]))
+	}
+	count := atomic.LoadInt64(&r.count)
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %d\n%s_count %d\n", name, count, name, atomic.LoadInt64(&r.sum), name, count)
+	fmt.Fprintf(b, "# HELP roproxy_large_responses_total Responses larger than LARGE_RESPONSE_WARN_BYTES.\n# TYPE roproxy_large_responses_total counter\nroproxy_large_responses_total %d\n",
+		atomic.LoadInt64(&r.large))
+}
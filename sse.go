@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// eventStreamKey is the ctx user value holding the *eventStream of a
+// request whose upstream answered with server-sent events.
+const eventStreamKey = "eventStream"
+
+// sseClient sends upstream requests that may be answered with server-sent
+// events (SSE_ENABLED). fasthttp's client only returns a response once its
+// body is read, which for an event stream is when the stream ends, so these
+// go over net/http, which returns after the headers. It dials with the same
+// dialer and TLS config as client.
+type sseClient struct {
+	client *fasthttp.Client
+	t      *http.Transport
+}
+
+func newSSEClient(client *fasthttp.Client) *sseClient {
+	c := &sseClient{client: client}
+	c.t = &http.Transport{
+		DialTLSContext: c.dialTLS,
+		// bodies are passed through still encoded, as with fasthttp
+		DisableCompression:     true,
+		MaxResponseHeaderBytes: int64(client.ReadBufferSize),
+		MaxIdleConnsPerHost:    client.MaxConnsPerHost,
+		IdleConnTimeout:        client.MaxIdleConnDuration,
+	}
+	return c
+}
+
+func (c *sseClient) dialTLS(_ context.Context, network, addr string) (net.Conn, error) {
+	conn, err := c.client.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if c.client.TLSConfig != nil {
+		cfg = c.client.TLSConfig.Clone()
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// wantsEventStream reports whether the request in ctx is sent through the
+// sseClient: SSE_ENABLED is set and it's a GET accepting text/event-stream,
+// as EventSource requests are.
+func wantsEventStream(cfg *Config, ctx *fasthttp.RequestCtx) bool {
+	return cfg.SSEEnabled && ctx.IsGet() &&
+		bytes.Contains(bytes.ToLower(ctx.Request.Header.Peek("Accept")), []byte("text/event-stream"))
+}
+
+// do sends req and fills resp's status and headers. When the response is
+// an event stream its body is returned unread, for the caller to pass on
+// and close; the deadline, or the client's ReadTimeout when zero, only
+// covers the headers. Any other response is read in full into resp, as
+// by h2Client.do, and do returns nil.
+func (c *sseClient) do(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) (*eventStream, error) {
+	if deadline.IsZero() {
+		deadline = time.Now().Add(c.client.ReadTimeout)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(time.Until(deadline), cancel)
+
+	hreq, err := toHTTPRequest(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	hresp, err := c.t.RoundTrip(hreq)
+	if err != nil {
+		cancel()
+		if !timer.Stop() {
+			return nil, fasthttp.ErrTimeout
+		}
+		return nil, err
+	}
+	if isEventStream(hresp.Header.Get("Content-Type")) && timer.Stop() {
+		resp.Reset()
+		resp.SetStatusCode(hresp.StatusCode)
+		for k, vs := range hresp.Header {
+			if k == "Content-Length" || isHopByHop(strings.ToLower(k)) {
+				continue
+			}
+			for _, v := range vs {
+				resp.Header.Add(k, v)
+			}
+		}
+		return &eventStream{body: hresp.Body, cancel: cancel}, nil
+	}
+	defer cancel()
+	defer timer.Stop()
+	defer hresp.Body.Close()
+	if err := fromHTTPResponse(hresp, resp, c.client.MaxResponseBodySize); err != nil {
+		if ctx.Err() != nil {
+			return nil, fasthttp.ErrTimeout
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+func isEventStream(contentType string) bool {
+	return strings.EqualFold(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]), "text/event-stream")
+}
+
+// eventStream is an upstream event stream being passed to a client. The
+// server writes a body stream of unknown size chunk by chunk, flushing
+// each, so events reach the client as they arrive.
+type eventStream struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+
+	// conn is the client connection. The server gives each response
+	// SERVER_WRITE_TIMEOUT to be written, which a stream outlives, so the
+	// deadline is lifted on the first read, once the server has set it.
+	conn   net.Conn
+	lifted bool
+}
+
+func (e *eventStream) Read(p []byte) (int, error) {
+	if !e.lifted && e.conn != nil {
+		e.conn.SetWriteDeadline(time.Time{})
+		e.lifted = true
+	}
+	return e.body.Read(p)
+}
+
+// Close is called by the server once the stream ends or the client goes
+// away.
+func (e *eventStream) Close() error {
+	e.cancel()
+	return e.body.Close()
+}
+
+// writeEventStream answers ctx with the event stream upstream answered
+// with, resp holding its status and headers. Nothing is cached, and the
+// stream isn't held to the limits on in-flight requests once it's
+// answering.
+func writeEventStream(cfg *Config, ctx *fasthttp.RequestCtx, resp *fasthttp.Response, stream *eventStream) {
+	ctx.SetStatusCode(resp.StatusCode())
+	resp.Header.VisitAll(func(k, v []byte) {
+		ctx.Response.Header.Add(string(k), string(v))
+	})
+	// for reverse proxies in front that buffer responses
+	ctx.Response.Header.Set("X-Accel-Buffering", "no")
+	setTimingHeaders(cfg, ctx)
+	stream.conn = ctx.Conn()
+	ctx.SetBodyStream(stream, -1)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestEventStream(t *testing.T) {
+	next := make(chan struct{})
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) != "/v1/events" {
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{"events":false}`)
+			return
+		}
+		ctx.SetContentType("text/event-stream")
+		ctx.Response.Header.Set("Cache-Control", "no-cache")
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			w.WriteString("id: 1\ndata: first\n\n")
+			w.Flush()
+			<-next
+			w.WriteString("id: 2\ndata: second\n\n")
+			w.Flush()
+		})
+	}
+	cfg := testConfig()
+	cfg.SSEEnabled = true
+	cfg.Timeout = Duration(200 * time.Millisecond)
+	cfg.ServerWriteTimeout = Duration(200 * time.Millisecond)
+	cfg.CacheTTL = Duration(time.Minute)
+	s := newTestServer(t, cfg, upstream)
+	// over TCP, which unlike the in-memory listener fails writes past
+	// their deadline
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go newHTTPServer(cfg, s.requestHandler).Serve(ln)
+	client := &fasthttp.Client{Dial: func(string) (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) }}
+
+	conn, err := client.Dial("proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /notifications/v1/events HTTP/1.1\r\nHost: proxy\r\nAccept: text/event-stream\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	var h fasthttp.ResponseHeader
+	if err := h.Read(br); err != nil {
+		t.Fatal(err)
+	}
+	if h.StatusCode() != 200 || string(h.ContentType()) != "text/event-stream" || string(h.Peek("Cache-Control")) != "no-cache" {
+		t.Fatalf("headers: %s", h.Header())
+	}
+	if h.ContentLength() != -1 {
+		t.Errorf("Content-Length %d, want chunked", h.ContentLength())
+	}
+	events := bufio.NewReader(httputil.NewChunkedReader(br))
+	readEvent := func() string {
+		t.Helper()
+		var lines []string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading event: %v", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	if e := readEvent(); e != "id: 1\ndata: first\n" {
+		t.Errorf("first event %q", e)
+	}
+	// past both the upstream read and client write timeouts
+	time.Sleep(400 * time.Millisecond)
+	close(next)
+	if e := readEvent(); e != "id: 2\ndata: second\n" {
+		t.Errorf("second event %q", e)
+	}
+	if rest, err := ioutil.ReadAll(events); err != nil || len(rest) > 0 {
+		t.Errorf("after the stream ended: %q, %v", rest, err)
+	}
+
+	// any other answer is passed on as usual
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://proxy/notifications/v1/settings")
+	req.Header.Set("Accept", "text/event-stream")
+	var resp fasthttp.Response
+	if err := client.DoTimeout(req, &resp, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != 200 || string(resp.Body()) != `{"events":false}` || len(resp.Header.Peek("X-Proxy-Cache")) > 0 {
+		t.Errorf("non-stream answer: %d %q, X-Proxy-Cache %q", resp.StatusCode(), resp.Body(), resp.Header.Peek("X-Proxy-Cache"))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// thumbnailBatchLimit is how many requests thumbnails.roblox.com takes
+	// in one /v1/batch call.
+	thumbnailBatchLimit = 100
+
+	// thumbnailResolveMaxSize is the largest width or height resolve=true
+	// inlines as a data URI.
+	thumbnailResolveMaxSize = 150
+)
+
+// thumbnailRequest is one entry of a thumbnails /v1/batch request.
+type thumbnailRequest struct {
+	RequestID string `json:"requestId"`
+	TargetID  int64  `json:"targetId"`
+	Type      string `json:"type"`
+	Size      string `json:"size"`
+	Format    string `json:"format"`
+}
+
+// thumbnailsHandler serves GET /_proxy/thumbnails?userIds=1,2,3: the
+// thumbnails of many users from batch calls, as a map of user ID to image
+// URL (null when there is none). Optional parameters are size (150x150),
+// format (Png) and type (AvatarHeadshot). With resolve=true, small images
+// are fetched and inlined as data URIs. Complete answers are cached for
+// THUMBNAIL_CACHE_TTL.
+func (s *Server) thumbnailsHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		proxyError(ctx, 405, "method_not_allowed", "Use GET.")
+		return
+	}
+	cfg := s.config()
+	key := cacheKey("GET", "", string(ctx.RequestURI()))
+	if s.thumbCache != nil {
+		if cached := s.thumbCache.get(key); cached != nil {
+			cached.writeTo(ctx, false)
+			return
+		}
+	}
+
+	args := ctx.QueryArgs()
+	var ids []int64
+	for _, v := range strings.Split(string(args.Peek("userIds")), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			proxyError(ctx, 400, "invalid_user_ids", "userIds must be a comma-separated list of user IDs.")
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		proxyError(ctx, 400, "invalid_user_ids", "userIds must be a comma-separated list of user IDs.")
+		return
+	}
+	size := queryDefault(args, "size", "150x150")
+	format := queryDefault(args, "format", "Png")
+	typ := queryDefault(args, "type", "AvatarHeadshot")
+	resolve := string(args.Peek("resolve")) == "true"
+	if resolve && !smallThumbnail(size) {
+		proxyError(ctx, 400, "thumbnail_too_large", "resolve=true is only available for sizes up to "+
+			strconv.Itoa(thumbnailResolveMaxSize)+"x"+strconv.Itoa(thumbnailResolveMaxSize)+".")
+		return
+	}
+
+	b := &batchRequest{endpoint: batchEndpoint{limit: thumbnailBatchLimit}}
+	for _, id := range ids {
+		entry, _ := json.Marshal(thumbnailRequest{
+			RequestID: strconv.FormatInt(id, 10),
+			TargetID:  id,
+			Type:      typ,
+			Size:      size,
+			Format:    format,
+		})
+		b.ids = append(b.ids, entry)
+	}
+	resp, err := s.splitBatch(cfg, internalCtx(ctx, "POST", "/thumbnails/v1/batch", []byte{}), b)
+	defer fasthttp.ReleaseResponse(resp)
+	if err != nil || resp.StatusCode() != 200 {
+		proxyError(ctx, 502, "thumbnails_failed", "Thumbnails request failed with status "+strconv.Itoa(resp.StatusCode())+".")
+		return
+	}
+	var page struct {
+		Data []struct {
+			TargetID int64           `json:"targetId"`
+			State    string          `json:"state"`
+			ImageURL string          `json:"imageUrl"`
+			Error    json.RawMessage `json:"error"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Body(), &page); err != nil {
+		proxyError(ctx, 502, "thumbnails_failed", "Thumbnails response was not understood.")
+		return
+	}
+
+	urls := make(map[string]*string, len(ids))
+	for _, id := range ids {
+		urls[strconv.FormatInt(id, 10)] = nil
+	}
+	complete := true
+	for _, d := range page.Data {
+		if d.Error != nil || d.State != "Completed" || d.ImageURL == "" {
+			// failed chunks and pending thumbnails shouldn't be cached
+			complete = false
+			continue
+		}
+		url := d.ImageURL
+		urls[strconv.FormatInt(d.TargetID, 10)] = &url
+	}
+	if resolve && !s.inlineThumbnails(cfg, urls) {
+		complete = false
+	}
+
+	writeJSON(ctx, 200, urls)
+	if s.thumbCache != nil && complete {
+		ctx.Response.Header.Set("X-Proxy-Cache", "MISS")
+		s.thumbCache.set(key, newCachedResponse(&ctx.Response))
+	}
+}
+
+// inlineThumbnails replaces each image URL with a data URI of the image,
+// or null when it can't be fetched, and reports whether all were fetched.
+func (s *Server) inlineThumbnails(cfg *Config, urls map[string]*string) bool {
+	fetch := map[string]string{}
+	for id, url := range urls {
+		if url != nil {
+			fetch[id] = *url
+		}
+	}
+	var mu sync.Mutex
+	ok := true
+	sem := make(chan struct{}, cfg.BatchConcurrency)
+	var wg sync.WaitGroup
+	for id, url := range fetch {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id, url string) {
+			defer func() { <-sem; wg.Done() }()
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			req.SetRequestURI(url)
+			req.Header.Set("User-Agent", cfg.UserAgent)
+			var uri *string
+			if err := s.client.DoTimeout(req, resp, cfg.Timeout.D()); err == nil && resp.StatusCode() == 200 {
+				v := "data:" + string(resp.Header.ContentType()) + ";base64," + base64.StdEncoding.EncodeToString(resp.Body())
+				uri = &v
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			urls[id] = uri
+			ok = ok && uri != nil
+		}(id, url)
+	}
+	wg.Wait()
+	return ok
+}
+
+// smallThumbnail reports whether a WxH size is small enough to inline.
+func smallThumbnail(size string) bool {
+	w, h, ok := cut(strings.ToLower(size), "x")
+	wn, err1 := strconv.Atoi(w)
+	hn, err2 := strconv.Atoi(h)
+	return ok && err1 == nil && err2 == nil && wn <= thumbnailResolveMaxSize && hn <= thumbnailResolveMaxSize
+}
+
+func queryDefault(args *fasthttp.Args, key, def string) string {
+	if v := string(args.Peek(key)); v != "" {
+		return v
+	}
+	return def
+}
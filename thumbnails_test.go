@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// thumbnailsUpstream fakes thumbnails.roblox.com's batch endpoint and the
+// CDN. User 13 is still pending.
+type thumbnailsUpstream struct {
+	mu       sync.Mutex
+	batches  [][]thumbnailRequest
+	cdnCalls int
+}
+
+func (u *thumbnailsUpstream) handler(ctx *fasthttp.RequestCtx) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if string(ctx.Host()) == "tr.rbxcdn.com" {
+		u.cdnCalls++
+		ctx.SetContentType("image/png")
+		ctx.SetBodyString("png" + string(ctx.Path()))
+		return
+	}
+	var reqs []thumbnailRequest
+	if string(ctx.Host()) != "thumbnails.roblox.com" || string(ctx.Path()) != "/v1/batch" || json.Unmarshal(ctx.PostBody(), &reqs) != nil {
+		ctx.Error("unexpected request", 404)
+		return
+	}
+	if len(reqs) > thumbnailBatchLimit {
+		ctx.Error(`{"errors":[{"message":"Too many requests in batch"}]}`, 400)
+		return
+	}
+	u.batches = append(u.batches, reqs)
+	var data []string
+	for _, r := range reqs {
+		if r.TargetID == 13 {
+			data = append(data, fmt.Sprintf(`{"requestId":%q,"targetId":%d,"state":"Pending","imageUrl":""}`, r.RequestID, r.TargetID))
+			continue
+		}
+		data = append(data, fmt.Sprintf(`{"requestId":%q,"targetId":%d,"state":"Completed","imageUrl":"https://tr.rbxcdn.com/%d/%s/%s"}`,
+			r.RequestID, r.TargetID, r.TargetID, r.Size, r.Format))
+	}
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"data":[` + strings.Join(data, ",") + `]}`)
+}
+
+func (u *thumbnailsUpstream) take() (batches [][]thumbnailRequest, cdnCalls int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	batches, cdnCalls = u.batches, u.cdnCalls
+	u.batches, u.cdnCalls = nil, 0
+	return batches, cdnCalls
+}
+
+func getThumbnails(t *testing.T, s *Server, query string) (*fasthttp.Response, map[string]*string) {
+	t.Helper()
+	resp := serveRaw(t, s, "GET /_proxy/thumbnails?"+query+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	var urls map[string]*string
+	if resp.StatusCode() == 200 {
+		if err := json.Unmarshal(resp.Body(), &urls); err != nil {
+			t.Fatalf("%v in %q", err, resp.Body())
+		}
+	}
+	return resp, urls
+}
+
+func TestThumbnails(t *testing.T) {
+	u := &thumbnailsUpstream{}
+	s := newTestServer(t, testConfig(), u.handler)
+
+	resp, urls := getThumbnails(t, s, "userIds=1,2&size=48x48&format=Webp")
+	if resp.StatusCode() != 200 || len(urls) != 2 || urls["1"] == nil || *urls["1"] != "https://tr.rbxcdn.com/1/48x48/Webp" {
+		t.Errorf("got %d %q", resp.StatusCode(), resp.Body())
+	}
+	batches, _ := u.take()
+	want := thumbnailRequest{RequestID: "2", TargetID: 2, Type: "AvatarHeadshot", Size: "48x48", Format: "Webp"}
+	if len(batches) != 1 || len(batches[0]) != 2 || batches[0][1] != want {
+		t.Errorf("upstream batches = %+v, want one with %+v", batches, want)
+	}
+
+	// Pending thumbnails are null, and such answers aren't cached
+	_, urls = getThumbnails(t, s, "userIds=12,13")
+	if urls["12"] == nil || urls["13"] != nil {
+		t.Errorf("pending thumbnail: %v", urls)
+	}
+	resp, _ = getThumbnails(t, s, "userIds=12,13")
+	if string(resp.Header.Peek("X-Proxy-Cache")) == "HIT" {
+		t.Error("incomplete answer was cached")
+	}
+	u.take()
+
+	// Complete answers are
+	resp, _ = getThumbnails(t, s, "userIds=1,2&size=48x48&format=Webp")
+	if string(resp.Header.Peek("X-Proxy-Cache")) != "HIT" {
+		t.Errorf("X-Proxy-Cache = %q, want HIT", resp.Header.Peek("X-Proxy-Cache"))
+	}
+	if batches, _ := u.take(); len(batches) != 0 {
+		t.Errorf("cached answer sent %d batches", len(batches))
+	}
+
+	for _, query := range []string{"", "userIds=1,x", "userIds=1&size=420x420&resolve=true"} {
+		if resp, _ := getThumbnails(t, s, query); resp.StatusCode() != 400 {
+			t.Errorf("%q: status = %d, want 400", query, resp.StatusCode())
+		}
+	}
+}
+
+func TestThumbnailsSplit(t *testing.T) {
+	u := &thumbnailsUpstream{}
+	s := newTestServer(t, testConfig(), u.handler)
+
+	ids := make([]string, 250)
+	for i := range ids {
+		ids[i] = fmt.Sprint(1000 + i)
+	}
+	resp, urls := getThumbnails(t, s, "userIds="+strings.Join(ids, ","))
+	if resp.StatusCode() != 200 || len(urls) != 250 {
+		t.Fatalf("got %d with %d entries", resp.StatusCode(), len(urls))
+	}
+	for _, id := range ids {
+		if urls[id] == nil {
+			t.Errorf("no URL for %s", id)
+		}
+	}
+	batches, _ := u.take()
+	if len(batches) != 3 {
+		t.Errorf("sent %d batches, want 3", len(batches))
+	}
+}
+
+func TestThumbnailsResolve(t *testing.T) {
+	u := &thumbnailsUpstream{}
+	s := newTestServer(t, testConfig(), u.handler)
+
+	_, urls := getThumbnails(t, s, "userIds=1,2,13&resolve=true")
+	if urls["1"] == nil || *urls["1"] != "data:image/png;base64,cG5nLzEvMTUweDE1MC9Qbmc=" || urls["13"] != nil {
+		t.Errorf("resolved = %v", urls)
+	}
+	if _, cdnCalls := u.take(); cdnCalls != 2 {
+		t.Errorf("fetched %d images, want 2", cdnCalls)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var timeoutHeader = reserveHeader("X-Proxy-Timeout",
+	"Deadline for this request, spanning every attempt and backoff, as a duration such as 1500ms. It is clamped between MIN_TIMEOUT and the request's usual deadline.")
+
+// timeoutKey is the ctx user value holding the X-Proxy-Timeout deadline, as
+// a time.Duration.
+const timeoutKey = "timeout"
+
+// applyTimeout handles X-Proxy-Timeout, which is stripped from every
+// request. The duration can only tighten the deadline the request would
+// otherwise get, from TIMEOUT_OVERRIDES or TIMEOUT, and not below
+// MIN_TIMEOUT unless that deadline is shorter still. It reports whether the request may proceed; otherwise the
+// error response has been written.
+func applyTimeout(cfg *Config, ctx *fasthttp.RequestCtx) bool {
+	v := strings.TrimSpace(string(ctx.Request.Header.Peek(timeoutHeader)))
+	ctx.Request.Header.Del(timeoutHeader)
+	if v == "" {
+		return true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		proxyError(ctx, 400, "invalid_timeout", timeoutHeader+" must be a positive duration, such as 1500ms.")
+		return false
+	}
+	max := cfg.requestTimeout(splitRequestURI(ctx)[0])
+	if max <= 0 {
+		max = cfg.Timeout.D()
+	}
+	if d < cfg.MinTimeout.D() {
+		d = cfg.MinTimeout.D()
+	}
+	// raising it to MIN_TIMEOUT mustn't loosen a shorter
+	// TIMEOUT_OVERRIDES entry
+	if d > max {
+		d = max
+	}
+	ctx.SetUserValue(timeoutKey, d)
+	return true
+}
+
+// requestDeadline is when a request started now has to be answered by:
+// its X-Proxy-Timeout, or else its TIMEOUT_OVERRIDES entry. It is zero when
+// only the client timeouts apply.
+func requestDeadline(cfg *Config, ctx *fasthttp.RequestCtx) time.Time {
+	d, ok := ctx.UserValue(timeoutKey).(time.Duration)
+	if !ok {
+		d = cfg.requestTimeout(splitRequestURI(ctx)[0])
+	}
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// timeoutResponse answers a request that ran past its deadline, naming
+// the X-Proxy-Timeout it asked for.
+func timeoutResponse(ctx *fasthttp.RequestCtx) *fasthttp.Response {
+	if d, ok := ctx.UserValue(timeoutKey).(time.Duration); ok {
+		return errorResponse(504, "upstream_timeout", fmt.Sprintf("Upstream did not respond within the %v %s.", d, timeoutHeader))
+	}
+	return errorResponse(504, "upstream_timeout", "Upstream did not respond in time.")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestApplyTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		override time.Duration // TIMEOUT_OVERRIDES entry for users
+		header   string
+		want     time.Duration // 0 for no per-request deadline
+		ok       bool
+	}{
+		{"no header", 0, "", 0, true},
+		{"in range", 0, "1500ms", 1500 * time.Millisecond, true},
+		{"below min_timeout", 0, "1ms", 100 * time.Millisecond, true},
+		{"above timeout", 0, "1m", 10 * time.Second, true},
+		{"above override", 5 * time.Second, "20s", 5 * time.Second, true},
+		{"override below min_timeout", 50 * time.Millisecond, "1ms", 50 * time.Millisecond, true},
+		{"bare number", 0, "1500", 0, false},
+		{"negative", 0, "-1s", 0, false},
+		{"zero", 0, "0s", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.override > 0 {
+				cfg.TimeoutOverrides = TimeoutOverrides{"users": Duration(tt.override)}
+			}
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI("/users/v1/users/1")
+			if tt.header != "" {
+				ctx.Request.Header.Set(timeoutHeader, tt.header)
+			}
+			if ok := applyTimeout(cfg, ctx); ok != tt.ok {
+				t.Fatalf("applyTimeout = %v, want %v", ok, tt.ok)
+			}
+			if !tt.ok {
+				if ctx.Response.StatusCode() != 400 {
+					t.Errorf("status = %d, want 400", ctx.Response.StatusCode())
+				}
+				return
+			}
+			got, _ := ctx.UserValue(timeoutKey).(time.Duration)
+			if got != tt.want {
+				t.Errorf("timeout = %v, want %v", got, tt.want)
+			}
+			if len(ctx.Request.Header.Peek(timeoutHeader)) > 0 {
+				t.Error("header not stripped")
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	var gotHeader string
+	slow := func(ctx *fasthttp.RequestCtx) {
+		gotHeader = string(ctx.Request.Header.Peek(timeoutHeader))
+		time.Sleep(300 * time.Millisecond)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	cfg.Retries = 3
+	s := newTestServer(t, cfg, slow)
+
+	start := time.Now()
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"+timeoutHeader+": 150ms\r\n\r\n")
+	if resp.StatusCode() != 504 || !strings.Contains(string(resp.Body()), "150ms") {
+		t.Errorf("short timeout: %d %s, want 504 naming 150ms", resp.StatusCode(), resp.Body())
+	}
+	// the retries and their backoff fit in the same deadline
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("short timeout took %v", elapsed)
+	}
+	if gotHeader != "" {
+		t.Errorf("upstream got %s: %q", timeoutHeader, gotHeader)
+	}
+
+	resp = serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"+timeoutHeader+": 2s\r\n\r\n")
+	if resp.StatusCode() != 200 {
+		t.Errorf("long timeout: status = %d, want 200", resp.StatusCode())
+	}
+	resp = serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n"+timeoutHeader+": soon\r\n\r\n")
+	if resp.StatusCode() != 400 {
+		t.Errorf("invalid timeout: status = %d, want 400", resp.StatusCode())
+	}
+}
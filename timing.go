@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// upstreamDurationKey is the RequestCtx user value accumulating the time
+// spent inside client.Do across all attempts of a request.
+const upstreamDurationKey = "upstreamDuration"
+
+func addUpstreamDuration(ctx *fasthttp.RequestCtx, d time.Duration) {
+	prev, _ := ctx.UserValue(upstreamDurationKey).(time.Duration)
+	ctx.SetUserValue(upstreamDurationKey, prev+d)
+}
+
+// setTimingHeaders exposes the upstream time as Server-Timing and
+// X-Upstream-Duration-Ms when EXPOSE_TIMING is enabled, so clients can tell
+// proxy overhead from Roblox latency.
+func setTimingHeaders(cfg *Config, ctx *fasthttp.RequestCtx) {
+	if !cfg.ExposeTiming {
+		return
+	}
+	d, ok := ctx.UserValue(upstreamDurationKey).(time.Duration)
+	if !ok {
+		return
+	}
+	ms := float64(d.Microseconds()) / 1000
+	ctx.Response.Header.Add("Server-Timing", fmt.Sprintf("upstream;dur=%.1f", ms))
+	ctx.Response.Header.Set("X-Upstream-Duration-Ms", strconv.FormatInt(d.Milliseconds(), 10))
+}
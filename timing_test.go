@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestExposeTiming(t *testing.T) {
+	slow := func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(50 * time.Millisecond)
+		okUpstream(ctx)
+	}
+	cfg := testConfig()
+	s := newTestServer(t, cfg, slow)
+	resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if v := resp.Header.Peek("Server-Timing"); len(v) > 0 {
+		t.Errorf("Server-Timing %q without EXPOSE_TIMING", v)
+	}
+
+	cfg = testConfig()
+	cfg.ExposeTiming = true
+	s = newTestServer(t, cfg, slow)
+	resp = serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	timing := string(resp.Header.Peek("Server-Timing"))
+	dur, err := strconv.ParseFloat(strings.TrimPrefix(timing, "upstream;dur="), 64)
+	if !strings.HasPrefix(timing, "upstream;dur=") || err != nil || dur < 50 {
+		t.Errorf("Server-Timing = %q, want upstream;dur= of at least 50ms", timing)
+	}
+	ms, err := strconv.Atoi(string(resp.Header.Peek("X-Upstream-Duration-Ms")))
+	if err != nil || ms < 50 || float64(ms) > dur {
+		t.Errorf("X-Upstream-Duration-Ms = %q, want the Server-Timing duration in whole ms", resp.Header.Peek("X-Upstream-Duration-Ms"))
+	}
+
+	// the proxy's own answers spent no time upstream
+	resp = serveRaw(t, s, "GET /healthz HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if v := resp.Header.Peek("Server-Timing"); len(v) > 0 {
+		t.Errorf("/healthz Server-Timing = %q", v)
+	}
+}
@@ -0,0 +1,266 @@
+// Package transform applies small, ordered edits to JSON documents. It is
+// the engine behind the proxy's TRANSFORMS setting.
+//
+// A pipeline is written as operations separated by "|", applied left to
+// right:
+//
+//	pick(data.id,data.name)|rename(data.name,title)|flatten(data)
+//
+// Paths are dotted keys. A segment that is a number indexes an array; any
+// other segment reaching an array applies to each of its elements, so
+// data.name is the name of every element of data. The operations are:
+//
+//	pick(path,...)       keep only the listed paths, which don't index arrays
+//	rename(path,name)    rename the key at path to name, in the same object
+//	flatten(path)        replace the array at path with its first element, or null when it's empty
+//	default(path,value)  set path to value, a JSON literal or else a string, when it's missing or null
+//	number(path,...)     turn strings holding numbers at the paths into numbers
+//
+// Operations only ever apply where the path leads; one that finds nothing
+// to change leaves the document alone.
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Op is one parsed operation.
+type Op struct {
+	name  string
+	paths [][]string
+	to    string // rename
+	value []byte // default, as JSON
+}
+
+// Pipeline is a sequence of operations applied in order.
+type Pipeline []Op
+
+// Parse reads a pipeline written as described in the package comment.
+func Parse(spec string) (Pipeline, error) {
+	var p Pipeline
+	for _, s := range strings.Split(spec, "|") {
+		op, err := parseOp(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, op)
+	}
+	return p, nil
+}
+
+func parseOp(s string) (Op, error) {
+	open := strings.IndexByte(s, '(')
+	if open < 1 || !strings.HasSuffix(s, ")") {
+		return Op{}, fmt.Errorf("%q is not name(arguments)", s)
+	}
+	op := Op{name: s[:open]}
+	args := s[open+1 : len(s)-1]
+	var paths []string
+	switch op.name {
+	case "pick", "number":
+		paths = strings.Split(args, ",")
+	case "rename":
+		from, to := splitArg(args)
+		if to == "" || strings.Contains(to, ".") {
+			return Op{}, fmt.Errorf("%q: rename takes a path and a key name", s)
+		}
+		paths, op.to = []string{from}, to
+	case "flatten":
+		if strings.Contains(args, ",") {
+			return Op{}, fmt.Errorf("%q: flatten takes one path", s)
+		}
+		paths = []string{args}
+	case "default":
+		path, value := splitArg(args)
+		if value == "" {
+			return Op{}, fmt.Errorf("%q: default takes a path and a value", s)
+		}
+		op.value = []byte(value)
+		if !json.Valid(op.value) {
+			op.value, _ = json.Marshal(value)
+		}
+		paths = []string{path}
+	default:
+		return Op{}, fmt.Errorf("%q: unknown operation %s", s, op.name)
+	}
+	for _, path := range paths {
+		segs := strings.Split(strings.TrimSpace(path), ".")
+		for _, seg := range segs {
+			if seg == "" {
+				return Op{}, fmt.Errorf("%q: %q is not a dotted path", s, path)
+			}
+		}
+		op.paths = append(op.paths, segs)
+	}
+	return op, nil
+}
+
+// splitArg splits args at its first comma, trimming both halves.
+func splitArg(args string) (string, string) {
+	i := strings.IndexByte(args, ',')
+	if i < 0 {
+		return strings.TrimSpace(args), ""
+	}
+	return strings.TrimSpace(args[:i]), strings.TrimSpace(args[i+1:])
+}
+
+// Apply runs the pipeline over the JSON document body and returns the
+// result. Numbers are kept as they were written. The error is for a body
+// that isn't JSON.
+func (p Pipeline) Apply(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("more than one JSON value")
+	}
+	for _, op := range p {
+		doc = op.apply(doc)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (op Op) apply(doc interface{}) interface{} {
+	switch op.name {
+	case "pick":
+		t := tree{}
+		for _, path := range op.paths {
+			t.add(path)
+		}
+		if v, ok := t.project(doc); ok {
+			return v
+		}
+		return doc
+	case "rename":
+		visit(doc, op.paths[0], func(obj map[string]interface{}, key string) {
+			if v, ok := obj[key]; ok && key != op.to {
+				delete(obj, key)
+				obj[op.to] = v
+			}
+		})
+	case "flatten":
+		visit(doc, op.paths[0], func(obj map[string]interface{}, key string) {
+			if arr, ok := obj[key].([]interface{}); ok {
+				if len(arr) == 0 {
+					obj[key] = nil
+				} else {
+					obj[key] = arr[0]
+				}
+			}
+		})
+	case "default":
+		visit(doc, op.paths[0], func(obj map[string]interface{}, key string) {
+			if obj[key] == nil {
+				// decoded for each use, so no two keys share a value
+				dec := json.NewDecoder(bytes.NewReader(op.value))
+				dec.UseNumber()
+				var v interface{}
+				dec.Decode(&v)
+				obj[key] = v
+			}
+		})
+	case "number":
+		for _, path := range op.paths {
+			visit(doc, path, func(obj map[string]interface{}, key string) {
+				s, ok := obj[key].(string)
+				if !ok {
+					return
+				}
+				if _, err := strconv.ParseFloat(s, 64); err == nil && json.Valid([]byte(s)) {
+					obj[key] = json.Number(s)
+				}
+			})
+		}
+	}
+	return doc
+}
+
+// visit calls fn with the object and key of every value path leads to,
+// whether or not the object has the key.
+func visit(v interface{}, path []string, fn func(obj map[string]interface{}, key string)) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			fn(v, path[0])
+		} else if next, ok := v[path[0]]; ok {
+			visit(next, path[1:], fn)
+		}
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i >= 0 && i < len(v) && len(path) > 1 {
+				visit(v[i], path[1:], fn)
+			}
+			return
+		}
+		for _, e := range v {
+			visit(e, path, fn)
+		}
+	}
+}
+
+// tree is a set of paths by their first segment, for pick. A nil subtree
+// keeps the whole value.
+type tree map[string]tree
+
+func (t tree) add(path []string) {
+	sub, seen := t[path[0]]
+	switch {
+	case len(path) == 1:
+		t[path[0]] = nil
+	case seen && sub == nil:
+		// the whole value is already kept
+	default:
+		if sub == nil {
+			sub = tree{}
+			t[path[0]] = sub
+		}
+		sub.add(path[1:])
+	}
+}
+
+// project returns v with only the paths in t. Arrays are projected element
+// by element, keeping scalar elements as they are; false is returned for a
+// scalar, which no path can go into.
+func (t tree) project(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, sub := range t {
+			e, ok := v[k]
+			switch {
+			case !ok:
+			case sub == nil:
+				out[k] = e
+			default:
+				if p, ok := sub.project(e); ok {
+					out[k] = p
+				}
+			}
+		}
+		return out, true
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			if p, ok := t.project(e); ok {
+				out[i] = p
+			} else {
+				out[i] = e
+			}
+		}
+		return out, true
+	}
+	return nil, false
+}
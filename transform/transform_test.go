@@ -0,0 +1,84 @@
+package transform
+
+import "testing"
+
+func TestApply(t *testing.T) {
+	for _, tc := range []struct {
+		name, spec, in, want string
+	}{
+		{"pick", "pick(data.id,data.name,nextPageCursor)",
+			`{"data":[{"id":1,"name":"a","price":5},{"id":2}],"nextPageCursor":null,"previousPageCursor":"x"}`,
+			`{"data":[{"id":1,"name":"a"},{"id":2}],"nextPageCursor":null}`},
+		{"pick whole value", "pick(data,data.id)", `{"data":{"id":1,"name":"a"},"x":1}`, `{"data":{"id":1,"name":"a"}}`},
+		{"pick scalar elements", "pick(id)", `[{"id":1,"x":2},3]`, `[{"id":1},3]`},
+		{"pick into scalar", "pick(data.id)", `{"data":5}`, `{}`},
+		{"rename", "rename(data.name,title)", `{"data":[{"name":"a"},{"id":2}]}`, `{"data":[{"title":"a"},{"id":2}]}`},
+		{"rename top level", "rename(a,b)", `{"a":1,"b":2}`, `{"b":1}`},
+		{"flatten", "flatten(data)", `{"data":[{"id":1},{"id":2}]}`, `{"data":{"id":1}}`},
+		{"flatten empty", "flatten(data)", `{"data":[]}`, `{"data":null}`},
+		{"flatten non-array", "flatten(data)", `{"data":{"id":1}}`, `{"data":{"id":1}}`},
+		{"index", "rename(data.1.name,title)", `{"data":[{"name":"a"},{"name":"b"}]}`, `{"data":[{"name":"a"},{"title":"b"}]}`},
+		{"index out of range", "flatten(data.5.x)", `{"data":[1]}`, `{"data":[1]}`},
+		{"default", "default(data.price,0)", `{"data":[{"price":null},{"price":3},{}]}`, `{"data":[{"price":0},{"price":3},{"price":0}]}`},
+		{"default string", "default(name,unknown)", `{}`, `{"name":"unknown"}`},
+		{"default object", "default(a,{\"x\":[1,2]})|rename(0.a.x,y)", `[{},{}]`, `[{"a":{"y":[1,2]}},{"a":{"x":[1,2]}}]`},
+		{"number", "number(a,b,c,d)", `{"a":"12","b":"1.5e3","c":"0x10","d":"NaN","e":"7"}`, `{"a":12,"b":1.5e3,"c":"0x10","d":"NaN","e":"7"}`},
+		{"large numbers kept", "pick(id)", `{"id":12345678901234567890,"x":1}`, `{"id":12345678901234567890}`},
+		{"no html escaping", "pick(a)", `{"a":"<b>&"}`, `{"a":"<b>&"}`},
+		{"pipeline order", "flatten(data)|rename(data.name,title)|pick(data.title)",
+			`{"data":[{"name":"a","id":1}],"x":1}`, `{"data":{"title":"a"}}`},
+		{"nothing to change", "rename(missing.key,x)|flatten(a.b)", `{"a":1}`, `{"a":1}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := Parse(tc.spec)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			got, err := p.Apply([]byte(tc.in))
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	p, err := Parse("pick(a)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{``, `{"a":`, `<html>`, `{"a":1} {"a":2}`} {
+		if _, err := p.Apply([]byte(body)); err == nil {
+			t.Errorf("%q: no error", body)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		ok   bool
+	}{
+		{"pick(a.b, c) | rename(a.b,d) | flatten(x) | default(y,[1,2]) | number(z)", true},
+		{"pick(a)", true},
+		{"", false},
+		{"pick(a)|", false},
+		{"pick", false},
+		{"pick(a", false},
+		{"(a)", false},
+		{"unknown(a)", false},
+		{"pick(a..b)", false},
+		{"pick()", false},
+		{"rename(a)", false},
+		{"rename(a,b.c)", false},
+		{"default(a)", false},
+		{"flatten(a,b)", false},
+	} {
+		if _, err := Parse(tc.spec); (err == nil) != tc.ok {
+			t.Errorf("Parse(%q): %v", tc.spec, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+
+	"roproxy/transform"
+)
+
+// transformRoute is one TRANSFORMS entry, written subdomain/path=ops with
+// ops a transform pipeline. The pattern is matched with path.Match.
+type transformRoute struct {
+	pattern  string
+	pipeline transform.Pipeline
+}
+
+// parseTransforms reads TRANSFORMS: entries separated by ";", since the
+// pipelines themselves use commas.
+func parseTransforms(list string) ([]transformRoute, error) {
+	var out []transformRoute
+	for _, entry := range strings.Split(list, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, ops, ok := cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not subdomain/path=operations", entry)
+		}
+		pattern = strings.ToLower(strings.Trim(strings.TrimSpace(pattern), "/"))
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("%q: invalid pattern %q", entry, pattern)
+		}
+		p, err := transform.Parse(ops)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		out = append(out, transformRoute{pattern: pattern, pipeline: p})
+	}
+	return out, nil
+}
+
+// matchTransform returns the first TRANSFORMS entry for the request path,
+// or nil.
+func matchTransform(cfg *Config, ctx *fasthttp.RequestCtx) *transformRoute {
+	p := strings.ToLower(strings.Trim(string(ctx.Path()), "/"))
+	for i, r := range cfg.transforms {
+		if ok, _ := path.Match(r.pattern, p); ok {
+			return &cfg.transforms[i]
+		}
+	}
+	return nil
+}
+
+// applyTransform runs r over a successful JSON response of up to
+// TRANSFORMS_MAX_BYTES and marks it with X-Proxy-Transformed, naming the
+// entry. Anything else is left alone, and so is a body the pipeline can't
+// read: a transform never fails the request.
+func (s *Server) applyTransform(cfg *Config, resp *fasthttp.Response, r *transformRoute) {
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 || !isJSONContentType(resp.Header.ContentType()) ||
+		len(resp.Header.Peek("Content-Encoding")) > 0 || len(resp.Body()) == 0 || int64(len(resp.Body())) > cfg.TransformsMaxBytes {
+		s.transforms.add(r.pattern, "skipped")
+		return
+	}
+	body, err := r.pipeline.Apply(resp.Body())
+	if err != nil {
+		log.Printf("WARN transform %s: %v; passing the response on as it is", r.pattern, err)
+		s.transforms.add(r.pattern, "failed")
+		return
+	}
+	resp.SetBody(body)
+	resp.Header.SetContentLength(len(body))
+	resp.Header.Set("X-Proxy-Transformed", r.pattern)
+	s.transforms.add(r.pattern, "applied")
+}
+
+// transformStats counts TRANSFORMS outcomes by entry and result.
+type transformStats struct {
+	mu     sync.Mutex
+	counts map[[2]string]int64
+}
+
+func newTransformStats() *transformStats {
+	return &transformStats{counts: map[[2]string]int64{}}
+}
+
+func (t *transformStats) add(pattern, result string) {
+	t.mu.Lock()
+	t.counts[[2]string{pattern, result}]++
+	t.mu.Unlock()
+}
+
+func (t *transformStats) reset() {
+	t.mu.Lock()
+	t.counts = map[[2]string]int64{}
+	t.mu.Unlock()
+}
+
+func (t *transformStats) writeMetrics(b *bytes.Buffer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([][2]string, 0, len(t.counts))
+	for k := range t.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	fmt.Fprintf(b, "# HELP roproxy_transforms_total Responses matched by a TRANSFORMS entry, by entry and result (applied, failed or skipped).\n# TYPE roproxy_transforms_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(b, "roproxy_transforms_total{transform=%q,result=%q} %d\n", k[0], k[1], t.counts[k])
+	}
+}
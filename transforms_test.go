@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestTransforms(t *testing.T) {
+	var sawEncoding string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		sawEncoding = string(ctx.Request.Header.Peek("Accept-Encoding"))
+		ctx.SetContentType("application/json")
+		switch string(ctx.Path()) {
+		case "/v1/games":
+			ctx.SetBodyString(`{"data":[{"name":"Obby","playing":"12","price":null}]}`)
+		case "/v1/broken":
+			ctx.SetBodyString(`{"data":[`)
+		default:
+			ctx.SetBodyString(`{"data":[{"name":"x"}]}`)
+		}
+	}
+	cfg := testConfig()
+	cfg.Transforms = "games/v1/games=flatten(data)|rename(data.name,title)|number(data.playing)|default(data.price,0); games/v1/broken=pick(data)"
+	s := newTestServer(t, cfg, upstream)
+	get := func(uri string) *fasthttp.Response {
+		t.Helper()
+		return serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\nAccept-Encoding: gzip\r\n\r\n")
+	}
+
+	resp := get("/games/v1/games")
+	if string(resp.Body()) != `{"data":{"playing":12,"price":0,"title":"Obby"}}` || string(resp.Header.Peek("X-Proxy-Transformed")) != "games/v1/games" {
+		t.Errorf("transformed: %q, X-Proxy-Transformed %q", resp.Body(), resp.Header.Peek("X-Proxy-Transformed"))
+	}
+	if cl := resp.Header.ContentLength(); cl != len(resp.Body()) {
+		t.Errorf("Content-Length %d, body %d bytes", cl, len(resp.Body()))
+	}
+	if sawEncoding != "" {
+		t.Errorf("upstream got Accept-Encoding %q", sawEncoding)
+	}
+
+	// a body the pipeline can't read is passed on, never a 500
+	resp = get("/games/v1/broken")
+	if resp.StatusCode() != 200 || string(resp.Body()) != `{"data":[` || len(resp.Header.Peek("X-Proxy-Transformed")) > 0 {
+		t.Errorf("broken: %d %q", resp.StatusCode(), resp.Body())
+	}
+
+	resp = get("/games/v1/other")
+	if string(resp.Body()) != `{"data":[{"name":"x"}]}` || len(resp.Header.Peek("X-Proxy-Transformed")) > 0 || sawEncoding != "gzip" {
+		t.Errorf("not matched: %q, upstream Accept-Encoding %q", resp.Body(), sawEncoding)
+	}
+
+	cfg.TransformsMaxBytes = 10
+	if resp = get("/games/v1/games"); len(resp.Header.Peek("X-Proxy-Transformed")) > 0 {
+		t.Errorf("over transforms_max_bytes: transformed to %q", resp.Body())
+	}
+
+	metrics := string(serveHandler(t, s, (*Server).metricsHandler, "GET /metrics HTTP/1.1\r\nHost: proxy\r\n\r\n").Body())
+	for _, want := range []string{
+		`roproxy_transforms_total{transform="games/v1/broken",result="failed"} 1`,
+		`roproxy_transforms_total{transform="games/v1/games",result="applied"} 1`,
+		`roproxy_transforms_total{transform="games/v1/games",result="skipped"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestParseTransforms(t *testing.T) {
+	for _, list := range []string{
+		"games/v1/games",
+		"games/v1/[=pick(a)",
+		"=pick(a)",
+		"games/v1/games=pick(a)|bogus(b)",
+	} {
+		if _, err := parseTransforms(list); err == nil {
+			t.Errorf("%q accepted", list)
+		}
+	}
+	routes, err := parseTransforms(" /Games/v1/*/ = pick(a,b) ;; users/v1/users=flatten(data) ")
+	if err != nil || len(routes) != 2 || routes[0].pattern != "games/v1/*" || len(routes[0].pipeline) != 1 {
+		t.Errorf("parsed %+v, %v", routes, err)
+	}
+}
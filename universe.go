@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// universeCacheMax bounds the place-to-universe cache. The mapping never
+// changes, so entries don't expire; the cache starts over when full.
+const universeCacheMax = 100000
+
+// universeCache remembers which universe each place belongs to.
+type universeCache struct {
+	mu      sync.Mutex
+	byPlace map[int64]int64
+}
+
+func newUniverseCache() *universeCache {
+	return &universeCache{byPlace: map[int64]int64{}}
+}
+
+func (c *universeCache) get(placeID int64) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.byPlace[placeID]
+	return id, ok
+}
+
+func (c *universeCache) set(placeID, universeID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.byPlace) >= universeCacheMax {
+		c.byPlace = map[int64]int64{}
+	}
+	c.byPlace[placeID] = universeID
+}
+
+// universeInfo is the /_proxy/universe answer. The game fields are only
+// filled in with expand=true.
+type universeInfo struct {
+	PlaceID    int64  `json:"placeId"`
+	UniverseID int64  `json:"universeId"`
+	Name       string `json:"name,omitempty"`
+	Playing    *int64 `json:"playing,omitempty"`
+	Visits     *int64 `json:"visits,omitempty"`
+}
+
+// universeHandler serves GET /_proxy/universe/{placeId}: the universe the
+// place belongs to, looked up once and then served from memory. With
+// expand=true the game's name, player count and visits are added from
+// games.roblox.com.
+func (s *Server) universeHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		proxyError(ctx, 405, "method_not_allowed", "Use GET.")
+		return
+	}
+	placeID, err := strconv.ParseInt(strings.TrimPrefix(string(ctx.Path()), "/_proxy/universe/"), 10, 64)
+	if err != nil || placeID < 1 {
+		proxyError(ctx, 400, "invalid_place_id", "Use /_proxy/universe/{placeId}.")
+		return
+	}
+
+	info := universeInfo{PlaceID: placeID}
+	var ok bool
+	if info.UniverseID, ok = s.universes.get(placeID); ok {
+		ctx.Response.Header.Set("X-Proxy-Cache", "HIT")
+	} else {
+		var body struct {
+			UniverseID *int64 `json:"universeId"`
+		}
+		uri := "/apis/universes/v1/places/" + strconv.FormatInt(placeID, 10) + "/universe"
+		if !s.fetchJSON(ctx, uri, &body) {
+			return
+		}
+		if body.UniverseID == nil {
+			proxyError(ctx, 404, "place_not_found", "Place "+strconv.FormatInt(placeID, 10)+" has no universe.")
+			return
+		}
+		info.UniverseID = *body.UniverseID
+		s.universes.set(placeID, info.UniverseID)
+		ctx.Response.Header.Set("X-Proxy-Cache", "MISS")
+	}
+
+	if string(ctx.QueryArgs().Peek("expand")) == "true" {
+		var games struct {
+			Data []struct {
+				Name    string `json:"name"`
+				Playing int64  `json:"playing"`
+				Visits  int64  `json:"visits"`
+			} `json:"data"`
+		}
+		if !s.fetchJSON(ctx, "/games/v1/games?universeIds="+strconv.FormatInt(info.UniverseID, 10), &games) {
+			return
+		}
+		if len(games.Data) > 0 {
+			g := games.Data[0]
+			info.Name, info.Playing, info.Visits = g.Name, &g.Playing, &g.Visits
+		}
+	}
+	writeJSON(ctx, 200, info)
+}
+
+// fetchJSON GETs uri upstream on behalf of ctx and decodes the JSON reply
+// into v. On failure the error is written to ctx and false returned.
+func (s *Server) fetchJSON(ctx *fasthttp.RequestCtx, uri string, v interface{}) bool {
+	if e := s.callJSON(ctx, "GET", uri, nil, v); e != nil {
+		proxyError(ctx, e.Status, e.Code, e.Message)
+		return false
+	}
+	return true
+}
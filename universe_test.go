@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestUniverse(t *testing.T) {
+	var lookups, gameCalls int32
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		switch string(ctx.Host()) + string(ctx.RequestURI()) {
+		case "apis.roblox.com/universes/v1/places/1818/universe":
+			atomic.AddInt32(&lookups, 1)
+			ctx.SetBodyString(`{"universeId":13058}`)
+		case "apis.roblox.com/universes/v1/places/5/universe":
+			ctx.SetBodyString(`{"universeId":null}`)
+		case "apis.roblox.com/universes/v1/places/6/universe":
+			ctx.Error(`{"errors":[]}`, 503)
+		case "games.roblox.com/v1/games?universeIds=13058":
+			atomic.AddInt32(&gameCalls, 1)
+			ctx.SetBodyString(`{"data":[{"id":13058,"rootPlaceId":1818,"name":"Classic: Crossroads","playing":12,"visits":5000000}]}`)
+		default:
+			ctx.Error("unexpected "+string(ctx.Host())+string(ctx.RequestURI()), 404)
+		}
+	}
+	s := newTestServer(t, testConfig(), upstream)
+	get := func(uri string) (*fasthttp.Response, map[string]interface{}) {
+		t.Helper()
+		resp := serveRaw(t, s, "GET "+uri+" HTTP/1.1\r\nHost: proxy\r\nAccept: application/json\r\n\r\n")
+		var body map[string]interface{}
+		if err := json.Unmarshal(resp.Body(), &body); err != nil {
+			t.Fatalf("%s: %v in %q", uri, err, resp.Body())
+		}
+		return resp, body
+	}
+
+	resp, body := get("/_proxy/universe/1818")
+	if resp.StatusCode() != 200 || body["placeId"] != float64(1818) || body["universeId"] != float64(13058) || len(body) != 2 {
+		t.Errorf("lookup: %d %v", resp.StatusCode(), body)
+	}
+	if c := string(resp.Header.Peek("X-Proxy-Cache")); c != "MISS" {
+		t.Errorf("first lookup X-Proxy-Cache = %q, want MISS", c)
+	}
+	resp, body = get("/_proxy/universe/1818?expand=true")
+	if c := string(resp.Header.Peek("X-Proxy-Cache")); c != "HIT" {
+		t.Errorf("second lookup X-Proxy-Cache = %q, want HIT", c)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("looked up the place %d times, want 1", n)
+	}
+	if body["universeId"] != float64(13058) || body["name"] != "Classic: Crossroads" || body["playing"] != float64(12) || body["visits"] != float64(5000000) {
+		t.Errorf("expanded: %v", body)
+	}
+	if n := atomic.LoadInt32(&gameCalls); n != 1 {
+		t.Errorf("fetched the game %d times, want 1", n)
+	}
+
+	for _, tc := range []struct {
+		uri    string
+		status int
+		code   string
+	}{
+		{"/_proxy/universe/5", 404, "place_not_found"},
+		{"/_proxy/universe/6", 502, "upstream_error"},
+		{"/_proxy/universe/abc", 400, "invalid_place_id"},
+	} {
+		resp, body := get(tc.uri)
+		if resp.StatusCode() != tc.status || body["code"] != tc.code {
+			t.Errorf("%s: %d %v, want %d %s", tc.uri, resp.StatusCode(), body, tc.status, tc.code)
+		}
+	}
+}
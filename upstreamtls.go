@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// compileUpstreamTLS loads UPSTREAM_CA_FILE and decodes UPSTREAM_PIN_SHA256.
+func (c *Config) compileUpstreamTLS() error {
+	c.rootCAs = nil
+	if c.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(c.UpstreamCAFile)
+		if err != nil {
+			return fmt.Errorf("upstream_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if c.RootCAMode == "append" {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				return fmt.Errorf("upstream_ca_file: loading system roots: %v", err)
+			}
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("upstream_ca_file: no PEM certificates in %s", c.UpstreamCAFile)
+		}
+		c.rootCAs = pool
+	}
+	c.pins = nil
+	for _, pin := range strings.Split(c.UpstreamPinSHA256, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if pin == "" {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("upstream_pin_sha256: %q is not a base64 SHA-256 hash", pin)
+		}
+		if c.pins == nil {
+			c.pins = map[string]bool{}
+		}
+		c.pins[pin] = true
+	}
+	return nil
+}
+
+// upstreamTLSConfig is the TLS configuration for upstream connections.
+// fasthttp and the HTTP/2 and SSE clients only use the dialed host as the
+// server name when ServerName is empty, so TLS_SERVER_NAME applies to all.
+func (c *Config) upstreamTLSConfig() *tls.Config {
+	t := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            c.rootCAs,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.TLSServerName,
+	}
+	if c.pins != nil {
+		t.VerifyPeerCertificate = c.verifyPins
+	}
+	return t
+}
+
+// verifyPins accepts a connection when any certificate in its chain has a
+// public key listed in UPSTREAM_PIN_SHA256.
+func (c *Config) verifyPins(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var certs []*x509.Certificate
+	for _, chain := range verifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(verifiedChains) == 0 {
+		// InsecureSkipVerify: nothing was verified, check what was sent
+		for _, raw := range rawCerts {
+			if cert, err := x509.ParseCertificate(raw); err == nil {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	var observed []string
+	for _, cert := range certs {
+		pin := spkiHash(cert)
+		if c.pins[pin] {
+			return nil
+		}
+		observed = append(observed, pin)
+	}
+	err := &pinError{observed: observed}
+	log.Printf("WARN %v", err)
+	return err
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// pinError is an upstream certificate chain matching none of the pins.
+type pinError struct {
+	observed []string
+}
+
+func (e *pinError) Error() string {
+	return "upstream certificate matches no UPSTREAM_PIN_SHA256 pin; observed sha256/" + strings.Join(e.observed, ", sha256/")
+}
+
+// isTLSError reports whether err is a failed TLS handshake with upstream:
+// an untrusted or mismatched certificate or a pin mismatch.
+func isTLSError(err error) bool {
+	var (
+		pe  *pinError
+		ua  x509.UnknownAuthorityError
+		ci  x509.CertificateInvalidError
+		he  x509.HostnameError
+		rhe tls.RecordHeaderError
+	)
+	return errors.As(err, &pe) || errors.As(err, &ua) || errors.As(err, &ci) || errors.As(err, &he) || errors.As(err, &rhe)
+}
+
+// isRobloxDomain reports whether domain is roblox.com or one of its
+// subdomains.
+func isRobloxDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	return domain == upstreamDomain || strings.HasSuffix(domain, "."+upstreamDomain)
+}
+
+// warnInsecure logs that INSECURE_SKIP_VERIFY is on, now and every hour, so
+// it can't go unnoticed in the logs.
+func warnInsecure(targetDomain string) {
+	for {
+		log.Printf("WARN INSECURE_SKIP_VERIFY is on: upstream certificates for %s are NOT verified. Never run this in production.", targetDomain)
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// testCert is a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert issues a certificate for dnsName signed by parent, or a CA
+// when parent is nil.
+func newTestCert(t *testing.T, parent *testCert, dnsName string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{dnsName}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// newTLSTestServer returns a Server, with the TLS settings from cfg, whose
+// upstream presents a certificate for *.roblox.com issued by ca.
+func newTLSTestServer(t *testing.T, cfg *Config, ca *testCert) *Server {
+	t.Helper()
+	leaf := newTestCert(t, ca, "*.roblox.com")
+	keyDER, err := x509.MarshalECPrivateKey(leaf.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { ln.Close() })
+	go (&fasthttp.Server{Handler: okUpstream}).ServeTLSEmbed(ln, leaf.pem, keyPEM)
+
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) { return ln.Dial() }
+	return s
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	ca := newTestCert(t, nil, "Test Interception CA")
+	other := newTestCert(t, nil, "Other CA")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		caFile string
+		mode   string
+		pins   string
+		status int
+	}{
+		{"system roots only", "", "append", "", 502},
+		{"ca appended", caFile, "append", "", 200},
+		{"ca replacing roots", caFile, "replace", "", 200},
+		{"pinned ca", caFile, "append", spkiHash(other.cert) + ", sha256/" + spkiHash(ca.cert), 200},
+		{"pin mismatch", caFile, "append", spkiHash(other.cert), 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.UpstreamCAFile = tt.caFile
+			cfg.RootCAMode = tt.mode
+			cfg.UpstreamPinSHA256 = tt.pins
+			s := newTLSTestServer(t, cfg, ca)
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+			log.SetOutput(os.Stderr)
+
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.status == 502 {
+				if got := string(resp.Header.Peek("X-Proxy-Error")); got != "tls_error" {
+					t.Errorf("X-Proxy-Error = %q, want tls_error", got)
+				}
+			}
+			if tt.name == "pin mismatch" && !strings.Contains(logs.String(), spkiHash(ca.cert)) {
+				t.Errorf("log doesn't show the observed pin:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	cfg := testConfig()
+	cfg.UpstreamPinSHA256 = "not-a-hash"
+	if err := cfg.compile(); err == nil {
+		t.Error("invalid pin accepted")
+	}
+	cfg = testConfig()
+	cfg.UpstreamCAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if err := cfg.compile(); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
+
+func TestInsecureSkipVerifyGuard(t *testing.T) {
+	for _, domain := range []string{"roblox.com", "ROBLOX.com.", "www.roblox.com"} {
+		cfg := testConfig()
+		cfg.TargetDomain = domain
+		cfg.InsecureSkipVerify = true
+		if err := cfg.validate(); err == nil {
+			t.Errorf("insecure_skip_verify accepted for target_domain %s", domain)
+		}
+	}
+	for _, domain := range []string{"mock.test", "notroblox.com"} {
+		cfg := testConfig()
+		cfg.TargetDomain = domain
+		cfg.InsecureSkipVerify = true
+		if err := cfg.validate(); err != nil {
+			t.Errorf("target_domain %s: %v", domain, err)
+		}
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	cfg := testConfig()
+	cfg.TargetDomain = "mock.test"
+	cfg.InsecureSkipVerify = true
+	s := newTLSTestServer(t, cfg, newTestCert(t, nil, "Untrusted CA"))
+
+	for _, path := range []string{"/users/v1/users/1", "/healthz"} {
+		resp := serveRaw(t, s, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		if resp.StatusCode() != 200 {
+			t.Errorf("%s: status = %d: %s", path, resp.StatusCode(), resp.Body())
+		}
+		if got := string(resp.Header.Peek("X-Proxy-Insecure")); got != "true" {
+			t.Errorf("%s: X-Proxy-Insecure = %q, want true", path, got)
+		}
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	ca := newTestCert(t, nil, "Test CA")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the upstream is dialed as users.mock.test but only has a certificate
+	// for *.roblox.com
+	for _, tt := range []struct {
+		serverName string
+		status     int
+	}{
+		{"", 502},
+		{"users.roblox.com", 200},
+	} {
+		cfg := testConfig()
+		cfg.TargetDomain = "mock.test"
+		cfg.UpstreamCAFile = caFile
+		cfg.TLSServerName = tt.serverName
+		s := newTLSTestServer(t, cfg, ca)
+		if resp := serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != tt.status {
+			t.Errorf("tls_server_name %q: %d, want %d: %s", tt.serverName, resp.StatusCode(), tt.status, resp.Body())
+		}
+	}
+
+	cfg := testConfig()
+	cfg.TLSServerName = "users.roblox.com:443"
+	if err := cfg.validate(); err == nil {
+		t.Error("tls_server_name with a port accepted")
+	}
+}
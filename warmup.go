@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// warmup opens WARMUP_CONNS idle connections to each WARMUP_HOSTS
+// subdomain by sending concurrent HEAD requests for WARMUP_PATH, so the
+// first real requests after a start don't pay for DNS, TCP and TLS. All
+// hosts are warmed in parallel and given up on after WARMUP_TIMEOUT. It
+// marks the server warm when done, whatever the results.
+func (s *Server) warmup() {
+	defer atomic.StoreInt32(&s.warm, 1)
+	cfg := s.config()
+	deadline := time.Now().Add(cfg.WarmupTimeout.D())
+	var wg sync.WaitGroup
+	for _, sub := range strings.Split(cfg.WarmupHosts, ",") {
+		if sub = strings.ToLower(strings.TrimSpace(sub)); sub == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			s.warmHost(cfg, host, deadline)
+		}(sub + "." + cfg.TargetDomain)
+	}
+	wg.Wait()
+}
+
+func (s *Server) warmHost(cfg *Config, host string, deadline time.Time) {
+	start := time.Now()
+	errs := make(chan error, cfg.WarmupConns)
+	for i := 0; i < cfg.WarmupConns; i++ {
+		go func() {
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			req.Header.SetMethod("HEAD")
+			req.SetRequestURI("https://" + host + cfg.WarmupPath)
+			req.Header.Set("User-Agent", cfg.UserAgent)
+			errs <- s.client.DoDeadline(req, resp, deadline)
+		}()
+	}
+	ok := 0
+	var lastErr error
+	for i := 0; i < cfg.WarmupConns; i++ {
+		if err := <-errs; err != nil {
+			lastErr = err
+		} else {
+			ok++
+		}
+	}
+	if lastErr != nil {
+		log.Printf("WARN warmup %s: %d/%d connections in %v, last error: %v", host, ok, cfg.WarmupConns, time.Since(start).Round(time.Millisecond), lastErr)
+		return
+	}
+	log.Printf("Warmup %s: %d/%d connections in %v", host, ok, cfg.WarmupConns, time.Since(start).Round(time.Millisecond))
+}
+
+// isWarm reports whether warmup has finished.
+func (s *Server) isWarm() bool {
+	return atomic.LoadInt32(&s.warm) == 1
+}
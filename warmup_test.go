@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestWarmup(t *testing.T) {
+	var mu sync.Mutex
+	dials := map[string]int{}
+	var methods []string
+	upstream := func(ctx *fasthttp.RequestCtx) {
+		mu.Lock()
+		methods = append(methods, string(ctx.Method()))
+		mu.Unlock()
+		// hold the first requests so warmup needs a connection per request
+		time.Sleep(20 * time.Millisecond)
+		okUpstream(ctx)
+	}
+	ln := newTestUpstream(t, upstream)
+	cfg := testConfig()
+	cfg.WarmupHosts = "users, games"
+	cfg.WarmupConns = 3
+	cfg.ReadyzWaitWarmup = true
+	s := newTestServerDirect(t, cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) {
+		mu.Lock()
+		dials[addr]++
+		mu.Unlock()
+		return ln.Dial()
+	}
+
+	if resp := serveRaw(t, s, "GET /readyz HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 503 {
+		t.Errorf("/readyz before warmup = %d, want 503", resp.StatusCode())
+	}
+	s.warmup()
+	if resp := serveRaw(t, s, "GET /readyz HTTP/1.1\r\nHost: proxy\r\n\r\n"); resp.StatusCode() != 200 {
+		t.Errorf("/readyz after warmup = %d, want 200", resp.StatusCode())
+	}
+
+	mu.Lock()
+	if dials["users.roblox.com:443"] != 3 || dials["games.roblox.com:443"] != 3 {
+		t.Errorf("warmup dialed %v, want 3 connections to each host", dials)
+	}
+	for _, m := range methods {
+		if m != "HEAD" {
+			t.Errorf("warmup sent %s, want HEAD", m)
+		}
+	}
+	mu.Unlock()
+
+	serveRaw(t, s, "GET /users/v1/users/1 HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	mu.Lock()
+	defer mu.Unlock()
+	if dials["users.roblox.com:443"] != 3 {
+		t.Errorf("first request dialed a new connection instead of using a warm one")
+	}
+}
+
+func TestWarmupTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.WarmupHosts = "users"
+	cfg.WarmupTimeout = Duration(100 * time.Millisecond)
+	s := newTestServerDirect(t, cfg)
+	s.client.Dial = func(addr string) (net.Conn, error) {
+		time.Sleep(time.Second)
+		return nil, net.ErrClosed
+	}
+
+	start := time.Now()
+	s.warmup()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("warmup of an unreachable host took %v, want about WARMUP_TIMEOUT", d)
+	}
+	if !s.isWarm() {
+		t.Error("server not marked warm after warmup gave up")
+	}
+}
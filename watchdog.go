@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// watchdog requests /healthz from every listener each WATCHDOG_INTERVAL,
+// over a fresh connection so that a wedged accept loop is noticed too. Once
+// a listener has failed WATCHDOG_FAILURES probes in a row, or the process
+// runs more than WATCHDOG_MAX_GOROUTINES goroutines, trip is called with the
+// reason and the failure counts start over. The watchdog stops when draining
+// starts or stop is closed.
+func (s *Server) watchdog(probes []*fasthttp.HostClient, trip func(reason string), stop <-chan struct{}) {
+	failures := make([]int, len(probes))
+	for {
+		cfg := s.config()
+		select {
+		case <-stop:
+			return
+		case <-time.After(cfg.WatchdogInterval.D()):
+		}
+		if s.isDraining() {
+			return
+		}
+
+		if max := cfg.WatchdogMaxGoroutines; max > 0 {
+			if n := runtime.NumGoroutine(); n > max {
+				trip(fmt.Sprintf("%d goroutines running, limit is %d", n, max))
+				continue
+			}
+		}
+		for i, c := range probes {
+			err := probeHealthz(c, cfg.WatchdogInterval.D())
+			if err == nil {
+				failures[i] = 0
+				continue
+			}
+			failures[i]++
+			log.Printf("WARN watchdog: health probe on %s failed (%d in a row): %v", c.Addr, failures[i], err)
+			if failures[i] >= cfg.WatchdogFailures {
+				for j := range failures {
+					failures[j] = 0
+				}
+				trip(fmt.Sprintf("%s failed %d health probes in a row", c.Addr, cfg.WatchdogFailures))
+				break
+			}
+		}
+	}
+}
+
+// newHealthProbe returns a client for the watchdog's self-requests to the
+// listener at addr.
+func newHealthProbe(addr string) *fasthttp.HostClient {
+	return &fasthttp.HostClient{
+		Addr: addr,
+		Dial: func(string) (net.Conn, error) { return dialLoopback(addr) },
+	}
+}
+
+// dialLoopback connects to the listener at addr from the local host.
+func dialLoopback(addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.DialTimeout("unix", strings.TrimPrefix(addr, "unix:"), time.Second)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	return fasthttp.DialTimeout(net.JoinHostPort(host, port), time.Second)
+}
+
+func probeHealthz(c *fasthttp.HostClient, timeout time.Duration) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://localhost/healthz")
+	req.SetConnectionClose()
+	if err := c.DoTimeout(req, resp, timeout); err != nil {
+		return err
+	}
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("status %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// dumpGoroutines logs the stacks of every goroutine.
+func dumpGoroutines() {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 64<<20 {
+			log.Printf("Goroutine dump:\n%s", buf[:n])
+			return
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// startWatchdog serves handler on an in-memory listener and runs the
+// watchdog against it, returning the channel trip reasons are sent to.
+func startWatchdog(t *testing.T, cfg *Config, handler fasthttp.RequestHandler) <-chan string {
+	t.Helper()
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { ln.Close() })
+	go (&fasthttp.Server{Handler: handler}).Serve(ln)
+
+	s := newServer(cfg)
+	probe := &fasthttp.HostClient{
+		Addr: "inmemory",
+		Dial: func(string) (net.Conn, error) { return ln.Dial() },
+	}
+	trips := make(chan string, 10)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go s.watchdog([]*fasthttp.HostClient{probe}, func(reason string) { trips <- reason }, stop)
+	return trips
+}
+
+func watchdogConfig() *Config {
+	cfg := testConfig()
+	cfg.WatchdogInterval = Duration(20 * time.Millisecond)
+	cfg.WatchdogFailures = 2
+	return cfg
+}
+
+func TestWatchdogTripsOnWedgedHandler(t *testing.T) {
+	wedged := make(chan struct{})
+	t.Cleanup(func() { close(wedged) })
+	trips := startWatchdog(t, watchdogConfig(), func(ctx *fasthttp.RequestCtx) { <-wedged })
+
+	select {
+	case reason := <-trips:
+		if !strings.Contains(reason, "failed 2 health probes") {
+			t.Errorf("reason = %q", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not trip")
+	}
+}
+
+func TestWatchdogHealthy(t *testing.T) {
+	s := newTestServer(t, testConfig(), okUpstream)
+	trips := startWatchdog(t, watchdogConfig(), s.requestHandler)
+
+	select {
+	case reason := <-trips:
+		t.Fatalf("watchdog tripped on a healthy listener: %s", reason)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestWatchdogGoroutineLimit(t *testing.T) {
+	cfg := watchdogConfig()
+	cfg.WatchdogMaxGoroutines = 1
+	s := newTestServer(t, testConfig(), okUpstream)
+	trips := startWatchdog(t, cfg, s.requestHandler)
+
+	select {
+	case reason := <-trips:
+		if !strings.Contains(reason, "goroutines running") {
+			t.Errorf("reason = %q", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not trip")
+	}
+}